@@ -0,0 +1,190 @@
+package argonproxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// INSTANCE IDENTITY AND ABUSE REPORTS
+// -----------------------------
+
+// abuseReportTTL is how long reports are kept in the store
+const abuseReportTTL = 90 * 24 * time.Hour
+
+// abuseReportLimit bounds the reports kept, and abuseReportsPerHour the
+// reports accepted from one client IP per hour
+const (
+	abuseReportLimit    = 1000
+	abuseReportsPerHour = 10
+)
+
+// proxiedBy is the X-Proxied-By value stamped on proxied responses
+var proxiedBy string
+
+// instanceName identifies this instance, as --instance-id or the derived ID
+var instanceName string
+
+// setInstanceID fills in instanceName and proxiedBy. Without --instance-id, the ID is derived
+// from the host name so it is stable without revealing it.
+func setInstanceID() {
+	id := *instanceID
+	if id == "" {
+		hostname, _ := os.Hostname()
+		sum := sha256.Sum256([]byte(hostname))
+		id = hex.EncodeToString(sum[:4])
+	}
+	instanceName = id
+	proxiedBy = "argon-proxy/" + version + " (" + id + ")"
+}
+
+// addProxiedBy marks a response as relayed by this instance
+func addProxiedBy(w http.ResponseWriter) {
+	w.Header().Set("X-Proxied-By", proxiedBy)
+}
+
+// abuseReport is a report submitted to /abuse
+type abuseReport struct {
+	ID          string    `json:"id"`
+	Received    time.Time `json:"received"`
+	URL         string    `json:"url"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Description string    `json:"description"`
+	Email       string    `json:"email,omitempty"`
+	ClientIP    string    `json:"client_ip"`
+}
+
+// registerAbuseHandlers adds the report page when a contact is configured
+func registerAbuseHandlers(mux *http.ServeMux) {
+	if *abuseContact == "" {
+		return
+	}
+	mux.HandleFunc("/abuse", handleAbuse)
+}
+
+var abusePage = template.Must(template.New("abuse").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Report abuse</title></head>
+<body>
+<h1>Report abuse</h1>
+<p>This is a public CORS proxy ({{.ProxiedBy}}). It relays requests for other sites and does not host content itself.
+If it was used to reach or serve something harmful, tell us below or write to <a href="mailto:{{.Contact}}">{{.Contact}}</a>.
+The <code>X-Request-ID</code> and <code>X-Proxied-By</code> headers of the response help us find the request.</p>
+<form method="post" action="/abuse">
+<p><label>URL involved<br><input name="url" size="80" required></label></p>
+<p><label>X-Request-ID (if known)<br><input name="request_id" size="40"></label></p>
+<p><label>What happened<br><textarea name="description" rows="6" cols="80" required></textarea></label></p>
+<p><label>Your email (optional)<br><input name="email" type="email" size="40"></label></p>
+<p><button type="submit">Send report</button></p>
+</form>
+</body></html>
+`))
+
+// handleAbuse shows the report form and accepts reports as a form or JSON
+func handleAbuse(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		abusePage.Execute(w, map[string]string{"Contact": *abuseContact, "ProxiedBy": proxiedBy})
+		return
+	case "POST":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client := getClientIP(r)
+	limitKey := "abuse-limit:" + client + ":" + time.Now().UTC().Format(statsHourFormat)
+	if n, err := store.Incr(limitKey, 1, time.Hour); err == nil && n > abuseReportsPerHour {
+		http.Error(w, "Too many reports, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	report := abuseReport{Received: time.Now().UTC(), ClientIP: client}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		report.Received, report.ClientIP = time.Now().UTC(), client
+	} else {
+		report.URL = r.FormValue("url")
+		report.RequestID = r.FormValue("request_id")
+		report.Description = r.FormValue("description")
+		report.Email = r.FormValue("email")
+	}
+	if strings.TrimSpace(report.URL) == "" || strings.TrimSpace(report.Description) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url and description are required"})
+		return
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	report.ID = hex.EncodeToString(b)
+	if err := saveAbuseReport(&report); err != nil {
+		log.Printf("Error saving abuse report: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not save the report"})
+		return
+	}
+	log.Printf("Abuse report %s from %s about %s", report.ID, client, report.URL)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": report.ID})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Thank you. Your report was received as " + report.ID + ".\n"))
+}
+
+// saveAbuseReport stores a report and adds it to the index read by /admin/abuse
+func saveAbuseReport(report *abuseReport) error {
+	data, _ := json.Marshal(report)
+	if err := store.Set("abuse:"+report.ID, data, abuseReportTTL); err != nil {
+		return err
+	}
+	ids := loadAbuseIndex()
+	ids = append([]string{report.ID}, ids...)
+	if len(ids) > abuseReportLimit {
+		ids = ids[:abuseReportLimit]
+	}
+	index, _ := json.Marshal(ids)
+	return store.Set("abuse:index", index, abuseReportTTL)
+}
+
+// loadAbuseIndex returns the stored report IDs, newest first
+func loadAbuseIndex() []string {
+	var ids []string
+	if data, ok, err := store.Get("abuse:index"); err == nil && ok {
+		json.Unmarshal(data, &ids)
+	}
+	return ids
+}
+
+// handleAdminAbuse lists the reports that have not expired, newest first
+func handleAdminAbuse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports := []abuseReport{}
+	for _, id := range loadAbuseIndex() {
+		data, ok, err := store.Get("abuse:" + id)
+		if err != nil || !ok {
+			continue
+		}
+		var report abuseReport
+		if json.Unmarshal(data, &report) == nil {
+			reports = append(reports, report)
+		}
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
@@ -0,0 +1,299 @@
+package argonproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// ACCESS LOG SHIPPING
+// -----------------------------
+
+// accessLogAttempts is how often a batch is sent before it is dropped
+const accessLogAttempts = 5
+
+// accessRecord is one access log line
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Route      string    `json:"route"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Target     string    `json:"target,omitempty"`
+	TargetIDN  string    `json:"target_idn,omitempty"` // Unicode form of a punycode target host
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	ClientIP   string    `json:"client_ip"`
+	Identity   string    `json:"identity,omitempty"`
+	Origin     string    `json:"origin,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	ReportOnly []string  `json:"report_only,omitempty"` // policies that would have refused the request
+}
+
+// accessLogQueue holds records waiting to be shipped; when it is full, new
+// records are dropped rather than slowing requests down
+var accessLogQueue chan *accessRecord
+
+// accessLogResults counts shipped, dropped and failed records
+var accessLogResults struct {
+	sent, dropped, failed atomic.Uint64
+}
+
+type accessRecordContextKey struct{}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if accessLogQueue == nil {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_access_log_records_total Access log records by shipping outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_access_log_records_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_access_log_records_total{result=\"sent\"} %d\n", accessLogResults.sent.Load())
+		fmt.Fprintf(w, "argon_proxy_access_log_records_total{result=\"dropped\"} %d\n", accessLogResults.dropped.Load())
+		fmt.Fprintf(w, "argon_proxy_access_log_records_total{result=\"failed\"} %d\n", accessLogResults.failed.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_access_log_queue Access log records waiting to be shipped.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_access_log_queue gauge\n")
+		fmt.Fprintf(w, "argon_proxy_access_log_queue %d\n", len(accessLogQueue))
+	})
+}
+
+// startAccessLog starts the shipper when a collector is configured
+func startAccessLog() error {
+	if *accessLogURL == "" {
+		return nil
+	}
+	if *accessLogFormat != "ndjson" && *accessLogFormat != "loki" {
+		return fmt.Errorf("--access-log-format must be ndjson or loki")
+	}
+	if *accessLogBatch < 1 || *accessLogBuffer < 1 || *accessLogInterval <= 0 {
+		return fmt.Errorf("--access-log-batch, --access-log-buffer and --access-log-interval must be positive")
+	}
+	for _, pair := range splitList(*accessLogHeaders) {
+		if name, _, ok := strings.Cut(pair, "="); !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("--access-log-headers: %q is not Name=value", pair)
+		}
+	}
+	accessLogQueue = make(chan *accessRecord, *accessLogBuffer)
+	go runAccessLogShipper()
+	return nil
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (aw *accessLogWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through so streamed responses keep streaming
+func (aw *accessLogWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack records a switch of protocols; the relay notes its own byte count
+func (aw *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(aw.ResponseWriter).Hijack()
+	if err == nil && aw.status == 0 {
+		aw.status, aw.hijacked = http.StatusSwitchingProtocols, true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// withAccessLog queues a record for every request once it is answered
+func withAccessLog(next http.Handler) http.Handler {
+	if *accessLogURL == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &accessRecord{
+			Time:      time.Now().UTC(),
+			RequestID: requestID(r),
+			Route:     routeFor(r).Name,
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			ClientIP:  getClientIP(r),
+			Origin:    r.Header.Get("Origin"),
+			UserAgent: r.Header.Get("User-Agent"),
+		}
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessRecordContextKey{}, rec)))
+
+		rec.Status = aw.status
+		if !aw.hijacked {
+			rec.Bytes = aw.bytes
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.DurationMs = float64(time.Since(rec.Time).Microseconds()) / 1000
+		select {
+		case accessLogQueue <- rec:
+		default:
+			accessLogResults.dropped.Add(1)
+		}
+	})
+}
+
+// noteAccess lets handlers add what only they know to the request's record
+func noteAccess(r *http.Request, fill func(rec *accessRecord)) {
+	if rec, ok := r.Context().Value(accessRecordContextKey{}).(*accessRecord); ok {
+		fill(rec)
+	}
+}
+
+// runAccessLogShipper sends the queued records in batches, when a batch is
+// full or the interval has passed
+func runAccessLogShipper() {
+	ticker := time.NewTicker(*accessLogInterval)
+	defer ticker.Stop()
+	batch := make([]*accessRecord, 0, *accessLogBatch)
+	for {
+		select {
+		case rec := <-accessLogQueue:
+			batch = append(batch, rec)
+			if len(batch) < *accessLogBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		shipAccessLog(batch)
+		batch = batch[:0]
+	}
+}
+
+// shipAccessLog posts a batch, retrying with backoff on network errors, 429
+// and 5xx answers. Records keep queueing meanwhile, up to --access-log-buffer.
+func shipAccessLog(batch []*accessRecord) {
+	body, contentType := encodeAccessLog(batch)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postAccessLog(body, contentType)
+		if err == nil {
+			accessLogResults.sent.Add(uint64(len(batch)))
+			return
+		}
+		var permanent permanentError
+		if attempt == accessLogAttempts || errors.As(err, &permanent) {
+			accessLogResults.failed.Add(uint64(len(batch)))
+			log.Printf("Dropping %d access log records: %v", len(batch), err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentError is a collector answer that retrying will not change
+type permanentError struct{ error }
+
+// postAccessLog sends one encoded batch to the collector
+func postAccessLog(body []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", *accessLogURL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "argon-proxy/"+version)
+	for _, pair := range splitList(*accessLogHeaders) {
+		name, value, _ := strings.Cut(pair, "=")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("collector answered %s", resp.Status)
+	default:
+		return permanentError{fmt.Errorf("collector answered %s", resp.Status)}
+	}
+}
+
+// encodeAccessLog renders a batch as NDJSON or as a Loki push request with
+// one stream per route
+func encodeAccessLog(batch []*accessRecord) ([]byte, string) {
+	if *accessLogFormat != "loki" {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, rec := range batch {
+			enc.Encode(rec)
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, rec := range batch {
+		s := streams[rec.Route]
+		if s == nil {
+			s = &lokiStream{Stream: map[string]string{"job": "argon-proxy", "instance": instanceName, "route": rec.Route}}
+			streams[rec.Route] = s
+			order = append(order, rec.Route)
+		}
+		line, _ := json.Marshal(rec)
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(rec.Time.UnixNano(), 10), string(line)})
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, route := range order {
+		push.Streams = append(push.Streams, streams[route])
+	}
+	data, _ := json.Marshal(push)
+	return data, "application/json"
+}
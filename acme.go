@@ -0,0 +1,594 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// -----------------------------
+// ACME CERTIFICATES
+// -----------------------------
+
+// acmeRenewBefore is how long before expiry the certificate is renewed
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmePropagationTimeout bounds the wait for challenge records to show up in DNS
+const acmePropagationTimeout = 3 * time.Minute
+
+// dnsProvider publishes the TXT records of DNS-01 challenges. All values
+// for a name are given at once, since a domain and its wildcard share the
+// same _acme-challenge record.
+type dnsProvider interface {
+	present(ctx context.Context, name string, values []string) error
+	cleanup(ctx context.Context, name string, values []string) error
+}
+
+// dnsProviders holds the supported --acme-dns values
+var dnsProviders = map[string]func() (dnsProvider, error){
+	"cloudflare": newCloudflareDNS,
+	"route53":    newRoute53DNS,
+}
+
+// acmeChallengePath is where HTTP-01 challenges are fetched by the CA
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// acmeHTTPChallenges holds the key authorizations of pending HTTP-01
+// challenges by token
+var acmeHTTPChallenges sync.Map
+
+// acmeCertificates obtains and renews the served certificate
+type acmeCertificates struct {
+	domains  []string
+	dir      string
+	provider dnsProvider // nil answers HTTP-01 challenges instead of DNS-01
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// acmeCerts is set when --acme-domains is given
+var acmeCerts *acmeCertificates
+
+// acmeEnabled reports whether certificates come from ACME
+func acmeEnabled() bool {
+	return *acmeDomains != ""
+}
+
+// startACME loads the cached certificate or obtains one, then keeps it renewed
+func startACME() error {
+	if !acmeEnabled() {
+		return nil
+	}
+	var provider dnsProvider
+	if *acmeDNS == "" {
+		if *redirectHTTP == "" {
+			return fmt.Errorf("HTTP-01 challenges are answered on --redirect-http, e.g. :80; set it or choose a DNS provider with --acme-dns")
+		}
+		if strings.Contains(*acmeDomains, "*") {
+			return fmt.Errorf("wildcard domains need DNS-01 challenges; set --acme-dns")
+		}
+	} else {
+		newProvider, ok := dnsProviders[*acmeDNS]
+		if !ok {
+			return fmt.Errorf("--acme-dns must be cloudflare or route53")
+		}
+		var err error
+		if provider, err = newProvider(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*acmeCacheDir, 0o700); err != nil {
+		return err
+	}
+	acmeCerts = &acmeCertificates{domains: splitList(*acmeDomains), dir: *acmeCacheDir, provider: provider}
+
+	if err := acmeCerts.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Ignoring cached ACME certificate: %v", err)
+	}
+	if acmeCerts.needsRenewal() {
+		if err := acmeCerts.obtain(); err != nil {
+			if acmeCerts.current() == nil {
+				return fmt.Errorf("obtaining certificate: %v", err)
+			}
+			log.Printf("Error renewing ACME certificate, serving the cached one: %v", err)
+		}
+	}
+	go acmeCerts.renewLoop()
+	return nil
+}
+
+// serverTLSConfig returns the listener TLS config for ACME certificates, or
+// nil when the --tls-cert files are served
+func serverTLSConfig() *tls.Config {
+	if acmeCerts == nil {
+		return nil
+	}
+	return &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return acmeCerts.current(), nil
+	}}
+}
+
+// current returns the certificate being served
+func (a *acmeCertificates) current() *tls.Certificate {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.cert
+}
+
+// needsRenewal reports whether there is no certificate, it is close to
+// expiring or it does not cover the configured domains
+func (a *acmeCertificates) needsRenewal() bool {
+	cert := a.current()
+	if cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+		return true
+	}
+	for _, domain := range a.domains {
+		if cert.Leaf.VerifyHostname(strings.Replace(domain, "*", "acme-check", 1)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// renewLoop checks twice a day whether the certificate must be renewed
+func (a *acmeCertificates) renewLoop() {
+	for range time.Tick(12 * time.Hour) {
+		if !a.needsRenewal() {
+			continue
+		}
+		if err := a.obtain(); err != nil {
+			log.Printf("Error renewing ACME certificate: %v", err)
+		}
+	}
+}
+
+// load reads the cached certificate and key
+func (a *acmeCertificates) load() error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(a.dir, "cert.pem"), filepath.Join(a.dir, "key.pem"))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	a.cert = &cert
+	a.mu.Unlock()
+	return nil
+}
+
+// accountKey loads the ACME account key, creating it on first use
+func (a *acmeCertificates) accountKey() (crypto.Signer, error) {
+	file := filepath.Join(a.dir, "account.key")
+	if data, err := os.ReadFile(file); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s holds no PEM key", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	return key, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+// obtain orders a certificate for the domains, answering DNS-01 challenges
+// through the DNS provider or HTTP-01 challenges on --redirect-http, and
+// stores and serves it
+func (a *acmeCertificates) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	key, err := a.accountKey()
+	if err != nil {
+		return fmt.Errorf("account key: %v", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: *acmeDirectory, UserAgent: "argon-proxy/" + version}
+	account := &acme.Account{}
+	if *acmeEmail != "" {
+		account.Contact = []string{"mailto:" + *acmeEmail}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("registering account: %v", err)
+	}
+
+	log.Printf("Requesting ACME certificate for %s", strings.Join(a.domains, ", "))
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(a.domains...))
+	if err != nil {
+		return fmt.Errorf("creating order: %v", err)
+	}
+
+	// Collect the challenges first so each record name is published once
+	type pending struct {
+		authzURL  string
+		challenge *acme.Challenge
+	}
+	var challenges []pending
+	records := make(map[string][]string)
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		challengeType := "dns-01"
+		if a.provider == nil {
+			challengeType = "http-01"
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("no %s challenge offered for %s", challengeType, authz.Identifier.Value)
+		}
+		if a.provider == nil {
+			response, err := client.HTTP01ChallengeResponse(challenge.Token)
+			if err != nil {
+				return err
+			}
+			acmeHTTPChallenges.Store(challenge.Token, response)
+			defer acmeHTTPChallenges.Delete(challenge.Token)
+			challenges = append(challenges, pending{authzURL, challenge})
+			continue
+		}
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		records[name] = append(records[name], value)
+		challenges = append(challenges, pending{authzURL, challenge})
+	}
+
+	for name, values := range records {
+		if err := a.provider.present(ctx, name, values); err != nil {
+			return fmt.Errorf("publishing %s: %v", name, err)
+		}
+		defer func(name string, values []string) {
+			if err := a.provider.cleanup(context.Background(), name, values); err != nil {
+				log.Printf("Error removing ACME challenge record %s: %v", name, err)
+			}
+		}(name, values)
+	}
+	for name, values := range records {
+		waitForTXT(ctx, name, values)
+	}
+
+	for _, p := range challenges {
+		if _, err := client.Accept(ctx, p.challenge); err != nil {
+			return fmt.Errorf("accepting challenge: %v", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, p.authzURL); err != nil {
+			return fmt.Errorf("authorization failed: %v", err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("order failed: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: a.domains}, certKey)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing order: %v", err)
+	}
+
+	var certPEM bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(certKey)
+	if err := os.WriteFile(filepath.Join(a.dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(a.dir, "cert.pem"), certPEM.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := a.load(); err != nil {
+		return err
+	}
+	log.Printf("Obtained ACME certificate for %s, valid until %s", strings.Join(a.domains, ", "),
+		a.current().Leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// handleACMEChallenge answers the CA's HTTP-01 challenge requests. It
+// reports whether the request was one.
+func handleACMEChallenge(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePath)
+	if !ok {
+		return false
+	}
+	response, ok := acmeHTTPChallenges.Load(token)
+	if !ok {
+		http.Error(w, "Unknown challenge", http.StatusNotFound)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, response.(string))
+	return true
+}
+
+// waitForTXT polls DNS until a record holds all values, giving up after
+// acmePropagationTimeout and leaving the verdict to the CA
+func waitForTXT(ctx context.Context, name string, values []string) {
+	ctx, cancel := context.WithTimeout(ctx, acmePropagationTimeout)
+	defer cancel()
+	for {
+		found, _ := net.DefaultResolver.LookupTXT(ctx, name)
+		missing := len(values)
+		for _, value := range values {
+			for _, txt := range found {
+				if txt == value {
+					missing--
+					break
+				}
+			}
+		}
+		if missing == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("ACME challenge record %s not visible yet, continuing anyway", name)
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// dnsZoneCandidates returns the parent domains of a record name, longest first
+func dnsZoneCandidates(name string) []string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	var zones []string
+	for i := 1; i < len(labels)-1; i++ {
+		zones = append(zones, strings.Join(labels[i:], "."))
+	}
+	return zones
+}
+
+// -----------------------------
+// CLOUDFLARE DNS
+// -----------------------------
+
+// cloudflareDNS manages records with an API token from $CLOUDFLARE_API_TOKEN
+type cloudflareDNS struct {
+	token string
+
+	mu      sync.Mutex
+	created map[string][]string // record name -> "zone/record" IDs
+}
+
+func newCloudflareDNS() (dnsProvider, error) {
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("--acme-dns cloudflare needs $CLOUDFLARE_API_TOKEN")
+	}
+	return &cloudflareDNS{token: token, created: make(map[string][]string)}, nil
+}
+
+// call sends a Cloudflare API request and decodes its result
+func (c *cloudflareDNS) call(ctx context.Context, method, path string, body, result any) error {
+	var payload io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.cloudflare.com/client/v4"+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct{ Message string }
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s", resp.Status)
+	}
+	if !envelope.Success {
+		messages := []string{resp.Status}
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s", strings.Join(messages, ": "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// zoneID finds the zone a record name belongs to
+func (c *cloudflareDNS) zoneID(ctx context.Context, name string) (string, error) {
+	for _, zone := range dnsZoneCandidates(name) {
+		var zones []struct{ ID string }
+		if err := c.call(ctx, "GET", "/zones?name="+url.QueryEscape(zone), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", name)
+}
+
+func (c *cloudflareDNS) present(ctx context.Context, name string, values []string) error {
+	zone, err := c.zoneID(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		var record struct{ ID string }
+		body := map[string]any{"type": "TXT", "name": name, "content": value, "ttl": 60}
+		if err := c.call(ctx, "POST", "/zones/"+zone+"/dns_records", body, &record); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.created[name] = append(c.created[name], zone+"/dns_records/"+record.ID)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *cloudflareDNS) cleanup(ctx context.Context, name string, values []string) error {
+	c.mu.Lock()
+	records := c.created[name]
+	delete(c.created, name)
+	c.mu.Unlock()
+	for _, record := range records {
+		if err := c.call(ctx, "DELETE", "/zones/"+record, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------
+// ROUTE 53 DNS
+// -----------------------------
+
+// route53DNS manages records with AWS credentials found like those of aws_sigv4
+type route53DNS struct {
+	signer *awsSigV4
+}
+
+func newRoute53DNS() (dnsProvider, error) {
+	signer := &awsSigV4{Service: "route53", Region: "us-east-1"}
+	if _, err := signer.credentials(); err != nil {
+		return nil, fmt.Errorf("--acme-dns route53: %v", err)
+	}
+	return &route53DNS{signer: signer}, nil
+}
+
+// call sends a signed Route 53 API request and decodes its XML result
+func (d *route53DNS) call(ctx context.Context, method, path string, body []byte, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "https://route53.amazonaws.com/2013-04-01"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	creds, err := d.signer.credentials()
+	if err != nil {
+		return err
+	}
+	d.signer.sign(req, body, creds, time.Now().UTC())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &failure)
+		return fmt.Errorf("route53: %s: %s", resp.Status, failure.Message)
+	}
+	if result != nil {
+		return xml.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// zoneID finds the public hosted zone a record name belongs to
+func (d *route53DNS) zoneID(ctx context.Context, name string) (string, error) {
+	for _, zone := range dnsZoneCandidates(name) {
+		var list struct {
+			Zones []struct {
+				ID      string `xml:"Id"`
+				Name    string `xml:"Name"`
+				Private bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		if err := d.call(ctx, "GET", "/hostedzonesbyname?maxitems=5&dnsname="+url.QueryEscape(zone), nil, &list); err != nil {
+			return "", err
+		}
+		for _, z := range list.Zones {
+			if strings.TrimSuffix(z.Name, ".") == zone && !z.Private {
+				return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("route53: no hosted zone found for %s", name)
+}
+
+// change applies one action to the TXT record set holding values
+func (d *route53DNS) change(ctx context.Context, action, name string, values []string) error {
+	zone, err := d.zoneID(ctx, name)
+	if err != nil {
+		return err
+	}
+	var records strings.Builder
+	for _, value := range values {
+		records.WriteString("<ResourceRecord><Value>\"")
+		xml.EscapeText(&records, []byte(value))
+		records.WriteString("\"</Value></ResourceRecord>")
+	}
+	var escapedName strings.Builder
+	xml.EscapeText(&escapedName, []byte(name))
+	body := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeBatch><Changes><Change>` +
+		`<Action>` + action + `</Action><ResourceRecordSet><Name>` + escapedName.String() + `.</Name><Type>TXT</Type><TTL>60</TTL>` +
+		`<ResourceRecords>` + records.String() + `</ResourceRecords></ResourceRecordSet></Change></Changes></ChangeBatch>` +
+		`</ChangeResourceRecordSetsRequest>`
+	return d.call(ctx, "POST", "/hostedzone/"+zone+"/rrset/", []byte(body), nil)
+}
+
+func (d *route53DNS) present(ctx context.Context, name string, values []string) error {
+	return d.change(ctx, "UPSERT", name, values)
+}
+
+func (d *route53DNS) cleanup(ctx context.Context, name string, values []string) error {
+	return d.change(ctx, "DELETE", name, values)
+}
@@ -0,0 +1,206 @@
+package argonproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------
+// ADMIN API
+// -----------------------------
+
+// redactedValue replaces secrets in admin output
+const redactedValue = "[REDACTED]"
+
+// requireAdmin only lets requests with the admin bearer token through. The
+// scheme is matched case-insensitively, as HTTP auth schemes are.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="argon-proxy admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerAdminHandlers adds the admin endpoints when an admin token is configured
+func registerAdminHandlers(mux *http.ServeMux) {
+	if *adminToken == "" {
+		return
+	}
+	mux.HandleFunc("/admin/config", requireAdmin(handleAdminConfig))
+	mux.HandleFunc("/admin/audit", requireAdmin(handleAdminAudit))
+	mux.HandleFunc("/admin/audit/", requireAdmin(handleAdminAudit))
+	mux.HandleFunc("/admin/har", requireAdmin(handleAdminHAR))
+	mux.HandleFunc("/admin/har/", requireAdmin(handleAdminHAR))
+	mux.HandleFunc("/admin/certs", requireAdmin(handleAdminCerts))
+	mux.HandleFunc("/admin/stats", requireAdmin(handleAdminStats))
+	mux.HandleFunc("/admin/abuse", requireAdmin(handleAdminAbuse))
+	mux.HandleFunc("/admin/compare", requireAdmin(handleAdminCompare))
+	mux.HandleFunc("/admin/purge", requireAdmin(handleAdminPurge))
+	mux.HandleFunc("/admin/cache", requireAdmin(handleAdminCache))
+	mux.HandleFunc("/admin/cache/flush", requireAdmin(handleAdminCacheFlush))
+	mux.HandleFunc("/admin/reload", requireAdmin(handleAdminReload))
+}
+
+// handleAdminConfig returns the effective configuration with secrets redacted
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := effectiveConfig()
+	if err != nil {
+		http.Error(w, "Error building config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "yaml") {
+		format = "yaml"
+	}
+
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		enc.Encode(config)
+		enc.Close()
+		return
+	}
+
+	writeJSON(w, http.StatusOK, config)
+}
+
+// writeJSON writes an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// effectiveConfig collects every flag value and the active routes into a
+// generic document with secret values redacted
+func effectiveConfig() (map[string]any, error) {
+	flags := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := encryptedFlags[f.Name]; ok {
+			flags[f.Name] = redactedValue
+			return
+		}
+		if headerListFlags[f.Name] {
+			flags[f.Name] = redactHeaderList(f.Value.String())
+			return
+		}
+		if getter, ok := f.Value.(flag.Getter); ok {
+			flags[f.Name] = getter.Get()
+		} else {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+
+	table := activeRoutes.Load()
+	doc := map[string]any{
+		"flags":         flags,
+		"default_route": table.fallback,
+		"routes":        table.routes,
+	}
+
+	// Round-trip through JSON so routes become plain maps that can be redacted
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	redactSecrets(config)
+	return config, nil
+}
+
+// redactSecrets masks non-empty values whose key looks like it holds a secret
+func redactSecrets(value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if isSecretName(key) && item != "" && item != nil {
+				v[key] = redactedValue
+				continue
+			}
+			if text, ok := item.(string); ok {
+				v[key] = redactString(text)
+				continue
+			}
+			redactSecrets(item)
+		}
+	case []any:
+		for i, item := range v {
+			if text, ok := item.(string); ok {
+				v[i] = redactString(text)
+				continue
+			}
+			redactSecrets(item)
+		}
+	}
+}
+
+// redactString masks the password of a URL such as redis://:pw@host, and
+// values that were decrypted from the config file
+func redactString(value string) string {
+	if _, ok := decryptedSecrets.Load(value); ok {
+		return redactedValue
+	}
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	masked := url.User(u.User.Username()).String() + ":" + redactedValue
+	return strings.Replace(value, u.User.String()+"@", masked+"@", 1)
+}
+
+// headerListFlags are the flags holding comma-separated Name=value headers,
+// whose values are credentials more often than not
+var headerListFlags = map[string]bool{"access-log-headers": true}
+
+// redactHeaderList masks the values of a Name=value header list, keeping
+// the names so the configuration can still be checked
+func redactHeaderList(list string) string {
+	pairs := splitList(list)
+	for i, pair := range pairs {
+		if name, value, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(value) != "" {
+			pairs[i] = strings.TrimSpace(name) + "=" + redactedValue
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// isSecretName reports whether a setting name suggests a secret value
+func isSecretName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, word := range []string{"secret", "token", "password", "credential", "authorization"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return strings.HasSuffix(lower, "key") || strings.HasSuffix(lower, "keys")
+}
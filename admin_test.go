@@ -0,0 +1,69 @@
+package argonproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedactHeaderList(t *testing.T) {
+	tests := []struct {
+		list, want string
+	}{
+		{"", ""},
+		{"Authorization=Bearer abc", "Authorization=[REDACTED]"},
+		{"Authorization=Bearer abc, X-Scope-OrgID=tenant1", "Authorization=[REDACTED],X-Scope-OrgID=[REDACTED]"},
+		{"X-Empty=", "X-Empty="},
+	}
+	for _, tt := range tests {
+		if got := redactHeaderList(tt.list); got != tt.want {
+			t.Errorf("redactHeaderList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestEffectiveConfigRedactsAccessLogHeaders(t *testing.T) {
+	if _, err := NewTestHandler("--access-log-headers=Authorization=Bearer s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+	config, err := effectiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := config["flags"].(map[string]any)
+	if got := flags["access-log-headers"]; got != "Authorization=[REDACTED]" {
+		t.Errorf("access-log-headers = %q", got)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	defer NewTestHandler()
+	if _, err := NewTestHandler("--admin-token=s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"bearer s3cret", http.StatusOK},
+		{"BEARER s3cret", http.StatusOK},
+		{"s3cret", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		req.Header.Set("Authorization", tt.authorization)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: status = %d, want %d", tt.authorization, rec.Code, tt.want)
+		}
+	}
+}
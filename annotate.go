@@ -0,0 +1,42 @@
+package argonproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// UPSTREAM ANNOTATIONS
+// -----------------------------
+
+// Headers describing the upstream exchange behind a proxied response
+const (
+	upstreamStatusHeader   = "X-Argon-Upstream-Status"
+	upstreamDurationHeader = "X-Argon-Upstream-Duration"
+	upstreamHostHeader     = "X-Argon-Upstream-Host"
+)
+
+// annotateUpstream tells the client which host the request went to, how
+// long it took to answer and, when it did, with what status, so upstream
+// behavior can be told apart from the proxy's own errors and overhead.
+// resp is nil when the upstream did not answer.
+func annotateUpstream(w http.ResponseWriter, proxyReq *http.Request, resp *http.Response, elapsed time.Duration) {
+	if !*upstreamAnnotations {
+		return
+	}
+	// After redirects, the host that gave the final answer
+	host := proxyReq.URL.Host
+	if resp != nil && resp.Request != nil {
+		host = resp.Request.URL.Host
+	}
+	exposed := []string{upstreamHostHeader, upstreamDurationHeader}
+	w.Header().Set(upstreamHostHeader, host)
+	w.Header().Set(upstreamDurationHeader, strconv.FormatInt(elapsed.Milliseconds(), 10))
+	if resp != nil {
+		w.Header().Set(upstreamStatusHeader, strconv.Itoa(resp.StatusCode))
+		exposed = append(exposed, upstreamStatusHeader)
+	}
+	w.Header().Add("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+}
@@ -0,0 +1,303 @@
+package argonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// RESPONSE ARCHIVING
+// -----------------------------
+
+// archiveWorkers is the number of concurrent uploads
+const archiveWorkers = 4
+
+// gcsScope is the OAuth scope needed to write objects to Cloud Storage
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// archiveTarget copies a route's successful responses into an S3 or GCS
+// bucket after they have been sent to the client
+type archiveTarget struct {
+	URL             string   `json:"url"` // s3://bucket/prefix or gs://bucket/prefix
+	ContentTypes    []string `json:"content_types,omitempty"`
+	MaxBytes        int      `json:"max_bytes,omitempty"`
+	Region          string   `json:"region,omitempty"`
+	Endpoint        string   `json:"endpoint,omitempty"` // S3-compatible or GCS emulator base URL
+	AccessKeyID     string   `json:"access_key_id,omitempty"`
+	SecretAccessKey string   `json:"secret_access_key,omitempty"`
+
+	bucket, prefix string
+	signer         *awsSigV4
+}
+
+// archiveJob is one response waiting to be uploaded
+type archiveJob struct {
+	target      *archiveTarget
+	key         string
+	contentType string
+	source      string
+	status      int
+	body        []byte
+}
+
+// archiveQueue feeds the upload workers; jobs are dropped when it is full
+var archiveQueue chan *archiveJob
+
+var startArchiveWorkers sync.Once
+
+// archiveResults counts archived responses by outcome
+var archiveResults struct {
+	uploaded, failed, dropped, tooLarge atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if archiveQueue == nil {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_archive_total Responses archived to object storage, by outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_archive_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_archive_total{result=\"uploaded\"} %d\n", archiveResults.uploaded.Load())
+		fmt.Fprintf(w, "argon_proxy_archive_total{result=\"failed\"} %d\n", archiveResults.failed.Load())
+		fmt.Fprintf(w, "argon_proxy_archive_total{result=\"dropped\"} %d\n", archiveResults.dropped.Load())
+		fmt.Fprintf(w, "argon_proxy_archive_total{result=\"too_large\"} %d\n", archiveResults.tooLarge.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_archive_queue Responses waiting to be archived.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_archive_queue gauge\n")
+		fmt.Fprintf(w, "argon_proxy_archive_queue %d\n", len(archiveQueue))
+	})
+}
+
+// prepare parses the bucket URL, checks credentials and starts the upload workers
+func (a *archiveTarget) prepare(routeName string) error {
+	u, err := url.Parse(a.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "s3" && u.Scheme != "gs") {
+		return fmt.Errorf("route %q: archive url must be s3://bucket/prefix or gs://bucket/prefix", routeName)
+	}
+	a.bucket, a.prefix = u.Host, strings.Trim(u.Path, "/")
+	if a.MaxBytes == 0 {
+		a.MaxBytes = 10 << 20
+	}
+	a.Endpoint = strings.TrimRight(a.Endpoint, "/")
+
+	if u.Scheme == "s3" {
+		if a.Region == "" && a.Endpoint != "" {
+			a.Region = "us-east-1"
+		}
+		a.signer = &awsSigV4{Service: "s3", Region: a.Region, AccessKeyID: a.AccessKeyID, SecretAccessKey: a.SecretAccessKey}
+		if err := a.signer.prepare(routeName); err != nil {
+			return fmt.Errorf("archive: %v", err)
+		}
+	} else if _, err := cachedCloudToken("gcp-access|"+gcsScope, func() (cachedToken, error) { return gcpAccessToken(gcsScope) }); err != nil {
+		return fmt.Errorf("route %q: archive: %v", routeName, err)
+	}
+
+	startArchiveWorkers.Do(func() {
+		archiveQueue = make(chan *archiveJob, *archiveQueueSize)
+		for i := 0; i < archiveWorkers; i++ {
+			go runArchiveWorker()
+		}
+	})
+	return nil
+}
+
+// archiveTee keeps a copy of the response body as it is relayed
+type archiveTee struct {
+	target *archiveTarget
+	r      *http.Request
+	resp   *http.Response
+	body   *captureBuffer
+	source io.Reader
+	eof    bool
+}
+
+// Read implements io.Reader, noting when the upstream body was fully read
+func (t *archiveTee) Read(p []byte) (int, error) {
+	n, err := t.source.Read(p)
+	t.body.Write(p[:n])
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+// startArchive tees the response body when the route archives responses of
+// this status and content type, or returns nil
+func startArchive(r *http.Request, resp *http.Response) *archiveTee {
+	a := routeFor(r).Archive
+	if a == nil || resp.StatusCode < 200 || resp.StatusCode > 299 || isLongLivedStream(resp) {
+		return nil
+	}
+	if len(a.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		matched := false
+		for _, pattern := range a.ContentTypes {
+			if mediaTypeMatches(pattern, mediaType) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+
+	t := &archiveTee{target: a, r: r, resp: resp, body: &captureBuffer{limit: a.MaxBytes}, source: resp.Body}
+	resp.Body = teeBody{t, resp.Body}
+	return t
+}
+
+// finish queues the copy for upload once the whole body was relayed; it
+// never waits for the upload
+func (t *archiveTee) finish(target string) {
+	if t == nil || !t.eof {
+		return
+	}
+	if t.body.truncated {
+		archiveResults.tooLarge.Add(1)
+		return
+	}
+
+	name := requestID(t.r)
+	contentType := t.resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	job := &archiveJob{
+		target:      t.target,
+		key:         path.Join(t.target.prefix, routeFor(t.r).Name, time.Now().UTC().Format("2006/01/02"), name),
+		contentType: contentType,
+		source:      target,
+		status:      t.resp.StatusCode,
+		body:        t.body.buf.Bytes(),
+	}
+	select {
+	case archiveQueue <- job:
+	default:
+		archiveResults.dropped.Add(1)
+		if *verbose {
+			log.Printf("Archive queue full, dropping response for %s", target)
+		}
+	}
+}
+
+// runArchiveWorker uploads queued responses, retrying failures twice
+func runArchiveWorker() {
+	for job := range archiveQueue {
+		var err error
+		for attempt := 1; attempt <= 3; attempt++ {
+			if err = job.upload(); err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			archiveResults.failed.Add(1)
+			log.Printf("Archiving %s to %s failed: %v", job.source, job.key, err)
+			continue
+		}
+		archiveResults.uploaded.Add(1)
+	}
+}
+
+// upload stores the job's body in its bucket
+func (job *archiveJob) upload() error {
+	var req *http.Request
+	var err error
+	if job.target.signer != nil {
+		req, err = job.s3Request()
+	} else {
+		req, err = job.gcsRequest()
+	}
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: upstream, Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// s3Request builds a signed PutObject request
+func (job *archiveJob) s3Request() (*http.Request, error) {
+	a := job.target
+	u := &url.URL{Scheme: "https", Host: a.bucket + ".s3." + a.Region + ".amazonaws.com", Path: "/" + job.key}
+	if a.Endpoint != "" {
+		base, err := url.Parse(a.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		u = base.JoinPath(a.bucket, job.key)
+	}
+
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(job.body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", job.contentType)
+	req.Header.Set("X-Amz-Meta-Source", job.source)
+	req.Header.Set("X-Amz-Meta-Status", strconv.Itoa(job.status))
+
+	creds, err := a.signer.credentials()
+	if err != nil {
+		return nil, err
+	}
+	a.signer.sign(req, job.body, creds, time.Now().UTC())
+	return req, nil
+}
+
+// gcsRequest builds a multipart upload carrying the object and its metadata
+func (job *archiveJob) gcsRequest() (*http.Request, error) {
+	token, err := cachedCloudToken("gcp-access|"+gcsScope, func() (cachedToken, error) { return gcpAccessToken(gcsScope) })
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	meta, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	json.NewEncoder(meta).Encode(map[string]any{
+		"name":        job.key,
+		"contentType": job.contentType,
+		"metadata":    map[string]string{"source": job.source, "status": strconv.Itoa(job.status)},
+	})
+	content, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {job.contentType}})
+	content.Write(job.body)
+	mw.Close()
+
+	base := "https://storage.googleapis.com"
+	if job.target.Endpoint != "" {
+		base = job.target.Endpoint
+	}
+	endpoint := base + "/upload/storage/v1/b/" + url.PathEscape(job.target.bucket) + "/o?uploadType=multipart"
+	req, err := http.NewRequest("POST", endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+mw.Boundary())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
@@ -0,0 +1,44 @@
+// Package argonproxytest runs argon-proxy and an echo upstream on
+// httptest servers, for the Go tests of projects that sit behind the proxy.
+//
+// The proxy's configuration is process-wide, so tests that start it with
+// different flags must not run in parallel.
+package argonproxytest
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	argonproxy "github.com/a2hop/argon-proxy"
+)
+
+// NewServer starts the proxy configured by command-line style flags, as
+// argonproxy.NewTestHandler, on a server that is closed when the test ends
+func NewServer(t testing.TB, args ...string) *httptest.Server {
+	t.Helper()
+	handler, err := argonproxy.NewTestHandler(args...)
+	if err != nil {
+		t.Fatalf("argon-proxy: %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// NewUpstream starts the echo server the selftest command uses, closed when
+// the test ends. See argonproxy.TestUpstreamHandler for what it serves.
+func NewUpstream(t testing.TB) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(argonproxy.TestUpstreamHandler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// ProxyURL returns the URL that fetches target through a proxy started at
+// proxyURL, e.g. by NewServer; more query parameters can be appended with
+// "&" and are forwarded to the target
+func ProxyURL(proxyURL, target string) string {
+	return strings.TrimSuffix(proxyURL, "/") + "/proxy/?target=" + url.QueryEscape(target)
+}
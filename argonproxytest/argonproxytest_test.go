@@ -0,0 +1,42 @@
+package argonproxytest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestProxyToUpstream(t *testing.T) {
+	upstream := NewUpstream(t)
+	proxy := NewServer(t, "--allow-origin=https://app.example.com")
+
+	tests := []struct {
+		name, origin, wantOrigin string
+	}{
+		{"allowed origin", "https://app.example.com", "https://app.example.com"},
+		{"no origin", "", "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", ProxyURL(proxy.URL, upstream.URL+"/echo"), nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := resp.Header.Get("X-Echo-Method"); got != "POST" {
+				t.Errorf("X-Echo-Method = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// AUDIT LOG AND REPLAY
+// -----------------------------
+
+// auditLog keeps the most recent proxied exchanges in a ring buffer
+type auditLog struct {
+	mu      sync.Mutex
+	entries []*exchange
+	next    int
+}
+
+var audit = &auditLog{}
+
+func init() {
+	registerRecorder(func() bool { return *auditSize > 0 }, audit.add)
+}
+
+// add stores an exchange, overwriting the oldest once the log is full
+func (a *auditLog) add(ex *exchange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) < *auditSize {
+		a.entries = append(a.entries, ex)
+		return
+	}
+	a.entries[a.next] = ex
+	a.next = (a.next + 1) % len(a.entries)
+}
+
+// recent returns the stored exchanges, newest first
+func (a *auditLog) recent() []*exchange {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]*exchange, 0, len(a.entries))
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		list = append(list, a.entries[(a.next+i)%len(a.entries)])
+	}
+	return list
+}
+
+// find returns the exchange with the given request ID
+func (a *auditLog) find(id string) *exchange {
+	for _, ex := range a.recent() {
+		if ex.ID == id {
+			return ex
+		}
+	}
+	return nil
+}
+
+// auditSummary is the list view of an audited exchange
+type auditSummary struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"duration_ms"`
+	ClientIP   string    `json:"client_ip"`
+	Route      string    `json:"route"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditDetail is the full view of an audited exchange
+type auditDetail struct {
+	auditSummary
+	RequestHeader     http.Header `json:"request_headers"`
+	RequestBody       string      `json:"request_body"`
+	RequestTruncated  bool        `json:"request_body_truncated"`
+	ResponseHeader    http.Header `json:"response_headers"`
+	ResponseBody      string      `json:"response_body"`
+	ResponseTruncated bool        `json:"response_body_truncated"`
+}
+
+// summary builds the list view of an exchange
+func (ex *exchange) summary() auditSummary {
+	return auditSummary{
+		ID:         ex.ID,
+		Time:       ex.Started,
+		DurationMs: ex.Duration.Milliseconds(),
+		ClientIP:   ex.ClientIP,
+		Route:      ex.Route,
+		Method:     ex.Method,
+		URL:        ex.URL,
+		Status:     ex.Status,
+		Error:      ex.Error,
+	}
+}
+
+// redactHeaders hides credentials in headers shown through the admin API
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for key := range out {
+		if isSecretName(key) || strings.EqualFold(key, "Cookie") || strings.EqualFold(key, "Set-Cookie") {
+			out[key] = []string{redactedValue}
+		}
+	}
+	return out
+}
+
+// handleAdminAudit serves GET /admin/audit, GET /admin/audit/{id} and
+// POST /admin/audit/{id}/replay
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/audit"), "/")
+
+	if rest == "" {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		list := []auditSummary{}
+		for _, ex := range audit.recent() {
+			if limit > 0 && len(list) >= limit {
+				break
+			}
+			list = append(list, ex.summary())
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	ex := audit.find(id)
+	if ex == nil {
+		http.Error(w, "Audit entry not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, auditDetail{
+			auditSummary:      ex.summary(),
+			RequestHeader:     redactHeaders(ex.RequestHeader),
+			RequestBody:       string(ex.RequestBody),
+			RequestTruncated:  ex.RequestTruncated,
+			ResponseHeader:    redactHeaders(ex.ResponseHeader),
+			ResponseBody:      string(ex.ResponseBody),
+			ResponseTruncated: ex.ResponseTruncated,
+		})
+	case action == "replay" && r.Method == "POST":
+		replayExchange(w, ex)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// replayResult describes how a replayed response differs from the recorded one
+type replayResult struct {
+	ID             string         `json:"id"`
+	URL            string         `json:"url"`
+	RecordedStatus int            `json:"recorded_status"`
+	ReplayedStatus int            `json:"replayed_status"`
+	StatusChanged  bool           `json:"status_changed"`
+	HeaderChanges  []headerChange `json:"header_changes"`
+	BodyChanged    bool           `json:"body_changed"`
+	BodyComparable bool           `json:"body_comparable"`
+	BodyDiff       []string       `json:"body_diff,omitempty"`
+	DurationMs     int64          `json:"duration_ms"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// headerChange is a response header whose value differs between two responses
+type headerChange struct {
+	Header   string `json:"header"`
+	Recorded string `json:"recorded,omitempty"`
+	Replayed string `json:"replayed,omitempty"`
+}
+
+// volatileHeaders change on every response and are left out of diffs
+var volatileHeaders = map[string]bool{"Date": true, "Age": true, "X-Request-Id": true}
+
+// replayExchange re-sends a recorded request through the route it was
+// proxied on, with that route's transport and redirect policy, and diffs
+// the new response
+func replayExchange(w http.ResponseWriter, ex *exchange) {
+	if ex.RequestTruncated {
+		http.Error(w, "Request body was truncated when recorded; cannot replay", http.StatusConflict)
+		return
+	}
+
+	req, err := http.NewRequest(ex.Method, ex.URL, bytes.NewReader(ex.RequestBody))
+	if err != nil {
+		http.Error(w, "Error creating replay request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = ex.RequestHeader.Clone()
+	rt := activeRoutes.Load().named(ex.Route)
+	req = req.WithContext(context.WithValue(req.Context(), routeContextKey{}, rt))
+
+	result := replayResult{ID: ex.ID, URL: ex.URL, RecordedStatus: ex.Status}
+	started := time.Now()
+	client := rt.upstreamClient()
+	restrictRedirects(req, client)
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	defer resp.Body.Close()
+
+	body := &captureBuffer{limit: *captureBodyLimit}
+	io.Copy(body, resp.Body)
+	result.DurationMs = time.Since(started).Milliseconds()
+
+	result.ReplayedStatus = resp.StatusCode
+	result.StatusChanged = resp.StatusCode != ex.Status
+	result.HeaderChanges = diffHeaders(ex.ResponseHeader, resp.Header)
+
+	// Bodies can only be compared when neither side was cut off
+	result.BodyComparable = !ex.ResponseTruncated && !body.truncated
+	result.BodyChanged = !bytes.Equal(ex.ResponseBody, body.buf.Bytes())
+	if result.BodyChanged && result.BodyComparable {
+		result.BodyDiff = diffLines(string(ex.ResponseBody), body.buf.String())
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// diffHeaders lists headers that were added, removed or changed
+func diffHeaders(recorded, replayed http.Header) []headerChange {
+	keys := make(map[string]bool)
+	for key := range recorded {
+		keys[key] = true
+	}
+	for key := range replayed {
+		keys[key] = true
+	}
+
+	changes := []headerChange{}
+	for key := range keys {
+		if volatileHeaders[key] {
+			continue
+		}
+		before := strings.Join(recorded.Values(key), ", ")
+		after := strings.Join(replayed.Values(key), ", ")
+		if before != after {
+			changes = append(changes, headerChange{Header: key, Recorded: before, Replayed: after})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Header < changes[j].Header })
+	return changes
+}
+
+// maxDiffCells bounds the work done by diffLines
+const maxDiffCells = 4000000
+
+// diffLines returns a line diff of two texts with "-"/"+" prefixed lines
+func diffLines(before, after string) []string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+	if len(a)*len(b) > maxDiffCells {
+		return []string{fmt.Sprintf("(bodies too large to diff: %d and %d lines)", len(a), len(b))}
+	}
+
+	// Longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return diff
+}
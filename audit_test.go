@@ -0,0 +1,49 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReplayFollowsRedirectPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://denied.example/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	if _, err := NewTestHandler("--deny-hosts=denied.example"); err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+
+	tests := []struct {
+		path, wantError string
+		wantStatus      int
+	}{
+		{"/ok", "", http.StatusOK},
+		{"/redirect", "target host not allowed", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ex := &exchange{ID: "1", Route: "default", Method: "GET", URL: upstream.URL + tt.path, RequestHeader: http.Header{}, Status: http.StatusOK}
+			rec := httptest.NewRecorder()
+			replayExchange(rec, ex)
+			var result replayResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.ReplayedStatus != tt.wantStatus {
+				t.Errorf("replayed status = %d, want %d", result.ReplayedStatus, tt.wantStatus)
+			}
+			if !strings.Contains(result.Error, tt.wantError) || (tt.wantError == "") != (result.Error == "") {
+				t.Errorf("error = %q, want one mentioning %q", result.Error, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package argonproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// -----------------------------
+// PROXY AUTHENTICATION
+// -----------------------------
+
+// Authenticator decides who may use /proxy/. Built-ins are selected with
+// -auth; a build can add its own by calling registerAuthenticator from an
+// init function, e.g. to check sessions issued by an existing login system.
+type Authenticator interface {
+	// Authenticate returns the caller's identity, "" for an anonymous caller
+	// when anonymous access is allowed, or an error when the request must be
+	// refused. errNoCredentials means the request carried none.
+	Authenticate(r *http.Request) (string, error)
+	// Challenge is the WWW-Authenticate value sent with a 401, or ""
+	Challenge() string
+	// Strip removes the credentials from a request before it goes upstream
+	Strip(proxyReq *http.Request)
+}
+
+// errNoCredentials is returned by an Authenticator when the request has none
+var errNoCredentials = errors.New("authentication required")
+
+// authenticators creates the Authenticator for each -auth value
+var authenticators = map[string]func() (Authenticator, error){
+	"none":   func() (Authenticator, error) { return nil, nil },
+	"apikey": func() (Authenticator, error) { return loadAPIKeys(*authFile) },
+	"basic":  func() (Authenticator, error) { return loadHtpasswd(*authFile) },
+	"jwt":    newJWTAuth,
+}
+
+// registerAuthenticator makes an Authenticator available as -auth=name
+func registerAuthenticator(name string, factory func() (Authenticator, error)) {
+	authenticators[name] = factory
+}
+
+// authenticator checks proxy requests; nil lets everyone through
+var authenticator Authenticator
+
+// authResults counts authentication attempts by outcome
+var authResults struct {
+	passed, failed, missing atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if authenticator == nil {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_auth_total Proxy requests by authentication outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_auth_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_auth_total{result=\"passed\"} %d\n", authResults.passed.Load())
+		fmt.Fprintf(w, "argon_proxy_auth_total{result=\"failed\"} %d\n", authResults.failed.Load())
+		fmt.Fprintf(w, "argon_proxy_auth_total{result=\"missing\"} %d\n", authResults.missing.Load())
+	})
+}
+
+// openAuthenticator creates the Authenticator selected with -auth
+func openAuthenticator(name string) (Authenticator, error) {
+	if name == "" {
+		name = "none"
+	}
+	factory, ok := authenticators[name]
+	if !ok {
+		names := make([]string, 0, len(authenticators))
+		for n := range authenticators {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("--auth must be one of: %s", strings.Join(names, ", "))
+	}
+	a, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("--auth=%s: %v", name, err)
+	}
+	return a, nil
+}
+
+type identityContextKey struct{}
+
+// requireAuth authenticates a proxy request, answering 401 when it fails and
+// 429 when its client IP has failed too often under --rate-limit. The
+// identity is kept on the request for identityFor.
+func requireAuth(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if authenticator == nil || federated(r) != nil {
+		return r, true
+	}
+	if !checkAuthFailures(w, r) {
+		return r, false
+	}
+	identity, err := authenticator.Authenticate(r)
+	if err == nil {
+		authResults.passed.Add(1)
+		noteAccess(r, func(rec *accessRecord) { rec.Identity = identity })
+		return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity)), true
+	}
+
+	if errors.Is(err, errNoCredentials) {
+		authResults.missing.Add(1)
+	} else {
+		authResults.failed.Add(1)
+		noteAuthFailure(r)
+		if *verbose {
+			log.Printf("Authentication failed for %s: %v", getClientIP(r), err)
+		}
+	}
+	addCORSHeaders(w, r)
+	if challenge := authenticator.Challenge(); challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.Header().Add("Access-Control-Expose-Headers", "WWW-Authenticate")
+	}
+	proxyError(w, r, http.StatusUnauthorized, err.Error(), "")
+	return r, false
+}
+
+// identityFor returns the authenticated caller of a request, or ""
+func identityFor(r *http.Request) string {
+	identity, _ := r.Context().Value(identityContextKey{}).(string)
+	return identity
+}
+
+// readCredentialLines returns the non-empty, non-comment lines of a file
+func readCredentialLines(path string) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--auth-file is required")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// -----------------------------
+// API KEYS
+// -----------------------------
+
+// apiKeyHeader carries the caller's API key
+const apiKeyHeader = "X-Argon-Key"
+
+// apiKeyAuth accepts the keys listed in a file, one "name:key" or
+// "name:sha256:<hex digest of key>" per line
+type apiKeyAuth struct {
+	names map[[sha256.Size]byte]string
+}
+
+// loadAPIKeys reads an API keys file
+func loadAPIKeys(path string) (*apiKeyAuth, error) {
+	lines, err := readCredentialLines(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &apiKeyAuth{names: make(map[[sha256.Size]byte]string)}
+	for i, line := range lines {
+		name, key, ok := strings.Cut(line, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:key", path, i+1)
+		}
+		var sum [sha256.Size]byte
+		if digest, hashed := strings.CutPrefix(key, "sha256:"); hashed {
+			b, err := hex.DecodeString(digest)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("%s:%d: invalid sha256 digest", path, i+1)
+			}
+			copy(sum[:], b)
+		} else {
+			sum = sha256.Sum256([]byte(key))
+		}
+		a.names[sum] = name
+	}
+	if len(a.names) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator. Keys are looked up by digest, so
+// the comparison does not leak how much of a key matched.
+func (a *apiKeyAuth) Authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		key = takeAPIKeyParam(r)
+	}
+	if key == "" {
+		return "", errNoCredentials
+	}
+	name, ok := a.names[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", errors.New("invalid API key")
+	}
+	return name, nil
+}
+
+// takeAPIKeyParam removes the --auth-key-param parameter from the request's
+// query and returns its value, so the key is neither logged nor forwarded
+// upstream with the other parameters. The parameter carries the key where
+// a header cannot be set, as in links and EventSource or <img> URLs.
+func takeAPIKeyParam(r *http.Request) string {
+	param := *authKeyParam
+	if param == "" || !strings.Contains(r.URL.RawQuery, param+"=") {
+		return ""
+	}
+	key := ""
+	parts := strings.Split(r.URL.RawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		name, value, _ := strings.Cut(part, "=")
+		if name != param {
+			kept = append(kept, part)
+			continue
+		}
+		if decoded, err := url.QueryUnescape(value); err == nil && key == "" {
+			key = decoded
+		}
+	}
+	r.URL.RawQuery = strings.Join(kept, "&")
+	return key
+}
+
+// Challenge implements Authenticator
+func (a *apiKeyAuth) Challenge() string { return "" }
+
+// Strip implements Authenticator
+func (a *apiKeyAuth) Strip(proxyReq *http.Request) { proxyReq.Header.Del(apiKeyHeader) }
+
+// -----------------------------
+// BASIC AUTH
+// -----------------------------
+
+// basicAuthCacheSize bounds the verified passwords remembered by basicAuth
+const basicAuthCacheSize = 10000
+
+// basicAuth accepts the users of an htpasswd file with bcrypt passwords
+// (htpasswd -B). bcrypt is deliberately slow, so passwords that verified are
+// remembered for a few minutes by digest.
+type basicAuth struct {
+	hashes map[string][]byte
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// loadHtpasswd reads an htpasswd file
+func loadHtpasswd(path string) (*basicAuth, error) {
+	lines, err := readCredentialLines(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &basicAuth{hashes: make(map[string][]byte), verified: make(map[[sha256.Size]byte]time.Time)}
+	for i, line := range lines {
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt passwords are supported (htpasswd -B)", path, i+1)
+		}
+		a.hashes[user] = []byte(hash)
+	}
+	if len(a.hashes) == 0 {
+		return nil, fmt.Errorf("%s has no users", path)
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator
+func (a *basicAuth) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errNoCredentials
+	}
+	hash, known := a.hashes[user]
+	if !known {
+		return "", errors.New("invalid username or password")
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	expires, cached := a.verified[sum]
+	a.mu.Unlock()
+	if cached && time.Now().Before(expires) {
+		return user, nil
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", errors.New("invalid username or password")
+	}
+	a.mu.Lock()
+	if len(a.verified) >= basicAuthCacheSize {
+		clear(a.verified)
+	}
+	a.verified[sum] = time.Now().Add(5 * time.Minute)
+	a.mu.Unlock()
+	return user, nil
+}
+
+// Challenge implements Authenticator
+func (a *basicAuth) Challenge() string { return `Basic realm="argon-proxy", charset="UTF-8"` }
+
+// Strip implements Authenticator
+func (a *basicAuth) Strip(proxyReq *http.Request) { proxyReq.Header.Del("Authorization") }
+
+// -----------------------------
+// JWT
+// -----------------------------
+
+// jwtLeeway allows for clock skew when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// jwtAuth accepts bearer JWTs signed with an HMAC secret (HS256/384/512) or
+// by the holder of a public key (RS256/384/512, ES256/384/512). The key
+// type decides the accepted algorithms, so a public key can never be used
+// as an HMAC secret.
+type jwtAuth struct {
+	secret    []byte
+	publicKey crypto.PublicKey
+	issuer    string
+	audience  string
+}
+
+// newJWTAuth configures JWT checks from -auth-jwt-secret or a PEM public key in -auth-file
+func newJWTAuth() (Authenticator, error) {
+	a := &jwtAuth{secret: []byte(*authJWTSecret), issuer: *authJWTIssuer, audience: *authJWTAudience}
+	if *authFile != "" {
+		data, err := os.ReadFile(*authFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.publicKey, err = parsePublicKeyPEM(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", *authFile, err)
+		}
+	}
+	if (len(a.secret) == 0) == (a.publicKey == nil) {
+		return nil, fmt.Errorf("set either --auth-jwt-secret or --auth-file with a PEM public key")
+	}
+	return a, nil
+}
+
+// parsePublicKeyPEM reads an RSA or ECDSA public key or certificate
+func parsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// Authenticate implements Authenticator, returning the token's subject
+func (a *jwtAuth) Authenticate(r *http.Request) (string, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token signature")
+	}
+	if err := a.verify(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Subject   string          `json:"sub"`
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"`
+		Expires   *float64        `json:"exp"`
+		NotBefore *float64        `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", errors.New("malformed token claims")
+	}
+	now := time.Now()
+	if claims.Expires != nil && now.After(time.Unix(int64(*claims.Expires), 0).Add(jwtLeeway)) {
+		return "", errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return "", errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return "", errors.New("token issuer not accepted")
+	}
+	if a.audience != "" && !jwtAudienceIncludes(claims.Audience, a.audience) {
+		return "", errors.New("token audience not accepted")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// verify checks a token signature with the configured key
+func (a *jwtAuth) verify(alg, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	invalid := errors.New("invalid token signature")
+
+	if strings.HasPrefix(alg, "HS") && len(a.secret) > 0 {
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return invalid
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := a.publicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return invalid
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("token algorithm %q not accepted", alg)
+}
+
+// decodeJWTPart decodes a base64url JSON token segment
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudienceIncludes reports whether an aud claim, a string or an array, names audience
+func jwtAudienceIncludes(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	for _, aud := range many {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge implements Authenticator
+func (a *jwtAuth) Challenge() string { return `Bearer realm="argon-proxy"` }
+
+// Strip implements Authenticator
+func (a *jwtAuth) Strip(proxyReq *http.Request) { proxyReq.Header.Del("Authorization") }
@@ -0,0 +1,81 @@
+package argonproxy
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKeyParam(t *testing.T) {
+	a := &apiKeyAuth{names: map[[sha256.Size]byte]string{sha256.Sum256([]byte("s3cret")): "alice"}}
+	defer func(saved string) { *authKeyParam = saved }(*authKeyParam)
+
+	tests := []struct {
+		name      string
+		param     string
+		header    string
+		query     string
+		identity  string
+		wantErr   bool
+		wantQuery string
+	}{
+		{"param", "key", "", "target=x&key=s3cret&a=1", "alice", false, "target=x&a=1"},
+		{"header leaves upstream key alone", "key", "s3cret", "target=x&key=GOOGLEKEY&a=1", "alice", false, "target=x&key=GOOGLEKEY&a=1"},
+		{"wrong param", "key", "", "target=x&key=GOOGLEKEY", "", true, "target=x"},
+		{"renamed param", "argon_key", "", "target=x&key=GOOGLEKEY&argon_key=s3cret", "alice", false, "target=x&key=GOOGLEKEY"},
+		{"param disabled", "", "", "target=x&key=s3cret", "", true, "target=x&key=s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*authKeyParam = tt.param
+			r := httptest.NewRequest("GET", "/proxy/?"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set(apiKeyHeader, tt.header)
+			}
+			identity, err := a.Authenticate(r)
+			if identity != tt.identity || (err != nil) != tt.wantErr {
+				t.Errorf("Authenticate = %q, %v; want %q, error %v", identity, err, tt.identity, tt.wantErr)
+			}
+			if r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", r.URL.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestAuthFailuresRateLimited(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keys, []byte("alice:s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+	handler, err := NewTestHandler("--auth=apikey", "--auth-file="+keys, "--rate-limit=0.01", "--rate-burst=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(remoteAddr, key string) int {
+		req := httptest.NewRequest("GET", "/proxy/?target="+url.QueryEscape("http://127.0.0.1:1/"), nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(apiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if got := serve("192.0.2.20:1234", "guess"); got != want {
+			t.Errorf("bad key %d: status = %d, want %d", i+1, got, want)
+		}
+	}
+	// The locked-out IP is refused even with the right key; others are not
+	if got := serve("192.0.2.20:1234", "s3cret"); got != http.StatusTooManyRequests {
+		t.Errorf("valid key from the locked-out IP: status = %d", got)
+	}
+	if got := serve("192.0.2.21:1234", "s3cret"); got == http.StatusUnauthorized || got == http.StatusTooManyRequests {
+		t.Errorf("valid key from another IP: status = %d", got)
+	}
+}
@@ -0,0 +1,284 @@
+package argonproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// DOMAIN BLOCKLISTS
+// -----------------------------
+
+// errBlocklisted is returned when a redirect leads to a blocklisted host
+var errBlocklisted = errors.New("target host is on a blocklist")
+
+// blocklistClient fetches blocklists given as URLs
+var blocklistClient = &http.Client{Timeout: time.Minute}
+
+// blocklistSource is one --blocklists entry and the domains it last listed
+type blocklistSource struct {
+	location string
+	domains  map[string]bool // false for passthru exceptions
+	etag     string          // validators of the last download, sent when refreshing
+	modified string
+}
+
+// blocklists holds the domains of every source, merged for lookups
+var blocklists struct {
+	mu      sync.Mutex // serializes refreshes
+	sources []*blocklistSource
+	domains atomic.Pointer[map[string]string] // domain to the source listing it, "" for exceptions
+	count   atomic.Int64
+	blocked atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		domains := blocklists.domains.Load()
+		if domains == nil {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_blocklist_domains Domains on the loaded --blocklists.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_blocklist_domains gauge\n")
+		fmt.Fprintf(w, "argon_proxy_blocklist_domains %d\n", blocklists.count.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_blocklist_blocked_total Targets and redirects refused for a blocklisted host.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_blocklist_blocked_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_blocklist_blocked_total %d\n", blocklists.blocked.Load())
+	})
+}
+
+// startBlocklists loads --blocklists and refreshes them every
+// --blocklist-refresh. Every source must load at startup; later a source
+// that fails to refresh keeps its previous domains.
+func startBlocklists() error {
+	if *blocklistSources == "" {
+		return nil
+	}
+	if *blocklistRefresh < time.Minute {
+		return errors.New("--blocklist-refresh must be at least 1m")
+	}
+	for _, location := range splitList(*blocklistSources) {
+		source := &blocklistSource{location: location}
+		if _, err := source.load(); err != nil {
+			return fmt.Errorf("loading blocklist %s: %v", location, err)
+		}
+		blocklists.sources = append(blocklists.sources, source)
+	}
+	mergeBlocklists()
+	go func() {
+		for range time.Tick(*blocklistRefresh) {
+			refreshBlocklists()
+		}
+	}()
+	return nil
+}
+
+// refreshBlocklists reloads every source, keeping the domains of those that fail
+func refreshBlocklists() {
+	blocklists.mu.Lock()
+	defer blocklists.mu.Unlock()
+	changed := false
+	for _, source := range blocklists.sources {
+		updated, err := source.load()
+		if err != nil {
+			log.Printf("Error refreshing blocklist %s, keeping %d domains: %v", source.location, len(source.domains), err)
+			continue
+		}
+		changed = changed || updated
+	}
+	if changed {
+		mergeBlocklists()
+	}
+}
+
+// mergeBlocklists publishes the domains of all sources for lookups
+func mergeBlocklists() {
+	merged := make(map[string]string)
+	count := 0
+	for _, source := range blocklists.sources {
+		for domain, blocked := range source.domains {
+			if !blocked {
+				if _, ok := merged[domain]; !ok {
+					merged[domain] = ""
+				}
+				continue
+			}
+			if merged[domain] == "" {
+				count++
+			}
+			merged[domain] = source.location
+		}
+	}
+	blocklists.domains.Store(&merged)
+	blocklists.count.Store(int64(count))
+	log.Printf("Blocklists: %d domains from %d sources", count, len(blocklists.sources))
+}
+
+// load reads the source, reporting false when a URL was not modified
+func (s *blocklistSource) load() (bool, error) {
+	if !strings.HasPrefix(s.location, "http://") && !strings.HasPrefix(s.location, "https://") {
+		f, err := os.Open(s.location)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		domains, err := parseBlocklist(f)
+		if err != nil {
+			return false, err
+		}
+		s.domains = domains
+		return true, nil
+	}
+
+	req, err := http.NewRequest("GET", s.location, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.modified != "" {
+		req.Header.Set("If-Modified-Since", s.modified)
+	}
+	resp, err := blocklistClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && s.domains != nil {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+	domains, err := parseBlocklist(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	s.domains, s.etag, s.modified = domains, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// parseBlocklist reads the domains of a hosts file ("0.0.0.0 bad.example"),
+// a plain list of domains, or an RPZ zone ("bad.example CNAME ."), with
+// RPZ passthru rules as exceptions. IP-based RPZ triggers and local names
+// are skipped.
+func parseBlocklist(r io.Reader) (map[string]bool, error) {
+	domains := make(map[string]bool)
+	origin := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name, blocked := "", true
+		switch {
+		case strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1:
+			origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+			continue
+		case len(fields) == 1:
+			name = fields[0]
+		case net.ParseIP(fields[0]) != nil:
+			// Hosts files block by pointing names at an unroutable address
+			if ip := net.ParseIP(fields[0]); !ip.IsUnspecified() && !ip.IsLoopback() {
+				continue
+			}
+			for _, alias := range fields[1:] {
+				addBlockedDomain(domains, alias, true)
+			}
+			continue
+		default:
+			cname := -1
+			for i, field := range fields {
+				if strings.EqualFold(field, "CNAME") {
+					cname = i
+					break
+				}
+			}
+			// Only RPZ records whose owner starts the line; others are zone metadata
+			if cname < 1 || cname+1 >= len(fields) || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			blocked = !strings.EqualFold(fields[cname+1], "rpz-passthru.")
+			name = strings.ToLower(fields[0])
+			if strings.HasSuffix(name, ".") {
+				trimmed, ok := strings.CutSuffix(strings.TrimSuffix(name, "."), "."+origin)
+				if origin == "" || !ok {
+					continue
+				}
+				name = trimmed
+			}
+			if strings.Contains(name, "rpz-") {
+				continue
+			}
+		}
+		addBlockedDomain(domains, name, blocked)
+	}
+	return domains, scanner.Err()
+}
+
+// addBlockedDomain adds a listed name; "*." prefixes are dropped, as every
+// listed domain covers its subdomains. A blocking entry wins over an
+// exception for the same name.
+func addBlockedDomain(domains map[string]bool, name string, blocked bool) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+	if !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return
+	}
+	domains[name] = domains[name] || blocked
+}
+
+// blocklisted returns the source listing host or one of its parent
+// domains, or "" if none does. The most specific listed name decides, so
+// an exception for a subdomain lets it through.
+func blocklisted(host string) string {
+	domains := blocklists.domains.Load()
+	if domains == nil {
+		return ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if source, ok := (*domains)[host]; ok {
+			return source
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return ""
+		}
+		host = parent
+	}
+}
+
+// checkBlocklist refuses a target whose host is on a blocklist
+func checkBlocklist(w http.ResponseWriter, r *http.Request, target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return true
+	}
+	source := blocklisted(u.Hostname())
+	if source == "" || reportOnly(r, "blocklist", fmt.Sprintf("target %s is on blocklist %s", target, source)) {
+		return true
+	}
+	blocklists.blocked.Add(1)
+	log.Printf("Refusing %s: %s is on blocklist %s", target, u.Hostname(), source)
+	addCORSHeaders(w, r)
+	proxyError(w, r, http.StatusForbidden, "Target host is on a blocklist", target)
+	return false
+}
@@ -0,0 +1,190 @@
+package argonproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// -----------------------------
+// TRANSFER BUDGETS
+// -----------------------------
+
+// budgetCounterTTL keeps a month's counters a little longer than the month
+const budgetCounterTTL = 35 * 24 * time.Hour
+
+// byteBudget caps the request and response bytes proxied per calendar month
+// (UTC). Once used up, requests are rejected or their responses throttled.
+type byteBudget struct {
+	MonthlyBytes int64  `json:"monthly_bytes"`
+	Action       string `json:"action,omitempty"`        // reject (default) or throttle
+	ThrottleRate int64  `json:"throttle_rate,omitempty"` // bytes per second once exhausted
+}
+
+// prepare validates the budget and fills in defaults
+func (b *byteBudget) prepare() error {
+	if b.MonthlyBytes <= 0 {
+		return fmt.Errorf("budget monthly_bytes must be positive")
+	}
+	switch b.Action {
+	case "":
+		b.Action = "reject"
+	case "reject", "throttle":
+	default:
+		return fmt.Errorf("budget action must be reject or throttle")
+	}
+	if b.ThrottleRate == 0 {
+		b.ThrottleRate = 64 << 10
+	}
+	return nil
+}
+
+// prepareBudgets validates the route's budget and its callers' budgets
+func (rt *Route) prepareBudgets() error {
+	if rt.Budget != nil {
+		if err := rt.Budget.prepare(); err != nil {
+			return fmt.Errorf("route %q: %v", rt.Name, err)
+		}
+	}
+	for identity, b := range rt.IdentityBudgets {
+		if err := b.prepare(); err != nil {
+			return fmt.Errorf("route %q, identity %q: %v", rt.Name, identity, err)
+		}
+	}
+	return nil
+}
+
+// budgetCounter is one budget that applies to a request and its counter key
+type budgetCounter struct {
+	budget *byteBudget
+	key    string
+	owner  string
+}
+
+// budgetState is what checkBudget learned about a request's budgets
+type budgetState struct {
+	counters []budgetCounter
+	throttle int64
+}
+
+type budgetContextKey struct{}
+
+// budgetsFor returns the budgets of the request's route and caller; an
+// "*" entry in identity_budgets applies to each caller without their own
+func budgetsFor(r *http.Request) []budgetCounter {
+	rt := routeFor(r)
+	month := time.Now().UTC().Format("200601")
+	var counters []budgetCounter
+	if rt.Budget != nil {
+		counters = append(counters, budgetCounter{rt.Budget, "budget:" + month + ":" + rt.Name, "This route"})
+	}
+	if identity := identityFor(r); identity != "" && len(rt.IdentityBudgets) > 0 {
+		b := rt.IdentityBudgets[identity]
+		if b == nil {
+			b = rt.IdentityBudgets["*"]
+		}
+		if b != nil {
+			counters = append(counters, budgetCounter{b, "budget:" + month + ":" + rt.Name + ":" + identity, identity})
+		}
+	}
+	return counters
+}
+
+// checkBudget refuses a request whose route or caller used up a rejecting
+// budget, answering 429 until the next month, and notes the throttle rate
+// of exhausted throttling budgets for throttleResponse
+func checkBudget(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	counters := budgetsFor(r)
+	if len(counters) == 0 {
+		return r, true
+	}
+
+	state := &budgetState{counters: counters}
+	for _, c := range counters {
+		used, err := store.Incr(c.key, 0, budgetCounterTTL)
+		if err != nil {
+			log.Printf("Error reading transfer budget %s: %v", c.key, err)
+			continue
+		}
+		if used < c.budget.MonthlyBytes || reportOnly(r, "budget", c.owner+" used its monthly transfer budget") {
+			continue
+		}
+		if c.budget.Action == "throttle" {
+			if state.throttle == 0 || c.budget.ThrottleRate < state.throttle {
+				state.throttle = c.budget.ThrottleRate
+			}
+			continue
+		}
+
+		now := time.Now().UTC()
+		nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		addCORSHeaders(w, r)
+		w.Header().Set("Retry-After", strconv.Itoa(int(nextMonth.Sub(now).Seconds())+1))
+		proxyError(w, r, http.StatusTooManyRequests, fmt.Sprintf("%s used its monthly transfer budget of %s; it resets on %s",
+			c.owner, formatBytes(c.budget.MonthlyBytes), nextMonth.Format("2006-01-02")), "")
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), budgetContextKey{}, state)), true
+}
+
+// throttleResponse slows the response body down once a throttling budget is used up
+func throttleResponse(r *http.Request, resp *http.Response) {
+	state, _ := r.Context().Value(budgetContextKey{}).(*budgetState)
+	if state == nil || state.throttle == 0 {
+		return
+	}
+	resp.Body = teeBody{&throttledReader{source: resp.Body, rate: state.throttle, start: time.Now()}, resp.Body}
+}
+
+// chargeBudget adds a request's transferred bytes to its budgets
+func chargeBudget(r *http.Request, bytes int64) {
+	state, _ := r.Context().Value(budgetContextKey{}).(*budgetState)
+	if state == nil || bytes <= 0 {
+		return
+	}
+	for _, c := range state.counters {
+		if _, err := store.Incr(c.key, bytes, budgetCounterTTL); err != nil {
+			log.Printf("Error charging transfer budget %s: %v", c.key, err)
+		}
+	}
+}
+
+// throttledReader reads no faster than rate bytes per second
+type throttledReader struct {
+	source io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+// Read implements io.Reader, sleeping while ahead of the rate
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.source.Read(p)
+	t.read += int64(n)
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
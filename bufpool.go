@@ -0,0 +1,48 @@
+package argonproxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// -----------------------------
+// BUFFER POOLS
+// -----------------------------
+
+// copyBufferSize matches the buffer io.Copy would otherwise allocate per call
+const copyBufferSize = 32 * 1024
+
+// copyBuffers holds the buffers used to relay bodies
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// byteBuffers holds scratch buffers for rendered responses
+var byteBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBuffer keeps unusually large buffers from being pinned by the pool
+const maxPooledBuffer = 64 * 1024
+
+// copyBody relays src to dst through a pooled buffer. Both sides are wrapped
+// so io.CopyBuffer cannot bypass the buffer via ReaderFrom or WriterTo.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return byteBuffers.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns a buffer to the pool once its bytes are no longer used
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	byteBuffers.Put(buf)
+}
@@ -0,0 +1,74 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkCopyBody compares relaying a 64 KiB body with io.Copy, as before
+// the buffer pool, against copyBody. The writer hides ReaderFrom like the
+// HTTP/2 and HTTP/3 response writers, so io.Copy allocates its own buffer.
+func BenchmarkCopyBody(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 64*1024)
+	copies := []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"pooled", copyBody},
+	}
+	for _, c := range copies {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for range b.N {
+				dst := struct{ io.Writer }{io.Discard}
+				if _, err := c.copy(dst, struct{ io.Reader }{bytes.NewReader(body)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkProxyErrorPage compares rendering an error page into a new
+// buffer, as before the buffer pool, against proxyError
+func BenchmarkProxyErrorPage(b *testing.B) {
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "502.html"), []byte("<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}} ({{.RequestID}})</p>"), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	rt := &Route{Name: "bench", ErrorPages: map[string]string{"502": "502.html"}}
+	if err := rt.loadErrorPages(dir); err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/proxy/?target=https%3A%2F%2Fexample.com", nil)
+	r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, rt))
+	data := errorPageData{Status: 502, StatusText: "Bad Gateway", Message: "Upstream unavailable", RequestID: requestID(r), Target: "https://example.com", Route: rt.Name}
+
+	b.Run("new buffer", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			page := rt.errorPageFor(http.StatusBadGateway)
+			var body bytes.Buffer
+			page.tmpl.Execute(&body, data)
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", page.contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(body.Bytes())
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			proxyError(httptest.NewRecorder(), r, http.StatusBadGateway, "Upstream unavailable", "https://example.com")
+		}
+	})
+}
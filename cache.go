@@ -0,0 +1,781 @@
+package argonproxy
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// RESPONSE CACHE
+// -----------------------------
+
+// cacheHeader tells clients whether a response came from the cache
+const cacheHeader = "X-Argon-Cache"
+
+// maxCacheVariants bounds the Vary variants kept per URL
+const maxCacheVariants = 8
+
+// cacheableStatuses are the statuses the cache keeps when the upstream
+// gives them a freshness lifetime
+var cacheableStatuses = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// cacheEntry is a stored response, fresh until expires. The body is held in
+// memory or, in the disk tier, in file. Shared entries are copies of the
+// one in the store.
+type cacheEntry struct {
+	target  string
+	status  int
+	header  http.Header
+	vary    map[string]string // the request headers the response varies on, as sent
+	stored  time.Time         // when the upstream generated it, going by its Age
+	expires time.Time
+	body    []byte
+	file    string
+	offset  int64 // where the body starts in file
+	length  int64
+	shared  bool
+}
+
+// cacheItem holds the variants of one route and URL
+type cacheItem struct {
+	key      string
+	variants []*cacheEntry
+	size     int64
+}
+
+// lruCache is a size-bounded LRU of responses, used for each cache tier
+type lruCache struct {
+	name  string
+	limit *int64            // the flag bounding its size
+	evict func(*cacheEntry) // releases an entry dropped from the cache, if set
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front is most recently used
+	size  int64
+
+	evictions atomic.Uint64
+}
+
+// newLRUCache returns an empty cache tier
+func newLRUCache(name string, limit *int64, evict func(*cacheEntry)) *lruCache {
+	return &lruCache{name: name, limit: limit, evict: evict, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+var (
+	responseCache = newLRUCache("memory", cacheSize, nil)
+	diskCache     = newLRUCache("disk", cacheDirSize, removeCacheFile)
+)
+
+// cacheResults counts cacheable requests by outcome
+var cacheResults struct {
+	memoryHits  atomic.Uint64
+	diskHits    atomic.Uint64
+	sharedHits  atomic.Uint64
+	misses      atomic.Uint64
+	revalidated atomic.Uint64
+}
+
+func init() {
+	purgeFuncs["responses"] = func() {
+		responseCache.flush()
+		diskCache.flush()
+		flushShared()
+	}
+	registerMetrics(func(w io.Writer) {
+		if !cacheEnabled() {
+			return
+		}
+		var tiers []*lruCache
+		if *cacheSize > 0 {
+			tiers = append(tiers, responseCache)
+		}
+		if *cacheDir != "" {
+			tiers = append(tiers, diskCache)
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_requests_total Cacheable requests, by whether the cache answered them.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_requests_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_cache_requests_total{result=\"hit\"} %d\n", cacheResults.memoryHits.Load()+cacheResults.diskHits.Load()+cacheResults.sharedHits.Load())
+		fmt.Fprintf(w, "argon_proxy_cache_requests_total{result=\"miss\"} %d\n", cacheResults.misses.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_revalidations_total Stale cached responses the upstream confirmed with 304 Not Modified.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_revalidations_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_cache_revalidations_total %d\n", cacheResults.revalidated.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_hits_total Cache hits, by the tier that held the response.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_hits_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_cache_hits_total{tier=\"memory\"} %d\n", cacheResults.memoryHits.Load())
+		fmt.Fprintf(w, "argon_proxy_cache_hits_total{tier=\"disk\"} %d\n", cacheResults.diskHits.Load())
+		fmt.Fprintf(w, "argon_proxy_cache_hits_total{tier=\"shared\"} %d\n", cacheResults.sharedHits.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_entries Responses held in the cache.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_entries gauge\n")
+		for _, c := range tiers {
+			entries, _ := c.usage()
+			fmt.Fprintf(w, "argon_proxy_cache_entries{tier=%s} %d\n", quoteLabel(c.name), entries)
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_bytes Bytes held in the cache.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_bytes gauge\n")
+		for _, c := range tiers {
+			_, size := c.usage()
+			fmt.Fprintf(w, "argon_proxy_cache_bytes{tier=%s} %d\n", quoteLabel(c.name), size)
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_cache_evictions_total Responses evicted to stay within --cache-size or --cache-dir-size.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_cache_evictions_total counter\n")
+		for _, c := range tiers {
+			fmt.Fprintf(w, "argon_proxy_cache_evictions_total{tier=%s} %d\n", quoteLabel(c.name), c.evictions.Load())
+		}
+	})
+}
+
+// usage returns how many responses and bytes the tier holds
+func (c *lruCache) usage() (entries int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.items {
+		entries += len(el.Value.(*cacheItem).variants)
+	}
+	return entries, c.size
+}
+
+// get returns the variant of key matching the request headers, which may
+// be stale
+func (c *lruCache) get(key string, header http.Header) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	item := el.Value.(*cacheItem)
+	for _, entry := range item.variants {
+		if entry.matches(header) {
+			c.lru.MoveToFront(el)
+			return entry
+		}
+	}
+	return nil
+}
+
+// add stores a variant, replacing one with the same Vary values, and evicts
+// the least recently used URLs until the tier fits its limit
+func (c *lruCache) add(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var item *cacheItem
+	if el, ok := c.items[key]; ok {
+		item = el.Value.(*cacheItem)
+		c.lru.MoveToFront(el)
+	} else {
+		item = &cacheItem{key: key}
+		c.items[key] = c.lru.PushFront(item)
+	}
+
+	var dropped []*cacheEntry
+	item.variants = slices.DeleteFunc(item.variants, func(old *cacheEntry) bool {
+		if !maps.Equal(old.vary, entry.vary) {
+			return false
+		}
+		// A revalidated entry keeps its predecessor's file
+		if old.file == "" || old.file != entry.file {
+			dropped = append(dropped, old)
+		}
+		return true
+	})
+	if len(item.variants) == maxCacheVariants {
+		dropped = append(dropped, item.variants[0])
+		item.variants = item.variants[1:]
+	}
+	item.variants = append(item.variants, entry)
+	c.resize(item)
+	c.release(dropped)
+
+	for c.size > *c.limit && c.lru.Len() > 0 {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*cacheItem)
+		c.lru.Remove(oldest)
+		delete(c.items, evicted.key)
+		c.size -= evicted.size
+		c.evictions.Add(uint64(len(evicted.variants)))
+		c.release(evicted.variants)
+	}
+}
+
+// remove drops one entry, such as one whose file has gone missing
+func (c *lruCache) remove(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	item := el.Value.(*cacheItem)
+	item.variants = slices.DeleteFunc(item.variants, func(e *cacheEntry) bool { return e == entry })
+	if len(item.variants) == 0 {
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
+	c.resize(item)
+	c.release([]*cacheEntry{entry})
+}
+
+// removeTarget drops every variant, on any route, of the target URL, or of
+// every URL starting with it when prefix is set, and returns how many
+func (c *lruCache) removeTarget(target string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.items {
+		item := el.Value.(*cacheItem)
+		var dropped []*cacheEntry
+		item.variants = slices.DeleteFunc(item.variants, func(e *cacheEntry) bool {
+			if e.target == target || (prefix && strings.HasPrefix(e.target, target)) {
+				dropped = append(dropped, e)
+				return true
+			}
+			return false
+		})
+		if len(dropped) == 0 {
+			continue
+		}
+		if len(item.variants) == 0 {
+			c.lru.Remove(el)
+			delete(c.items, key)
+		}
+		c.resize(item)
+		c.release(dropped)
+		removed += len(dropped)
+	}
+	return removed
+}
+
+// resize recounts an item's size after its variants changed
+func (c *lruCache) resize(item *cacheItem) {
+	c.size -= item.size
+	item.size = 0
+	for _, v := range item.variants {
+		item.size += v.size()
+	}
+	if _, ok := c.items[item.key]; ok {
+		c.size += item.size
+	}
+}
+
+// release hands dropped entries to the tier's evict function
+func (c *lruCache) release(entries []*cacheEntry) {
+	if c.evict == nil {
+		return
+	}
+	for _, entry := range entries {
+		c.evict(entry)
+	}
+}
+
+// flush empties the tier
+func (c *lruCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.items {
+		c.release(el.Value.(*cacheItem).variants)
+	}
+	clear(c.items)
+	c.lru.Init()
+	c.size = 0
+}
+
+// size approximates the memory or disk space an entry holds
+func (e *cacheEntry) size() int64 {
+	n := e.length + int64(len(e.target))
+	for key, values := range e.header {
+		n += int64(len(key))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// matches reports whether a request sends the headers the entry varies on
+func (e *cacheEntry) matches(header http.Header) bool {
+	for name, value := range e.vary {
+		if upstreamHeaderValue(header, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamHeaderValue is the value of a request header as it goes upstream.
+// With --upstream-accept-encoding, Accept-Encoding is the proxy's own and
+// responses are re-encoded for each client, so it never splits the cache.
+func upstreamHeaderValue(header http.Header, name string) string {
+	if name == "Accept-Encoding" && *upstreamAcceptEncoding != "" {
+		return *upstreamAcceptEncoding
+	}
+	return strings.Join(header.Values(name), ", ")
+}
+
+// cacheDirectives parses Cache-Control into lower-cased directives
+func cacheDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range splitList(strings.Join(header.Values("Cache-Control"), ",")) {
+		name, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
+
+// cacheRequest is a GET or HEAD request the cache may answer or store the
+// response of
+type cacheRequest struct {
+	key    string
+	target string
+	header http.Header // the upstream request headers before signing
+	keep   bool        // GET responses are kept; HEAD requests only look up
+	stale  *cacheEntry // the entry the upstream is asked to revalidate
+}
+
+// cacheEnabled reports whether any cache tier is configured
+func cacheEnabled() bool {
+	return *cacheSize > 0 || *cacheDir != "" || *cacheSharedTypes != ""
+}
+
+// cacheable reports whether a request can use the cache. Range requests are
+// answered from entries but their partial responses are not stored. Responses that
+// depend on more than the URL and headers, such as merged pages, deltas and
+// shadow comparisons, are left alone, and requests naming a checksum always
+// have the upstream's body verified.
+func cacheable(r *http.Request) bool {
+	rt := routeFor(r)
+	return cacheEnabled() && (r.Method == "GET" || r.Method == "HEAD") &&
+		r.Header.Get(paginateHeader) == "" && r.Header.Get(immutableHeader) == "" && r.Header.Get(checksumHeader) == "" && !isWebSocketRequest(r) &&
+		rt.JSONDelta == nil && rt.Compare == nil
+}
+
+// serveFromCache answers a GET or HEAD request with a fresh cached response,
+// reporting whether it did. Otherwise it returns the request to store the
+// upstream's response under, or nil when the response must not be stored.
+// Requests sending Cache-Control: no-cache have the entry revalidated even
+// when fresh; no-store also keeps their response out of the cache.
+func serveFromCache(w http.ResponseWriter, r *http.Request, proxyReq *http.Request) (*cacheRequest, bool) {
+	if !cacheable(r) {
+		return nil, false
+	}
+	directives := cacheDirectives(r.Header)
+	if _, ok := directives["no-store"]; ok {
+		return nil, false
+	}
+	c := &cacheRequest{
+		key:    routeFor(r).Name + "\n" + proxyReq.URL.String(),
+		target: proxyReq.URL.String(),
+		header: proxyReq.Header.Clone(),
+		keep:   r.Method == "GET" && r.Header.Get("Range") == "",
+	}
+	_, noCache := directives["no-cache"]
+	noCache = noCache || directives["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+
+	now := time.Now()
+	w.Header().Add("Access-Control-Expose-Headers", cacheHeader)
+	memory := responseCache.get(c.key, c.header)
+	if memory != nil && !noCache && now.Before(memory.expires) {
+		cacheResults.memoryHits.Add(1)
+		w.Header().Set(cacheHeader, "HIT")
+		serveCacheEntry(w, r, memory, nil, now)
+		return nil, true
+	}
+	disk := diskCache.get(c.key, c.header)
+	if disk != nil && !noCache && now.Before(disk.expires) {
+		body, err := disk.openBody()
+		if err == nil {
+			cacheResults.diskHits.Add(1)
+			w.Header().Set(cacheHeader, "HIT")
+			serveCacheEntry(w, r, disk, body, now)
+			return nil, true
+		}
+		log.Printf("Dropping cached response for %s: %v", disk.target, err)
+		diskCache.remove(c.key, disk)
+		disk = nil
+	}
+	shared := getShared(c.key, c.header)
+	if shared != nil && !noCache && now.Before(shared.expires) {
+		cacheResults.sharedHits.Add(1)
+		w.Header().Set(cacheHeader, "HIT")
+		serveCacheEntry(w, r, shared, nil, now)
+		return nil, true
+	}
+	if !noCache {
+		cacheResults.misses.Add(1)
+		w.Header().Set(cacheHeader, "MISS")
+	}
+
+	// A stale entry, or one the client wants checked, is revalidated with the
+	// upstream instead of fetched again. The client's own validators are
+	// checked against the entry once it is confirmed.
+	for _, entry := range []*cacheEntry{memory, disk, shared} {
+		if entry == nil {
+			continue
+		}
+		etag, modified := entry.header.Get("ETag"), entry.header.Get("Last-Modified")
+		if etag == "" && modified == "" {
+			continue
+		}
+		proxyReq.Header.Del("If-None-Match")
+		proxyReq.Header.Del("If-Modified-Since")
+		if etag != "" {
+			proxyReq.Header.Set("If-None-Match", etag)
+		}
+		if modified != "" {
+			proxyReq.Header.Set("If-Modified-Since", modified)
+		}
+		c.stale = entry
+		break
+	}
+	return c, false
+}
+
+// revalidated answers the request from the stale entry when the upstream
+// confirmed it with 304 Not Modified, reporting whether it did. The entry
+// takes the headers of the 304 and a new lifetime from them; disk entries
+// keep the old metadata in their file, so they are revalidated again after
+// a restart.
+func (c *cacheRequest) revalidated(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	if c == nil || c.stale == nil || resp.StatusCode != http.StatusNotModified {
+		return false
+	}
+	now := time.Now()
+	refreshed := *c.stale
+	refreshed.header = c.stale.header.Clone()
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		refreshed.header[name] = values
+	}
+	tier := responseCache
+	if refreshed.file != "" {
+		tier = diskCache
+	}
+	lifetime := c.freshness(&http.Response{StatusCode: refreshed.status, Header: refreshed.header})
+	refreshed.stored = now
+	if age, err := strconv.Atoi(refreshed.header.Get("Age")); err == nil {
+		refreshed.stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	refreshed.header.Del("Age")
+	refreshed.expires = now.Add(lifetime)
+	if lifetime > 0 && refreshed.shared {
+		putShared(c.key, &refreshed)
+	} else if lifetime > 0 {
+		tier.add(c.key, &refreshed)
+	}
+	cacheResults.revalidated.Add(1)
+
+	var body io.ReadSeekCloser
+	if refreshed.file != "" {
+		var err error
+		if body, err = refreshed.openBody(); err != nil {
+			log.Printf("Dropping cached response for %s: %v", refreshed.target, err)
+			tier.remove(c.key, &refreshed)
+			proxyError(w, r, http.StatusBadGateway, "Cached response unavailable", refreshed.target)
+			return true
+		}
+	}
+	w.Header().Set(cacheHeader, "REVALIDATED")
+	serveCacheEntry(w, r, &refreshed, body, now)
+	return true
+}
+
+// serveCacheEntry writes a cached response as if it had come from upstream.
+// body is the open file of a disk entry, nil for memory entries.
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body io.ReadSeekCloser, now time.Time) {
+	if body != nil {
+		defer body.Close()
+	} else {
+		body, _ = entry.openBody()
+	}
+	resp := &http.Response{StatusCode: entry.status, Header: entry.header.Clone(), Body: http.NoBody}
+	resp.Header.Set("Age", strconv.FormatInt(int64(now.Sub(entry.stored).Seconds()), 10))
+	if !checkHotlink(w, r, resp, entry.target) {
+		return
+	}
+	var written int64
+	served := false
+	switch {
+	case notModified(r, entry):
+		resp.StatusCode = http.StatusNotModified
+		resp.Header.Del("Content-Length")
+	case entry.status == http.StatusOK && (entry.file != "" || r.Header.Get("Range") != "") && !recodes(r, resp.Header):
+		// Disk entries and ranges of any entry are served from the seekable body
+		resp.StatusCode, written = serveCacheContent(w, r, resp, body)
+		served = true
+	case r.Method == "GET":
+		resp.ContentLength = entry.length
+		resp.Body = body
+	}
+	if !served {
+		recodeResponse(r, resp)
+		written = processProxyResponse(w, r, resp)
+	}
+	host := ""
+	if u, err := url.Parse(entry.target); err == nil {
+		host = u.Hostname()
+	}
+	recordStats(r, host, resp.StatusCode, written)
+	recordSLO(r, resp.StatusCode, written, time.Since(now))
+}
+
+// serveCacheContent answers from a 200 entry with http.ServeContent, which
+// serves Range, If-Range and HEAD requests from the body without reading it
+// into memory. The body is sent as stored, so its ranges are those of the
+// encoded body when it has a Content-Encoding. It returns the status and
+// body bytes sent.
+func serveCacheContent(w http.ResponseWriter, r *http.Request, resp *http.Response, body io.ReadSeeker) (int, int64) {
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if r.Header.Get("Range") != "" {
+		resp.Header.Del("Content-Length")
+	}
+	writeResponseHeaders(w, r, resp)
+	if _, ok := w.Header()["Content-Type"]; !ok {
+		w.Header()["Content-Type"] = nil // served as stored, not sniffed
+	}
+	aw := &accessLogWriter{ResponseWriter: w}
+	http.ServeContent(aw, r, "", modified, body)
+	return aw.status, aw.bytes
+}
+
+// notModified reports whether a conditional request is satisfied by the
+// cached entry, in which case the client gets 304
+func notModified(r *http.Request, entry *cacheEntry) bool {
+	if entry.status != http.StatusOK {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(entry.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitList(match) {
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(entry.header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// freshness is how long a response may be served from the cache: its
+// s-maxage, max-age or Expires, less its Age and capped by --cache-ttl. It
+// is zero for responses the cache must not keep.
+func (c *cacheRequest) freshness(resp *http.Response) time.Duration {
+	directives := cacheDirectives(resp.Header)
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0
+		}
+	}
+	if !cacheableStatuses[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" || isLongLivedStream(resp) {
+		return 0
+	}
+	// Responses to credentialed requests are only shared when marked public
+	_, public := directives["public"]
+	_, shared := directives["s-maxage"]
+	if (c.header.Get("Authorization") != "" || c.header.Get("Cookie") != "") && !public && !shared {
+		return 0
+	}
+
+	var lifetime time.Duration
+	if seconds, err := strconv.Atoi(cmp.Or(directives["s-maxage"], directives["max-age"])); err == nil {
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return max(0, min(lifetime, *cacheTTL))
+}
+
+// varyValues collects the request headers a response varies on. It reports
+// false for Vary: *, which no stored response can satisfy.
+func (c *cacheRequest) varyValues(resp *http.Response) (map[string]string, bool) {
+	vary := make(map[string]string)
+	names := splitList(strings.Join(resp.Header.Values("Vary"), ","))
+	// Encoded bodies are only reused for the encoding they were fetched with
+	if resp.Header.Get("Content-Encoding") != "" {
+		names = append(names, "Accept-Encoding")
+	}
+	for _, name := range names {
+		if name == "*" {
+			return nil, false
+		}
+		name = http.CanonicalHeaderKey(name)
+		vary[name] = upstreamHeaderValue(c.header, name)
+	}
+	return vary, true
+}
+
+// store has the response's body kept in the cache once it has been relayed
+// in full, when the response allows it. Types in --cache-shared-types go to
+// the shared tier in --store, up to --cache-shared-max-object. Other bodies
+// within --cache-max-object go to memory, unless onDisk sends them to
+// --cache-dir; bodies that outgrow memory spill to disk, up to
+// --cache-dir-max-object.
+func (c *cacheRequest) store(resp *http.Response) {
+	// Of coalesced requests, the one that was sent upstream stores the response
+	if c == nil || !c.keep || resp.Header.Get(coalescedHeader) != "" {
+		return
+	}
+	shared := onShared(resp)
+	if !shared && *cacheSize <= 0 && *cacheDir == "" {
+		return
+	}
+	disk := !shared && onDisk(resp)
+	limit := *cacheMaxObject
+	if *cacheDir != "" {
+		limit = *cacheDirMaxObject
+	}
+	if resp.ContentLength > limit {
+		return
+	}
+	lifetime := c.freshness(resp)
+	vary, ok := c.varyValues(resp)
+	if lifetime <= 0 || !ok {
+		return
+	}
+	stored := time.Now()
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+		stored = stored.Add(-time.Duration(age) * time.Second)
+	}
+	entry := &cacheEntry{
+		target:  c.target,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		vary:    vary,
+		stored:  stored,
+		expires: time.Now().Add(lifetime),
+	}
+	entry.header.Del("Age")
+	b := &cachingBody{source: resp.Body, key: c.key, entry: entry, length: resp.ContentLength, shared: shared}
+	if disk && !b.spill() {
+		return
+	}
+	resp.Body = b
+}
+
+// cachingBody copies a response body as it is relayed and stores the entry
+// once the body is complete
+type cachingBody struct {
+	source io.ReadCloser
+	key    string
+	entry  *cacheEntry
+	length int64 // Content-Length, or -1
+	buf    bytes.Buffer
+	disk   *diskWriter // set once the body goes to the disk tier
+	shared bool        // the body goes to the shared tier
+	done   bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.source.Read(p)
+	if b.done {
+		return n, err
+	}
+	limit := *cacheMaxObject
+	if b.shared {
+		limit = *cacheSharedMaxObject
+	}
+	if b.disk == nil && int64(b.buf.Len()+n) > limit && (b.shared || !b.spill()) {
+		b.done = true
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	if b.disk != nil {
+		if b.disk.length+int64(n) > *cacheDirMaxObject {
+			b.abandon()
+			return n, err
+		}
+		if _, werr := b.disk.Write(p[:n]); werr != nil {
+			log.Printf("Error writing cache file: %v", werr)
+			b.abandon()
+			return n, err
+		}
+	} else {
+		b.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.done = true
+		switch {
+		case b.disk != nil && (b.length < 0 || b.disk.length == b.length):
+			b.disk.commit(b.key, b.entry)
+			b.disk = nil
+		case b.disk == nil && (b.length < 0 || int64(b.buf.Len()) == b.length):
+			b.entry.body = b.buf.Bytes()
+			b.entry.length = int64(b.buf.Len())
+			if b.shared {
+				putShared(b.key, b.entry)
+			} else {
+				responseCache.add(b.key, b.entry)
+			}
+		}
+	}
+	return n, err
+}
+
+// spill moves the body to a file in the disk tier, reporting false when
+// there is none or the file cannot be created
+func (b *cachingBody) spill() bool {
+	if *cacheDir == "" {
+		return false
+	}
+	d, err := createCacheFile(b.key, b.entry)
+	if err == nil {
+		_, err = d.Write(b.buf.Bytes())
+	}
+	if err != nil {
+		log.Printf("Error creating cache file: %v", err)
+		if d != nil {
+			d.abort()
+		}
+		return false
+	}
+	b.disk, b.buf = d, bytes.Buffer{}
+	return true
+}
+
+// abandon stops caching the body
+func (b *cachingBody) abandon() {
+	b.done = true
+	if b.disk != nil {
+		b.disk.abort()
+		b.disk = nil
+	}
+}
+
+func (b *cachingBody) Close() error {
+	// Bodies not read to the end are not cached
+	if b.disk != nil {
+		b.disk.abort()
+		b.disk = nil
+	}
+	return b.source.Close()
+}
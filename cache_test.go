@@ -0,0 +1,67 @@
+package argonproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiskCacheRange(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("0123456789abcdefghij"))
+	}))
+	defer upstream.Close()
+	handler, err := NewTestHandler("--cache-dir=" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+		wantRange  string
+	}{
+		{"fill", nil, http.StatusOK, "0123456789abcdefghij", ""},
+		{"range", http.Header{"Range": {"bytes=5-9"}}, http.StatusPartialContent, "56789", "bytes 5-9/20"},
+		{"suffix range", http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, "hij", "bytes 17-19/20"},
+		{"if-range matches", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v1"`}}, http.StatusPartialContent, "01", "bytes 0-1/20"},
+		{"if-range differs", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v0"`}}, http.StatusOK, "0123456789abcdefghij", ""},
+		{"if-none-match", http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified, "", ""},
+		{"unsatisfiable", http.Header{"Range": {"bytes=50-"}}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/proxy/?target="+url.QueryEscape(upstream.URL+"/blob"), nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Body.String(); tt.wantStatus != http.StatusRequestedRangeNotSatisfiable && got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got == "" {
+				t.Error("no CORS headers on a cached response")
+			}
+		})
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream requests = %d, want 1", n)
+	}
+}
@@ -0,0 +1,285 @@
+package argonproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// CAPTCHA GATE
+// -----------------------------
+
+// captchaCookie and captchaHeader carry the session issued after a solved captcha
+const (
+	captchaCookie = "argon_captcha"
+	captchaHeader = "X-Argon-Captcha"
+)
+
+// captchaProvider describes a captcha service's widget and verification API
+type captchaProvider struct {
+	script    string
+	widget    string
+	verifyURL string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	"hcaptcha":  {"https://js.hcaptcha.com/1/api.js", "h-captcha", "https://api.hcaptcha.com/siteverify"},
+	"recaptcha": {"https://www.google.com/recaptcha/api.js", "g-recaptcha", "https://www.google.com/recaptcha/api/siteverify"},
+}
+
+// captchaResults counts verification attempts by outcome
+var captchaResults struct {
+	passed, failed, missing atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if *captchaProviderName == "" {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_captcha_total Captcha verifications and proxy requests refused for lack of a session.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_captcha_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_captcha_total{result=\"passed\"} %d\n", captchaResults.passed.Load())
+		fmt.Fprintf(w, "argon_proxy_captcha_total{result=\"failed\"} %d\n", captchaResults.failed.Load())
+		fmt.Fprintf(w, "argon_proxy_captcha_total{result=\"missing\"} %d\n", captchaResults.missing.Load())
+	})
+}
+
+// captchaEnabled reports whether proxy requests need a captcha session
+func captchaEnabled() bool {
+	return *captchaProviderName != ""
+}
+
+// validateCaptcha checks the captcha flags at startup
+func validateCaptcha() error {
+	if !captchaEnabled() {
+		return nil
+	}
+	if _, ok := captchaProviders[*captchaProviderName]; !ok {
+		return fmt.Errorf("--captcha must be hcaptcha or recaptcha")
+	}
+	if *captchaSecret == "" || *captchaSiteKey == "" {
+		return fmt.Errorf("--captcha needs --captcha-secret and --captcha-site-key")
+	}
+	return nil
+}
+
+// registerCaptchaHandlers adds the challenge page and verification endpoint
+func registerCaptchaHandlers(mux *http.ServeMux) {
+	if !captchaEnabled() {
+		return
+	}
+	mux.HandleFunc("/captcha", handleCaptchaPage)
+	mux.HandleFunc("/captcha/verify", handleCaptchaVerify)
+}
+
+// sessionKey derives the session signing key from the captcha secret, so
+// every instance sharing the secret accepts the same sessions
+func sessionKey() []byte {
+	sum := sha256.Sum256([]byte("argon-proxy captcha session\x00" + *captchaSecret))
+	return sum[:]
+}
+
+// signCaptchaSession returns a session token for the client valid until expires
+func signCaptchaSession(client string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, sessionKey())
+	mac.Write([]byte(exp + "|" + client))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCaptchaSession checks a session token against the requesting client
+func validCaptchaSession(token, client string) bool {
+	exp, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(signCaptchaSession(client, time.Unix(unix, 0))))
+}
+
+// requireCaptcha reports whether the request carries a valid captcha
+// session, answering 403 when it does not
+func requireCaptcha(w http.ResponseWriter, r *http.Request) bool {
+	if !captchaEnabled() {
+		return true
+	}
+	token := r.Header.Get(captchaHeader)
+	if token == "" {
+		if c, err := r.Cookie(captchaCookie); err == nil {
+			token = c.Value
+		}
+	}
+	if validCaptchaSession(token, getClientIP(r)) {
+		return true
+	}
+
+	captchaResults.missing.Add(1)
+	addCORSHeaders(w, r)
+	w.Header().Set(captchaHeader, "required; url=/captcha")
+	w.Header().Add("Access-Control-Expose-Headers", captchaHeader)
+	proxyError(w, r, http.StatusForbidden, "Captcha verification required; solve it at /captcha", "")
+	return false
+}
+
+// stripCaptchaSession removes the session cookie before the request goes upstream
+func stripCaptchaSession(proxyReq *http.Request) {
+	cookies := proxyReq.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	proxyReq.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != captchaCookie {
+			proxyReq.AddCookie(c)
+		}
+	}
+}
+
+var captchaPage = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Verification required</title>
+<script src="{{.Script}}" async defer></script>
+</head>
+<body>
+<p>Please confirm you are human to use this proxy.</p>
+<div class="{{.Widget}}" data-sitekey="{{.SiteKey}}" data-callback="argonVerified"></div>
+<p id="result"></p>
+<script>
+function argonVerified(token) {
+  fetch("/captcha/verify", {method: "POST", credentials: "include",
+    headers: {"Content-Type": "application/x-www-form-urlencoded"},
+    body: "token=" + encodeURIComponent(token)})
+  .then(function (r) { return r.json(); })
+  .then(function (s) {
+    if (!s.session) { document.getElementById("result").textContent = s.error || "Verification failed"; return; }
+    var back = {{.Return}};
+    if (back) { location.href = back; return; }
+    document.getElementById("result").textContent = "Verified until " + s.expires + ". Session: " + s.session;
+  });
+}
+</script>
+</body>
+</html>
+`))
+
+// handleCaptchaPage serves the challenge page; ?return=/path sends the
+// browser back after a successful verification
+func handleCaptchaPage(w http.ResponseWriter, r *http.Request) {
+	provider := captchaProviders[*captchaProviderName]
+	back := r.URL.Query().Get("return")
+	// Only local paths, so the page cannot be used as an open redirect
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.Contains(back, "\\") {
+		back = ""
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	captchaPage.Execute(w, map[string]string{
+		"Script":  provider.script,
+		"Widget":  provider.widget,
+		"SiteKey": *captchaSiteKey,
+		"Return":  back,
+	})
+}
+
+// handleCaptchaVerify checks a captcha response with the provider and issues
+// a session as a cookie and in the JSON reply
+func handleCaptchaVerify(w http.ResponseWriter, r *http.Request) {
+	addCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		handlePreflight(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	token := r.FormValue("token")
+	if token == "" {
+		token = r.FormValue(captchaProviders[*captchaProviderName].widget + "-response")
+	}
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing captcha token"})
+		return
+	}
+
+	client := getClientIP(r)
+	ok, err := verifyCaptcha(token, client)
+	if err != nil {
+		log.Printf("Captcha verification error: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "captcha provider unavailable"})
+		return
+	}
+	if !ok {
+		captchaResults.failed.Add(1)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "captcha verification failed"})
+		return
+	}
+	captchaResults.passed.Add(1)
+
+	expires := time.Now().Add(*captchaSession)
+	session := signCaptchaSession(client, expires)
+	secure := tlsEnabled() || (*trustProxy && r.Header.Get("X-Forwarded-Proto") == "https")
+	cookie := &http.Cookie{
+		Name:     captchaCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Cross-site pages can only send the cookie with SameSite=None, which needs Secure
+	if secure {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+	writeJSON(w, http.StatusOK, map[string]any{"session": session, "expires": expires.UTC().Format(time.RFC3339)})
+}
+
+// verifyCaptcha asks the provider whether a captcha response is valid
+func verifyCaptcha(token, client string) (bool, error) {
+	form := url.Values{"secret": {*captchaSecret}, "response": {token}, "remoteip": {client}}
+	if *captchaProviderName == "hcaptcha" {
+		form.Set("sitekey", *captchaSiteKey)
+	}
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.PostForm(captchaProviders[*captchaProviderName].verifyURL, form)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify returned %s", resp.Status)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	if !result.Success && *verbose {
+		log.Printf("Captcha rejected for %s: %s", client, strings.Join(result.ErrorCodes, ","))
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,141 @@
+package argonproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// -----------------------------
+// EXCHANGE CAPTURE
+// -----------------------------
+
+// exchange is a proxied request/response pair as seen on the upstream side
+type exchange struct {
+	ID                string
+	Started           time.Time
+	Duration          time.Duration
+	ClientIP          string
+	Route             string
+	Method            string
+	URL               string
+	RequestHeader     http.Header
+	RequestBody       []byte
+	RequestTruncated  bool
+	Status            int
+	ResponseHeader    http.Header
+	ResponseBody      []byte
+	ResponseTruncated bool
+	Error             string
+}
+
+// exchangeRecorder is a consumer of captured exchanges
+type exchangeRecorder struct {
+	active func() bool
+	record func(*exchange)
+}
+
+// exchangeRecorders receive completed captures while they are active
+var exchangeRecorders []exchangeRecorder
+
+// registerRecorder adds a consumer of captured exchanges
+func registerRecorder(active func() bool, record func(*exchange)) {
+	exchangeRecorders = append(exchangeRecorders, exchangeRecorder{active, record})
+}
+
+// captureBuffer keeps up to limit bytes of what is written to it
+type captureBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write implements io.Writer, silently dropping bytes beyond the limit
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := c.limit - c.buf.Len(); room < n {
+		c.truncated = true
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+	}
+	c.buf.Write(p)
+	return n, nil
+}
+
+// teeBody copies everything read from body into the capture buffer
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// capture records one exchange while it is proxied
+type capture struct {
+	ex        *exchange
+	request   *captureBuffer
+	response  *captureBuffer
+	recorders []func(*exchange)
+}
+
+// startCapture begins recording the upstream request, or returns nil when no
+// recorder is active. The request body is captured as it is sent.
+func startCapture(r *http.Request, proxyReq *http.Request) *capture {
+	var recorders []func(*exchange)
+	for _, recorder := range exchangeRecorders {
+		if recorder.active() {
+			recorders = append(recorders, recorder.record)
+		}
+	}
+	if len(recorders) == 0 {
+		return nil
+	}
+
+	c := &capture{
+		recorders: recorders,
+		ex: &exchange{
+			ID:            requestID(r),
+			Started:       time.Now(),
+			ClientIP:      getClientIP(r),
+			Route:         routeFor(r).Name,
+			Method:        proxyReq.Method,
+			URL:           proxyReq.URL.String(),
+			RequestHeader: proxyReq.Header.Clone(),
+		},
+		request:  &captureBuffer{limit: *captureBodyLimit},
+		response: &captureBuffer{limit: *captureBodyLimit},
+	}
+	if proxyReq.Body != nil {
+		proxyReq.Body = teeBody{io.TeeReader(proxyReq.Body, c.request), proxyReq.Body}
+	}
+	return c
+}
+
+// captureResponse starts recording the upstream response
+func (c *capture) captureResponse(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	c.ex.Status = resp.StatusCode
+	c.ex.ResponseHeader = resp.Header.Clone()
+	resp.Body = teeBody{io.TeeReader(resp.Body, c.response), resp.Body}
+}
+
+// finish completes the capture and hands it to the recorders
+func (c *capture) finish(err error) {
+	if c == nil {
+		return
+	}
+	c.ex.Duration = time.Since(c.ex.Started)
+	c.ex.RequestBody = c.request.buf.Bytes()
+	c.ex.RequestTruncated = c.request.truncated
+	c.ex.ResponseBody = c.response.buf.Bytes()
+	c.ex.ResponseTruncated = c.response.truncated
+	if err != nil {
+		c.ex.Error = err.Error()
+	}
+	for _, record := range c.recorders {
+		record(c.ex)
+	}
+}
@@ -0,0 +1,140 @@
+package argonproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// UPSTREAM CERTIFICATE MONITORING
+// -----------------------------
+
+// maxCertHosts bounds the number of upstream hosts whose certificates are kept
+const maxCertHosts = 1000
+
+// certInfo describes one certificate of an upstream chain
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// upstreamCert is the latest chain seen for an upstream host
+type upstreamCert struct {
+	Host       string     `json:"host"`
+	Chain      []certInfo `json:"chain"`
+	Expires    time.Time  `json:"expires"`
+	DaysLeft   int        `json:"days_left"`
+	Requests   uint64     `json:"requests"`
+	LastSeen   time.Time  `json:"last_seen"`
+	lastWarned time.Time
+}
+
+// certMonitor tracks the certificates presented by upstream hosts
+type certMonitor struct {
+	mu    sync.Mutex
+	hosts map[string]*upstreamCert
+}
+
+var certs = &certMonitor{hosts: make(map[string]*upstreamCert)}
+
+func init() {
+	registerMetrics(certs.writeMetrics)
+}
+
+// recordUpstreamCert stores the chain of a TLS connection to an upstream host
+// and warns when a frequently used certificate is close to expiring
+func recordUpstreamCert(host string, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	host = strings.ToLower(host)
+	leaf := state.PeerCertificates[0]
+
+	certs.mu.Lock()
+	defer certs.mu.Unlock()
+
+	entry := certs.hosts[host]
+	if entry == nil {
+		if len(certs.hosts) >= maxCertHosts {
+			return
+		}
+		entry = &upstreamCert{Host: host}
+		certs.hosts[host] = entry
+	}
+	entry.Requests++
+	entry.LastSeen = time.Now()
+
+	if len(entry.Chain) == 0 || entry.Chain[0].Serial != leaf.SerialNumber.String() {
+		entry.Chain = entry.Chain[:0]
+		entry.Expires = leaf.NotAfter
+		for _, cert := range state.PeerCertificates {
+			entry.Chain = append(entry.Chain, certInfo{
+				Subject:   cert.Subject.String(),
+				Issuer:    cert.Issuer.String(),
+				DNSNames:  cert.DNSNames,
+				Serial:    cert.SerialNumber.String(),
+				NotBefore: cert.NotBefore,
+				NotAfter:  cert.NotAfter,
+			})
+			// The chain is only as valid as its earliest expiring certificate
+			if cert.NotAfter.Before(entry.Expires) {
+				entry.Expires = cert.NotAfter
+			}
+		}
+	}
+
+	remaining := time.Until(entry.Expires)
+	if remaining < *certWarnBefore && entry.Requests >= uint64(*certWarnRequests) && time.Since(entry.lastWarned) >= 24*time.Hour {
+		entry.lastWarned = time.Now()
+		log.Printf("Warning: certificate for upstream %s expires %s (in %s, %d requests seen)",
+			host, entry.Expires.UTC().Format(time.RFC3339), remaining.Round(time.Hour), entry.Requests)
+	}
+}
+
+// list returns the tracked hosts sorted by expiry, soonest first
+func (m *certMonitor) list() []upstreamCert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]upstreamCert, 0, len(m.hosts))
+	for _, entry := range m.hosts {
+		item := *entry
+		item.Chain = append([]certInfo(nil), entry.Chain...)
+		item.DaysLeft = int(time.Until(entry.Expires).Hours() / 24)
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// writeMetrics exports the expiry time of each tracked upstream certificate
+func (m *certMonitor) writeMetrics(w io.Writer) {
+	list := m.list()
+	if len(list) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP argon_proxy_upstream_cert_expiry_timestamp_seconds Expiry of the upstream certificate chain as a Unix timestamp.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_upstream_cert_expiry_timestamp_seconds gauge\n")
+	for _, entry := range list {
+		fmt.Fprintf(w, "argon_proxy_upstream_cert_expiry_timestamp_seconds{host=%s} %d\n", quoteLabel(entry.Host), entry.Expires.Unix())
+	}
+}
+
+// handleAdminCerts serves GET /admin/certs
+func handleAdminCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, certs.list())
+}
@@ -0,0 +1,163 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// CHECKSUM VERIFICATION
+// -----------------------------
+
+// checksumHeader carries the SHA-256 a client expects of a response body
+const checksumHeader = "X-Argon-Sha256"
+
+// errChecksumMismatch ends a body whose SHA-256 is not the expected one
+var errChecksumMismatch = errors.New("response body does not match the expected SHA-256")
+
+// checksumResults counts verified response bodies by outcome
+var checksumResults struct {
+	ok       atomic.Uint64
+	mismatch atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if checksumResults.ok.Load() == 0 && checksumResults.mismatch.Load() == 0 {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_checksum_verifications_total Response bodies checked against an expected SHA-256, by result.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_checksum_verifications_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_checksum_verifications_total{result=\"ok\"} %d\n", checksumResults.ok.Load())
+		fmt.Fprintf(w, "argon_proxy_checksum_verifications_total{result=\"mismatch\"} %d\n", checksumResults.mismatch.Load())
+	})
+}
+
+// parseSHA256 reads a SHA-256 given in hex or as a subresource integrity
+// value, sha256-<base64>
+func parseSHA256(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	var sum []byte
+	var err error
+	if encoded, ok := strings.CutPrefix(value, "sha256-"); ok {
+		sum, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		sum, err = hex.DecodeString(value)
+	}
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a SHA-256 in hex or sha256-<base64> form", value)
+	}
+	return sum, nil
+}
+
+// prepareChecksums parses the route's expected SHA-256 per target URL
+func (rt *Route) prepareChecksums() error {
+	rt.checksums = make(map[string][]byte, len(rt.Checksums))
+	for target, value := range rt.Checksums {
+		sum, err := parseSHA256(value)
+		if err != nil {
+			return fmt.Errorf("route %q: checksum for %s: %v", rt.Name, target, err)
+		}
+		rt.checksums[target] = sum
+	}
+	return nil
+}
+
+// checksumCheck is the SHA-256 a GET response body must have
+type checksumCheck struct {
+	want   []byte
+	target string
+}
+
+// startChecksum returns the SHA-256 the request's response must have, from
+// the X-Argon-Sha256 header or the route's checksums, or nil if there is
+// none. A malformed header is answered 400.
+func startChecksum(w http.ResponseWriter, r *http.Request, finalURL string) (*checksumCheck, bool) {
+	value := r.Header.Get(checksumHeader)
+	if value == "" {
+		want, ok := routeFor(r).checksums[finalURL]
+		if !ok || r.Method != "GET" {
+			return nil, true
+		}
+		return &checksumCheck{want: want, target: finalURL}, true
+	}
+	if r.Method != "GET" {
+		proxyError(w, r, http.StatusBadRequest, checksumHeader+" is only supported on GET requests", finalURL)
+		return nil, false
+	}
+	want, err := parseSHA256(value)
+	if err != nil {
+		proxyError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s: %v", checksumHeader, err), finalURL)
+		return nil, false
+	}
+	return &checksumCheck{want: want, target: finalURL}, true
+}
+
+// prepare asks the upstream for the whole body as stored, so the checksum
+// covers the same bytes as the one published for the file
+func (c *checksumCheck) prepare(proxyReq *http.Request) {
+	if c == nil {
+		return
+	}
+	proxyReq.Header.Set("Accept-Encoding", "identity")
+	proxyReq.Header.Del("Range")
+	proxyReq.Header.Del("If-Range")
+}
+
+// verify hashes a 200 response body as it is relayed. Its last byte is
+// held back until the body is checked; on a mismatch it is never sent and
+// the body ends in errChecksumMismatch, which aborts the response so the
+// client cannot mistake it for a complete one.
+func (c *checksumCheck) verify(resp *http.Response) {
+	if c == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	resp.Body = &verifyingBody{source: resp.Body, check: c, hash: sha256.New()}
+}
+
+// verifyingBody hashes a body, checking it on EOF
+type verifyingBody struct {
+	source io.ReadCloser
+	check  *checksumCheck
+	hash   hash.Hash
+	held   []byte // the last byte read, not yet passed on
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	held := copy(p, b.held)
+	n, err := b.source.Read(p[held:])
+	b.hash.Write(p[held : held+n])
+	n += held
+	if err == io.EOF {
+		if sum := b.hash.Sum(nil); !bytes.Equal(sum, b.check.want) {
+			checksumResults.mismatch.Add(1)
+			log.Printf("SHA-256 mismatch for %s: got %x, want %x", b.check.target, sum, b.check.want)
+			return 0, errChecksumMismatch
+		}
+		checksumResults.ok.Add(1)
+		return n, err
+	}
+	b.held = b.held[:0]
+	if n > 0 {
+		b.held = append(b.held, p[n-1])
+		n--
+	}
+	return n, err
+}
+
+func (b *verifyingBody) Close() error {
+	return b.source.Close()
+}
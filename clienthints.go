@@ -0,0 +1,62 @@
+package argonproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// -----------------------------
+// CLIENT HINTS
+// -----------------------------
+
+// legacyClientHints are the client hint headers without the Sec-CH- prefix
+var legacyClientHints = map[string]bool{
+	"Save-Data": true, "Dpr": true, "Width": true, "Viewport-Width": true,
+	"Device-Memory": true, "Rtt": true, "Downlink": true, "Ect": true,
+}
+
+// isClientHint reports whether a request header is a client hint
+func isClientHint(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	return strings.HasPrefix(name, "Sec-Ch-") || legacyClientHints[name]
+}
+
+// prepareClientHints checks the route's hint names, so a typo does not
+// silently drop a hint the upstream relies on
+func (rt *Route) prepareClientHints() error {
+	for i, name := range rt.ClientHints {
+		name = strings.TrimSpace(name)
+		if !isClientHint(name) {
+			return fmt.Errorf("route %q: %q is not a client hint header", rt.Name, name)
+		}
+		rt.ClientHints[i] = name
+	}
+	return nil
+}
+
+// applyClientHints removes the client hints the route does not forward.
+// Routes without client_hints pass every hint through as sent.
+func applyClientHints(r *http.Request, proxyReq *http.Request) {
+	hints := routeFor(r).ClientHints
+	if len(hints) == 0 {
+		return
+	}
+	for name := range proxyReq.Header {
+		if isClientHint(name) && !slices.ContainsFunc(hints, func(hint string) bool { return strings.EqualFold(hint, name) }) {
+			proxyReq.Header.Del(name)
+		}
+	}
+}
+
+// addAcceptCH asks browsers for the route's forwarded client hints on later
+// requests to the proxy
+func addAcceptCH(w http.ResponseWriter, r *http.Request) {
+	rt := routeFor(r)
+	if !rt.AcceptCH || len(rt.ClientHints) == 0 {
+		return
+	}
+	w.Header().Set("Accept-CH", strings.Join(rt.ClientHints, ", "))
+}
@@ -0,0 +1,332 @@
+package argonproxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// CLOUD IDENTITY TOKENS
+// -----------------------------
+
+// identityToken configures a GCP ID token or Azure AD access token that is
+// attached to a route's upstream requests
+type identityToken struct {
+	Provider string `json:"provider"` // gcp or azure
+	Audience string `json:"audience"` // GCP audience or Azure resource / application ID URI
+	Header   string `json:"header,omitempty"`
+	ClientID string `json:"client_id,omitempty"` // Azure user-assigned managed identity
+}
+
+// cachedToken is a fetched token and when it stops being valid
+type cachedToken struct {
+	value   string
+	expires time.Time
+}
+
+// identityTokens caches tokens by provider and audience
+var identityTokens struct {
+	sync.Mutex
+	byKey map[string]cachedToken
+}
+
+// metadataClient talks to cloud metadata and token endpoints
+var metadataClient = &http.Client{Timeout: 5 * time.Second}
+
+// prepare validates the settings and fetches a first token, so a missing
+// identity is reported at startup
+func (t *identityToken) prepare(routeName string) error {
+	if t.Provider != "gcp" && t.Provider != "azure" {
+		return fmt.Errorf("route %q: identity_token provider must be gcp or azure", routeName)
+	}
+	if t.Audience == "" {
+		return fmt.Errorf("route %q: identity_token needs an audience", routeName)
+	}
+	if t.Header == "" {
+		t.Header = "Authorization"
+	}
+	if _, err := t.token(); err != nil {
+		return fmt.Errorf("route %q: identity_token: %v", routeName, err)
+	}
+	return nil
+}
+
+// token returns a cached token, fetching a new one shortly before expiry
+func (t *identityToken) token() (string, error) {
+	return cachedCloudToken(t.Provider+"|"+t.ClientID+"|"+t.Audience, func() (cachedToken, error) {
+		if t.Provider == "gcp" {
+			return gcpIDToken(t.Audience)
+		}
+		return azureAccessToken(t.Audience, t.ClientID)
+	})
+}
+
+// cachedCloudToken returns the token cached under key, calling fetch when
+// there is none or it expires within five minutes
+func cachedCloudToken(key string, fetch func() (cachedToken, error)) (string, error) {
+	identityTokens.Lock()
+	defer identityTokens.Unlock()
+	if c, ok := identityTokens.byKey[key]; ok && time.Until(c.expires) > 5*time.Minute {
+		return c.value, nil
+	}
+
+	c, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	if identityTokens.byKey == nil {
+		identityTokens.byKey = make(map[string]cachedToken)
+	}
+	identityTokens.byKey[key] = c
+	return c.value, nil
+}
+
+// applyIdentityToken sets the route's identity token on an upstream request
+func applyIdentityToken(r *http.Request, proxyReq *http.Request) error {
+	t := routeFor(r).IdentityToken
+	if t == nil {
+		return nil
+	}
+	token, err := t.token()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUpstreamCredentials, err)
+	}
+	proxyReq.Header.Set(t.Header, "Bearer "+token)
+	return nil
+}
+
+// gcpIDToken gets an ID token from a service account key file when
+// $GOOGLE_APPLICATION_CREDENTIALS is set, else from the metadata server
+// (Compute Engine, Cloud Run, GKE workload identity)
+func gcpIDToken(audience string) (cachedToken, error) {
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		return gcpServiceAccountIDToken(file, audience)
+	}
+
+	endpoint := "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?format=full&audience=" +
+		url.QueryEscape(audience)
+	req, _ := http.NewRequest("GET", endpoint, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := fetchToken(req)
+	if err != nil {
+		return cachedToken{}, err
+	}
+	token := strings.TrimSpace(string(body))
+	return cachedToken{value: token, expires: jwtExpiry(token)}, nil
+}
+
+// gcpServiceAccountIDToken exchanges a self-signed JWT for an ID token
+func gcpServiceAccountIDToken(file, audience string) (cachedToken, error) {
+	body, err := gcpServiceAccountGrant(file, map[string]any{"target_audience": audience})
+	if err != nil {
+		return cachedToken{}, err
+	}
+	var reply struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.IDToken == "" {
+		return cachedToken{}, errors.New("no id_token in token response")
+	}
+	return cachedToken{value: reply.IDToken, expires: jwtExpiry(reply.IDToken)}, nil
+}
+
+// gcpAccessToken gets an OAuth access token for a scope from the service
+// account key in $GOOGLE_APPLICATION_CREDENTIALS or the metadata server
+func gcpAccessToken(scope string) (cachedToken, error) {
+	var body []byte
+	var err error
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		body, err = gcpServiceAccountGrant(file, map[string]any{"scope": scope})
+	} else {
+		req, _ := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token?scopes="+
+			url.QueryEscape(scope), nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		body, err = fetchToken(req)
+	}
+	if err != nil {
+		return cachedToken{}, err
+	}
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.AccessToken == "" {
+		return cachedToken{}, errors.New("no access_token in token response")
+	}
+	return cachedToken{value: reply.AccessToken, expires: time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second)}, nil
+}
+
+// gcpServiceAccountGrant signs a JWT with a service account key, adding the
+// given claims, and returns the token endpoint's reply
+func gcpServiceAccountGrant(file string, claims map[string]any) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("%s: only service account keys are supported", file)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: invalid private key", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is not RSA", file)
+	}
+
+	now := time.Now()
+	claims["iss"] = account.ClientEmail
+	claims["sub"] = account.ClientEmail
+	claims["aud"] = account.TokenURI
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	req, _ := http.NewRequest("POST", account.TokenURI, strings.NewReader(url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return fetchToken(req)
+}
+
+// azureAccessToken gets an access token for a resource using workload
+// identity (AKS), the App Service identity endpoint or the VM's managed identity
+func azureAccessToken(resource, clientID string) (cachedToken, error) {
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+
+	var req *http.Request
+	if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); tokenFile != "" {
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return cachedToken{}, err
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com/"
+		}
+		endpoint := strings.TrimRight(authority, "/") + "/" + os.Getenv("AZURE_TENANT_ID") + "/oauth2/v2.0/token"
+		req, _ = http.NewRequest("POST", endpoint, strings.NewReader(url.Values{
+			"grant_type":            {"client_credentials"},
+			"client_id":             {clientID},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+			"scope":                 {strings.TrimRight(resource, "/") + "/.default"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		query := url.Values{"api-version": {"2019-08-01"}, "resource": {resource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, _ = http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, _ = http.NewRequest("GET", "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		req.Header.Set("Metadata", "true")
+	}
+
+	body, err := fetchToken(req)
+	if err != nil {
+		return cachedToken{}, err
+	}
+	// expires_in is a number from Entra ID but a string from managed identity endpoints
+	var reply struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.AccessToken == "" {
+		return cachedToken{}, errors.New("no access_token in token response")
+	}
+	expires := jwtExpiry(reply.AccessToken)
+	var seconds int64
+	if json.Unmarshal([]byte(strings.Trim(string(reply.ExpiresIn), `"`)), &seconds) == nil && seconds > 0 {
+		expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return cachedToken{value: reply.AccessToken, expires: expires}, nil
+}
+
+// fetchToken sends a token request and returns the response body
+func fetchToken(req *http.Request) ([]byte, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return body, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it; tokens that
+// cannot be parsed are treated as valid for ten minutes
+func jwtExpiry(token string) time.Time {
+	fallback := time.Now().Add(10 * time.Minute)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return fallback
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,8 @@
+// Command argon-proxy runs the Argon-Proxy CORS proxy server.
+package main
+
+import argonproxy "github.com/a2hop/argon-proxy"
+
+func main() {
+	argonproxy.Main()
+}
@@ -0,0 +1,312 @@
+package argonproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// -----------------------------
+// REQUEST COALESCING
+// -----------------------------
+
+// coalescedHeader marks a response shared from an identical request that
+// was already in flight
+const coalescedHeader = "X-Argon-Coalesced"
+
+// flights holds the shared upstream requests in progress by key
+var flights struct {
+	mu       sync.Mutex
+	inFlight map[string]*flight
+}
+
+// coalesceResults counts coalesced requests by whether they were sent upstream
+var coalesceResults struct {
+	sent   atomic.Uint64
+	shared atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if !*coalesce {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_coalesced_requests_total GET requests eligible for coalescing, by whether they were sent upstream or shared another's response.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_coalesced_requests_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_coalesced_requests_total{result=\"sent\"} %d\n", coalesceResults.sent.Load())
+		fmt.Fprintf(w, "argon_proxy_coalesced_requests_total{result=\"shared\"} %d\n", coalesceResults.shared.Load())
+	})
+}
+
+// coalesceRequests lets a GET request join an identical one already in
+// flight instead of sending its own, when --coalesce is set
+func coalesceRequests(r *http.Request, client *http.Client) {
+	if !*coalesce || r.Method != "GET" || r.ContentLength != 0 || isWebSocketRequest(r) {
+		return
+	}
+	client.Transport = &coalescingTransport{next: client.Transport, route: routeFor(r).Name}
+}
+
+// coalescingTransport sends identical upstream requests once. Requests are
+// identical when they go to the same URL on the same route with the same
+// headers, apart from --coalesce-ignore-headers.
+type coalescingTransport struct {
+	next  http.RoundTripper
+	route string
+}
+
+// coalesceKey identifies requests that may share a response
+func (t *coalescingTransport) coalesceKey(req *http.Request) string {
+	ignored := make(map[string]bool)
+	for _, name := range splitList(*coalesceIgnoreHeaders) {
+		ignored[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if !ignored[textproto.CanonicalMIMEHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", t.route, req.Host, req.URL)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%q\x00", textproto.CanonicalMIMEHeaderKey(name), req.Header[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RoundTrip joins the flight for the request's key, starting it if there
+// is none, and waits for the upstream's response
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Upgrade") != "" {
+		return t.next.RoundTrip(req)
+	}
+	key := t.coalesceKey(req)
+
+	flights.mu.Lock()
+	if flights.inFlight == nil {
+		flights.inFlight = make(map[string]*flight)
+	}
+	f := flights.inFlight[key]
+	var reader *flightReader
+	if f != nil {
+		reader = f.join(req.Context())
+	}
+	leader := reader == nil
+	if leader {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		f = &flight{key: key, ready: make(chan struct{}), cancel: cancel}
+		f.cond = sync.NewCond(&f.mu)
+		flights.inFlight[key] = f
+		reader = f.join(req.Context())
+		go f.run(t.next, req.WithContext(ctx))
+	}
+	flights.mu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-req.Context().Done():
+		reader.Close()
+		return nil, req.Context().Err()
+	}
+	if f.err != nil {
+		reader.Close()
+		return nil, f.err
+	}
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = reader
+	resp.Request = req
+	if leader {
+		coalesceResults.sent.Add(1)
+	} else {
+		coalesceResults.shared.Add(1)
+		resp.Header.Set(coalescedHeader, "true")
+	}
+	return &resp, nil
+}
+
+// flight is one upstream request shared by every request that joined it.
+// Its body is read into a buffer once and each joined request reads it from
+// there at its own pace; the fastest may get at most --coalesce-buffer bytes
+// ahead of the slowest. Requests join until the body is complete or the
+// buffer had to drop its start. The upstream request is cancelled once all
+// of them are gone.
+type flight struct {
+	key    string
+	ready  chan struct{} // closed once resp or err is set
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	readers map[*flightReader]struct{}
+	buf     []byte
+	base    int64 // body offset of buf[0]
+	done    bool
+	readErr error
+}
+
+// join adds a reader at the start of the body, or returns nil if the flight
+// can no longer be joined. flights.mu is held.
+func (f *flight) join(ctx context.Context) *flightReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done || f.base > 0 || (f.readers != nil && len(f.readers) == 0) {
+		return nil
+	}
+	reader := &flightReader{f: f, ctx: ctx}
+	if f.readers == nil {
+		f.readers = make(map[*flightReader]struct{})
+	}
+	f.readers[reader] = struct{}{}
+	// Wake the reader when its client goes away while it waits for data
+	reader.stop = context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	})
+	return reader
+}
+
+// leave stops the flight from being joined
+func (f *flight) leave() {
+	flights.mu.Lock()
+	if flights.inFlight[f.key] == f {
+		delete(flights.inFlight, f.key)
+	}
+	flights.mu.Unlock()
+}
+
+// run sends the upstream request and reads its body into the buffer
+func (f *flight) run(next http.RoundTripper, req *http.Request) {
+	defer f.cancel()
+	f.resp, f.err = next.RoundTrip(req)
+	if f.err != nil {
+		f.leave()
+		close(f.ready)
+		return
+	}
+	body := f.resp.Body
+	defer body.Close()
+	close(f.ready)
+
+	chunk := make([]byte, 32*1024)
+	joinable := true
+	for {
+		f.mu.Lock()
+		for len(f.readers) > 0 {
+			slowest := f.slowest()
+			if int64(len(f.buf)) >= *coalesceBuffer && slowest > f.base {
+				// Only the part every reader is past is dropped, which ends joining
+				f.buf = append([]byte(nil), f.buf[slowest-f.base:]...)
+				f.base = slowest
+				continue
+			}
+			if f.base+int64(len(f.buf))-slowest < *coalesceBuffer {
+				break
+			}
+			f.cond.Wait()
+		}
+		if len(f.readers) == 0 {
+			f.mu.Unlock()
+			return
+		}
+		trimmed := f.base > 0
+		f.mu.Unlock()
+		if trimmed && joinable {
+			joinable = false
+			f.leave()
+		}
+
+		n, err := body.Read(chunk)
+		f.mu.Lock()
+		f.buf = append(f.buf, chunk[:n]...)
+		if err != nil {
+			f.done = true
+			if err != io.EOF {
+				f.readErr = err
+			}
+		}
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		if err != nil {
+			f.leave()
+			return
+		}
+	}
+}
+
+// slowest returns the body offset of the reader furthest behind. f.mu is held.
+func (f *flight) slowest() int64 {
+	slowest := f.base + int64(len(f.buf))
+	for reader := range f.readers {
+		slowest = min(slowest, reader.offset)
+	}
+	return slowest
+}
+
+// flightReader is one request's view of a flight's body
+type flightReader struct {
+	f      *flight
+	ctx    context.Context
+	stop   func() bool
+	offset int64
+	closed bool
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r.offset == f.base+int64(len(f.buf)) && !f.done && !r.closed && r.ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if available := f.base + int64(len(f.buf)) - r.offset; available > 0 {
+		n := copy(p, f.buf[r.offset-f.base:])
+		r.offset += int64(n)
+		f.cond.Broadcast()
+		return n, nil
+	}
+	if r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	if f.readErr != nil {
+		return 0, f.readErr
+	}
+	return 0, io.EOF
+}
+
+// Close leaves the flight, cancelling the upstream request if it was the
+// last reader
+func (r *flightReader) Close() error {
+	f := r.f
+	f.mu.Lock()
+	if r.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.stop()
+	delete(f.readers, r)
+	last := len(f.readers) == 0 && !f.done
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	if last {
+		f.leave()
+		f.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubUpstream answers every request with a body from body. RoundTrip
+// waits for release when it is set, and passes each request's context to
+// started when that is set.
+type stubUpstream struct {
+	calls   atomic.Int64
+	release chan struct{}
+	started chan context.Context
+	body    func(ctx context.Context) io.Reader
+}
+
+func (u *stubUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.calls.Add(1)
+	if u.started != nil {
+		u.started <- req.Context()
+	}
+	if u.release != nil {
+		select {
+		case <-u.release:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(u.body(req.Context())), Request: req}, nil
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// blockingReader blocks until its context is done
+type blockingReader struct{ ctx context.Context }
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+// waitFor fails the test unless cond becomes true within five seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// flightReaders returns how many requests have joined flights in progress
+func flightReaders() int {
+	flights.mu.Lock()
+	defer flights.mu.Unlock()
+	n := 0
+	for _, f := range flights.inFlight {
+		f.mu.Lock()
+		n += len(f.readers)
+		f.mu.Unlock()
+	}
+	return n
+}
+
+// coalescedResult is the outcome of one request through a coalescingTransport
+type coalescedResult struct {
+	resp *http.Response
+	err  error
+}
+
+// startCoalesced sends n identical GET requests through transport at once,
+// waiting until all of them have joined one flight before the upstream is
+// released. Requests use ctxs[i] when given.
+func startCoalesced(t *testing.T, transport *coalescingTransport, upstream *stubUpstream, url string, ctxs ...context.Context) []chan coalescedResult {
+	t.Helper()
+	results := make([]chan coalescedResult, len(ctxs))
+	for i, ctx := range ctxs {
+		results[i] = make(chan coalescedResult, 1)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(result chan coalescedResult) {
+			resp, err := transport.RoundTrip(req)
+			result <- coalescedResult{resp, err}
+		}(results[i])
+		waitFor(t, "the request to join", func() bool { return flightReaders() == i+1 })
+	}
+	if upstream.calls.Load() != 1 {
+		t.Fatalf("upstream requests = %d, want 1", upstream.calls.Load())
+	}
+	return results
+}
+
+func setupCoalesce(t *testing.T) {
+	t.Helper()
+	if _, err := NewTestHandler("--coalesce", "--coalesce-buffer=65536"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { NewTestHandler() })
+}
+
+func TestCoalesceJoin(t *testing.T) {
+	setupCoalesce(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000) // over --coalesce-buffer
+	upstream := &stubUpstream{release: make(chan struct{}), body: func(context.Context) io.Reader { return bytes.NewReader(data) }}
+	transport := &coalescingTransport{next: upstream, route: "default"}
+
+	ctxs := make([]context.Context, 5)
+	for i := range ctxs {
+		ctxs[i] = context.Background()
+	}
+	results := startCoalesced(t, transport, upstream, "http://api.example/join", ctxs...)
+	close(upstream.release)
+
+	var wg sync.WaitGroup
+	shared := make([]bool, len(results))
+	for i, result := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := <-result
+			if r.err != nil {
+				t.Errorf("request %d: %v", i, r.err)
+				return
+			}
+			defer r.resp.Body.Close()
+			body, err := io.ReadAll(r.resp.Body)
+			if err != nil || !bytes.Equal(body, data) {
+				t.Errorf("request %d: read %d bytes, %v; want the %d upstream bytes", i, len(body), err, len(data))
+			}
+			shared[i] = r.resp.Header.Get(coalescedHeader) == "true"
+		}()
+	}
+	wg.Wait()
+	if upstream.calls.Load() != 1 {
+		t.Errorf("upstream requests = %d, want 1", upstream.calls.Load())
+	}
+	for i, want := range []bool{false, true, true, true, true} {
+		if shared[i] != want {
+			t.Errorf("request %d: %s = %v, want %v", i, coalescedHeader, shared[i], want)
+		}
+	}
+}
+
+func TestCoalesceSlowReaderHoldsBuffer(t *testing.T) {
+	setupCoalesce(t)
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	body := &countingReader{r: bytes.NewReader(data)}
+	upstream := &stubUpstream{release: make(chan struct{}), body: func(context.Context) io.Reader { return body }}
+	transport := &coalescingTransport{next: upstream, route: "default"}
+
+	results := startCoalesced(t, transport, upstream, "http://api.example/slow", context.Background(), context.Background())
+	close(upstream.release)
+	fast, slow := <-results[0], <-results[1]
+	if fast.err != nil || slow.err != nil {
+		t.Fatal(fast.err, slow.err)
+	}
+	defer fast.resp.Body.Close()
+	defer slow.resp.Body.Close()
+
+	fastDone := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(fast.resp.Body)
+		fastDone <- b
+	}()
+
+	// The fast reader may only get --coalesce-buffer ahead, plus the chunk
+	// in progress, while the slow one reads nothing
+	waitFor(t, "the buffer to fill", func() bool { return body.n.Load() >= *coalesceBuffer })
+	time.Sleep(50 * time.Millisecond)
+	if n := body.n.Load(); n > *coalesceBuffer+32*1024 {
+		t.Errorf("upstream read %d bytes ahead of the slow reader, over --coalesce-buffer %d", n, *coalesceBuffer)
+	}
+	select {
+	case <-fastDone:
+		t.Fatal("fast reader finished while the slow one had read nothing")
+	default:
+	}
+
+	slowBody, err := io.ReadAll(slow.resp.Body)
+	if err != nil || !bytes.Equal(slowBody, data) {
+		t.Errorf("slow reader: read %d bytes, %v", len(slowBody), err)
+	}
+	if fastBody := <-fastDone; !bytes.Equal(fastBody, data) {
+		t.Errorf("fast reader: read %d bytes", len(fastBody))
+	}
+}
+
+func TestCoalesceNoJoinAfterTrim(t *testing.T) {
+	setupCoalesce(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	upstream := &stubUpstream{body: func(context.Context) io.Reader { return bytes.NewReader(data) }}
+	transport := &coalescingTransport{next: upstream, route: "default"}
+
+	get := func() *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://api.example/trim", nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	first := get()
+	defer first.Body.Close()
+	// Reading past --coalesce-buffer drops the start of the body
+	head := make([]byte, 200*1024)
+	if _, err := io.ReadFull(first.Body, head); err != nil {
+		t.Fatal(err)
+	}
+
+	late := get()
+	defer late.Body.Close()
+	if upstream.calls.Load() != 2 || late.Header.Get(coalescedHeader) != "" {
+		t.Errorf("late request: upstream requests = %d, %s = %q; want its own request", upstream.calls.Load(), coalescedHeader, late.Header.Get(coalescedHeader))
+	}
+	for name, resp := range map[string]*http.Response{"first": first, "late": late} {
+		body, err := io.ReadAll(resp.Body)
+		if name == "first" {
+			body = append(head, body...)
+		}
+		if err != nil || !bytes.Equal(body, data) {
+			t.Errorf("%s request: read %d bytes, %v", name, len(body), err)
+		}
+	}
+}
+
+func TestCoalesceCancelBeforeResponse(t *testing.T) {
+	setupCoalesce(t)
+	upstream := &stubUpstream{
+		release: make(chan struct{}),
+		started: make(chan context.Context, 1),
+		body:    func(context.Context) io.Reader { return bytes.NewReader(nil) },
+	}
+	transport := &coalescingTransport{next: upstream, route: "default"}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	defer cancelFollower()
+	results := startCoalesced(t, transport, upstream, "http://api.example/cancel-early", leaderCtx, followerCtx)
+	upstreamCtx := <-upstream.started
+
+	// The leader leaving does not cancel the request the follower waits for
+	cancelLeader()
+	if r := <-results[0]; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("leader: err = %v, want context.Canceled", r.err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if upstreamCtx.Err() != nil {
+		t.Fatal("upstream request cancelled while the follower still waits")
+	}
+
+	cancelFollower()
+	if r := <-results[1]; !errors.Is(r.err, context.Canceled) {
+		t.Errorf("follower: err = %v, want context.Canceled", r.err)
+	}
+	waitFor(t, "the upstream request to be cancelled", func() bool { return upstreamCtx.Err() != nil })
+}
+
+func TestCoalesceCancelOnLastClose(t *testing.T) {
+	setupCoalesce(t)
+	upstream := &stubUpstream{
+		release: make(chan struct{}),
+		started: make(chan context.Context, 1),
+		body:    func(ctx context.Context) io.Reader { return blockingReader{ctx} },
+	}
+	transport := &coalescingTransport{next: upstream, route: "default"}
+
+	results := startCoalesced(t, transport, upstream, "http://api.example/cancel-late", context.Background(), context.Background())
+	upstreamCtx := <-upstream.started
+	close(upstream.release)
+	leader, follower := <-results[0], <-results[1]
+	if leader.err != nil || follower.err != nil {
+		t.Fatal(leader.err, follower.err)
+	}
+
+	// Closing one body leaves the shared upstream body streaming for the other
+	leader.resp.Body.Close()
+	time.Sleep(20 * time.Millisecond)
+	if upstreamCtx.Err() != nil {
+		t.Fatal("upstream request cancelled while the follower still reads")
+	}
+
+	follower.resp.Body.Close()
+	waitFor(t, "the upstream request to be cancelled", func() bool { return upstreamCtx.Err() != nil })
+	if _, err := follower.resp.Body.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("read after close: err = %v, want io.ErrClosedPipe", err)
+	}
+}
@@ -0,0 +1,324 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// UPSTREAM COMPARISON
+// -----------------------------
+
+// compareKeep is the number of recent mismatches kept for /admin/compare
+const compareKeep = 100
+
+// upstreamCompare sends a route's requests to a candidate upstream as well
+// and diffs the two responses, to validate an API migration. In "log" mode
+// the client gets the primary response and mismatches are logged; in
+// "respond" mode the client gets the diff instead.
+type upstreamCompare struct {
+	Candidate  string   `json:"candidate"` // base URL replacing the target's scheme and host
+	Mode       string   `json:"mode,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	SampleRate float64  `json:"sample_rate,omitempty"` // fraction of requests compared in log mode
+	MaxBytes   int      `json:"max_bytes,omitempty"`
+
+	candidate *url.URL
+}
+
+// compareResult is the structured diff of a primary and a candidate response
+type compareResult struct {
+	ID              string                `json:"id"`
+	Time            time.Time             `json:"time"`
+	Method          string                `json:"method"`
+	URL             string                `json:"url"`
+	CandidateURL    string                `json:"candidate_url"`
+	PrimaryStatus   int                   `json:"primary_status"`
+	CandidateStatus int                   `json:"candidate_status"`
+	StatusChanged   bool                  `json:"status_changed"`
+	HeaderChanges   []compareHeaderChange `json:"header_changes"`
+	BodyChanged     bool                  `json:"body_changed"`
+	BodyComparable  bool                  `json:"body_comparable"`
+	BodyDiff        []string              `json:"body_diff,omitempty"`
+	PrimaryMs       int64                 `json:"primary_ms"`
+	CandidateMs     int64                 `json:"candidate_ms"`
+	Error           string                `json:"error,omitempty"`
+}
+
+// compareHeaderChange is a response header that differs between the upstreams
+type compareHeaderChange struct {
+	Header    string `json:"header"`
+	Primary   string `json:"primary,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
+}
+
+// matches reports whether the responses were the same
+func (c *compareResult) matches() bool {
+	return c.Error == "" && !c.StatusChanged && len(c.HeaderChanges) == 0 && !c.BodyChanged
+}
+
+// candidateResponse is what the candidate upstream answered
+type candidateResponse struct {
+	status   int
+	header   http.Header
+	body     *captureBuffer
+	duration time.Duration
+	err      error
+}
+
+// comparison follows one request sent to both upstreams
+type comparison struct {
+	cfg       *upstreamCompare
+	result    compareResult
+	started   time.Time
+	primary   *captureBuffer
+	candidate chan candidateResponse
+}
+
+// compareResults counts comparisons by outcome and keeps recent mismatches
+var compareResults struct {
+	match, mismatch, failed atomic.Uint64
+
+	sync.Mutex
+	recent []compareResult
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		total := compareResults.match.Load() + compareResults.mismatch.Load() + compareResults.failed.Load()
+		if total == 0 {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_compare_total Requests compared against a candidate upstream, by outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_compare_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_compare_total{result=\"match\"} %d\n", compareResults.match.Load())
+		fmt.Fprintf(w, "argon_proxy_compare_total{result=\"mismatch\"} %d\n", compareResults.mismatch.Load())
+		fmt.Fprintf(w, "argon_proxy_compare_total{result=\"error\"} %d\n", compareResults.failed.Load())
+	})
+}
+
+// prepare validates the comparison settings and fills in defaults
+func (c *upstreamCompare) prepare(routeName string) error {
+	u, err := url.Parse(c.Candidate)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("route %q: compare candidate must be an http(s) base URL", routeName)
+	}
+	c.candidate = u
+	switch c.Mode {
+	case "":
+		c.Mode = "log"
+	case "log", "respond":
+	default:
+		return fmt.Errorf("route %q: compare mode must be log or respond", routeName)
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD"}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 1 << 20
+	}
+	return nil
+}
+
+// candidateURL moves a target onto the candidate upstream, keeping its path and query
+func (c *upstreamCompare) candidateURL(target *url.URL) *url.URL {
+	u := *target
+	u.Scheme, u.Host, u.User = c.candidate.Scheme, c.candidate.Host, nil
+	u.Path = strings.TrimSuffix(c.candidate.Path, "/") + target.Path
+	u.RawPath = ""
+	return &u
+}
+
+// startCompare sends a copy of the upstream request to the route's candidate
+// when the request qualifies, or returns nil. Request signing is not
+// applied to the copy, so it must be taken before signUpstreamRequest.
+func startCompare(r *http.Request, proxyReq *http.Request) *comparison {
+	cfg := routeFor(r).Compare
+	if cfg == nil {
+		return nil
+	}
+	allowed := false
+	for _, method := range cfg.Methods {
+		allowed = allowed || method == proxyReq.Method
+	}
+	if !allowed || (cfg.Mode == "log" && rand.Float64() >= cfg.SampleRate) {
+		return nil
+	}
+
+	// Both upstreams need the body, so it must fit in memory
+	var body []byte
+	if proxyReq.Body != nil && proxyReq.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(proxyReq.Body, int64(cfg.MaxBytes)+1))
+		if err != nil || len(body) > cfg.MaxBytes {
+			proxyReq.Body = teeBody{io.MultiReader(bytes.NewReader(body), proxyReq.Body), proxyReq.Body}
+			return nil
+		}
+		proxyReq.Body.Close()
+		proxyReq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	target := cfg.candidateURL(proxyReq.URL)
+	ctx := context.WithoutCancel(r.Context())
+	if cfg.Mode == "respond" {
+		ctx = r.Context()
+	}
+	req, err := http.NewRequestWithContext(ctx, proxyReq.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	req.Header = proxyReq.Header.Clone()
+
+	c := &comparison{
+		cfg:       cfg,
+		started:   time.Now(),
+		candidate: make(chan candidateResponse, 1),
+		result: compareResult{
+			ID:           requestID(r),
+			Time:         time.Now().UTC(),
+			Method:       proxyReq.Method,
+			URL:          proxyReq.URL.String(),
+			CandidateURL: target.String(),
+		},
+	}
+	client := routeFor(r).upstreamClient()
+	client.Timeout = time.Minute
+	go func() {
+		started := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			c.candidate <- candidateResponse{err: err, duration: time.Since(started)}
+			return
+		}
+		defer resp.Body.Close()
+		buf := &captureBuffer{limit: cfg.MaxBytes}
+		io.Copy(buf, resp.Body)
+		c.candidate <- candidateResponse{resp.StatusCode, resp.Header, buf, time.Since(started), nil}
+	}()
+	return c
+}
+
+// respondsWithDiff reports whether the client gets the diff instead of the response
+func (c *comparison) respondsWithDiff() bool {
+	return c != nil && c.cfg.Mode == "respond"
+}
+
+// tee keeps a copy of the primary response body as it is relayed
+func (c *comparison) tee(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	c.primary = &captureBuffer{limit: c.cfg.MaxBytes}
+	resp.Body = teeBody{io.TeeReader(resp.Body, c.primary), resp.Body}
+}
+
+// finish diffs the responses once the candidate answered, without holding up the client
+func (c *comparison) finish(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	primaryDuration := time.Since(c.started)
+	header := resp.Header.Clone()
+	go func() {
+		c.diff(resp.StatusCode, header, primaryDuration)
+		c.record()
+	}()
+}
+
+// respond reads both responses and writes their diff as the reply
+func (c *comparison) respond(w http.ResponseWriter, r *http.Request, resp *http.Response) int64 {
+	c.primary = &captureBuffer{limit: c.cfg.MaxBytes}
+	io.Copy(c.primary, resp.Body)
+	c.diff(resp.StatusCode, resp.Header, time.Since(c.started))
+	c.record()
+
+	data, _ := json.MarshalIndent(c.result, "", "  ")
+	addCORSHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	n, _ := w.Write(append(data, '\n'))
+	return int64(n)
+}
+
+// diff fills in the result from the primary response and the candidate's
+func (c *comparison) diff(status int, header http.Header, primaryDuration time.Duration) {
+	res := &c.result
+	res.PrimaryStatus = status
+	res.PrimaryMs = primaryDuration.Milliseconds()
+
+	candidate := <-c.candidate
+	res.CandidateMs = candidate.duration.Milliseconds()
+	if candidate.err != nil {
+		res.Error = candidate.err.Error()
+		return
+	}
+	res.CandidateStatus = candidate.status
+	res.StatusChanged = status != candidate.status
+	res.HeaderChanges = []compareHeaderChange{}
+	for _, change := range diffHeaders(header, candidate.header) {
+		res.HeaderChanges = append(res.HeaderChanges, compareHeaderChange{change.Header, change.Recorded, change.Replayed})
+	}
+
+	// Bodies can only be compared when neither side was cut off
+	res.BodyComparable = !c.primary.truncated && !candidate.body.truncated
+	res.BodyChanged = !bytes.Equal(c.primary.buf.Bytes(), candidate.body.buf.Bytes())
+	if res.BodyChanged && res.BodyComparable {
+		res.BodyDiff = diffLines(c.primary.buf.String(), candidate.body.buf.String())
+	}
+}
+
+// record counts the outcome and logs and keeps mismatches
+func (c *comparison) record() {
+	res := c.result
+	switch {
+	case res.Error != "":
+		compareResults.failed.Add(1)
+		log.Printf("Compare %s %s: candidate failed: %s", res.Method, res.CandidateURL, res.Error)
+	case res.matches():
+		compareResults.match.Add(1)
+		return
+	default:
+		compareResults.mismatch.Add(1)
+		log.Printf("Compare %s %s: candidate differs (status %d/%d, %d header changes, body changed: %v)",
+			res.Method, res.URL, res.PrimaryStatus, res.CandidateStatus, len(res.HeaderChanges), res.BodyChanged)
+	}
+
+	compareResults.Lock()
+	defer compareResults.Unlock()
+	compareResults.recent = append(compareResults.recent, res)
+	if len(compareResults.recent) > compareKeep {
+		compareResults.recent = compareResults.recent[len(compareResults.recent)-compareKeep:]
+	}
+}
+
+// handleAdminCompare lists recent mismatches and failures, newest first
+func handleAdminCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	compareResults.Lock()
+	list := make([]compareResult, 0, len(compareResults.recent))
+	for i := len(compareResults.recent) - 1; i >= 0; i-- {
+		list = append(list, compareResults.recent[i])
+	}
+	compareResults.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
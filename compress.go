@@ -0,0 +1,151 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// -----------------------------
+// UPSTREAM REQUEST COMPRESSION
+// -----------------------------
+
+// defaultCompressTypes are the request bodies compressed when a route lists none
+var defaultCompressTypes = []string{"application/json", "application/*+json", "application/xml", "text/*"}
+
+// requestCompression configures compression of a route's request bodies
+type requestCompression struct {
+	// Mode is "always", for upstreams known to accept the encoding, or
+	// "auto", which waits until the upstream lists it in an Accept-Encoding
+	// response header (RFC 7694)
+	Mode         string   `json:"mode,omitempty"`
+	Encoding     string   `json:"encoding,omitempty"` // gzip (default), br or zstd
+	MinSize      int64    `json:"min_size,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+	Level        int      `json:"level,omitempty"`
+}
+
+// encodingHosts holds "host|coding" for the request codings upstream hosts advertised
+var encodingHosts sync.Map
+
+// prepare validates the settings and fills in defaults
+func (c *requestCompression) prepare(routeName string) error {
+	switch c.Mode {
+	case "":
+		c.Mode = "auto"
+	case "auto", "always":
+	default:
+		return fmt.Errorf("route %q: request_compression mode must be auto or always", routeName)
+	}
+	if c.MinSize == 0 {
+		c.MinSize = 1024
+	}
+	if len(c.ContentTypes) == 0 {
+		c.ContentTypes = defaultCompressTypes
+	}
+	if c.Encoding == "" {
+		c.Encoding = "gzip"
+	}
+	c.Encoding = strings.ToLower(c.Encoding)
+	coding, ok := contentCodings[c.Encoding]
+	if !ok {
+		return fmt.Errorf("route %q: request_compression encoding must be gzip, br or zstd", routeName)
+	}
+	if c.Level == 0 {
+		c.Level = coding.defaultLevel
+	} else if c.Level < coding.minLevel || c.Level > coding.maxLevel {
+		return fmt.Errorf("route %q: request_compression level for %s must be between %d and %d",
+			routeName, c.Encoding, coding.minLevel, coding.maxLevel)
+	}
+	return nil
+}
+
+// wants reports whether a request body should be compressed. The client's
+// request gives the size; the upstream request does not know it.
+func (c *requestCompression) wants(r *http.Request, proxyReq *http.Request) bool {
+	if proxyReq.Body == nil || proxyReq.Body == http.NoBody || proxyReq.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	// Bodies of unknown length are usually large uploads, so they qualify
+	if r.ContentLength >= 0 && r.ContentLength < c.MinSize {
+		return false
+	}
+	if c.Mode == "auto" {
+		if _, ok := encodingHosts.Load(proxyReq.URL.Host + "|" + c.Encoding); !ok {
+			return false
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(proxyReq.Header.Get("Content-Type"))
+	for _, pattern := range c.ContentTypes {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaTypeMatches matches a media type against "type/sub", "type/*" or "type/*+suffix"
+func mediaTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if prefix, suffix, ok := strings.Cut(pattern, "*"); ok {
+		return len(mediaType) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix)
+	}
+	return pattern == mediaType
+}
+
+// compressUpstreamRequest compresses the request body when the route asks for it.
+// The body is compressed as it is sent, so its length is no longer known.
+func compressUpstreamRequest(r *http.Request, proxyReq *http.Request) {
+	c := routeFor(r).RequestCompression
+	if c == nil || !c.wants(r, proxyReq) {
+		return
+	}
+
+	body := proxyReq.Body
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := contentCodings[c.Encoding].writer(pw, c.Level)
+		if err == nil {
+			_, err = copyBody(zw, body)
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	proxyReq.Body = pr
+	proxyReq.ContentLength = -1
+	proxyReq.Header.Del("Content-Length")
+	proxyReq.Header.Set("Content-Encoding", c.Encoding)
+}
+
+// learnRequestEncoding remembers whether an upstream accepts request bodies
+// in the route's encoding, from its Accept-Encoding response header or a 415
+// to an encoded body. Only routes that compress learn, so arbitrary targets
+// do not fill the map.
+func learnRequestEncoding(r *http.Request, proxyReq *http.Request, resp *http.Response) {
+	c := routeFor(r).RequestCompression
+	if c == nil {
+		return
+	}
+	key := proxyReq.URL.Host + "|" + c.Encoding
+	if resp.StatusCode == http.StatusUnsupportedMediaType && proxyReq.Header.Get("Content-Encoding") == c.Encoding {
+		if _, known := encodingHosts.LoadAndDelete(key); known {
+			log.Printf("Upstream %s rejected a %s request body, no longer compressing", proxyReq.URL.Host, c.Encoding)
+		}
+		return
+	}
+	for _, value := range resp.Header.Values("Accept-Encoding") {
+		if acceptsCoding(value, c.Encoding) {
+			encodingHosts.Store(key, true)
+			return
+		}
+	}
+}
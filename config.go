@@ -0,0 +1,248 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------
+// CONFIGURATION FILE
+// -----------------------------
+
+// Config is the server settings part of the configuration file. Every
+// setting has a command line flag, which takes precedence when given.
+type Config struct {
+	Listen   listenConfig  `json:"listen"`
+	CORS     corsConfig    `json:"cors"`
+	Targets  targetConfig  `json:"targets"`
+	Headers  headerConfig  `json:"headers"`
+	Timeouts timeoutConfig `json:"timeouts"`
+}
+
+type listenConfig struct {
+	Address      string `json:"address,omitempty"`
+	Port         *int   `json:"port,omitempty"`
+	TLSCert      string `json:"tls_cert,omitempty"`
+	TLSKey       string `json:"tls_key,omitempty"`
+	RedirectHTTP string `json:"redirect_http,omitempty"`
+}
+
+type corsConfig struct {
+	AllowOrigin []string `json:"allow_origin,omitempty"`
+	NullOrigin  string   `json:"null_origin,omitempty"`
+	TokenSecret string   `json:"token_secret,omitempty"`
+	TrustProxy  *bool    `json:"trust_proxy,omitempty"`
+}
+
+type targetConfig struct {
+	AllowHosts         []string `json:"allow_hosts,omitempty"`
+	DenyHosts          []string `json:"deny_hosts,omitempty"`
+	DenyIPTargets      *bool    `json:"deny_ip_targets,omitempty"`
+	DenyPrivateTargets *bool    `json:"deny_private_targets,omitempty"`
+}
+
+type headerConfig struct {
+	StripParams            []string `json:"strip_params,omitempty"`
+	ClientHints            []string `json:"client_hints,omitempty"`
+	AcceptCH               *bool    `json:"accept_ch,omitempty"`
+	AcceptLanguage         string   `json:"accept_language,omitempty"`
+	UpstreamAcceptEncoding string   `json:"upstream_accept_encoding,omitempty"`
+	ResourcePolicy         string   `json:"corp,omitempty"`
+	EmbedderPolicy         string   `json:"coep,omitempty"`
+	ReferrerPolicy         string   `json:"referrer_policy,omitempty"`
+}
+
+type timeoutConfig struct {
+	Upstream string `json:"upstream,omitempty"`
+	Dial     string `json:"dial,omitempty"`
+	IdleConn string `json:"idle_conn,omitempty"`
+	Flush    string `json:"flush_interval,omitempty"`
+}
+
+// configSetting ties a key of the file to the flag it sets
+type configSetting struct {
+	key   string
+	flag  string
+	value any // nil, "" or an empty list when the file leaves it out
+}
+
+// settings lists the file's values with their keys and flags
+func (c *Config) settings() []configSetting {
+	return []configSetting{
+		{"listen.address", "address", c.Listen.Address},
+		{"listen.port", "port", c.Listen.Port},
+		{"listen.tls_cert", "tls-cert", c.Listen.TLSCert},
+		{"listen.tls_key", "tls-key", c.Listen.TLSKey},
+		{"listen.redirect_http", "redirect-http", c.Listen.RedirectHTTP},
+		{"cors.allow_origin", "allow-origin", c.CORS.AllowOrigin},
+		{"cors.null_origin", "null-origin", c.CORS.NullOrigin},
+		{"cors.token_secret", "cors-token-secret", c.CORS.TokenSecret},
+		{"cors.trust_proxy", "trust-proxy", c.CORS.TrustProxy},
+		{"targets.allow_hosts", "allow-hosts", c.Targets.AllowHosts},
+		{"targets.deny_hosts", "deny-hosts", c.Targets.DenyHosts},
+		{"targets.deny_ip_targets", "deny-ip-targets", c.Targets.DenyIPTargets},
+		{"targets.deny_private_targets", "deny-private-targets", c.Targets.DenyPrivateTargets},
+		{"headers.strip_params", "strip-params", c.Headers.StripParams},
+		{"headers.client_hints", "client-hints", c.Headers.ClientHints},
+		{"headers.accept_ch", "accept-ch", c.Headers.AcceptCH},
+		{"headers.accept_language", "accept-language", c.Headers.AcceptLanguage},
+		{"headers.upstream_accept_encoding", "upstream-accept-encoding", c.Headers.UpstreamAcceptEncoding},
+		{"headers.corp", "corp", c.Headers.ResourcePolicy},
+		{"headers.coep", "coep", c.Headers.EmbedderPolicy},
+		{"headers.referrer_policy", "referrer-policy", c.Headers.ReferrerPolicy},
+		{"timeouts.upstream", "upstream-timeout", c.Timeouts.Upstream},
+		{"timeouts.dial", "dial-timeout", c.Timeouts.Dial},
+		{"timeouts.idle_conn", "idle-conn-timeout", c.Timeouts.IdleConn},
+		{"timeouts.flush_interval", "flush-interval", c.Timeouts.Flush},
+	}
+}
+
+// validate checks the values flags would not catch themselves, naming the
+// offending key
+func (c *Config) validate() error {
+	if p := c.Listen.Port; p != nil && (*p < 1 || *p > 65535) {
+		return fmt.Errorf("listen.port: %d is not a valid port", *p)
+	}
+	if (c.Listen.TLSCert == "") != (c.Listen.TLSKey == "") {
+		return errors.New("listen.tls_cert and listen.tls_key must be given together")
+	}
+	for key, patterns := range map[string][]string{"targets.allow_hosts": c.Targets.AllowHosts, "targets.deny_hosts": c.Targets.DenyHosts} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || strings.Contains(pattern, ",") {
+				return fmt.Errorf("%s: invalid host pattern %q", key, pattern)
+			}
+		}
+	}
+	for key, value := range map[string]string{"timeouts.upstream": c.Timeouts.Upstream, "timeouts.dial": c.Timeouts.Dial, "timeouts.idle_conn": c.Timeouts.IdleConn} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("%s: invalid duration %q", key, value)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the configuration file as JSON, converting YAML
+// files (.yaml or .yml) first, and decrypts its enc:v1: values
+func readConfigFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", filename, err)
+		}
+		if data, err = json.Marshal(stringKeys(doc)); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", filename, err)
+		}
+	}
+	if data, err = decryptConfig(data); err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", filename, err)
+	}
+	return data, nil
+}
+
+// stringKeys converts YAML mappings with non-string keys, such as the
+// status codes of error_pages, to the string-keyed objects of JSON
+func stringKeys(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			v[key] = stringKeys(child)
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, child := range v {
+			m[fmt.Sprint(key)] = stringKeys(child)
+		}
+		return m
+	case []any:
+		for i, child := range v {
+			v[i] = stringKeys(child)
+		}
+	}
+	return value
+}
+
+// loadedSettings is the Config the flags were filled in from at startup
+var loadedSettings Config
+
+// readConfigSettings reads and validates the settings in a config file
+func readConfigSettings(filename string) (*Config, error) {
+	data, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return nil, fmt.Errorf("%s: %s: expected %s, got %s", filename, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &cfg, nil
+}
+
+// applyConfigFile sets the flags of fs that were not given on the command
+// line from the settings in the --config file
+func applyConfigFile(fs *flag.FlagSet) error {
+	if *configFile == "" {
+		return nil
+	}
+	cfg, err := readConfigSettings(*configFile)
+	if err != nil {
+		return err
+	}
+	loadedSettings = *cfg
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, s := range cfg.settings() {
+		value, ok := configValue(s.value)
+		if !ok || given[s.flag] {
+			continue
+		}
+		if err := fs.Lookup(s.flag).Value.Set(value); err != nil {
+			return fmt.Errorf("%s: %s: invalid value %q", *configFile, s.key, value)
+		}
+	}
+	return nil
+}
+
+// configValue formats a setting as its flag would be given, and reports
+// whether the file sets it at all
+func configValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case []string:
+		return strings.Join(v, ","), len(v) > 0
+	case *int:
+		if v != nil {
+			return strconv.Itoa(*v), true
+		}
+	case *bool:
+		if v != nil {
+			return strconv.FormatBool(*v), true
+		}
+	}
+	return "", false
+}
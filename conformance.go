@@ -0,0 +1,125 @@
+package argonproxy
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// -----------------------------
+// URL CONFORMANCE SUITE
+// -----------------------------
+
+// conformanceCorpus holds the golden cases run by the conformance subcommand
+//
+//go:embed conformance/urls.json
+var conformanceCorpus []byte
+
+// conformanceCase is a proxy request and the upstream URL it must produce,
+// or the error it must fail with
+type conformanceCase struct {
+	Name     string            `json:"name"`
+	Request  string            `json:"request"`         // request URI sent to the proxy
+	Flags    map[string]string `json:"flags,omitempty"` // set for this case only
+	Upstream string            `json:"upstream,omitempty"`
+	Host     string            `json:"host,omitempty"` // Host header, when it differs from the URL
+	Error    string            `json:"error,omitempty"`
+}
+
+// runConformance checks how the build turns proxy requests into upstream
+// URLs against the golden corpus, prints a report and returns the process
+// exit code. Flags given on the command line do not apply; each case starts
+// from the defaults.
+func runConformance() int {
+	var cases []conformanceCase
+	if err := json.Unmarshal(conformanceCorpus, &cases); err != nil {
+		fmt.Printf("Invalid conformance corpus: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Argon-Proxy URL conformance\n\n")
+	failed := 0
+	for _, c := range cases {
+		if err := c.run(); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s\n      request:  %s\n      %v\n", c.Name, c.Request, err)
+		} else {
+			fmt.Printf("PASS  %s\n", c.Name)
+		}
+	}
+
+	fmt.Printf("\n%d/%d cases passed\n", len(cases)-failed, len(cases))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// conformanceFlags are the flags affecting URL handling, reset for every case
+var conformanceFlags = []string{"forward-fragment", "strip-params"}
+
+// run sends the case's request through target parsing and upstream request
+// creation and compares the outcome with the golden values
+func (c conformanceCase) run() error {
+	saved := make(map[string]string)
+	for _, name := range conformanceFlags {
+		f := flag.Lookup(name)
+		saved[name] = f.Value.String()
+		f.Value.Set(f.DefValue)
+	}
+	savedParams := controlParams
+	defer func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+		controlParams = savedParams
+	}()
+	for name, value := range c.Flags {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("flag %s: %v", name, err)
+		}
+	}
+	setControlParams(*stripParams)
+
+	upstream, host, err := conformanceUpstream(c.Request)
+	switch {
+	case err != nil && c.Error == "":
+		return fmt.Errorf("got error:  %v\n      want:     %s", err, c.Upstream)
+	case err != nil && err.Error() != c.Error:
+		return fmt.Errorf("got error:  %v\n      want:     error %s", err, c.Error)
+	case err != nil:
+		return nil
+	case c.Error != "":
+		return fmt.Errorf("got:       %s\n      want:     error %s", upstream, c.Error)
+	case upstream != c.Upstream:
+		return fmt.Errorf("got:       %s\n      want:     %s", upstream, c.Upstream)
+	}
+	if want := c.Host; want != "" && host != want {
+		return fmt.Errorf("got Host:  %s\n      want:     %s", host, want)
+	}
+	return nil
+}
+
+// conformanceUpstream returns the URL, as sent on the wire, and the Host
+// header of the upstream request made for a proxy request URI
+func conformanceUpstream(requestURI string) (string, string, error) {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + requestURI + " HTTP/1.1\r\nHost: proxy.test\r\n\r\n")))
+	if err != nil {
+		return "", "", err
+	}
+	target, err := parseTargetURL(r)
+	if err != nil {
+		return "", "", err
+	}
+	proxyReq, err := createProxyRequest(r, resolveTargetURL(r, target))
+	if err != nil {
+		return "", "", err
+	}
+	sent := *proxyReq.URL
+	sent.User, sent.Fragment, sent.RawFragment = nil, "", ""
+	return sent.String(), proxyReq.Host, nil
+}
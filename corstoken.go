@@ -0,0 +1,102 @@
+package argonproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// CORS OVERRIDE TOKENS
+// -----------------------------
+
+// corsTokenHeader carries a backend-minted token that widens CORS for one request
+const corsTokenHeader = "X-Argon-Cors-Token"
+
+// corsTokenClaims is what a CORS token grants, and to whom
+type corsTokenClaims struct {
+	Origin  string   `json:"origin"`           // the page the token was minted for
+	Target  string   `json:"target,omitempty"` // target URL prefix the token is limited to
+	Expose  []string `json:"expose"`           // response headers exposed to the page
+	Expires int64    `json:"exp"`              // Unix time the token stops working
+}
+
+// signCORSToken returns the signature of a token's encoded claims
+func signCORSToken(claims string) string {
+	mac := hmac.New(sha256.New, []byte(*corsTokenSecret))
+	mac.Write([]byte(claims))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseCORSToken checks a token's signature and expiry and that it was
+// minted for this origin and target
+func parseCORSToken(token, origin, targetURL string) (*corsTokenClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signCORSToken(encoded))) {
+		return nil, errors.New("bad signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	var claims corsTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+
+	switch {
+	case claims.Expires == 0 || time.Now().Unix() > claims.Expires:
+		return nil, errors.New("expired")
+	case claims.Origin == "" || !strings.EqualFold(claims.Origin, origin):
+		return nil, fmt.Errorf("minted for origin %q", claims.Origin)
+	case !targetUnder(targetURL, claims.Target):
+		return nil, fmt.Errorf("minted for targets under %s", claims.Target)
+	}
+	for _, name := range claims.Expose {
+		if name == "" || strings.ContainsAny(name, " \t,:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return &claims, nil
+}
+
+// targetUnder reports whether a target URL is prefix or lies under it. The
+// prefix must end at a path boundary, so https://api.example.com does not
+// cover https://api.example.com.evil.test.
+func targetUnder(targetURL, prefix string) bool {
+	if !strings.HasPrefix(targetURL, prefix) {
+		return false
+	}
+	rest := targetURL[len(prefix):]
+	return prefix == "" || rest == "" || strings.HasSuffix(prefix, "/") || strings.ContainsRune("/?#", rune(rest[0]))
+}
+
+// applyCORSToken exposes the headers a valid X-Argon-Cors-Token grants. A
+// token that does not check out is refused with 403, so mistakes in minting
+// show up instead of silently exposing nothing.
+func applyCORSToken(w http.ResponseWriter, r *http.Request, targetURL string) bool {
+	token := r.Header.Get(corsTokenHeader)
+	if token == "" {
+		return true
+	}
+	var claims *corsTokenClaims
+	err := errors.New("--cors-token-secret is not set")
+	if *corsTokenSecret != "" {
+		claims, err = parseCORSToken(token, r.Header.Get("Origin"), targetURL)
+	}
+	if err != nil {
+		addCORSHeaders(w, r)
+		proxyError(w, r, http.StatusForbidden, "Invalid CORS token: "+err.Error(), targetURL)
+		return false
+	}
+	if len(claims.Expose) > 0 {
+		w.Header().Add("Access-Control-Expose-Headers", strings.Join(claims.Expose, ", "))
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// DEBUG HELPERS
+// -----------------------------
+
+// handleDebugCurl accepts the same URL forms as /proxy/ and returns the curl
+// command for the upstream request the proxy would make, without sending it.
+// Callers authenticate as for /proxy/, the request is built as the proxy
+// would build it, credentials included, and their values are redacted.
+func handleDebugCurl(w http.ResponseWriter, r *http.Request) {
+	r, ok := requireAuth(w, r)
+	if !ok || !checkRateLimit(w, r) {
+		return
+	}
+
+	// Parse the target exactly as /proxy/ would
+	proxyPath := r.Clone(r.Context())
+	proxyPath.URL.Path = "/proxy" + strings.TrimPrefix(r.URL.Path, "/debug/curl")
+	if r.URL.RawPath != "" {
+		proxyPath.URL.RawPath = "/proxy" + strings.TrimPrefix(r.URL.RawPath, "/debug/curl")
+	}
+
+	targetURL, err := parseTargetURL(proxyPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if targetURL == "" {
+		http.Error(w, "Usage: /debug/curl/{url} or /debug/curl/?target={url}, with the method, headers and body of the proxy request", http.StatusBadRequest)
+		return
+	}
+
+	finalURL := resolveTargetURL(proxyPath, targetURL)
+	if !checkIPTarget(w, proxyPath, finalURL) || !checkTargetHost(w, proxyPath, finalURL) || !checkBlocklist(w, proxyPath, finalURL) || !checkOriginTarget(w, proxyPath, finalURL) {
+		return
+	}
+	proxyReq, _, ok := buildUpstreamRequest(w, proxyPath, finalURL)
+	if !ok {
+		return
+	}
+	setUpstreamAcceptEncoding(proxyReq)
+	compressUpstreamRequest(proxyPath, proxyReq)
+	if !signAndChain(w, proxyPath, proxyReq, finalURL) {
+		return
+	}
+
+	var body []byte
+	if proxyReq.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(proxyReq.Body, int64(*captureBodyLimit)+1))
+	}
+
+	// Credentials are shown as placeholders, including the route's own headers
+	shown := proxyReq.Clone(proxyReq.Context())
+	shown.Header = redactHeaders(proxyReq.Header)
+	for name := range routeFor(proxyPath).UpstreamHeaders {
+		if shown.Header.Get(name) != "" {
+			shown.Header.Set(name, redactedValue)
+		}
+	}
+	if _, ok := shown.URL.User.Password(); ok {
+		shown.URL.User = url.UserPassword(shown.URL.User.Username(), redactedValue)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, curlCommand(shown, body, *captureBodyLimit))
+}
+
+// curlCommand renders a request as a shell-quoted curl command line
+func curlCommand(req *http.Request, body []byte, bodyLimit int) string {
+	parts := []string{"curl"}
+	if req.Method != "GET" {
+		parts = append(parts, "-X "+shellQuote(req.Method))
+	}
+	parts = append(parts, shellQuote(req.URL.String()))
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			parts = append(parts, "-H "+shellQuote(name+": "+value))
+		}
+	}
+
+	note := ""
+	switch {
+	case len(body) == 0:
+	case len(body) > bodyLimit:
+		parts = append(parts, "--data-binary @request-body.bin")
+		note = fmt.Sprintf("\n# The request body is larger than %d bytes; save it as request-body.bin", bodyLimit)
+	case !utf8.Valid(body):
+		parts = append(parts, "--data-binary @request-body.bin")
+		note = "\n# The request body is binary; save it as request-body.bin"
+	default:
+		parts = append(parts, "--data-binary "+shellQuote(string(body)))
+	}
+
+	return strings.Join(parts, " \\\n  ") + note
+}
+
+// shellQuote quotes a string for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,67 @@
+package argonproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugCurl(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys")
+	if err := os.WriteFile(keys, []byte("alice:s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	routes := filepath.Join(dir, "routes.json")
+	config := `{"routes": [{"name": "api", "hosts": ["proxy.test"], "upstream_headers": {"X-Vendor-Auth": "vendor-credential"}}]}`
+	if err := os.WriteFile(routes, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewTestHandler("--debug-curl", "--auth=apikey", "--auth-file="+keys, "--config="+routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+
+	tests := []struct {
+		name       string
+		key        string
+		target     string
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{"no key", "", "https://api.example.com/search", http.StatusUnauthorized, nil, nil},
+		{"credentials redacted", "s3cret", "https://api.example.com/search", http.StatusOK,
+			[]string{"'https://api.example.com/search'", "X-Vendor-Auth: [REDACTED]"}, []string{"vendor-credential", "s3cret"}},
+		{"url password redacted", "s3cret", "https://user:pw@api.example.com/", http.StatusOK,
+			[]string{"user:%5BREDACTED%5D@api.example.com"}, []string{":pw@"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://proxy.test/debug/curl/?target="+tt.target, nil)
+			if tt.key != "" {
+				req.Header.Set(apiKeyHeader, tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			out := rec.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("output lacks %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("output contains %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
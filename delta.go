@@ -0,0 +1,250 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// JSON PATCH DELTAS
+// -----------------------------
+
+// jsonDelta lets polling clients of a route receive an RFC 6902 JSON Patch
+// against the version they already have instead of the full JSON body
+type jsonDelta struct {
+	Param    string `json:"param,omitempty"`     // query parameter naming the client's ETag; default "since"
+	TTL      string `json:"ttl,omitempty"`       // how long versions are kept to diff against; default 1h
+	MaxBytes int64  `json:"max_bytes,omitempty"` // larger responses are relayed whole; default 1 MiB
+
+	ttl time.Duration
+}
+
+// deltaRequest is a GET on a route with json_delta, and the version the
+// client asked to diff against, if any
+type deltaRequest struct {
+	cfg   *jsonDelta
+	key   string // identifies the resource across versions
+	since string
+}
+
+// patchOperation is one RFC 6902 operation
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// prepare checks a route's json_delta settings and fills in defaults
+func (d *jsonDelta) prepare(routeName string) error {
+	if d.Param == "" {
+		d.Param = "since"
+	}
+	d.ttl = time.Hour
+	if d.TTL != "" {
+		ttl, err := time.ParseDuration(d.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("route %q: invalid json_delta ttl %q", routeName, d.TTL)
+		}
+		d.ttl = ttl
+	}
+	if d.MaxBytes < 0 {
+		return fmt.Errorf("route %q: json_delta max_bytes must be positive", routeName)
+	}
+	if d.MaxBytes == 0 {
+		d.MaxBytes = 1 << 20
+	}
+	return nil
+}
+
+// startDelta takes the version parameter off a GET upstream request on a
+// route with json_delta. Accept-Encoding is left to the transport so the
+// body arrives decoded and can be diffed.
+func startDelta(r *http.Request, proxyReq *http.Request) *deltaRequest {
+	cfg := routeFor(r).JSONDelta
+	if cfg == nil || r.Method != "GET" {
+		return nil
+	}
+	d := &deltaRequest{cfg: cfg}
+	var kept []string
+	for _, part := range strings.Split(proxyReq.URL.RawQuery, "&") {
+		key, value, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == cfg.Param {
+			d.since, _ = url.QueryUnescape(value)
+			continue
+		}
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	proxyReq.URL.RawQuery = strings.Join(kept, "&")
+	proxyReq.Header.Del("Accept-Encoding")
+
+	sum := sha256.Sum256([]byte(routeFor(r).Name + "\n" + proxyReq.URL.String()))
+	d.key = "delta:" + hex.EncodeToString(sum[:16])
+	return d
+}
+
+// apply keeps the version of a successful JSON response and, when the client
+// named an older version it has, replaces the body with a patch from it, or
+// the response with 304 Not Modified when nothing changed
+func (d *deltaRequest) apply(resp *http.Response) {
+	if d == nil || resp.StatusCode != http.StatusOK || !isJSONResponse(resp) || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, d.cfg.MaxBytes+1))
+	if err != nil || int64(len(body)) > d.cfg.MaxBytes {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		resp.Header.Set("ETag", etag)
+	}
+	if err := store.Set(d.key+":"+etag, body, d.cfg.ttl); err != nil {
+		log.Printf("Error storing JSON delta version: %v", err)
+	}
+
+	since := d.since
+	if since == "" {
+		return
+	}
+	if !strings.HasPrefix(since, `"`) {
+		since = `"` + since + `"`
+	}
+	if since == etag {
+		resp.StatusCode, resp.Status = http.StatusNotModified, "304 Not Modified"
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Type")
+		return
+	}
+	previous, ok, err := store.Get(d.key + ":" + since)
+	if err != nil || !ok {
+		return // the client gets the full body
+	}
+	patch, err := jsonPatch(previous, body)
+	if err != nil || len(patch) >= len(body) {
+		return
+	}
+	resp.Body, resp.ContentLength = io.NopCloser(bytes.NewReader(patch)), int64(len(patch))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(patch)))
+	resp.Header.Set("Content-Type", "application/json-patch+json")
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// jsonPatch returns the RFC 6902 patch turning one JSON document into another
+func jsonPatch(from, to []byte) ([]byte, error) {
+	a, err := decodeJSONNumbers(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeJSONNumbers(to)
+	if err != nil {
+		return nil, err
+	}
+	ops := diffJSON("", a, b, nil)
+	if ops == nil {
+		ops = []patchOperation{}
+	}
+	return json.Marshal(ops)
+}
+
+// decodeJSONNumbers decodes a document keeping numbers exactly as written
+func decodeJSONNumbers(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// diffJSON appends the operations turning a into b at path. Arrays are
+// compared by index, adding or removing elements at the end.
+func diffJSON(path string, a, b any, ops []patchOperation) []patchOperation {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			child := path + "/" + escapePointer(k)
+			old, inA := av[k]
+			value, inB := bv[k]
+			switch {
+			case !inB:
+				ops = append(ops, patchOperation{Op: "remove", Path: child})
+			case !inA:
+				ops = append(ops, patchOperation{Op: "add", Path: child, Value: patchValue(value)})
+			default:
+				ops = diffJSON(child, old, value, ops)
+			}
+		}
+		return ops
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		common := min(len(av), len(bv))
+		for i := 0; i < common; i++ {
+			ops = diffJSON(path+"/"+strconv.Itoa(i), av[i], bv[i], ops)
+		}
+		for i := len(av) - 1; i >= common; i-- {
+			ops = append(ops, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(bv); i++ {
+			ops = append(ops, patchOperation{Op: "add", Path: path + "/-", Value: patchValue(bv[i])})
+		}
+		return ops
+	}
+	if reflect.DeepEqual(a, b) {
+		return ops
+	}
+	return append(ops, patchOperation{Op: "replace", Path: path, Value: patchValue(b)})
+}
+
+// patchValue keeps JSON null as a value rather than an omitted field
+func patchValue(v any) any {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
+
+// escapePointer escapes a key for a JSON Pointer (RFC 6901)
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
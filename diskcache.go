@@ -0,0 +1,246 @@
+package argonproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// DISK CACHE TIER
+// -----------------------------
+
+// diskMeta is the first line of a cache file; the body follows it
+type diskMeta struct {
+	Key     string            `json:"key"`
+	Target  string            `json:"target"`
+	Status  int               `json:"status"`
+	Header  http.Header       `json:"header"`
+	Vary    map[string]string `json:"vary,omitempty"`
+	Stored  time.Time         `json:"stored"`
+	Expires time.Time         `json:"expires"`
+}
+
+// loadDiskCache indexes the responses left in --cache-dir by an earlier run,
+// least recently used first, so eviction picks up where it stopped.
+// Unfinished and unreadable files are removed.
+func loadDiskCache() error {
+	if err := os.MkdirAll(*cacheDir, 0o700); err != nil {
+		return err
+	}
+	type found struct {
+		entry *cacheEntry
+		key   string
+		used  time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(*cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		key, entry, err := readCacheFile(path)
+		if err != nil {
+			log.Printf("Removing unreadable cache file %s: %v", path, err)
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{entry, key, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(files, func(a, b found) int { return a.used.Compare(b.used) })
+	for _, f := range files {
+		diskCache.add(f.key, f.entry)
+	}
+	entries, size := diskCache.usage()
+	log.Printf("Disk cache %s holds %d responses, %d bytes", *cacheDir, entries, size)
+	return nil
+}
+
+// readCacheFile reads the metadata of a cache file
+func readCacheFile(path string) (string, *cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return "", nil, err
+	}
+	if meta.Key == "" || meta.Status == 0 {
+		return "", nil, errors.New("missing metadata")
+	}
+	if meta.Header == nil {
+		meta.Header = http.Header{}
+	}
+	return meta.Key, &cacheEntry{
+		target:  meta.Target,
+		status:  meta.Status,
+		header:  meta.Header,
+		vary:    meta.Vary,
+		stored:  meta.Stored,
+		expires: meta.Expires,
+		file:    path,
+		offset:  int64(len(line)),
+		length:  info.Size() - int64(len(line)),
+	}, nil
+}
+
+// removeCacheFile deletes the file of an entry leaving the disk tier
+func removeCacheFile(entry *cacheEntry) {
+	if err := os.Remove(entry.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Error removing cache file: %v", err)
+	}
+}
+
+// onDisk reports whether a response goes straight to the disk tier: bodies
+// larger than --cache-max-object and types listed in --cache-disk-types
+func onDisk(resp *http.Response) bool {
+	if *cacheDir == "" {
+		return false
+	}
+	if *cacheSize <= 0 || resp.ContentLength > *cacheMaxObject {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, pattern := range splitList(*cacheDiskTypes) {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// openBody opens an entry's body for reading. Disk entries stream from
+// their file.
+func (e *cacheEntry) openBody() (io.ReadSeekCloser, error) {
+	if e.file == "" {
+		return readSeekCloser{bytes.NewReader(e.body), io.NopCloser(nil)}, nil
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		return nil, err
+	}
+	// The modification time records use, so the LRU order survives restarts
+	now := time.Now()
+	os.Chtimes(e.file, now, now)
+	return readSeekCloser{io.NewSectionReader(f, e.offset, e.length), f}, nil
+}
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// diskWriter writes a response to a temporary cache file, renamed into
+// place once the body is complete
+type diskWriter struct {
+	file   *os.File
+	offset int64
+	length int64
+}
+
+// createCacheFile starts a cache file for the entry with its metadata.
+// Files are named after the key and Vary values, with a random suffix so a
+// replaced variant keeps its own file until evicted.
+func createCacheFile(key string, entry *cacheEntry) (*diskWriter, error) {
+	h := sha256.New()
+	io.WriteString(h, key)
+	names := make([]string, 0, len(entry.vary))
+	for name := range entry.vary {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		io.WriteString(h, "\n"+name+": "+entry.vary[name])
+	}
+	name := hex.EncodeToString(h.Sum(nil))
+	dir := filepath.Join(*cacheDir, name[:2])
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, name+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(diskMeta{
+		Key:     key,
+		Target:  entry.target,
+		Status:  entry.status,
+		Header:  entry.header,
+		Vary:    entry.vary,
+		Stored:  entry.stored,
+		Expires: entry.expires,
+	})
+	if err == nil {
+		_, err = f.Write(append(meta, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &diskWriter{file: f, offset: int64(len(meta) + 1)}, nil
+}
+
+func (d *diskWriter) Write(p []byte) (int, error) {
+	n, err := d.file.Write(p)
+	d.length += int64(n)
+	return n, err
+}
+
+// commit renames the finished file into place and adds the entry to the
+// disk tier
+func (d *diskWriter) commit(key string, entry *cacheEntry) {
+	tmp := d.file.Name()
+	err := d.file.Close()
+	final := strings.TrimSuffix(tmp, ".tmp")
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		log.Printf("Error writing cache file: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	entry.file, entry.offset, entry.length = final, d.offset, d.length
+	diskCache.add(key, entry)
+}
+
+// abort discards an unfinished file
+func (d *diskWriter) abort() {
+	d.file.Close()
+	os.Remove(d.file.Name())
+}
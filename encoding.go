@@ -0,0 +1,206 @@
+package argonproxy
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// -----------------------------
+// CONTENT CODINGS AND RECODING
+// -----------------------------
+
+// contentCoding compresses and decompresses one HTTP content coding
+type contentCoding struct {
+	minLevel, maxLevel, defaultLevel int
+
+	reader func(io.Reader) (io.ReadCloser, error)
+	writer func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+// contentCodings are the codings the proxy can decode and encode
+var contentCodings = map[string]contentCoding{
+	"gzip": {
+		minLevel: gzip.BestSpeed, maxLevel: gzip.BestCompression, defaultLevel: gzip.DefaultCompression,
+		reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) },
+	},
+	"br": {
+		minLevel: brotli.BestSpeed, maxLevel: brotli.BestCompression, defaultLevel: 4,
+		reader: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(brotli.NewReader(r)), nil },
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) { return brotli.NewWriterLevel(w, level), nil },
+	},
+	"zstd": {
+		minLevel: 1, maxLevel: 22, defaultLevel: 3,
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+// recodedResponses counts responses recoded for clients, by "from>to"
+var recodedResponses sync.Map
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		var pairs []string
+		recodedResponses.Range(func(key, _ any) bool {
+			pairs = append(pairs, key.(string))
+			return true
+		})
+		if len(pairs) == 0 {
+			return
+		}
+		sort.Strings(pairs)
+		fmt.Fprintf(w, "# HELP argon_proxy_response_recoded_total Upstream responses recoded to a content coding the client accepts.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_response_recoded_total counter\n")
+		for _, pair := range pairs {
+			from, to, _ := strings.Cut(pair, ">")
+			count, _ := recodedResponses.Load(pair)
+			fmt.Fprintf(w, "argon_proxy_response_recoded_total{from=%s,to=%s} %d\n", quoteLabel(from), quoteLabel(to), count.(*atomic.Uint64).Load())
+		}
+	})
+}
+
+// validateUpstreamEncodings checks the codings listed in -upstream-accept-encoding
+func validateUpstreamEncodings() error {
+	for _, coding := range splitList(*upstreamAcceptEncoding) {
+		if _, ok := contentCodings[strings.ToLower(coding)]; !ok {
+			return fmt.Errorf("--upstream-accept-encoding: unsupported coding %q, expected zstd, br or gzip", coding)
+		}
+	}
+	return nil
+}
+
+// acceptsCoding reports whether an Accept-Encoding header allows a coding,
+// honouring q=0 and "*"
+func acceptsCoding(header, coding string) bool {
+	exact, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64)
+		}
+		switch name {
+		case coding:
+			exact = q
+		case "*":
+			wildcard = q
+		}
+	}
+	return exact > 0 || (exact < 0 && wildcard > 0)
+}
+
+// setUpstreamAcceptEncoding asks upstreams for the codings of
+// -upstream-accept-encoding instead of the client's own list
+func setUpstreamAcceptEncoding(proxyReq *http.Request) {
+	if *upstreamAcceptEncoding == "" {
+		return
+	}
+	proxyReq.Header.Set("Accept-Encoding", strings.Join(splitList(*upstreamAcceptEncoding), ", "))
+}
+
+// recodes reports whether recodeResponse changes the coding of a complete
+// response with the given headers for the client
+func recodes(r *http.Request, header http.Header) bool {
+	from := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	_, known := contentCodings[from]
+	return *upstreamAcceptEncoding != "" && r.Method != "HEAD" && known && !acceptsCoding(r.Header.Get("Accept-Encoding"), from)
+}
+
+// recodeResponse decodes a response the client cannot read, because the
+// upstream used a coding only the proxy asked for, and re-encodes it in the
+// first -upstream-accept-encoding coding the client accepts, or sends it
+// uncompressed. Ranges and long-lived streams are left alone.
+func recodeResponse(r *http.Request, resp *http.Response) {
+	if *upstreamAcceptEncoding == "" || r.Method == "HEAD" || resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || isLongLivedStream(resp) {
+		return
+	}
+	from := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	accept := r.Header.Get("Accept-Encoding")
+	if from == "" || from == "identity" || acceptsCoding(accept, from) {
+		return
+	}
+	decoder, ok := contentCodings[from]
+	if !ok {
+		return
+	}
+	decoded, err := decoder.reader(resp.Body)
+	if err != nil {
+		log.Printf("Error decoding %s response: %v", from, err)
+		return
+	}
+
+	to := ""
+	for _, coding := range splitList(*upstreamAcceptEncoding) {
+		if coding = strings.ToLower(coding); acceptsCoding(accept, coding) {
+			to = coding
+			break
+		}
+	}
+
+	body := resp.Body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	counter, _ := recodedResponses.LoadOrStore(from+">"+cmp.Or(to, "identity"), new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+	if to == "" {
+		resp.Header.Del("Content-Encoding")
+		resp.Body = recodedBody{decoded, []io.Closer{decoded, body}}
+		return
+	}
+
+	encoder := contentCodings[to]
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := encoder.writer(pw, encoder.defaultLevel)
+		if err == nil {
+			_, err = copyBody(zw, decoded)
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		decoded.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Header.Set("Content-Encoding", to)
+	resp.Body = recodedBody{pr, []io.Closer{pr, body}}
+}
+
+// recodedBody reads a recoded response; closing it closes every stage down
+// to the upstream body, which stops a running encoder
+type recodedBody struct {
+	io.Reader
+	stages []io.Closer
+}
+
+// Close implements io.Closer
+func (b recodedBody) Close() error {
+	var err error
+	for _, stage := range b.stages {
+		err = stage.Close()
+	}
+	return err
+}
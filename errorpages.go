@@ -0,0 +1,115 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// -----------------------------
+// CUSTOM ERROR PAGES
+// -----------------------------
+
+// errorTemplate is the subset of text/template and html/template we render with
+type errorTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// errorPage is a parsed error page template and the content type it renders
+type errorPage struct {
+	tmpl        errorTemplate
+	contentType string
+}
+
+// errorPageData is the data available to error page templates
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Target     string
+	Route      string
+}
+
+// loadErrorPages parses the route's error page templates; relative paths are
+// resolved against the directory of the config file
+func (rt *Route) loadErrorPages(baseDir string) error {
+	rt.errorPages = make(map[string]*errorPage)
+	for key, file := range rt.ErrorPages {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("route %q: error page %s: %v", rt.Name, key, err)
+		}
+
+		page := &errorPage{contentType: getContentType(file)}
+		if path.Ext(file) == ".html" || path.Ext(file) == ".htm" {
+			page.tmpl, err = htmltemplate.New(key).Parse(string(content))
+		} else {
+			page.tmpl, err = template.New(key).Funcs(template.FuncMap{"json": jsonValue}).Parse(string(content))
+		}
+		if err != nil {
+			return fmt.Errorf("route %q: error page %s: %v", rt.Name, key, err)
+		}
+		rt.errorPages[key] = page
+	}
+	return nil
+}
+
+// jsonValue encodes a value for use inside JSON error page templates
+func jsonValue(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// errorPageFor picks the page for an exact status, its class (e.g. "5xx"), or "default"
+func (rt *Route) errorPageFor(status int) *errorPage {
+	for _, key := range []string{strconv.Itoa(status), fmt.Sprintf("%dxx", status/100), "default"} {
+		if page, ok := rt.errorPages[key]; ok {
+			return page
+		}
+	}
+	return nil
+}
+
+// proxyError responds with the route's custom error page, or plain text if none is configured
+func proxyError(w http.ResponseWriter, r *http.Request, status int, message string, target string) {
+	rt := routeFor(r)
+	page := rt.errorPageFor(status)
+	if page == nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  requestID(r),
+		Target:     target,
+		Route:      rt.Name,
+	}
+
+	body := getBuffer()
+	defer putBuffer(body)
+	if err := page.tmpl.Execute(body, data); err != nil {
+		log.Printf("Error rendering error page for route %s: %v", rt.Name, err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,226 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// EXTERNAL AUTHORIZATION
+// -----------------------------
+
+// authzCheck describes a proxy request to the authorization service
+type authzCheck struct {
+	Method   string            `json:"method"`
+	Target   string            `json:"target"`
+	Route    string            `json:"route"`
+	Origin   string            `json:"origin,omitempty"`
+	ClientIP string            `json:"client_ip"`
+	Identity string            `json:"identity,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// authzDecision is a policy's answer. From the authorization service, a 2xx
+// response allows the request and may add headers to the upstream request;
+// any other status denies it and is relayed to the client with the reason.
+type authzDecision struct {
+	Allow   bool              `json:"allow"`
+	Status  int               `json:"status,omitempty"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// authzResults counts authorization checks by outcome
+var authzResults struct {
+	allowed, denied, cached, failed atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if *extAuthzURL == "" {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_ext_authz_total External authorization checks by outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_ext_authz_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_ext_authz_total{result=\"allowed\"} %d\n", authzResults.allowed.Load())
+		fmt.Fprintf(w, "argon_proxy_ext_authz_total{result=\"denied\"} %d\n", authzResults.denied.Load())
+		fmt.Fprintf(w, "argon_proxy_ext_authz_total{result=\"cached\"} %d\n", authzResults.cached.Load())
+		fmt.Fprintf(w, "argon_proxy_ext_authz_total{result=\"failed\"} %d\n", authzResults.failed.Load())
+	})
+}
+
+type authzContextKey struct{}
+
+// authzSource is a policy consulted before a request is proxied
+type authzSource struct {
+	name     string
+	decide   func(ctx context.Context, r *http.Request, check authzCheck) (authzDecision, error)
+	failOpen func() bool
+}
+
+// authzSources are consulted in order; the first denial wins
+var authzSources []authzSource
+
+// authorizeRequest asks the configured policies whether the request may
+// reach target, answering the client itself when it may not. Headers the
+// policies add are kept on the request for applyAuthzHeaders.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, target string) (*http.Request, bool) {
+	if len(authzSources) == 0 {
+		return r, true
+	}
+	check := authzCheck{
+		Method:   r.Method,
+		Target:   target,
+		Route:    routeFor(r).Name,
+		Origin:   r.Header.Get("Origin"),
+		ClientIP: getClientIP(r),
+		Identity: identityFor(r),
+	}
+
+	var headers map[string]string
+	for _, source := range authzSources {
+		decision, err := source.decide(r.Context(), r, check)
+		if err != nil {
+			log.Printf("Authorization by %s failed for %s: %v", source.name, target, err)
+			if source.failOpen() {
+				continue
+			}
+			addCORSHeaders(w, r)
+			proxyError(w, r, http.StatusServiceUnavailable, "Authorization service unavailable", target)
+			return r, false
+		}
+		if !decision.Allow {
+			reason := decision.Reason
+			if reason == "" {
+				reason = "Request denied by policy"
+			}
+			addCORSHeaders(w, r)
+			proxyError(w, r, decision.Status, reason, target)
+			return r, false
+		}
+		for name, value := range decision.Headers {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[name] = value
+		}
+	}
+	if headers == nil {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), authzContextKey{}, headers)), true
+}
+
+// startExtAuthz adds the external authorization service to the policies
+func startExtAuthz() {
+	if *extAuthzURL == "" {
+		return
+	}
+	authzSources = append(authzSources, authzSource{"ext-authz", checkExtAuthz, func() bool { return *extAuthzFailOpen }})
+}
+
+// checkExtAuthz asks the external authorization service about a request.
+// Decisions are cached in the store for --ext-authz-cache, or for the
+// max-age the service returns.
+func checkExtAuthz(ctx context.Context, r *http.Request, check authzCheck) (authzDecision, error) {
+	for _, name := range strings.Split(*extAuthzHeaders, ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if value := r.Header.Get(name); name != "" && value != "" {
+			if check.Headers == nil {
+				check.Headers = make(map[string]string)
+			}
+			check.Headers[name] = value
+		}
+	}
+	payload, _ := json.Marshal(check)
+	sum := sha256.Sum256(payload)
+	key := "authz:" + hex.EncodeToString(sum[:])
+
+	var decision authzDecision
+	if cached, ok, err := store.Get(key); err == nil && ok && json.Unmarshal(cached, &decision) == nil {
+		authzResults.cached.Add(1)
+		return decision, nil
+	}
+	decision, ttl, err := askAuthz(ctx, payload)
+	if err != nil {
+		authzResults.failed.Add(1)
+		return decision, err
+	}
+	if decision.Allow {
+		authzResults.allowed.Add(1)
+	} else {
+		authzResults.denied.Add(1)
+	}
+	if ttl > 0 {
+		data, _ := json.Marshal(decision)
+		if err := store.Set(key, data, ttl); err != nil && *verbose {
+			log.Printf("Error caching authorization decision: %v", err)
+		}
+	}
+	return decision, nil
+}
+
+// askAuthz posts a check to the authorization service and returns its
+// decision and how long it may be cached
+func askAuthz(ctx context.Context, payload []byte) (authzDecision, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, *extAuthzTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", *extAuthzURL, bytes.NewReader(payload))
+	if err != nil {
+		return authzDecision{}, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return authzDecision{}, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return authzDecision{}, 0, fmt.Errorf("authorization service returned %s", resp.Status)
+	}
+
+	// The body is optional; a bare status is a complete answer
+	var decision authzDecision
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &decision) != nil {
+		return authzDecision{}, 0, fmt.Errorf("authorization service returned invalid JSON")
+	}
+	decision.Allow = resp.StatusCode >= 200 && resp.StatusCode <= 299
+	decision.Status = resp.StatusCode
+	if !decision.Allow && resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusTooManyRequests {
+		decision.Status = http.StatusForbidden
+	}
+
+	ttl := *extAuthzCache
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			ttl = 0
+		} else if v, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(v); err == nil {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return decision, ttl, nil
+}
+
+// applyAuthzHeaders adds the headers the policies asked for
+func applyAuthzHeaders(r *http.Request, proxyReq *http.Request) {
+	headers, _ := r.Context().Value(authzContextKey{}).(map[string]string)
+	for name, value := range headers {
+		proxyReq.Header.Set(name, value)
+	}
+}
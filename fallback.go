@@ -0,0 +1,135 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------
+// UPSTREAM FALLBACKS
+// -----------------------------
+
+// fallbackHeader tells clients a response came from the route's fallback
+const fallbackHeader = "X-Argon-Fallback"
+
+// upstreamFallback is served to GET and HEAD requests when a route's upstream
+// cannot be reached or times out, so pages degrade instead of failing
+type upstreamFallback struct {
+	Target      string `json:"target,omitempty"`       // URL fetched instead of the failed upstream
+	Body        string `json:"body,omitempty"`         // served when there is no target or it fails too
+	ContentType string `json:"content_type,omitempty"` // of body; default JSON when body is JSON, else text
+	Status      int    `json:"status,omitempty"`       // of body; default 200
+	On5xx       bool   `json:"on_5xx,omitempty"`       // also replace 5xx responses
+}
+
+// prepare checks a route's fallback and fills in defaults
+func (f *upstreamFallback) prepare(routeName string) error {
+	if f.Target == "" && f.Body == "" {
+		return fmt.Errorf("route %q: fallback needs a target or a body", routeName)
+	}
+	if f.Target != "" {
+		u, err := url.Parse(f.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("route %q: fallback target must be an http or https URL", routeName)
+		}
+	}
+	if f.Status == 0 {
+		f.Status = http.StatusOK
+	}
+	if f.Status < 200 || f.Status > 599 {
+		return fmt.Errorf("route %q: invalid fallback status %d", routeName, f.Status)
+	}
+	if f.ContentType == "" {
+		f.ContentType = "text/plain; charset=utf-8"
+		if json.Valid([]byte(f.Body)) {
+			f.ContentType = "application/json"
+		}
+	}
+	return nil
+}
+
+// fallbackFor5xx reports whether a response should be replaced by the
+// route's fallback
+func fallbackFor5xx(r *http.Request, resp *http.Response) bool {
+	f := routeFor(r).Fallback
+	return f != nil && f.On5xx && resp.StatusCode >= 500
+}
+
+// serveFallback answers a request whose upstream failed with the route's
+// fallback target or body. It reports false when the route has no fallback
+// for the request, which then gets the usual error.
+func serveFallback(w http.ResponseWriter, r *http.Request, cause string) bool {
+	f := routeFor(r).Fallback
+	if f == nil || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+
+	if f.Target != "" {
+		resp, cancel, err := fetchFallback(r, f.Target)
+		if err == nil && resp.StatusCode < 500 {
+			defer cancel()
+			defer resp.Body.Close()
+			log.Printf("Serving fallback %s for %s: %s", f.Target, r.URL.RequestURI(), cause)
+			resp.Header.Set(fallbackHeader, "target")
+			writeFallback(w, r, resp)
+			return true
+		}
+		if err == nil {
+			resp.Body.Close()
+			cancel()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Fallback %s failed too: %v", f.Target, err)
+		if f.Body == "" {
+			return false
+		}
+	}
+
+	log.Printf("Serving fallback body for %s: %s", r.URL.RequestURI(), cause)
+	writeFallback(w, r, &http.Response{
+		StatusCode: f.Status,
+		Header: http.Header{
+			"Content-Type":   {f.ContentType},
+			"Content-Length": {strconv.Itoa(len(f.Body))},
+			fallbackHeader:   {"body"},
+		},
+		ContentLength: int64(len(f.Body)),
+		Body:          io.NopCloser(strings.NewReader(f.Body)),
+	})
+	return true
+}
+
+// fetchFallback requests the fallback target within --upstream-timeout.
+// cancel must be called once the response is done.
+func fetchFallback(r *http.Request, target string) (*http.Response, func(), error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req, timer, cancel := withUpstreamTimeout(req)
+	resp, err := routeFor(r).upstreamClient().Do(req)
+	timer.stop()
+	if timer.timedOut() && err != nil {
+		err = fmt.Errorf("no response within %s", *upstreamTimeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// writeFallback relays a fallback response like an upstream one
+func writeFallback(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	w.Header().Add("Access-Control-Expose-Headers", fallbackHeader)
+	processProxyResponse(w, r, resp)
+}
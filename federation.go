@@ -0,0 +1,145 @@
+package argonproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// PROXY CHAINING
+// -----------------------------
+
+// Headers an edge instance adds when it forwards through another instance
+const (
+	federationHeaderPrefix = "X-Argon-Federation-"
+	federationClient       = federationHeaderPrefix + "Client"
+	federationIdentity     = federationHeaderPrefix + "Identity"
+	federationTimestamp    = federationHeaderPrefix + "Timestamp"
+	federationSignature    = federationHeaderPrefix + "Signature"
+)
+
+// federationMaxSkew is how far a signed timestamp may be from the clock
+const federationMaxSkew = 5 * time.Minute
+
+// proxyChain sends a route's requests through another Argon-Proxy instance
+// instead of straight to the target
+type proxyChain struct {
+	URL    string `json:"url"`    // base URL of the next instance
+	Secret string `json:"secret"` // its --federation-secret; may reference Vault
+
+	url *url.URL
+}
+
+// federatedContext is what a verified upstream instance vouched for
+type federatedContext struct {
+	client, identity string
+}
+
+type federatedContextKey struct{}
+
+// prepare checks the chain settings
+func (c *proxyChain) prepare(routeName string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("route %q: chain url must be an http(s) base URL", routeName)
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("route %q: chain secret is required", routeName)
+	}
+	c.url = u
+	return nil
+}
+
+// signFederation computes the signature binding the forwarded client and
+// identity to one request
+func signFederation(secret, timestamp, client, identity, id, method, target string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{timestamp, client, identity, id, method, target}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chainUpstreamRequest points an upstream request of a chained route at the
+// next instance, with the target in its query and signed headers carrying
+// the original client
+func chainUpstreamRequest(r *http.Request, proxyReq *http.Request) error {
+	c := routeFor(r).Chain
+	if c == nil {
+		return nil
+	}
+	secret, err := expandSecrets(c.Secret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUpstreamCredentials, err)
+	}
+
+	target := *proxyReq.URL
+	target.Fragment, target.RawFragment = "", ""
+	next := *c.url
+	next.Path = strings.TrimSuffix(next.Path, "/") + "/proxy/"
+	next.RawPath = ""
+	next.RawQuery = "target=" + url.QueryEscape(target.String())
+	proxyReq.URL = &next
+	proxyReq.Host = next.Host
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	client, identity, id := getClientIP(r), identityFor(r), requestID(r)
+	proxyReq.Header.Set(federationClient, client)
+	proxyReq.Header.Set(federationIdentity, identity)
+	proxyReq.Header.Set("X-Request-ID", id) // the next instance logs the same ID
+	proxyReq.Header.Set(federationTimestamp, timestamp)
+	proxyReq.Header.Set(federationSignature, signFederation(secret, timestamp, client, identity, id, proxyReq.Method, target.String()))
+	return nil
+}
+
+// acceptFederation trusts the client and identity forwarded by another
+// instance when their signature matches a --federation-secret. Requests
+// without a signature are handled as usual; a bad signature gets 401.
+func acceptFederation(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	signature := r.Header.Get(federationSignature)
+	if signature == "" || *federationSecret == "" {
+		return r, true
+	}
+	target, _ := parseTargetURL(r)
+
+	timestamp := r.Header.Get(federationTimestamp)
+	client, identity := r.Header.Get(federationClient), r.Header.Get(federationIdentity)
+	valid := false
+	if unix, err := strconv.ParseInt(timestamp, 10, 64); err == nil && time.Since(time.Unix(unix, 0)).Abs() <= federationMaxSkew {
+		for _, secret := range splitList(*federationSecret) {
+			expected := signFederation(secret, timestamp, client, identity, r.Header.Get("X-Request-ID"), r.Method, target)
+			if hmac.Equal([]byte(expected), []byte(signature)) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		addCORSHeaders(w, r)
+		proxyError(w, r, http.StatusUnauthorized, "Invalid federation signature", target)
+		return r, false
+	}
+	if routeFor(r).Chain != nil {
+		proxyError(w, r, http.StatusLoopDetected, "Federated request would be chained again", target)
+		return r, false
+	}
+
+	ctx := context.WithValue(r.Context(), federatedContextKey{}, &federatedContext{client: client, identity: identity})
+	if identity != "" {
+		ctx = context.WithValue(ctx, identityContextKey{}, identity)
+	}
+	noteAccess(r, func(rec *accessRecord) { rec.ClientIP, rec.Identity = client, identity })
+	return r.WithContext(ctx), true
+}
+
+// federated returns what the instance that forwarded the request vouched
+// for, or nil when it came from a client
+func federated(r *http.Request) *federatedContext {
+	f, _ := r.Context().Value(federatedContextKey{}).(*federatedContext)
+	return f
+}
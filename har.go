@@ -0,0 +1,253 @@
+package argonproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// HAR CAPTURE
+// -----------------------------
+
+// harCapture collects exchanges for an admin-triggered, time-bounded window
+type harCapture struct {
+	mu         sync.Mutex
+	until      time.Time
+	maxEntries int
+	entries    []*exchange
+}
+
+var har = &harCapture{}
+
+func init() {
+	registerRecorder(har.active, har.add)
+}
+
+// active reports whether a capture window is open and has room left
+func (h *harCapture) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().Before(h.until) && len(h.entries) < h.maxEntries
+}
+
+// add stores an exchange while the capture window is open
+func (h *harCapture) add(ex *exchange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < h.maxEntries {
+		h.entries = append(h.entries, ex)
+	}
+}
+
+// handleAdminHAR serves POST /admin/har/start, POST /admin/har/stop and GET /admin/har
+func handleAdminHAR(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/admin/har/start" && r.Method == "POST":
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || duration <= 0 {
+			duration = 5 * time.Minute
+		}
+		if duration > *harMaxDuration {
+			duration = *harMaxDuration
+		}
+		maxEntries, err := strconv.Atoi(r.URL.Query().Get("max"))
+		if err != nil || maxEntries <= 0 {
+			maxEntries = 1000
+		}
+
+		har.mu.Lock()
+		har.entries = nil
+		har.until = time.Now().Add(duration)
+		har.maxEntries = maxEntries
+		har.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]any{"capturing_until": har.until, "max_entries": maxEntries})
+
+	case r.URL.Path == "/admin/har/stop" && r.Method == "POST":
+		har.mu.Lock()
+		har.until = time.Time{}
+		count := len(har.entries)
+		har.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"entries": count})
+
+	case r.URL.Path == "/admin/har" && r.Method == "GET":
+		har.mu.Lock()
+		entries := append([]*exchange(nil), har.entries...)
+		har.mu.Unlock()
+
+		redact := r.URL.Query().Get("redact") != "false"
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="argon-proxy-%s.har"`, time.Now().UTC().Format("20060102-150405")))
+		writeJSON(w, http.StatusOK, buildHAR(entries, redact))
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// HAR 1.2 document structure (http://www.softwareishard.com/blog/har-12-spec/)
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// buildHAR converts captured exchanges into a HAR document
+func buildHAR(entries []*exchange, redact bool) harLog {
+	doc := harLog{Log: harLogBody{
+		Version: "1.2",
+		Creator: harCreator{Name: "argon-proxy", Version: version},
+		Entries: []harEntry{},
+	}}
+
+	for _, ex := range entries {
+		reqHeader, respHeader := ex.RequestHeader, ex.ResponseHeader
+		if redact {
+			reqHeader, respHeader = redactHeaders(reqHeader), redactHeaders(respHeader)
+		}
+
+		entry := harEntry{
+			StartedDateTime: ex.Started.UTC().Format(time.RFC3339Nano),
+			Time:            float64(ex.Duration.Microseconds()) / 1000,
+			Request: harRequest{
+				Method:      ex.Method,
+				URL:         ex.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(reqHeader),
+				QueryString: harQuery(ex.URL),
+				HeadersSize: -1,
+				BodySize:    len(ex.RequestBody),
+			},
+			Response: harResponse{
+				Status:      ex.Status,
+				StatusText:  http.StatusText(ex.Status),
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(respHeader),
+				Content:     harBody(ex.ResponseBody, respHeader.Get("Content-Type")),
+				RedirectURL: respHeader.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    len(ex.ResponseBody),
+			},
+			Timings: harTimings{Wait: float64(ex.Duration.Microseconds()) / 1000},
+		}
+		if len(ex.RequestBody) > 0 {
+			entry.Request.PostData = &harPostData{MimeType: reqHeader.Get("Content-Type"), Text: string(ex.RequestBody)}
+		}
+		if ex.Error != "" {
+			entry.Comment = "upstream error: " + ex.Error
+		} else if ex.RequestTruncated || ex.ResponseTruncated {
+			entry.Comment = "body truncated at capture limit"
+		}
+		doc.Log.Entries = append(doc.Log.Entries, entry)
+	}
+	return doc
+}
+
+// harHeaders flattens headers into HAR name/value pairs
+func harHeaders(h http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			list = append(list, harNameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+// harQuery lists the query parameters of a URL
+func harQuery(rawURL string) []harNameValue {
+	list := []harNameValue{}
+	if u, err := url.Parse(rawURL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				list = append(list, harNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	return list
+}
+
+// harBody stores a body as text, or base64 when it is not valid UTF-8
+func harBody(body []byte, mimeType string) harContent {
+	content := harContent{Size: len(body), MimeType: mimeType}
+	if utf8.Valid(body) {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	return content
+}
@@ -0,0 +1,93 @@
+package argonproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// -----------------------------
+// HEALTH CHECKS
+// -----------------------------
+
+// processStarted is when the proxy started, for the reported uptime
+var processStarted = time.Now()
+
+// healthStatus is the body of /healthz and /readyz
+type healthStatus struct {
+	Status        string            `json:"status"`
+	Version       string            `json:"version"`
+	Instance      string            `json:"instance"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	Checks        map[string]string `json:"checks,omitempty"` // readiness checks and their results
+}
+
+// newHealthStatus fills in what every health response reports
+func newHealthStatus() healthStatus {
+	return healthStatus{
+		Status:        "ok",
+		Version:       version,
+		Instance:      instanceName,
+		UptimeSeconds: int64(time.Since(processStarted).Seconds()),
+	}
+}
+
+// handleHealthz is the liveness check: the process is up and serving
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, newHealthStatus())
+}
+
+// handleReadyz is the readiness check: the store answers and, with
+// --ready-probe, so does the probe URL. It answers 503 if either fails.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := newHealthStatus()
+	status.Checks = map[string]string{"store": "ok"}
+	if _, _, err := store.Get("readyz"); err != nil {
+		status.Checks["store"] = err.Error()
+		status.Status = "unavailable"
+	}
+	if *readyProbe != "" {
+		status.Checks["probe"] = "ok"
+		if err := probeReady(r.Context()); err != nil {
+			status.Checks["probe"] = err.Error()
+			status.Status = "unavailable"
+		}
+	}
+
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, status)
+}
+
+// probeReady requests --ready-probe, which must answer without a 5xx status
+// within --ready-probe-timeout
+func probeReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, *readyProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", *readyProbe, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: upstream}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
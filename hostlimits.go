@@ -0,0 +1,199 @@
+package argonproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// UPSTREAM HOST LIMITS
+// -----------------------------
+
+// hostLimits protects the hosts of an upstream_hosts entry from more traffic
+// than they take. Requests over a limit wait up to queue_timeout for their
+// turn and are otherwise answered 503. The limits are shared by every host
+// the entry matches.
+type hostLimits struct {
+	MaxRPS        float64 `json:"max_rps,omitempty"`        // requests per second sent upstream
+	MaxConcurrent int     `json:"max_concurrent,omitempty"` // requests in flight at once
+	QueueTimeout  string  `json:"queue_timeout,omitempty"`  // how long excess requests wait; default 0 answers 503 at once
+
+	queueTimeout time.Duration
+	slots        chan struct{} // one per request in flight; nil when concurrency is unlimited
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+
+	queued   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// errUpstreamBusy is returned when an upstream is at its limits
+var errUpstreamBusy = errors.New("upstream busy")
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		var limited []*upstreamHost
+		for _, h := range activeRoutes.Load().upstreamHosts {
+			if h.limited() {
+				limited = append(limited, h)
+			}
+		}
+		if len(limited) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_upstream_in_flight Requests in flight to an upstream_hosts entry with max_concurrent.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_upstream_in_flight gauge\n")
+		for _, h := range limited {
+			if h.slots != nil {
+				fmt.Fprintf(w, "argon_proxy_upstream_in_flight{hosts=%s} %d\n", quoteLabel(strings.Join(h.Hosts, ",")), len(h.slots))
+			}
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_upstream_limited_total Requests over an upstream_hosts entry's limits, by outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_upstream_limited_total counter\n")
+		for _, h := range limited {
+			hosts := quoteLabel(strings.Join(h.Hosts, ","))
+			fmt.Fprintf(w, "argon_proxy_upstream_limited_total{hosts=%s,action=\"queued\"} %d\n", hosts, h.queued.Load())
+			fmt.Fprintf(w, "argon_proxy_upstream_limited_total{hosts=%s,action=\"rejected\"} %d\n", hosts, h.rejected.Load())
+		}
+	})
+}
+
+// prepareLimits checks the limits and sets up their state
+func (l *hostLimits) prepareLimits() error {
+	if l.MaxRPS < 0 || l.MaxConcurrent < 0 {
+		return errors.New("max_rps and max_concurrent must not be negative")
+	}
+	l.queueTimeout = 0
+	if l.QueueTimeout != "" {
+		d, err := time.ParseDuration(l.QueueTimeout)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid queue_timeout %q", l.QueueTimeout)
+		}
+		l.queueTimeout = d
+	}
+	l.slots = nil
+	if l.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+	l.tokens, l.updated = l.burst(), time.Now()
+	return nil
+}
+
+// limited reports whether the entry sets any limit
+func (l *hostLimits) limited() bool {
+	return l.MaxRPS > 0 || l.MaxConcurrent > 0
+}
+
+// burst is how many requests may go out at once after a quiet spell
+func (l *hostLimits) burst() float64 {
+	return math.Max(1, math.Ceil(l.MaxRPS))
+}
+
+// acquire waits for the upstream to take another request. On
+// errUpstreamBusy, retryAfter is when the client may try again.
+func (l *hostLimits) acquire(ctx context.Context) (release func(), retryAfter time.Duration, err error) {
+	if l.MaxRPS > 0 {
+		if retryAfter, err := l.takeToken(ctx); err != nil {
+			return nil, retryAfter, err
+		}
+	}
+	if l.slots == nil {
+		return func() {}, 0, nil
+	}
+	release = func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, 0, nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		l.rejected.Add(1)
+		return nil, time.Second, errUpstreamBusy
+	}
+	l.queued.Add(1)
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, 0, nil
+	case <-timer.C:
+		l.rejected.Add(1)
+		return nil, time.Second, errUpstreamBusy
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// takeToken spends one of max_rps' tokens, waiting for it when it comes
+// within queue_timeout
+func (l *hostLimits) takeToken(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	l.tokens = math.Min(l.burst(), l.tokens+now.Sub(l.updated).Seconds()*l.MaxRPS)
+	l.updated = now
+	var wait time.Duration
+	if l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.MaxRPS * float64(time.Second))
+	}
+	if wait > l.queueTimeout {
+		l.mu.Unlock()
+		l.rejected.Add(1)
+		return wait, errUpstreamBusy
+	}
+	// Tokens go negative while requests queue, lining them up
+	l.tokens--
+	l.mu.Unlock()
+	if wait == 0 {
+		return 0, nil
+	}
+
+	l.queued.Add(1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return 0, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// limitUpstream holds a request until its target host's upstream_hosts
+// limits let it through. When they do not, the client gets 503 with
+// Retry-After and ok is false. release must be called once the upstream
+// exchange is over.
+func limitUpstream(w http.ResponseWriter, r *http.Request, proxyReq *http.Request, finalURL string) (release func(), ok bool) {
+	h := upstreamHostFor(proxyReq.URL.Hostname())
+	if h == nil || !h.limited() {
+		return func() {}, true
+	}
+	release, retryAfter, err := h.acquire(r.Context())
+	if err == nil {
+		return release, true
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		log.Printf("Upstream %s is at its limits, refusing %s %s", proxyReq.URL.Host, r.Method, r.URL.RequestURI())
+		addCORSHeaders(w, r)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		proxyError(w, r, http.StatusServiceUnavailable, "Upstream is busy, try again later", finalURL)
+		return nil, false
+	}
+	http.Error(w, "Client closed request", statusClientClosed)
+	return nil, false
+}
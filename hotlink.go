@@ -0,0 +1,95 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// HOTLINK PROTECTION
+// -----------------------------
+
+// hotlinkBlocked counts media responses refused to other sites
+var hotlinkBlocked atomic.Uint64
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		table := activeRoutes.Load()
+		enabled := len(table.fallback.HotlinkOrigins) > 0
+		for _, rt := range table.routes {
+			enabled = enabled || len(rt.HotlinkOrigins) > 0
+		}
+		if !enabled {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_hotlink_blocked_total Media responses refused to pages of other sites.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_hotlink_blocked_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_hotlink_blocked_total %d\n", hotlinkBlocked.Load())
+	})
+}
+
+// requestOrigin returns the Origin of a request, or the origin of its Referer
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return strings.ToLower(origin)
+	}
+	u, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// originMatches compares an origin against an exact or "https://*.example.com" pattern
+func originMatches(pattern, origin string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+	if prefix, suffix, ok := strings.Cut(pattern, "*."); ok {
+		return strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+suffix)
+	}
+	return pattern == origin
+}
+
+// checkHotlink refuses a media response to a page whose origin is not in the
+// route's hotlink_origins, so other sites cannot embed it through the proxy.
+// The upstream body is closed unread.
+func checkHotlink(w http.ResponseWriter, r *http.Request, resp *http.Response, target string) bool {
+	rt := routeFor(r)
+	if len(rt.HotlinkOrigins) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	matched := false
+	for _, pattern := range splitList(*hotlinkTypes) {
+		if mediaTypeMatches(pattern, mediaType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return true
+	}
+
+	origin := requestOrigin(r)
+	if origin == "" && *hotlinkAllowEmpty {
+		return true
+	}
+	for _, pattern := range rt.HotlinkOrigins {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+
+	if reportOnly(r, "hotlink", fmt.Sprintf("media embedded by %q", origin)) {
+		return true
+	}
+	hotlinkBlocked.Add(1)
+	resp.Body.Close()
+	addCORSHeaders(w, r)
+	proxyError(w, r, http.StatusForbidden, "Media may only be embedded by allowed sites", target)
+	return false
+}
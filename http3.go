@@ -0,0 +1,227 @@
+package argonproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// -----------------------------
+// HTTP/3 UPSTREAMS
+// -----------------------------
+
+// upstreamTransport sends requests over HTTP/3 to hosts that are forced with
+// -http3-hosts or that advertised h3 through Alt-Svc, and over TCP otherwise
+type upstreamTransport struct {
+	tcp       http.RoundTripper
+	h3        *http3.Transport
+	tlsConfig *tls.Config
+
+	// host is set on the transports of upstream_hosts entries, which perHost
+	// holds for the transport they were derived from
+	host    *upstreamHost
+	perHost sync.Map
+
+	mu     sync.Mutex
+	altSvc map[string]time.Time // host:port -> h3 advertisement expiry
+}
+
+// upstream is the transport used by routes without their own TLS settings,
+// built by configureUpstreamTLS once the flags are parsed
+var upstream *upstreamTransport
+
+// newDefaultUpstream creates the shared transport, checking TLS like route transports
+func newDefaultUpstream() *upstreamTransport {
+	tcp := newTCPTransport(upstreamTLSConfig())
+	return newUpstreamTransport(tcp, tcp.TLSClientConfig)
+}
+
+// newUpstreamTransport creates a transport using tlsConfig for HTTP/3 connections
+func newUpstreamTransport(tcp http.RoundTripper, tlsConfig *tls.Config) *upstreamTransport {
+	return &upstreamTransport{
+		tcp:       tcp,
+		h3:        &http3.Transport{TLSClientConfig: tlsConfig, Dial: dialQUIC},
+		tlsConfig: tlsConfig,
+		altSvc:    make(map[string]time.Time),
+	}
+}
+
+// forHost returns the transport applying an upstream_hosts entry's settings
+// on top of this transport's
+func (t *upstreamTransport) forHost(h *upstreamHost) *upstreamTransport {
+	if derived, ok := t.perHost.Load(h); ok {
+		return derived.(*upstreamTransport)
+	}
+	tcp := t.tcp.(*http.Transport).Clone()
+	h.apply(tcp.TLSClientConfig)
+	derived := newUpstreamTransport(tcp, tcp.TLSClientConfig)
+	derived.host = h
+	if h.Address != "" {
+		tcp.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialUpstream(ctx, network, h.dialAddress(addr))
+		}
+		derived.h3.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return dialQUIC(ctx, h.dialAddress(addr), tlsCfg, cfg)
+		}
+	}
+	actual, _ := t.perHost.LoadOrStore(h, derived)
+	return actual.(*upstreamTransport)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host == nil {
+		if h := upstreamHostFor(req.URL.Hostname()); h != nil {
+			return t.forHost(h).RoundTrip(req)
+		}
+	}
+	// WebSocket handshakes need an HTTP/1.1 connection to take over
+	if req.URL.Scheme != "https" || req.Header.Get("Upgrade") != "" {
+		return t.tcp.RoundTrip(req)
+	}
+
+	key := altSvcKey(req.URL.Hostname(), req.URL.Port())
+	if http3Forced(req.URL.Hostname()) {
+		return t.h3.RoundTrip(req)
+	}
+
+	if t.learned(key) {
+		resp, err := t.h3.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		// Stop using HTTP/3 for the host and retry over TCP if the body allows it
+		t.forget(key)
+		if *verbose {
+			log.Printf("HTTP/3 request to %s failed, falling back to TCP: %v", req.URL.Host, err)
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			return nil, err
+		}
+	}
+
+	resp, err := t.tcp.RoundTrip(req)
+	if err == nil && *http3AltSvc {
+		t.learn(key, req.URL.Port(), resp.Header.Get("Alt-Svc"))
+	}
+	return resp, err
+}
+
+// http3Forced reports whether the host is listed in -http3-hosts
+func http3Forced(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range splitList(*http3Hosts) {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// altSvcKey identifies an upstream origin by host and port
+func altSvcKey(host, port string) string {
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// learned reports whether the origin currently advertises HTTP/3
+func (t *upstreamTransport) learned(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expires, ok := t.altSvc[key]
+	if ok && time.Now().After(expires) {
+		delete(t.altSvc, key)
+		return false
+	}
+	return ok
+}
+
+// forget stops using HTTP/3 for the origin
+func (t *upstreamTransport) forget(key string) {
+	t.mu.Lock()
+	delete(t.altSvc, key)
+	t.mu.Unlock()
+}
+
+// learn records an h3 advertisement from an Alt-Svc header. Only
+// alternatives on the same host and port are used.
+func (t *upstreamTransport) learn(key, port, header string) {
+	if header == "" {
+		return
+	}
+	if port == "" {
+		port = "443"
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if strings.TrimSpace(header) == "clear" {
+		delete(t.altSvc, key)
+		return
+	}
+
+	for _, alternative := range strings.Split(header, ",") {
+		params := strings.Split(alternative, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		authority = strings.Trim(authority, `"`)
+		if authority != ":"+port {
+			continue
+		}
+
+		maxAge := 24 * time.Hour
+		for _, param := range params[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "ma" {
+				if seconds, err := strconv.Atoi(value); err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+		if _, known := t.altSvc[key]; !known && *verbose {
+			log.Printf("Upstream %s advertises HTTP/3, using it for the next %s", key, maxAge)
+		}
+		t.altSvc[key] = time.Now().Add(maxAge)
+		return
+	}
+}
+
+// -----------------------------
+// HTTP/3 LISTENER
+// -----------------------------
+
+// startHTTP3 serves the handler over QUIC on the UDP port matching the TCP
+// listener and returns a handler that advertises it to TCP clients via Alt-Svc
+func startHTTP3(listenAddr string, handler http.Handler) http.Handler {
+	h3 := &http3.Server{Addr: listenAddr, Handler: handler}
+	go func() {
+		var err error
+		if cfg := serverTLSConfig(); cfg != nil {
+			h3.TLSConfig = http3.ConfigureTLSConfig(cfg)
+			err = h3.ListenAndServe()
+		} else {
+			err = h3.ListenAndServeTLS(*tlsCert, *tlsKey)
+		}
+		if err != nil {
+			log.Printf("HTTP/3 listener stopped: %v", err)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,162 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// -----------------------------
+// IDEMPOTENCY KEYS
+// -----------------------------
+
+// idempotentEntry is a request seen with an Idempotency-Key and, once it
+// completed, the response that is replayed to retries
+type idempotentEntry struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// idempotentMethods are the methods whose retries are deduplicated
+var idempotentMethods = map[string]bool{"POST": true, "PATCH": true}
+
+// idempotentWriter records the response relayed for a keyed request
+type idempotentWriter struct {
+	http.ResponseWriter
+	key         string
+	fingerprint string
+	status      int
+	body        *captureBuffer
+}
+
+// startIdempotent handles the Idempotency-Key of a request. It returns false
+// when the response was already written (a replay or a conflict), and a
+// writer that records the response when the request is new.
+func startIdempotent(w http.ResponseWriter, r *http.Request, target string) (*idempotentWriter, bool) {
+	requestKey := r.Header.Get("Idempotency-Key")
+	if *idempotencyWindow <= 0 || requestKey == "" || !idempotentMethods[r.Method] {
+		return nil, true
+	}
+
+	// The body is fingerprinted so a key reused for a different request is caught
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(*idempotencyBodyLimit)+1))
+	if bodyTooLarge(err) {
+		proxyError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", *maxBodySize), target)
+		return nil, false
+	}
+	if err != nil {
+		proxyError(w, r, http.StatusBadRequest, "Error reading request body", target)
+		return nil, false
+	}
+	if len(body) > *idempotencyBodyLimit {
+		r.Body = teeBody{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Keys are scoped to the caller: its identity, or its IP when anonymous,
+	// so callers sharing an address never get each other's responses
+	scope := sha256.Sum256([]byte(routeFor(r).Name + "\x00" + rateLimitKey(r) + "\x00" + r.Method + "\x00" + target + "\x00" + requestKey))
+	key := "idempotency:" + hex.EncodeToString(scope[:])
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	pending, _ := json.Marshal(idempotentEntry{Fingerprint: fingerprint})
+	added, err := store.Add(key, pending, *idempotencyWindow)
+	if err != nil {
+		log.Printf("Error storing Idempotency-Key: %v", err)
+		return nil, true
+	}
+	if !added {
+		var entry idempotentEntry
+		raw, ok, err := store.Get(key)
+		if err != nil || !ok || json.Unmarshal(raw, &entry) != nil {
+			return nil, true
+		}
+		switch {
+		case entry.Fingerprint != fingerprint:
+			proxyError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request", target)
+		case !entry.Done:
+			proxyError(w, r, http.StatusConflict, "A request with this Idempotency-Key is still in progress", target)
+		default:
+			if *verbose {
+				log.Printf("Replaying stored response for Idempotency-Key %q", requestKey)
+			}
+			for name, values := range entry.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.Status)
+			w.Write(entry.Body)
+		}
+		return nil, false
+	}
+
+	return &idempotentWriter{
+		ResponseWriter: w,
+		key:            key,
+		fingerprint:    fingerprint,
+		body:           &captureBuffer{limit: *idempotencyBodyLimit},
+	}, true
+}
+
+// WriteHeader implements http.ResponseWriter
+func (iw *idempotentWriter) WriteHeader(status int) {
+	if iw.status == 0 {
+		iw.status = status
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (iw *idempotentWriter) Write(p []byte) (int, error) {
+	if iw.status == 0 {
+		iw.status = http.StatusOK
+	}
+	iw.body.Write(p)
+	return iw.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through so streamed responses keep streaming
+func (iw *idempotentWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (iw *idempotentWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// finish stores the response for replay, or releases the key when the
+// request failed in a way a retry may fix
+func (iw *idempotentWriter) finish() {
+	if iw.status == 0 || iw.status >= 500 || iw.body.truncated {
+		if err := store.Delete(iw.key); err != nil {
+			log.Printf("Error releasing Idempotency-Key: %v", err)
+		}
+		return
+	}
+
+	header := iw.Header().Clone()
+	header.Del("X-Request-ID")
+	done, _ := json.Marshal(idempotentEntry{
+		Fingerprint: iw.fingerprint,
+		Done:        true,
+		Status:      iw.status,
+		Header:      header,
+		Body:        iw.body.buf.Bytes(),
+	})
+	if err := store.Set(iw.key, done, *idempotencyWindow); err != nil {
+		log.Printf("Error storing response for Idempotency-Key: %v", err)
+	}
+}
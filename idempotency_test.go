@@ -0,0 +1,52 @@
+package argonproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response %d", calls.Add(1))
+	}))
+	defer upstream.Close()
+	keys := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keys, []byte("alice:alicekey\nbob:bobkey\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewTestHandler("--idempotency-window=1m", "--auth=apikey", "--auth-file="+keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+
+	tests := []struct {
+		name, apiKey, remoteAddr, want string
+	}{
+		{"first request", "alicekey", "198.51.100.1:1000", "response 1"},
+		{"retry is replayed", "alicekey", "198.51.100.1:1001", "response 1"},
+		{"other caller behind the same address", "bobkey", "198.51.100.1:1002", "response 2"},
+		{"same caller from another address", "alicekey", "203.0.113.9:1000", "response 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/proxy/?target="+url.QueryEscape(upstream.URL+"/orders"), strings.NewReader(`{"item":1}`))
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("Idempotency-Key", "order-1")
+			req.Header.Set(apiKeyHeader, tt.apiKey)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package argonproxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// -----------------------------
+// INTERNATIONALIZED DOMAIN NAMES
+// -----------------------------
+
+// errInvalidIDN is returned for a Unicode target host that has no valid
+// punycode form
+var errInvalidIDN = errors.New("invalid internationalized domain name in target")
+
+// punycodeTarget converts a Unicode host in a decoded target to punycode,
+// which is what resolvers and upstreams expect in DNS lookups, the Host
+// header and SNI. The Unicode form is kept on the request's access record.
+func punycodeTarget(r *http.Request, target string) (string, error) {
+	rest := target
+	scheme := ""
+	if i := strings.Index(rest, "://"); i != -1 {
+		scheme, rest = rest[:i+3], rest[i+3:]
+	}
+	end := strings.IndexAny(rest, "/?#")
+	if end == -1 {
+		end = len(rest)
+	}
+	authority, tail := rest[:end], rest[end:]
+	userinfo := ""
+	if at := strings.LastIndex(authority, "@"); at != -1 {
+		userinfo, authority = authority[:at+1], authority[at+1:]
+	}
+	host, port := authority, ""
+	if colon := strings.LastIndex(authority, ":"); colon != -1 && !strings.HasPrefix(authority, "[") {
+		host, port = authority[:colon], authority[colon:]
+	}
+	if strings.HasPrefix(host, "[") {
+		return target, nil
+	}
+	if strings.Contains(host, "%") {
+		// Path targets arrive with the host still percent-encoded
+		unescaped, err := url.PathUnescape(host)
+		if err != nil {
+			return target, nil // left for the URL parser to reject
+		}
+		host = unescaped
+	}
+	if isASCII(host) {
+		return target, nil
+	}
+	if !utf8.ValidString(host) {
+		return "", errInvalidIDN
+	}
+
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", errInvalidIDN
+	}
+	if *verbose {
+		log.Printf("Target host %s converted to %s", host, ascii)
+	}
+	noteAccess(r, func(rec *accessRecord) { rec.TargetIDN = host })
+	return scheme + userinfo + ascii + port + tail, nil
+}
+
+// isASCII reports whether s has only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,211 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// IMMUTABLE URLS
+// -----------------------------
+
+// Headers asking for and returning an immutable URL
+const (
+	immutableHeader    = "X-Argon-Immutable"
+	immutableURLHeader = "X-Argon-Immutable-URL"
+)
+
+// immutableObject is a response body stored under its content hash. It is
+// stored as a line of JSON metadata followed by the raw body.
+type immutableObject struct {
+	ContentType string    `json:"content_type,omitempty"`
+	Stored      time.Time `json:"stored"`
+	Body        []byte    `json:"body,omitempty"` // only in objects stored as one JSON document
+}
+
+// encode lays the object out for the store
+func (obj *immutableObject) encode() []byte {
+	meta, _ := json.Marshal(immutableObject{ContentType: obj.ContentType, Stored: obj.Stored})
+	data := make([]byte, 0, len(meta)+1+len(obj.Body))
+	data = append(append(meta, '\n'), obj.Body...)
+	return data
+}
+
+// decodeImmutable reads a stored object, including ones stored with the
+// body inside the JSON document
+func decodeImmutable(data []byte) (immutableObject, error) {
+	var obj immutableObject
+	meta, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return obj, json.Unmarshal(data, &obj)
+	}
+	if err := json.Unmarshal(meta, &obj); err != nil {
+		return obj, err
+	}
+	obj.Body = body
+	return obj, nil
+}
+
+// immutableObjects tracks the objects this instance stored, oldest first,
+// so their total size stays within --immutable-max-total
+var immutableObjects struct {
+	mu    sync.Mutex
+	order []string // hashes
+	items map[string]immutableItem
+	total int64
+}
+
+type immutableItem struct {
+	size    int64
+	expires time.Time // zero when kept forever
+}
+
+// reserveImmutable makes room for an object of size bytes, removing the
+// oldest objects from the store as needed. It reports false when the
+// object is already stored or can never fit.
+func reserveImmutable(hash string, size int64) bool {
+	objects := &immutableObjects
+	objects.mu.Lock()
+	defer objects.mu.Unlock()
+	if objects.items == nil {
+		objects.items = make(map[string]immutableItem)
+	}
+	if item, ok := objects.items[hash]; ok && (item.expires.IsZero() || time.Now().Before(item.expires)) {
+		return false
+	}
+	if size > *immutableMaxTotal {
+		return false
+	}
+	var evict []string
+	now := time.Now()
+	for len(objects.order) > 0 {
+		oldest := objects.items[objects.order[0]]
+		expired := !oldest.expires.IsZero() && now.After(oldest.expires)
+		if !expired && objects.total+size <= *immutableMaxTotal {
+			break
+		}
+		if !expired {
+			evict = append(evict, objects.order[0])
+		}
+		objects.total -= oldest.size
+		delete(objects.items, objects.order[0])
+		objects.order = objects.order[1:]
+	}
+	item := immutableItem{size: size}
+	if *immutableTTL > 0 {
+		item.expires = now.Add(*immutableTTL)
+	}
+	objects.items[hash] = item
+	objects.order = append(objects.order, hash)
+	objects.total += size
+
+	for _, old := range evict {
+		if err := store.Delete("immutable:" + old); err != nil {
+			log.Printf("Error evicting immutable object: %v", err)
+		}
+	}
+	return true
+}
+
+// wantsImmutable reports whether a proxy request asked for an immutable URL.
+// The upstream request then leaves Accept-Encoding to the transport, so the
+// stored body and its hash are of the decoded content.
+func wantsImmutable(r *http.Request, proxyReq *http.Request) bool {
+	if !*immutableEnabled || r.Method != "GET" || r.Header.Get(immutableHeader) == "" {
+		return false
+	}
+	proxyReq.Header.Del("Accept-Encoding")
+	return true
+}
+
+// storeImmutable keeps a successful response under the SHA-256 of its body
+// and tells the client the /immutable/ URL it can be fetched from. Bodies
+// over --immutable-max-bytes are relayed without one, and the oldest objects
+// are removed to keep all of them within --immutable-max-total.
+func storeImmutable(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" || isLongLivedStream(resp) {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, *immutableMaxBytes+1))
+	if err != nil || int64(len(body)) > *immutableMaxBytes {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	if reserveImmutable(hash, int64(len(body))) {
+		obj := immutableObject{ContentType: resp.Header.Get("Content-Type"), Stored: time.Now().UTC(), Body: body}
+		if err := store.Set("immutable:"+hash, obj.encode(), *immutableTTL); err != nil {
+			log.Printf("Error storing immutable object: %v", err)
+			return
+		}
+	}
+	w.Header().Set(immutableURLHeader, "/immutable/"+hash)
+	w.Header().Add("Access-Control-Expose-Headers", immutableURLHeader)
+}
+
+// registerImmutableHandlers adds /immutable/ when --immutable is set
+func registerImmutableHandlers(mux *http.ServeMux) {
+	if !*immutableEnabled {
+		return
+	}
+	mux.HandleFunc("/immutable/", handleImmutable)
+}
+
+// handleImmutable serves a stored object by its hash, which may be followed
+// by a file extension, with caching for as long as browsers allow
+func handleImmutable(w http.ResponseWriter, r *http.Request) {
+	if !checkCORSOrigin(w, r) {
+		return
+	}
+	if r.Method == "OPTIONS" {
+		handlePreflight(w, r)
+		return
+	}
+	addCORSHeaders(w, r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/immutable/")
+	hash := strings.TrimSuffix(name, path.Ext(name))
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	data, ok, err := store.Get("immutable:" + hash)
+	if err != nil {
+		http.Error(w, "Store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	obj, err := decodeImmutable(data)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	addProxiedBy(w)
+	http.ServeContent(w, r, "", obj.Stored, bytes.NewReader(obj.Body))
+}
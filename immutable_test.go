@@ -0,0 +1,69 @@
+package argonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecodeImmutable(t *testing.T) {
+	stored := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	legacy, _ := json.Marshal(immutableObject{ContentType: "text/plain", Stored: stored, Body: []byte("old body")})
+	tests := []struct {
+		name string
+		data []byte
+		want immutableObject
+	}{
+		{"raw", (&immutableObject{ContentType: "image/png", Stored: stored, Body: []byte("\x89PNG\n\x00")}).encode(), immutableObject{ContentType: "image/png", Stored: stored, Body: []byte("\x89PNG\n\x00")}},
+		{"empty body", (&immutableObject{Stored: stored}).encode(), immutableObject{Stored: stored, Body: []byte{}}},
+		{"single JSON document", legacy, immutableObject{ContentType: "text/plain", Stored: stored, Body: []byte("old body")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeImmutable(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ContentType != tt.want.ContentType || !got.Stored.Equal(tt.want.Stored) || !bytes.Equal(got.Body, tt.want.Body) {
+				t.Errorf("decodeImmutable = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveImmutable(t *testing.T) {
+	if _, err := NewTestHandler("--immutable", "--immutable-max-total=100"); err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+	for _, hash := range []string{"a", "b"} {
+		store.Set("immutable:"+hash, []byte("x"), 0)
+	}
+
+	steps := []struct {
+		hash string
+		size int64
+		want bool
+	}{
+		{"a", 40, true},
+		{"b", 40, true},
+		{"a", 40, false},    // already stored
+		{"big", 101, false}, // never fits
+		{"c", 40, true},     // evicts a
+		{"d", 60, true},     // evicts b
+	}
+	for _, step := range steps {
+		if got := reserveImmutable(step.hash, step.size); got != step.want {
+			t.Errorf("reserveImmutable(%q, %d) = %v, want %v", step.hash, step.size, got, step.want)
+		}
+	}
+	if immutableObjects.total != 100 {
+		t.Errorf("total = %d, want 100", immutableObjects.total)
+	}
+	for _, hash := range []string{"a", "b"} {
+		if _, ok, _ := store.Get("immutable:" + hash); ok {
+			t.Errorf("object %q was not evicted", hash)
+		}
+	}
+}
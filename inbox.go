@@ -0,0 +1,314 @@
+package argonproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// WEBHOOK INBOXES
+// -----------------------------
+
+// Limits on inboxes and the webhooks they accept
+const (
+	inboxMaxBody        = 1 << 20
+	inboxCreatesPerHour = 20
+	inboxPollInterval   = time.Second // for webhooks received by other instances
+	inboxKeepAlive      = 15 * time.Second
+)
+
+// inboxMessage is one webhook received by an inbox
+type inboxMessage struct {
+	Seq         int64             `json:"seq"`
+	Received    time.Time         `json:"received"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path,omitempty"` // after /hook/{id}
+	Query       string            `json:"query,omitempty"`
+	Headers     map[string]string `json:"headers"`
+	ContentType string            `json:"content_type,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	BodyBase64  string            `json:"body_base64,omitempty"` // when the body is not UTF-8
+	ClientIP    string            `json:"client_ip"`
+}
+
+// inboxWaiters wakes the streams of an inbox when this instance receives a
+// webhook for it, by closing the channel stored for its ID
+var inboxWaiters sync.Map
+
+// registerInboxHandlers adds /hook/ when --inbox is set
+func registerInboxHandlers(mux *http.ServeMux) {
+	if !*inboxEnabled {
+		return
+	}
+	mux.HandleFunc("/hook/", handleHook)
+}
+
+// handleHook creates inboxes (POST /hook/), receives webhooks
+// (/hook/{id}[/...]) and serves them to the inbox's reader
+// (GET /hook/{id}/events)
+func handleHook(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/hook/")
+	if rest == "" {
+		createInbox(w, r)
+		return
+	}
+	id, path, _ := strings.Cut(rest, "/")
+	if !validInboxID(id) {
+		http.Error(w, "Inbox not found", http.StatusNotFound)
+		return
+	}
+	if path == "events" {
+		readInbox(w, r, id)
+		return
+	}
+	receiveWebhook(w, r, id, path)
+}
+
+// validInboxID reports whether id has the form of a created inbox ID
+func validInboxID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// createInbox makes a new inbox and returns its ID and the token that reads it
+func createInbox(w http.ResponseWriter, r *http.Request) {
+	if !checkCORSOrigin(w, r) {
+		return
+	}
+	if r.Method == "OPTIONS" {
+		handlePreflight(w, r)
+		return
+	}
+	addCORSHeaders(w, r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+	client := getClientIP(r)
+	limitKey := "inbox-limit:" + client + ":" + time.Now().UTC().Format(statsHourFormat)
+	if n, err := store.Incr(limitKey, 1, time.Hour); err == nil && n > inboxCreatesPerHour {
+		http.Error(w, "Too many inboxes, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	b := make([]byte, 48)
+	rand.Read(b)
+	id, token := hex.EncodeToString(b[:16]), base64.RawURLEncoding.EncodeToString(b[16:])
+	sum := sha256.Sum256([]byte(token))
+	if err := store.Set("inbox:"+id, []byte(hex.EncodeToString(sum[:])), *inboxTTL); err != nil {
+		log.Printf("Error creating inbox: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not create the inbox"})
+		return
+	}
+	if *verbose {
+		log.Printf("Inbox %s created for %s", id, client)
+	}
+	base := "/hook/" + id
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"id":         id,
+		"token":      token,
+		"url":        base,
+		"events_url": base + "/events",
+		"expires":    time.Now().Add(*inboxTTL).UTC().Format(time.RFC3339),
+	})
+}
+
+// receiveWebhook stores a request to an inbox for its reader
+func receiveWebhook(w http.ResponseWriter, r *http.Request, id, path string) {
+	if _, ok, err := store.Get("inbox:" + id); err != nil || !ok {
+		http.Error(w, "Inbox not found", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, inboxMaxBody))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Webhook body exceeds %d bytes", inboxMaxBody), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg := inboxMessage{
+		Received:    time.Now().UTC(),
+		Method:      r.Method,
+		Query:       r.URL.RawQuery,
+		Headers:     make(map[string]string, len(r.Header)),
+		ContentType: r.Header.Get("Content-Type"),
+		ClientIP:    getClientIP(r),
+	}
+	if path != "" {
+		msg.Path = "/" + path
+	}
+	for name, values := range r.Header {
+		msg.Headers[name] = strings.Join(values, ", ")
+	}
+	if utf8.Valid(body) {
+		msg.Body = string(body)
+	} else {
+		msg.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+
+	seq, err := store.Incr("inbox:"+id+":seq", 1, *inboxTTL)
+	if err == nil {
+		msg.Seq = seq
+		data, _ := json.Marshal(msg)
+		err = store.Set(inboxMessageKey(id, seq), data, *inboxTTL)
+	}
+	if err != nil {
+		log.Printf("Error storing webhook for inbox %s: %v", id, err)
+		http.Error(w, "Could not store the webhook", http.StatusServiceUnavailable)
+		return
+	}
+	if int64(*inboxKeep) < seq {
+		store.Delete(inboxMessageKey(id, seq-int64(*inboxKeep)))
+	}
+	if wake, ok := inboxWaiters.LoadAndDelete(id); ok {
+		close(wake.(chan struct{}))
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"received": seq})
+}
+
+// inboxMessageKey is the store key of one webhook
+func inboxMessageKey(id string, seq int64) string {
+	return "inbox:" + id + ":" + strconv.FormatInt(seq, 10)
+}
+
+// errInboxToken is returned when a read does not carry the inbox's token
+var errInboxToken = errors.New("missing or invalid inbox token")
+
+// checkInboxToken verifies the token of a read, given as a bearer token or,
+// for EventSource which cannot set headers, a token query parameter
+func checkInboxToken(r *http.Request, id string) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	stored, found, err := store.Get("inbox:" + id)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(token))
+	if !found || token == "" || !hmac.Equal(stored, []byte(hex.EncodeToString(sum[:]))) {
+		return errInboxToken
+	}
+	return nil
+}
+
+// readInbox returns the webhooks after ?since= (or Last-Event-ID) as JSON,
+// or streams them as server-sent events when the client accepts them
+func readInbox(w http.ResponseWriter, r *http.Request, id string) {
+	if !checkCORSOrigin(w, r) {
+		return
+	}
+	if r.Method == "OPTIONS" {
+		handlePreflight(w, r)
+		return
+	}
+	addCORSHeaders(w, r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := checkInboxToken(r, id); err != nil {
+		if errors.Is(err, errInboxToken) {
+			http.Error(w, "Inbox not found or invalid token", http.StatusNotFound)
+		} else {
+			http.Error(w, "Store unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		since, _ = strconv.ParseInt(last, 10, 64)
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Accept"))
+	if mediaType != "text/event-stream" {
+		messages, next := inboxMessages(id, since)
+		writeJSON(w, http.StatusOK, map[string]any{"messages": messages, "next": next})
+		return
+	}
+	streamInbox(w, r, id, since)
+}
+
+// inboxMessages returns the stored webhooks after since, and the sequence
+// number to read from next
+func inboxMessages(id string, since int64) ([]json.RawMessage, int64) {
+	messages := []json.RawMessage{}
+	last, err := store.Incr("inbox:"+id+":seq", 0, *inboxTTL)
+	if err != nil {
+		return messages, since
+	}
+	for seq := max(since+1, last-int64(*inboxKeep)+1); seq <= last; seq++ {
+		if data, ok, err := store.Get(inboxMessageKey(id, seq)); err == nil && ok {
+			messages = append(messages, data)
+		}
+	}
+	return messages, max(since, last)
+}
+
+// streamInbox sends webhooks as server-sent events until the client leaves,
+// counting against its stream limit
+func streamInbox(w http.ResponseWriter, r *http.Request, id string, since int64) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	release, ok := trackStream(r, cancel)
+	if !ok {
+		http.Error(w, "Too many open streams for this client", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	poll := time.NewTicker(inboxPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(inboxKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		wake, _ := inboxWaiters.LoadOrStore(id, make(chan struct{}))
+		messages, next := inboxMessages(id, since)
+		for _, data := range messages {
+			var seq struct {
+				Seq int64 `json:"seq"`
+			}
+			json.Unmarshal(data, &seq)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq.Seq, data)
+		}
+		since = next
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake.(chan struct{}):
+		case <-poll.C:
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package argonproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// -----------------------------
+// CROSS-ORIGIN ISOLATION HEADERS
+// -----------------------------
+
+// isolationPolicy sets the Cross-Origin-Resource-Policy,
+// Cross-Origin-Embedder-Policy and Referrer-Policy of proxied responses.
+// Empty fields leave the upstream's header untouched.
+type isolationPolicy struct {
+	ResourcePolicy string `json:"cross_origin_resource_policy,omitempty"`
+	EmbedderPolicy string `json:"cross_origin_embedder_policy,omitempty"`
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+}
+
+var (
+	resourcePolicies = map[string]bool{"same-site": true, "same-origin": true, "cross-origin": true}
+	embedderPolicies = map[string]bool{"unsafe-none": true, "require-corp": true, "credentialless": true}
+	referrerPolicies = map[string]bool{
+		"no-referrer": true, "no-referrer-when-downgrade": true, "origin": true,
+		"origin-when-cross-origin": true, "same-origin": true, "strict-origin": true,
+		"strict-origin-when-cross-origin": true, "unsafe-url": true,
+	}
+)
+
+// validate checks the policy values against the values browsers understand
+func (p *isolationPolicy) validate() error {
+	if p.ResourcePolicy != "" && !resourcePolicies[p.ResourcePolicy] {
+		return fmt.Errorf("invalid Cross-Origin-Resource-Policy %q", p.ResourcePolicy)
+	}
+	if p.EmbedderPolicy != "" && !embedderPolicies[p.EmbedderPolicy] {
+		return fmt.Errorf("invalid Cross-Origin-Embedder-Policy %q", p.EmbedderPolicy)
+	}
+	// Referrer-Policy may list fallbacks, e.g. "no-referrer, strict-origin-when-cross-origin"
+	for _, token := range splitList(p.ReferrerPolicy) {
+		if !referrerPolicies[token] {
+			return fmt.Errorf("invalid Referrer-Policy %q", token)
+		}
+	}
+	return nil
+}
+
+// merge fills unset fields from another policy
+func (p isolationPolicy) merge(other isolationPolicy) isolationPolicy {
+	if p.ResourcePolicy == "" {
+		p.ResourcePolicy = other.ResourcePolicy
+	}
+	if p.EmbedderPolicy == "" {
+		p.EmbedderPolicy = other.EmbedderPolicy
+	}
+	if p.ReferrerPolicy == "" {
+		p.ReferrerPolicy = other.ReferrerPolicy
+	}
+	return p
+}
+
+// validateIsolation checks the route policy and its per-origin overrides
+func (rt *Route) validateIsolation() error {
+	if err := rt.isolationPolicy.validate(); err != nil {
+		return fmt.Errorf("route %q: %v", rt.Name, err)
+	}
+	for origin, policy := range rt.OriginIsolation {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("route %q, origin %s: %v", rt.Name, origin, err)
+		}
+	}
+	return nil
+}
+
+// addIsolationHeaders sets the isolation headers for the request's route and
+// Origin, replacing those sent by the upstream
+func addIsolationHeaders(w http.ResponseWriter, r *http.Request) {
+	rt := routeFor(r)
+	policy := rt.isolationPolicy
+	if override, ok := rt.OriginIsolation[strings.ToLower(r.Header.Get("Origin"))]; ok {
+		policy = override.merge(policy)
+	}
+
+	if policy.ResourcePolicy != "" {
+		w.Header().Set("Cross-Origin-Resource-Policy", policy.ResourcePolicy)
+	}
+	if policy.EmbedderPolicy != "" {
+		w.Header().Set("Cross-Origin-Embedder-Policy", policy.EmbedderPolicy)
+	}
+	if policy.ReferrerPolicy != "" {
+		w.Header().Set("Referrer-Policy", policy.ReferrerPolicy)
+	}
+}
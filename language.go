@@ -0,0 +1,38 @@
+package argonproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// -----------------------------
+// ACCEPT-LANGUAGE POLICY
+// -----------------------------
+
+// prepareAcceptLanguage checks the route's Accept-Language policy: pass (the
+// client's header as sent), strip, or a fixed value sent instead
+func (rt *Route) prepareAcceptLanguage() error {
+	rt.AcceptLanguage = strings.TrimSpace(rt.AcceptLanguage)
+	switch rt.AcceptLanguage {
+	case "", "pass", "strip":
+		return nil
+	}
+	if !httpguts.ValidHeaderFieldValue(rt.AcceptLanguage) {
+		return fmt.Errorf("route %q: invalid accept_language %q", rt.Name, rt.AcceptLanguage)
+	}
+	return nil
+}
+
+// applyAcceptLanguage strips or replaces the Accept-Language header sent upstream
+func applyAcceptLanguage(r *http.Request, proxyReq *http.Request) {
+	switch policy := routeFor(r).AcceptLanguage; policy {
+	case "", "pass":
+	case "strip":
+		proxyReq.Header.Del("Accept-Language")
+	default:
+		proxyReq.Header.Set("Accept-Language", policy)
+	}
+}
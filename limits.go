@@ -0,0 +1,140 @@
+package argonproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// CLIENT-VISIBLE LIMITS
+// -----------------------------
+
+// limitHeaders are the headers that tell clients about the proxy's limits
+const (
+	maxBodyHeader = "X-Argon-Max-Body"
+	timeoutHeader = "X-Argon-Timeout"
+)
+
+// addLimitHeaders advertises the configured limits on a proxy response and
+// lets browser clients read them
+func addLimitHeaders(w http.ResponseWriter) {
+	var exposed []string
+	if *maxBodySize > 0 {
+		w.Header().Set(maxBodyHeader, strconv.FormatInt(*maxBodySize, 10))
+		exposed = append(exposed, maxBodyHeader)
+	}
+	if *upstreamTimeout > 0 {
+		w.Header().Set(timeoutHeader, strconv.FormatFloat(upstreamTimeout.Seconds(), 'f', -1, 64))
+		exposed = append(exposed, timeoutHeader)
+	}
+	if *rateLimit > 0 {
+		// Set by checkRateLimit once the client is known
+		exposed = append(exposed, rateLimitLimitHeader, rateLimitRemainingHeader, rateLimitResetHeader, "Retry-After")
+	}
+	if len(exposed) > 0 {
+		w.Header().Add("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	}
+}
+
+// limitRequestBody rejects bodies over --max-body-size, checking the declared
+// length up front and capping the bytes actually read
+func limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	if *maxBodySize <= 0 {
+		return true
+	}
+	reason := fmt.Sprintf("request body exceeds %d bytes", *maxBodySize)
+	if r.ContentLength > *maxBodySize {
+		if reportOnly(r, "body-size", reason) {
+			return true
+		}
+		proxyError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", *maxBodySize), "")
+		return false
+	}
+	if r.ContentLength < 0 && routeFor(r).reportsOnly("body-size") {
+		r.Body = &bodySizeReporter{ReadCloser: r.Body, r: r, reason: reason}
+		return true
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, *maxBodySize)
+	return true
+}
+
+// bodySizeReporter reports a body of unknown length once it grows past
+// --max-body-size under a report-only body-size policy
+type bodySizeReporter struct {
+	io.ReadCloser
+	r        *http.Request
+	reason   string
+	read     int64
+	reported bool
+}
+
+func (b *bodySizeReporter) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > *maxBodySize && !b.reported {
+		b.reported = true
+		reportOnly(b.r, "body-size", b.reason)
+	}
+	return n, err
+}
+
+// bodyTooLarge reports whether err came from reading past --max-body-size
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// statusClientClosed is recorded for requests whose client disconnected
+// before the upstream responded, following nginx
+const statusClientClosed = 499
+
+// upstreamTimer bounds the wait for the upstream's response headers. The
+// body is not covered, so long downloads and event streams keep going.
+type upstreamTimer struct {
+	timer *time.Timer
+	fired atomic.Bool
+}
+
+// withUpstreamTimeout arms an upstreamTimer for a request. Each attempt
+// gets the full --upstream-timeout: call restart before sending the request
+// again, and stop once Do returned for the last time. cancel once the
+// response is done.
+func withUpstreamTimeout(proxyReq *http.Request) (req *http.Request, t *upstreamTimer, cancel func()) {
+	t = &upstreamTimer{}
+	if *upstreamTimeout <= 0 {
+		return proxyReq, t, func() {}
+	}
+	ctx, cancel := context.WithCancel(proxyReq.Context())
+	t.timer = time.AfterFunc(*upstreamTimeout, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+	return proxyReq.WithContext(ctx), t, cancel
+}
+
+// timedOut reports whether an attempt ran out of time, which also cancelled
+// the request
+func (t *upstreamTimer) timedOut() bool {
+	return t.fired.Load()
+}
+
+// restart gives another attempt the full timeout
+func (t *upstreamTimer) restart() {
+	if t.timer != nil && !t.fired.Load() {
+		t.timer.Reset(*upstreamTimeout)
+	}
+}
+
+// stop ends the timeout once the response headers arrived
+func (t *upstreamTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,43 @@
+package argonproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTimeoutCoversEveryAttempt(t *testing.T) {
+	defer func(saved time.Duration) { *upstreamTimeout = saved }(*upstreamTimeout)
+	*upstreamTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		attempts int  // attempts that fail fast before the last one
+		stop     bool // whether the last attempt got its response
+		want     bool
+	}{
+		{"first attempt hangs", 0, false, true},
+		{"failover attempt hangs", 2, false, true},
+		{"failover attempt answers", 2, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, timer, cancel := withUpstreamTimeout(httptest.NewRequest("GET", "/", nil))
+			defer cancel()
+			for range tt.attempts {
+				time.Sleep(10 * time.Millisecond)
+				if timer.timedOut() {
+					t.Fatal("timed out during a fast attempt")
+				}
+				timer.restart()
+			}
+			if tt.stop {
+				timer.stop()
+			}
+			time.Sleep(100 * time.Millisecond)
+			if timer.timedOut() != tt.want || (req.Context().Err() != nil) != tt.want {
+				t.Errorf("timedOut = %v, context error = %v; want timed out %v", timer.timedOut(), req.Context().Err(), tt.want)
+			}
+		})
+	}
+}
@@ -1,68 +1,493 @@
-// Argon-Proxy: A CORS proxy server that handles URL query parameters properly
-package main
+// Package argonproxy is Argon-Proxy, a CORS proxy server that handles URL
+// query parameters properly. The argon-proxy command is in cmd/argon-proxy;
+// NewTestHandler runs the proxy inside Go tests.
+package argonproxy
 
 import (
+	"crypto/rand"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Command line flags
 var (
-	port          = flag.Int("port", 8080, "Port to listen on")
-	address       = flag.String("address", "127.0.0.1", "Address to listen on")
-	allowedOrigin = flag.String("allow-origin", "*", "CORS Allow-Origin header value")
-	verbose       = flag.Bool("verbose", false, "Enable verbose logging")
-	trustProxy    = flag.Bool("trust-proxy", false, "Trust X-Forwarded-* headers from Nginx")
+	port                   = flag.Int("port", 8080, "Port to listen on")
+	address                = flag.String("address", "127.0.0.1", "Address to listen on")
+	allowedOrigin          = flag.String("allow-origin", "*", "CORS allowed origins: * or a comma-separated list, e.g. https://app.example.com,https://*.example.org; other origins get 403")
+	verbose                = flag.Bool("verbose", false, "Enable verbose logging")
+	trustProxy             = flag.Bool("trust-proxy", false, "Trust X-Forwarded-* headers from Nginx")
+	configFile             = flag.String("config", "", "Path to a JSON or YAML file with server settings and host-based routes; flags given on the command line take precedence")
+	stripParams            = flag.String("strip-params", "", "Comma-separated query parameters consumed by the proxy and never forwarded (target is always stripped)")
+	forwardFragment        = flag.Bool("forward-fragment", false, "Send the target URL fragment to the upstream encoded as %23")
+	metricsEnabled         = flag.Bool("metrics", false, "Expose Prometheus metrics at /metrics")
+	metricsMaxHosts        = flag.Int("metrics-max-hosts", 100, "Maximum distinct target hosts tracked in metrics before bucketing into \"other\"")
+	metricsHosts           = flag.String("metrics-hosts", "", "Comma-separated target host patterns tracked in metrics; all others are bucketed into \"other\"")
+	auditSize              = flag.Int("audit-size", 0, "Number of recent proxied requests kept in the in-memory audit log (0 disables)")
+	captureBodyLimit       = flag.Int("capture-body-limit", 64*1024, "Maximum request/response body bytes recorded per audited request")
+	adminToken             = flag.String("admin-token", "", "Bearer token for the /admin/ API (disabled when empty; defaults to $ARGON_ADMIN_TOKEN)")
+	subdomainSuffix        = flag.String("subdomain-suffix", "", "Domain under which subdomains encode the target host (e.g. proxy.example.com)")
+	harMaxDuration         = flag.Duration("har-max-duration", time.Hour, "Longest HAR capture window the admin API may start")
+	debugCurl              = flag.Bool("debug-curl", false, "Enable /debug/curl/, which returns the curl command for the upstream request instead of sending it")
+	schemaBodyLimit        = flag.Int64("schema-body-limit", 1<<20, "Largest JSON response body validated against a route response_schema; bigger bodies pass unchecked")
+	sloLatency             = flag.Duration("slo-latency", 0, "Latency objective for requests not matched by a route (0 disables)")
+	sloMaxBytes            = flag.Int64("slo-max-bytes", 0, "Response size objective in bytes for requests not matched by a route (0 disables)")
+	sloObjective           = flag.Float64("slo-objective", 0.99, "Fraction of requests that must meet the SLO thresholds")
+	sloBurnRate            = flag.Float64("slo-burn-rate", 14.4, "Burn rate over both the last 5m and 1h that triggers an SLO alert")
+	sloWebhook             = flag.String("slo-webhook", "", "URL that receives a JSON POST when an SLO burn rate alert fires")
+	certWarnBefore         = flag.Duration("cert-warn-before", 14*24*time.Hour, "Log a warning when an upstream certificate expires within this time")
+	certWarnRequests       = flag.Int("cert-warn-requests", 100, "Requests to an upstream host before its certificate expiry is warned about")
+	http3Hosts             = flag.String("http3-hosts", "", "Comma-separated upstream host patterns always fetched over HTTP/3 (QUIC)")
+	http3AltSvc            = flag.Bool("http3-alt-svc", false, "Switch upstreams that advertise h3 in Alt-Svc to HTTP/3, falling back to TCP on failure")
+	tlsCert                = flag.String("tls-cert", "", "TLS certificate file; serves HTTPS together with --tls-key")
+	tlsKey                 = flag.String("tls-key", "", "TLS private key file for --tls-cert")
+	http3Listen            = flag.Bool("http3", false, "Also serve HTTP/3 over QUIC on the same UDP port (experimental, requires TLS)")
+	idempotencyWindow      = flag.Duration("idempotency-window", 0, "How long POST/PATCH responses are replayed for retries with the same Idempotency-Key (0 disables)")
+	idempotencyBodyLimit   = flag.Int("idempotency-body-limit", 1<<20, "Largest request or response body handled by Idempotency-Key deduplication")
+	resourcePolicy         = flag.String("corp", "", "Cross-Origin-Resource-Policy set on proxied responses (same-site, same-origin or cross-origin)")
+	embedderPolicy         = flag.String("coep", "", "Cross-Origin-Embedder-Policy set on proxied responses (unsafe-none, require-corp or credentialless)")
+	referrerPolicy         = flag.String("referrer-policy", "", "Referrer-Policy set on proxied responses")
+	maxStreamsPerClient    = flag.Int("max-streams-per-client", 0, "Maximum simultaneous long-lived streams (e.g. server-sent events) per client IP (0 is unlimited)")
+	streamLimitPolicy      = flag.String("stream-limit-policy", "reject", "What happens when a client exceeds --max-streams-per-client: reject or evict-oldest")
+	storeURL               = flag.String("store", "memory", "Storage for stateful features: memory, bolt:///path/to/file.db or redis://[:password@]host:port[/db]")
+	configKeyFile          = flag.String("config-key-file", "", "File holding the key for enc:v1: values in flags and the config file (defaults to $ARGON_CONFIG_KEY)")
+	vaultAddr              = flag.String("vault-addr", "", "HashiCorp Vault address for ${vault:path#field} config references (defaults to $VAULT_ADDR)")
+	vaultToken             = flag.String("vault-token", "", "Vault token (defaults to $VAULT_TOKEN)")
+	vaultRoleID            = flag.String("vault-role-id", "", "Vault AppRole role ID, used instead of a token")
+	vaultSecretID          = flag.String("vault-secret-id", "", "Vault AppRole secret ID")
+	vaultRefresh           = flag.Duration("vault-refresh", 5*time.Minute, "How often secrets read from Vault are refreshed")
+	captchaProviderName    = flag.String("captcha", "", "Require a solved captcha before /proxy/ can be used: hcaptcha or recaptcha")
+	captchaSiteKey         = flag.String("captcha-site-key", "", "Captcha site key shown on the /captcha challenge page")
+	captchaSecret          = flag.String("captcha-secret", "", "Captcha secret key used for server-side verification")
+	captchaSession         = flag.Duration("captcha-session", 30*time.Minute, "How long a solved captcha lets a client use the proxy")
+	maxBodySize            = flag.Int64("max-body-size", 0, "Largest request body accepted by /proxy/ in bytes (0 is unlimited)")
+	upstreamTimeout        = flag.Duration("upstream-timeout", 0, "How long to wait for an upstream to start responding before answering 504 (0 waits indefinitely)")
+	gomaxprocs             = flag.Int("gomaxprocs", 0, "Number of CPUs used to run Go code (0 detects the container CPU limit)")
+	listenerCount          = flag.Int("listeners", 1, "TCP listeners opened on the port with SO_REUSEPORT; the kernel spreads connections across them")
+	archiveQueueSize       = flag.Int("archive-queue", 100, "Responses waiting for upload to a route archive bucket before new ones are dropped")
+	statsHours             = flag.Int("stats-hours", 24, "Hours of usage aggregates kept for /admin/stats (0 disables)")
+	authMode               = flag.String("auth", "none", "Who may use /proxy/: none, apikey (X-Argon-Key header or ?key=), basic or jwt (bearer token)")
+	authFile               = flag.String("auth-file", "", "Credentials for --auth: a name:key file for apikey, a bcrypt htpasswd file for basic, or a PEM public key for jwt")
+	authKeyParam           = flag.String("auth-key-param", "key", "Query parameter that may carry the key for --auth=apikey when X-Argon-Key is not sent; it is not forwarded upstream (empty disables it)")
+	authJWTSecret          = flag.String("auth-jwt-secret", "", "HMAC secret for --auth=jwt tokens signed with HS256, HS384 or HS512")
+	authJWTIssuer          = flag.String("auth-jwt-issuer", "", "Required iss claim of --auth=jwt tokens")
+	authJWTAudience        = flag.String("auth-jwt-audience", "", "Required aud claim of --auth=jwt tokens")
+	extAuthzURL            = flag.String("ext-authz-url", "", "HTTP authorization service asked to allow or deny each proxy request")
+	extAuthzHeaders        = flag.String("ext-authz-headers", "Authorization", "Comma-separated client request headers sent to --ext-authz-url")
+	extAuthzTimeout        = flag.Duration("ext-authz-timeout", 2*time.Second, "How long to wait for the authorization service")
+	extAuthzCache          = flag.Duration("ext-authz-cache", 30*time.Second, "How long authorization decisions are cached unless the service sends Cache-Control")
+	extAuthzFailOpen       = flag.Bool("ext-authz-fail-open", false, "Allow requests when the authorization service is unreachable instead of answering 503")
+	opaBundle              = flag.String("opa-bundle", "", "Rego policy bundle deciding proxy requests: an http(s) URL of a bundle server, or a local bundle file or directory")
+	opaRefresh             = flag.Duration("opa-refresh", time.Minute, "How often the --opa-bundle is reloaded")
+	opaDecision            = flag.String("opa-decision", "argon/proxy", "Path of the policy decision, a boolean or an object with allow, status, reason and headers")
+	hotlinkOrigins         = flag.String("hotlink-origins", "", "Comma-separated origins (e.g. https://*.example.com) whose pages may embed media through the proxy; others get 403")
+	hotlinkTypes           = flag.String("hotlink-types", "image/*,video/*,audio/*", "Content types protected by --hotlink-origins")
+	hotlinkAllowEmpty      = flag.Bool("hotlink-allow-empty", false, "Serve protected media to requests with neither Origin nor Referer")
+	instanceID             = flag.String("instance-id", "", "Instance name in the X-Proxied-By response header (defaults to a hash of the host name)")
+	abuseContact           = flag.String("abuse-contact", "", "Email address for abuse reports; enables the /abuse report page")
+	tlsWarnBelow           = flag.String("tls-warn-below", "1.2", "Flag upstream TLS connections older than this version (1.0-1.3) as weak")
+	tlsBlockWeak           = flag.Bool("tls-block-weak", false, "Refuse upstream TLS connections with a weak protocol or cipher, or downgraded from the version seen before")
+	upstreamTLSMin         = flag.String("upstream-tls-min-version", "", "Oldest TLS version accepted from upstreams: 1.0, 1.1, 1.2 or 1.3 (default: Go default, 1.2)")
+	upstreamTLSCiphers     = flag.String("upstream-tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites offered to upstreams (default: Go defaults)")
+	upstreamTLSCurves      = flag.String("upstream-tls-curves", "", "Comma-separated key exchange curves offered to upstreams, in order of preference")
+	acmeDomains            = flag.String("acme-domains", "", "Comma-separated domains, e.g. proxy.example.com,*.proxy.example.com, to serve with an ACME certificate")
+	acmeDNS                = flag.String("acme-dns", "", "DNS provider answering ACME DNS-01 challenges: cloudflare or route53; without it HTTP-01 challenges are answered on --redirect-http")
+	acmeEmail              = flag.String("acme-email", "", "Contact email for the ACME account")
+	acmeDirectory          = flag.String("acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL")
+	acmeCacheDir           = flag.String("acme-cache", "acme", "Directory keeping the ACME account key and certificate")
+	upstreamAcceptEncoding = flag.String("upstream-accept-encoding", "", "Comma-separated codings (zstd, br, gzip) requested from upstreams, recoding responses the client cannot decode")
+	accessLogURL           = flag.String("access-log-url", "", "Collector URL that batches of access log records are POSTed to (NDJSON or Loki push API)")
+	accessLogFormat        = flag.String("access-log-format", "ndjson", "Access log batch format: ndjson or loki")
+	accessLogBatch         = flag.Int("access-log-batch", 500, "Access log records sent per batch")
+	accessLogInterval      = flag.Duration("access-log-interval", 5*time.Second, "Longest time access log records wait before a partial batch is sent")
+	accessLogBuffer        = flag.Int("access-log-buffer", 10000, "Access log records queued while the collector is slow or down; further records are dropped")
+	accessLogHeaders       = flag.String("access-log-headers", "", "Comma-separated Name=value headers sent to the collector, e.g. Authorization=Bearer ...")
+	syslogAddr             = flag.String("syslog", "", "Send the log to syslog (RFC 5424): local, udp://host:port, tcp://host:port or unix:///path")
+	syslogFacility         = flag.String("syslog-facility", "daemon", "Syslog facility, e.g. daemon or local0 to local7")
+	denyIPTargets          = flag.Bool("deny-ip-targets", false, "Reject targets and redirects given as raw IP addresses; only host names are proxied")
+	denyPrivateTargets     = flag.Bool("deny-private-targets", false, "Refuse upstream connections to loopback, private, link-local and other non-public addresses, checked on the connection itself")
+	privateTargetsAllow    = flag.String("private-targets-allow", "", "Comma-separated host patterns that may still reach private addresses with --deny-private-targets")
+	federationSecret       = flag.String("federation-secret", "", "Comma-separated shared secrets accepted from instances that chain requests through this one")
+	region                 = flag.String("region", "", "Region of this instance, preferred among a route's regional_upstreams endpoints without latency probes")
+	paginateMaxPages       = flag.Int("paginate-max-pages", 0, "Let clients of the default route merge up to this many pages of a paginated JSON API with the X-Argon-Paginate header (0 disables)")
+	inboxEnabled           = flag.Bool("inbox", false, "Accept webhooks at /hook/{id} into inboxes created with POST /hook/, for browsers to poll or stream")
+	inboxTTL               = flag.Duration("inbox-ttl", 24*time.Hour, "How long an inbox and its webhooks are kept after the inbox is created")
+	inboxKeep              = flag.Int("inbox-keep", 100, "Most recent webhooks kept per inbox")
+	allowHosts             = flag.String("allow-hosts", "", "Comma-separated glob patterns (e.g. *.api.example.com) of the only target hosts that may be proxied")
+	denyHosts              = flag.String("deny-hosts", "", "Comma-separated glob patterns of target hosts that are never proxied; takes precedence over --allow-hosts")
+	blocklistSources       = flag.String("blocklists", "", "Comma-separated domain blocklists (hosts file, domain list or RPZ zone; local paths or http(s) URLs) whose hosts are never proxied")
+	blocklistRefresh       = flag.Duration("blocklist-refresh", time.Hour, "How often --blocklists are reloaded")
+	immutableEnabled       = flag.Bool("immutable", false, "Store GET responses of requests with an X-Argon-Immutable header under their content hash and serve them at /immutable/{hash}")
+	immutableMaxBytes      = flag.Int64("immutable-max-bytes", 10<<20, "Largest response stored for an immutable URL")
+	immutableTTL           = flag.Duration("immutable-ttl", 30*24*time.Hour, "How long objects behind immutable URLs are kept (0 keeps them forever)")
+	immutableMaxTotal      = flag.Int64("immutable-max-total", 256<<20, "Total bytes of immutable objects this instance keeps in the store; the oldest are removed to make room")
+	maxIdleConns           = flag.Int("max-idle-conns", 100, "Idle upstream connections kept for reuse across all hosts (0 for no limit)")
+	maxIdleConnsPerHost    = flag.Int("max-idle-conns-per-host", 16, "Idle upstream connections kept for reuse per target host")
+	idleConnTimeout        = flag.Duration("idle-conn-timeout", 90*time.Second, "How long an idle upstream connection is kept (0 for no limit)")
+	dialTimeout            = flag.Duration("dial-timeout", 30*time.Second, "Time allowed to connect to an upstream")
+	clientHints            = flag.String("client-hints", "", "Comma-separated client hint headers forwarded upstream, e.g. Sec-CH-UA,Save-Data,DPR; other hints are removed (empty forwards all)")
+	acceptCH               = flag.Bool("accept-ch", false, "Advertise the --client-hints with Accept-CH so browsers send them")
+	flushInterval          = flag.Duration("flush-interval", 0, "How often responses of unknown length are flushed to the client while streaming (0 after every write, -1 only when the buffer fills); event streams always flush every write")
+	acceptLanguage         = flag.String("accept-language", "pass", "Accept-Language sent upstream: pass (the client's), strip, or a fixed value such as en-US,en;q=0.9")
+	redirectHTTP           = flag.String("redirect-http", "", "Address of a plain HTTP listener that redirects to HTTPS with 301, e.g. :80")
+	reportOnlyList         = flag.String("report-only", "", "Comma-separated policies that log what they would refuse instead of refusing: origin, methods, targets, body-size, streams, budget, schedule, hotlink, rate-limit, or all")
+	readyProbe             = flag.String("ready-probe", "", "URL /readyz requests to check an upstream; a 5xx status or no answer makes the proxy unready")
+	readyProbeTimeout      = flag.Duration("ready-probe-timeout", 2*time.Second, "How long /readyz waits for --ready-probe")
+	upstreamAnnotations    = flag.Bool("upstream-annotations", true, "Add X-Argon-Upstream-Status, X-Argon-Upstream-Duration and X-Argon-Upstream-Host to proxied responses")
+	nullOrigin             = flag.String("null-origin", "reject", "Requests with Origin: null (sandboxed iframes, file:// pages): reject with 403, or allow with Access-Control-Allow-Origin: null")
+	rateLimit              = flag.Float64("rate-limit", 0, "Requests per second each client may make, counted by authenticated identity or else client IP; over it they get 429 (0 is unlimited). Counted per instance unless --store is shared")
+	rateBurst              = flag.Int("rate-burst", 0, "Requests a client may make at once before --rate-limit applies (0 is --rate-limit rounded up)")
+	corsTokenSecret        = flag.String("cors-token-secret", "", "Secret that backends sign X-Argon-CORS-Token headers with, letting a request expose extra response headers")
+	webDAV                 = flag.Bool("webdav", false, "Accept WebDAV and CalDAV methods (PROPFIND, MKCOL, REPORT, ...) on routes without their own methods, and forward OPTIONS requests that are not CORS preflights")
+	coalesce               = flag.Bool("coalesce", false, "Send identical GET requests that are in flight at the same time upstream once and share the response")
+	coalesceBuffer         = flag.Int64("coalesce-buffer", 4<<20, "Bytes of a shared response the fastest client may get ahead of the slowest")
+	coalesceIgnoreHeaders  = flag.String("coalesce-ignore-headers", "X-Request-ID,Traceparent,Tracestate,X-Forwarded-For,X-Real-IP", "Comma-separated request headers that do not keep otherwise identical requests from being coalesced")
+	parallelHosts          = flag.String("parallel-hosts", "", "Comma-separated upstream host patterns whose large downloads are fetched as parallel range requests")
+	parallelChunkSize      = flag.Int64("parallel-chunk-size", 8<<20, "Bytes fetched per range request of a parallel download; downloads must be over two chunks")
+	parallelConnections    = flag.Int("parallel-connections", 4, "Range requests in flight at once per parallel download")
+	resumeAttempts         = flag.Int("resume-attempts", 3, "Range requests made to resume a GET response whose upstream connection breaks mid-body (0 disables)")
+	scanCommand            = flag.String("scan-command", "", "Command scanning downloads, given the body on stdin; exit status 1 blocks the download, as with clamdscan --no-summary -")
+	scanICAP               = flag.String("scan-icap", "", "ICAP service scanning downloads with RESPMOD, e.g. icap://127.0.0.1:1344/avscan")
+	scanTypes              = flag.String("scan-types", "", "Comma-separated media types (type/sub, type/*) of downloads to scan (empty scans all)")
+	scanMinSize            = flag.Int64("scan-min-size", 0, "Smallest response body scanned")
+	scanMaxSize            = flag.Int64("scan-max-size", 100<<20, "Largest response body scanned; larger downloads are refused")
+	scanTimeout            = flag.Duration("scan-timeout", 30*time.Second, "How long a scan may take before the download fails")
+	cacheSize              = flag.Int64("cache-size", 0, "Memory in bytes for cached GET and HEAD responses (0 disables the response cache)")
+	cacheTTL               = flag.Duration("cache-ttl", 10*time.Minute, "Longest a response is served from the cache, whatever its Cache-Control allows")
+	cacheMaxObject         = flag.Int64("cache-max-object", 1<<20, "Largest response body kept in the memory cache, so big downloads do not evict small hot responses")
+	cacheDir               = flag.String("cache-dir", "", "Directory for a disk tier of the response cache, kept across restarts (empty disables it)")
+	cacheDirSize           = flag.Int64("cache-dir-size", 1<<30, "Disk space in bytes for the disk cache tier; least recently used responses are evicted beyond it")
+	cacheDirMaxObject      = flag.Int64("cache-dir-max-object", 256<<20, "Largest response body kept in the disk cache tier")
+	cacheDiskTypes         = flag.String("cache-disk-types", "", "Comma-separated media types (type/sub, type/*) cached on disk rather than in memory, such as image/*")
+	cacheSharedTypes       = flag.String("cache-shared-types", "", "Comma-separated media types (type/sub, type/*) cached in --store, shared by every instance, such as application/json")
+	cacheSharedMaxObject   = flag.Int64("cache-shared-max-object", 256<<10, "Largest response body kept in the shared cache tier")
 )
 
+// version is set at build time with
+// -ldflags "-X github.com/a2hop/argon-proxy.version=..."
+var version = "dev"
+
 //go:embed getconfig/*
 var SampleConfigs embed.FS
 
-// main is the entry point for the CORS proxy server
-func main() {
+// Main is the entry point for the CORS proxy server, run by cmd/argon-proxy
+func Main() {
 	flag.Parse()
 
-	// Register HTTP handlers
-	http.HandleFunc("/proxy/", handleProxy)
-	http.HandleFunc("/proxy", handleProxy) // Also handle /proxy without trailing slash
-	http.HandleFunc("/getconfig/", handleConfigFiles)
-	http.HandleFunc("/", handleRoot)
+	// Config key commands run before anything needs the key
+	switch flag.Arg(0) {
+	case "keygen":
+		key, err := generateSecretKey()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		fmt.Println(key)
+		return
+	case "encrypt-secret":
+		if err := runEncryptSecret(os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("Failed to encrypt: %v", err)
+		}
+		return
+	}
+
+	// Settings from the config file fill in flags not given
+	if err := applyConfigFile(flag.CommandLine); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Decrypt enc:v1: values given on the command line
+	if err := decryptFlags(); err != nil {
+		log.Fatalf("Failed to decrypt flags: %v", err)
+	}
+
+	if err := startSyslog(); err != nil {
+		log.Fatal(err)
+	}
+	applyGOMAXPROCS()
+	setInstanceID()
+	setControlParams(*stripParams)
+	if *adminToken == "" {
+		*adminToken = os.Getenv("ARGON_ADMIN_TOKEN")
+	}
+	if *vaultAddr == "" {
+		*vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if *vaultToken == "" {
+		*vaultToken = os.Getenv("VAULT_TOKEN")
+	}
+
+	// Connect to Vault before loading config that references it
+	if err := startVault(); err != nil {
+		log.Fatalf("Failed to start Vault client: %v", err)
+	}
+
+	// Apply the upstream TLS policy before routes build their transports
+	if err := configureUpstreamTLS(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load host-based routes
+	table, err := loadRouteTable(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	activeRoutes.Store(table)
+
+	// Open the storage shared by stateful features
+	if store, err = openStore(*storeURL); err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	startStats()
+	defer flushStats()
+
+	// Run a subcommand instead of the server if one is given
+	switch flag.Arg(0) {
+	case "":
+	case "selftest":
+		os.Exit(runSelfTest())
+	case "conformance":
+		os.Exit(runConformance())
+	case "test-routes":
+		os.Exit(runTestRoutes(flag.Arg(1)))
+	case "install":
+		if err := installService(); err != nil {
+			log.Fatalf("Failed to install service: %v", err)
+		}
+		return
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatalf("Failed to uninstall service: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("--tls-cert and --tls-key must be given together")
+	}
+	if *tlsCert != "" && acmeEnabled() {
+		log.Fatalf("--tls-cert and --acme-domains cannot be used together")
+	}
+	if *http3Listen && !tlsEnabled() {
+		log.Fatalf("--http3 requires --tls-cert and --tls-key, or --acme-domains")
+	}
+	if *redirectHTTP != "" && !tlsEnabled() {
+		log.Fatalf("--redirect-http requires --tls-cert and --tls-key, or --acme-domains")
+	}
+
+	if *streamLimitPolicy != "reject" && *streamLimitPolicy != "evict-oldest" {
+		log.Fatalf("--stream-limit-policy must be reject or evict-oldest")
+	}
+	if err := validateHostPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if *maxIdleConns < 0 || *maxIdleConnsPerHost < 1 || *idleConnTimeout < 0 || *dialTimeout <= 0 {
+		log.Fatalf("--max-idle-conns must not be negative, --max-idle-conns-per-host must be at least 1 and --dial-timeout positive")
+	}
+	if *inboxEnabled && (*inboxKeep < 1 || *inboxTTL <= 0) {
+		log.Fatalf("--inbox-keep and --inbox-ttl must be positive")
+	}
+	if u, err := url.Parse(*readyProbe); *readyProbe != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || *readyProbeTimeout <= 0) {
+		log.Fatalf("--ready-probe must be an http or https URL and --ready-probe-timeout positive")
+	}
+	if *coalesce && *coalesceBuffer < 64*1024 {
+		log.Fatal("--coalesce-buffer must be at least 64KiB")
+	}
+	if *parallelHosts != "" && (*parallelChunkSize < 64*1024 || *parallelConnections < 2) {
+		log.Fatalf("--parallel-chunk-size must be at least 64KiB and --parallel-connections at least 2")
+	}
+	if *cacheDir != "" && (*cacheDirSize <= 0 || *cacheDirMaxObject <= 0) {
+		log.Fatalf("--cache-dir-size and --cache-dir-max-object must be positive")
+	}
+	if *rateLimit < 0 || *rateBurst < 0 {
+		log.Fatalf("--rate-limit and --rate-burst must not be negative")
+	}
+	if err := validateCaptcha(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateTLSWatch(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateUpstreamEncodings(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateScan(); err != nil {
+		log.Fatal(err)
+	}
+	if authenticator, err = openAuthenticator(*authMode); err != nil {
+		log.Fatal(err)
+	}
+	if err := startBlocklists(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startPolicy(); err != nil {
+		log.Fatalf("Failed to load policy bundle: %v", err)
+	}
+	startExtAuthz()
+	if err := startAccessLog(); err != nil {
+		log.Fatal(err)
+	}
+	if *cacheDir != "" {
+		if err := loadDiskCache(); err != nil {
+			log.Fatalf("Failed to open --cache-dir: %v", err)
+		}
+	}
+	startScheduledFetches()
+	startPurgeListener()
+	watchReloadSignal()
+	// Plain HTTP is served first, as it answers HTTP-01 challenges
+	if err := startHTTPRedirect(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startACME(); err != nil {
+		log.Fatalf("Failed to set up ACME certificates: %v", err)
+	}
 
 	// Format listen address
 	listenAddr := fmt.Sprintf("%s:%d", *address, *port)
 
+	// Let the platform service manager drive the server if it started us
+	if runAsService(listenAddr) {
+		return
+	}
+
 	// Log startup information
 	printStartupInfo(listenAddr)
 
 	// Start the server
 	log.Printf("Server starting on %s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, nil); err != nil {
+	if err := serve(listenAddr); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
+// server is the running HTTP server, kept so service managers can stop it
+var server *http.Server
+
+// serverStarted is closed once server is set
+var serverStarted = make(chan struct{})
+
+// serve runs the HTTP server until it fails or is shut down
+func serve(listenAddr string) error {
+	handler := newHandler()
+	if *http3Listen {
+		handler = startHTTP3(listenAddr, handler)
+	}
+	server = &http.Server{Addr: listenAddr, Handler: handler, TLSConfig: serverTLSConfig()}
+	close(serverStarted)
+	listeners, err := listen(listenAddr, *listenerCount)
+	if err != nil {
+		return err
+	}
+	return serveListeners(server, listeners)
+}
+
+// startHTTPRedirect listens for plain HTTP on --redirect-http and sends every
+// request to the same host and path on the HTTPS listener
+func startHTTPRedirect() error {
+	if *redirectHTTP == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", *redirectHTTP)
+	if err != nil {
+		return fmt.Errorf("--redirect-http: %v", err)
+	}
+	log.Printf("Redirecting HTTP on %s to HTTPS", l.Addr())
+	go func() {
+		if err := http.Serve(l, http.HandlerFunc(redirectToHTTPS)); err != nil {
+			log.Printf("HTTP redirect listener stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// redirectToHTTPS answers a plain HTTP request with 301 to its HTTPS URL,
+// except for the CA's ACME challenges
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if handleACMEChallenge(w, r) {
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		return
+	}
+	if *port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(*port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// tlsEnabled reports whether the server listens with TLS
+func tlsEnabled() bool {
+	return (*tlsCert != "" && *tlsKey != "") || acmeEnabled()
+}
+
+// newHandler registers the HTTP handlers and wraps them with routing
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy/", handleProxy)
+	mux.HandleFunc("/proxy", handleProxy) // Also handle /proxy without trailing slash
+	mux.HandleFunc("/getconfig/", handleConfigFiles)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	if *metricsEnabled {
+		mux.HandleFunc("/metrics", handleMetrics)
+	}
+	if *debugCurl {
+		mux.HandleFunc("/debug/curl", handleDebugCurl)
+		mux.HandleFunc("/debug/curl/", handleDebugCurl)
+	}
+	registerAdminHandlers(mux)
+	registerCaptchaHandlers(mux)
+	registerAbuseHandlers(mux)
+	registerInboxHandlers(mux)
+	registerSnapshotHandlers(mux)
+	registerImmutableHandlers(mux)
+	mux.HandleFunc("/", handleRoot)
+
+	return withRoute(withAccessLog(withSubdomainTarget(mux)))
+}
+
 // -----------------------------
 // PROXY REQUEST HANDLING
 // -----------------------------
 
 // handleProxy processes proxy requests to external services
 func handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Handle OPTIONS requests for CORS preflight
-	if r.Method == "OPTIONS" {
-		handlePreflight(w, r)
+	r, ok := admitProxyRequest(w, r, "")
+	if !ok {
 		return
 	}
 
 	// Parse target URL from request
-	targetURL := parseTargetURL(r)
+	targetURL, err := parseTargetURL(r)
+	if err != nil {
+		proxyError(w, r, http.StatusBadRequest, err.Error(), "")
+		return
+	}
 
 	if targetURL == "" {
 		displayUsage(w, r, "proxy")
@@ -73,88 +498,433 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 	processProxyRequest(w, r, targetURL)
 }
 
-// parseTargetURL extracts the target URL from the request
+// admitProxyRequest runs the checks every proxy request passes before its
+// target is looked at, whether the target comes from /proxy/ or from a
+// subdomain: CORS origin and preflight, method, federation, authentication,
+// rate limit, captcha, schedule, budget and body size. It returns false
+// when the response was already written.
+func admitProxyRequest(w http.ResponseWriter, r *http.Request, target string) (*http.Request, bool) {
+	addLimitHeaders(w)
+
+	// Browsers on origins the route does not allow are refused, preflights included
+	if !checkCORSOrigin(w, r) {
+		return r, false
+	}
+
+	// Handle OPTIONS requests for CORS preflight
+	if isPreflight(r) {
+		handlePreflight(w, r)
+		return r, false
+	}
+
+	// Reject methods the route does not allow
+	if !routeFor(r).allowsMethod(r.Method) && !reportOnly(r, "methods", "method not allowed") {
+		proxyError(w, r, http.StatusMethodNotAllowed, "Method not allowed", target)
+		return r, false
+	}
+
+	// Requests forwarded by another instance carry their client's identity
+	r, ok := acceptFederation(w, r)
+	if !ok {
+		return r, false
+	}
+	if r, ok = requireAuth(w, r); !ok {
+		return r, false
+	}
+	if !checkRateLimit(w, r) {
+		return r, false
+	}
+
+	// Anonymous clients must have solved a captcha
+	if identityFor(r) == "" && federated(r) == nil && !requireCaptcha(w, r) {
+		return r, false
+	}
+
+	// Routes and callers may be limited to certain hours
+	if !checkSchedule(w, r) {
+		return r, false
+	}
+	if r, ok = checkBudget(w, r); !ok {
+		return r, false
+	}
+
+	return r, limitRequestBody(w, r)
+}
+
+// errAmbiguousTarget is returned when a request names more than one target
+var errAmbiguousTarget = errors.New("multiple targets specified; use exactly one target parameter or path")
+
+// errInvalidTargetEncoding is returned when the target cannot be URL-decoded
+var errInvalidTargetEncoding = errors.New("invalid URL encoding in target")
+
+// parseTargetURL extracts and decodes the target URL from the request
 // Uses manual parsing to handle nested query parameters
-func parseTargetURL(r *http.Request) string {
-	// First try to get the target from query parameters
-	rawQuery := r.URL.RawQuery
-	targetPrefix := "target="
-	targetStart := strings.Index(rawQuery, targetPrefix)
+func parseTargetURL(r *http.Request) (string, error) {
+	// Path targets keep their escaping (so a literal %23 stays in the path)
+	// unless the whole URL was encoded, e.g. /proxy/https%3A%2F%2Fexample.com
+	pathTarget := ""
+	if escapedPath := r.URL.EscapedPath(); strings.HasPrefix(escapedPath, "/proxy/") {
+		pathTarget = escapedPath[len("/proxy/"):]
+		if lower := strings.ToLower(pathTarget); strings.HasPrefix(lower, "http%3a") || strings.HasPrefix(lower, "https%3a") ||
+			strings.HasPrefix(lower, "ws%3a") || strings.HasPrefix(lower, "wss%3a") {
+			decoded, err := url.PathUnescape(pathTarget)
+			if err != nil {
+				return "", errInvalidTargetEncoding
+			}
+			pathTarget = decoded
+		}
+	}
 
-	if targetStart == -1 {
-		// If not in query, check if target is provided in the path
-		if strings.HasPrefix(r.URL.Path, "/proxy/") {
-			return r.URL.Path[len("/proxy/"):]
+	// Look for target parameters in the raw query string. Only exact "target="
+	// keys count, and more than one is rejected so allowlist checks cannot be
+	// confused by a second target hidden later in the query.
+	targetPrefix := "target="
+	queryTarget := ""
+	found := false
+	for _, part := range strings.Split(r.URL.RawQuery, "&") {
+		if !strings.HasPrefix(part, targetPrefix) {
+			continue
 		}
-		return ""
+		if found {
+			return "", errAmbiguousTarget
+		}
+		found = true
+		queryTarget = part[len(targetPrefix):]
+	}
+
+	if !found {
+		return punycodeTarget(r, pathTarget)
 	}
 
-	// Extract target value from raw query string
-	targetValueEncoded := rawQuery[targetStart+len(targetPrefix):]
-	endIndex := strings.Index(targetValueEncoded, "&")
-	if endIndex != -1 {
-		targetValueEncoded = targetValueEncoded[:endIndex]
+	// A target in both the path and the query is just as ambiguous
+	if pathTarget != "" {
+		return "", errAmbiguousTarget
 	}
 
 	if *verbose {
-		log.Printf("Target URL from raw query (encoded): %s", targetValueEncoded)
+		log.Printf("Target URL from raw query (encoded): %s", queryTarget)
 	}
 
-	return targetValueEncoded
+	// Decode the query target; a literal hash must arrive as %2523
+	decoded, err := url.QueryUnescape(queryTarget)
+	if err != nil {
+		return "", errInvalidTargetEncoding
+	}
+
+	return punycodeTarget(r, decoded)
 }
 
-// processProxyRequest handles the proxy forwarding logic
-func processProxyRequest(w http.ResponseWriter, r *http.Request, rawTargetURL string) {
-	if *verbose {
-		log.Printf("Processing raw target URL: %s", rawTargetURL)
+// buildUpstreamRequest creates the upstream request with the route's
+// regional upstream, client hints, languages and credentials. It returns
+// false when the response was already written.
+func buildUpstreamRequest(w http.ResponseWriter, r *http.Request, finalURL string) (*http.Request, *regionalPick, bool) {
+	proxyReq, err := createProxyRequest(r, finalURL)
+	if err != nil {
+		proxyError(w, r, http.StatusInternalServerError, "Error creating proxy request", finalURL)
+		return nil, nil, false
+	}
+	if err := prepareWebDAV(w, r, proxyReq); err != nil {
+		proxyError(w, r, http.StatusBadRequest, err.Error(), finalURL)
+		return nil, nil, false
 	}
+	regional := selectRegional(r, proxyReq)
 
-	// Decode the raw target URL string
-	decodedURL, err := url.QueryUnescape(rawTargetURL)
-	if err != nil {
-		http.Error(w, "Invalid URL encoding in target", http.StatusBadRequest)
+	applyClientHints(r, proxyReq)
+	applyAcceptLanguage(r, proxyReq)
+
+	// Add the headers the policy service asked for and the route's upstream credentials
+	applyAuthzHeaders(r, proxyReq)
+	if err := applyUpstreamHeaders(r, proxyReq); err != nil {
+		log.Printf("Error adding upstream credentials: %v", err)
+		proxyError(w, r, http.StatusBadGateway, "Upstream credentials unavailable", finalURL)
+		return nil, nil, false
+	}
+	if err := applyIdentityToken(r, proxyReq); err != nil {
+		log.Printf("Error adding identity token: %v", err)
+		proxyError(w, r, http.StatusBadGateway, "Upstream credentials unavailable", finalURL)
+		return nil, nil, false
+	}
+	return proxyReq, regional, true
+}
+
+// signAndChain signs the upstream request and prepares it for the next
+// instance of a chained route, as the last changes before it is sent. It
+// returns false when the response was already written.
+func signAndChain(w http.ResponseWriter, r *http.Request, proxyReq *http.Request, finalURL string) bool {
+	if err := signUpstreamRequest(r, proxyReq); err != nil {
+		log.Printf("Error signing upstream request: %v", err)
+		switch {
+		case errors.Is(err, errUpstreamCredentials):
+			proxyError(w, r, http.StatusBadGateway, "Upstream credentials unavailable", finalURL)
+		case bodyTooLarge(err):
+			proxyError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", *maxBodySize), finalURL)
+		case errors.Is(err, errSignBodyTooLarge):
+			proxyError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes, the most that can be signed", sigv4MaxBody), finalURL)
+		default:
+			proxyError(w, r, http.StatusBadRequest, "Error reading request body", finalURL)
+		}
+		return false
+	}
+	if err := chainUpstreamRequest(r, proxyReq); err != nil {
+		log.Printf("Error chaining upstream request: %v", err)
+		proxyError(w, r, http.StatusBadGateway, "Upstream credentials unavailable", finalURL)
+		return false
+	}
+	return true
+}
+
+// processProxyRequest handles the proxy forwarding logic
+func processProxyRequest(w http.ResponseWriter, r *http.Request, decodedURL string) {
+	finalURL := resolveTargetURL(r, decodedURL)
+	noteAccess(r, func(rec *accessRecord) { rec.Target = finalURL })
+
+	if !checkIPTarget(w, r, finalURL) || !checkTargetHost(w, r, finalURL) || !checkBlocklist(w, r, finalURL) || !checkOriginTarget(w, r, finalURL) {
+		return
+	}
+	if !applyCORSToken(w, r, finalURL) {
+		return
+	}
+	checksum, ok := startChecksum(w, r, finalURL)
+	if !ok {
 		return
 	}
 
-	// Ensure the URL has a scheme (http:// or https://)
-	if !strings.HasPrefix(decodedURL, "http://") && !strings.HasPrefix(decodedURL, "https://") {
-		decodedURL = "https://" + decodedURL
+	// Let the policy service decide before anything is sent
+	r, ok = authorizeRequest(w, r, finalURL)
+	if !ok {
+		return
 	}
 
-	if *verbose {
-		log.Printf("Decoded target URL: %s", decodedURL)
+	// Replay the stored response for a retried Idempotency-Key
+	idem, ok := startIdempotent(w, r, finalURL)
+	if !ok {
+		return
+	}
+	if idem != nil {
+		w = idem
+		defer idem.finish()
 	}
 
-	// Process additional query parameters
-	finalURL := buildFinalURL(r, decodedURL)
+	// A merged paginated response may be asked for with X-Argon-Paginate
+	paged, ok := startPagination(w, r, finalURL)
+	if !ok {
+		return
+	}
 
 	// Create proxy request
-	proxyReq, err := createProxyRequest(r, finalURL)
-	if err != nil {
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+	proxyReq, regional, ok := buildUpstreamRequest(w, r, finalURL)
+	if !ok {
+		return
+	}
+	// Fresh cached responses are served without asking the upstream
+	cached, hit := serveFromCache(w, r, proxyReq)
+	if hit {
+		return
+	}
+	// Copy the request to the route's candidate upstream before it is compressed and signed
+	compare := startCompare(r, proxyReq)
+	// Compress before signing, which covers the body as sent
+	setUpstreamAcceptEncoding(proxyReq)
+	checksum.prepare(proxyReq)
+	compressUpstreamRequest(r, proxyReq)
+	delta := startDelta(r, proxyReq)
+	immutable := wantsImmutable(r, proxyReq)
+	if !signAndChain(w, r, proxyReq, finalURL) {
 		return
 	}
 
+	// Upstreams with max_rps or max_concurrent take requests at their own pace
+	release, ok := limitUpstream(w, r, proxyReq, finalURL)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Record the exchange if the audit log or another recorder wants it
+	capture := startCapture(r, proxyReq)
+
 	// Send the request
-	client := &http.Client{}
+	started := time.Now()
+	client := routeFor(r).upstreamClient()
+	restrictRedirects(r, client)
+	coalesceRequests(r, client)
+	proxyReq, timer, cancel := withUpstreamTimeout(proxyReq)
+	defer cancel()
 	resp, err := client.Do(proxyReq)
+	for err != nil && !timer.timedOut() && r.Context().Err() == nil && regional.failover(proxyReq, err) {
+		timer.restart()
+		resp, err = client.Do(proxyReq)
+	}
+	timer.stop()
+	annotateUpstream(w, proxyReq, resp, time.Since(started))
+	if timer.timedOut() && err != nil {
+		err = fmt.Errorf("no response within %s", *upstreamTimeout)
+		capture.finish(err)
+		recordProxyMetrics(proxyReq.URL.Hostname(), 0, 0)
+		recordStats(r, proxyReq.URL.Hostname(), 0, 0)
+		recordSLO(r, 0, 0, time.Since(started))
+		if serveFallback(w, r, err.Error()) {
+			return
+		}
+		proxyError(w, r, http.StatusGatewayTimeout, fmt.Sprintf("Upstream timed out: %v", err), finalURL)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error proxying request: %v", err), http.StatusBadGateway)
+		capture.finish(err)
+		recordProxyMetrics(proxyReq.URL.Hostname(), 0, 0)
+		recordStats(r, proxyReq.URL.Hostname(), 0, 0)
+		recordSLO(r, 0, 0, time.Since(started))
+		if r.Context().Err() != nil {
+			if *verbose {
+				log.Printf("Client disconnected before %s responded", proxyReq.URL.Host)
+			}
+			http.Error(w, "Client closed request", statusClientClosed)
+			return
+		}
+		if bodyTooLarge(err) {
+			proxyError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", *maxBodySize), finalURL)
+			return
+		}
+		if errors.Is(err, errTargetNotAllowed) || errors.Is(err, errHostDenied) || errors.Is(err, errBlocklisted) || errors.Is(err, errIPTarget) || errors.Is(err, errPrivateTarget) {
+			proxyError(w, r, http.StatusForbidden, fmt.Sprintf("Error proxying request: %v", err), finalURL)
+			return
+		}
+		if serveFallback(w, r, err.Error()) {
+			return
+		}
+		proxyError(w, r, http.StatusBadGateway, fmt.Sprintf("Error proxying request: %v", err), finalURL)
+		return
+	}
+	// The body may be wrapped below; closing the outermost wrapper closes all
+	defer func() { resp.Body.Close() }()
+
+	// A stale cached response the upstream confirmed is served from the cache
+	if cached.revalidated(w, r, resp) {
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		return
+	}
+
+	// A route's fallback may stand in for an upstream error response
+	if fallbackFor5xx(r, resp) && serveFallback(w, r, resp.Status) {
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordSLO(r, resp.StatusCode, 0, time.Since(started))
 		return
 	}
-	defer resp.Body.Close()
 
 	// Process the response
-	processProxyResponse(w, r, resp)
+	recordUpstreamCert(proxyReq.URL.Hostname(), resp.TLS)
+	checkUpstreamTLS(w, proxyReq.URL.Hostname(), resp.TLS)
+	learnRequestEncoding(r, proxyReq, resp)
+	resumeDownload(r, client, resp)
+	accelerateDownload(r, client, resp)
+	checksum.verify(resp)
+	capture.captureResponse(resp)
+	if !validateResponseSchema(w, r, resp, finalURL) {
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordSLO(r, http.StatusBadGateway, 0, time.Since(started))
+		return
+	}
+
+	if !checkHotlink(w, r, resp, finalURL) {
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordSLO(r, http.StatusForbidden, 0, time.Since(started))
+		return
+	}
+	if !scanDownload(w, r, resp, finalURL) {
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordSLO(r, http.StatusForbidden, 0, time.Since(started))
+		return
+	}
+
+	// Hold long-lived streams against the client's stream limit
+	if isLongLivedStream(resp) {
+		release, ok := trackStream(r, func() { resp.Body.Close() })
+		if !ok {
+			capture.finish(nil)
+			proxyError(w, r, http.StatusTooManyRequests, "Too many open streams for this client", finalURL)
+			return
+		}
+		defer release()
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols && isWebSocketRequest(r) {
+		elapsed := time.Since(started)
+		sent, received := relayWebSocket(w, r, resp)
+		noteAccess(r, func(rec *accessRecord) { rec.Bytes = sent })
+		chargeBudget(r, sent+received)
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, sent)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, sent)
+		recordSLO(r, resp.StatusCode, 0, elapsed)
+		return
+	}
+	if compare.respondsWithDiff() {
+		written := compare.respond(w, r, resp)
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, written)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, written)
+		recordSLO(r, http.StatusOK, written, time.Since(started))
+		return
+	}
+	if err := paged.merge(w, r, client, proxyReq, resp); err != nil {
+		log.Printf("Error merging pages from %s: %v", proxyReq.URL.Host, err)
+		capture.finish(nil)
+		recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, 0)
+		recordSLO(r, http.StatusBadGateway, 0, time.Since(started))
+		proxyError(w, r, http.StatusBadGateway, fmt.Sprintf("Error merging pages: %v", err), finalURL)
+		return
+	}
+	cached.store(resp)
+	delta.apply(resp)
+	if immutable {
+		storeImmutable(w, resp)
+	}
+	compare.tee(resp)
+	recodeResponse(r, resp)
+	throttleResponse(r, resp)
+	archive := startArchive(r, resp)
+	written := processProxyResponse(w, r, resp)
+	archive.finish(finalURL)
+	compare.finish(resp)
+	chargeBudget(r, max(r.ContentLength, 0)+written)
+	capture.finish(nil)
+	recordProxyMetrics(proxyReq.URL.Hostname(), resp.StatusCode, written)
+	recordStats(r, proxyReq.URL.Hostname(), resp.StatusCode, written)
+	recordSLO(r, resp.StatusCode, written, time.Since(started))
+}
+
+// resolveTargetURL turns a decoded target into the URL sent upstream
+func resolveTargetURL(r *http.Request, decodedURL string) string {
+	// Ensure the URL has a scheme (http:// or https://)
+	decodedURL = webSocketTarget(decodedURL)
+	if !strings.HasPrefix(decodedURL, "http://") && !strings.HasPrefix(decodedURL, "https://") {
+		decodedURL = "https://" + decodedURL
+	}
+
+	if *verbose {
+		log.Printf("Decoded target URL: %s", decodedURL)
+	}
+
+	// Process additional query parameters
+	return buildFinalURL(r, decodedURL)
 }
 
 // buildFinalURL constructs the final URL with additional parameters
 func buildFinalURL(r *http.Request, decodedURL string) string {
-	// Extract non-target query parameters
+	// Extract non-control query parameters, keeping their order and encoding
 	rawQuery := r.URL.RawQuery
 	additionalParams := ""
 	for _, part := range strings.Split(rawQuery, "&") {
-		if !strings.HasPrefix(part, "target=") && part != "" {
+		if part != "" && !isControlParam(part) {
 			if additionalParams == "" {
 				additionalParams = part
 			} else {
@@ -163,16 +933,28 @@ func buildFinalURL(r *http.Request, decodedURL string) string {
 		}
 	}
 
+	// Split off the fragment so parameters are added before it
+	finalURL, fragment, hasFragment := strings.Cut(decodedURL, "#")
+
 	// Combine target URL with additional parameters
-	finalURL := decodedURL
 	if additionalParams != "" {
-		if strings.Contains(decodedURL, "?") {
+		if strings.Contains(finalURL, "?") {
 			finalURL += "&" + additionalParams
 		} else {
 			finalURL += "?" + additionalParams
 		}
 	}
 
+	// Put the fragment back; HTTP clients never send fragments, so optionally
+	// forward it to the upstream as encoded data instead
+	if hasFragment {
+		if *forwardFragment {
+			finalURL += "%23" + strings.NewReplacer("#", "%23", "?", "%3F").Replace(fragment)
+		} else {
+			finalURL += "#" + fragment
+		}
+	}
+
 	if *verbose {
 		log.Printf("Final URL to proxy: %s", finalURL)
 	}
@@ -180,15 +962,40 @@ func buildFinalURL(r *http.Request, decodedURL string) string {
 	return finalURL
 }
 
+// controlParams holds the query parameters consumed by the proxy itself
+var controlParams = map[string]bool{"target": true}
+
+// setControlParams makes target and the configured parameter names the
+// strip list, replacing any set before
+func setControlParams(list string) {
+	controlParams = map[string]bool{"target": true}
+	for _, name := range splitList(list) {
+		controlParams[name] = true
+	}
+}
+
+// isControlParam reports whether a raw "key=value" query part must not be forwarded
+func isControlParam(part string) bool {
+	key, _, _ := strings.Cut(part, "=")
+	if decoded, err := url.QueryUnescape(key); err == nil {
+		key = decoded
+	}
+	return controlParams[key]
+}
+
 // createProxyRequest creates a new HTTP request for the target URL
 func createProxyRequest(r *http.Request, finalURL string) (*http.Request, error) {
-	proxyReq, err := http.NewRequest(r.Method, finalURL, r.Body)
+	// The upstream request is abandoned when the client disconnects
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, finalURL, r.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	// Copy original headers
 	copyRequestHeaders(r, proxyReq)
+	if isWebSocketRequest(r) {
+		proxyReq.Header.Set("Connection", "Upgrade")
+	}
 
 	// Set the Host header from the target URL
 	if hostStart := strings.Index(finalURL, "://"); hostStart != -1 {
@@ -205,13 +1012,28 @@ func createProxyRequest(r *http.Request, finalURL string) (*http.Request, error)
 
 // copyRequestHeaders copies relevant headers from the original request
 func copyRequestHeaders(r *http.Request, proxyReq *http.Request) {
-	// Copy original headers, except those that should be skipped
+	// Copy original headers, except those that should be skipped. All values
+	// share one backing array; the capped slices keep a later Add on one
+	// header from overwriting the next.
+	n := 0
+	for _, values := range r.Header {
+		n += len(values)
+	}
+	backing := make([]string, 0, n)
 	for key, values := range r.Header {
-		if !shouldSkipHeader(key) {
-			for _, value := range values {
-				proxyReq.Header.Add(key, value)
-			}
+		if shouldSkipHeader(key) {
+			continue
 		}
+		start := len(backing)
+		backing = append(backing, values...)
+		proxyReq.Header[key] = backing[start:len(backing):len(backing)]
+	}
+
+	if captchaEnabled() {
+		stripCaptchaSession(proxyReq)
+	}
+	if authenticator != nil {
+		authenticator.Strip(proxyReq)
 	}
 
 	// Forward the real client IP if available
@@ -220,26 +1042,74 @@ func copyRequestHeaders(r *http.Request, proxyReq *http.Request) {
 	}
 }
 
-// processProxyResponse handles the response from the target server
-func processProxyResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+// processProxyResponse handles the response from the target server and
+// returns the number of body bytes relayed
+func processProxyResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) int64 {
+	writeResponseHeaders(w, r, resp)
+
+	// Set the status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy the response body, flushing streamed responses as they arrive
+	body, stop := streamWriter(w, resp)
+	written, err := copyBody(body, resp.Body)
+	stop()
+	if errors.Is(err, errChecksumMismatch) {
+		// Abort rather than let the client take the short body as complete
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		log.Printf("Error copying response: %v", err)
+	}
+	return written
+}
+
+// writeResponseHeaders sets the client's response headers from the
+// upstream's, with the proxy's CORS and isolation headers
+func writeResponseHeaders(w http.ResponseWriter, r *http.Request, resp *http.Response) {
 	// Add CORS headers
 	addCORSHeaders(w, r)
 
-	// Copy the response headers, excluding ones that might conflict with our CORS headers
+	// Copy the response headers, excluding ones that might conflict with our CORS headers.
+	// Keys from the client are already canonical, so the map is written directly,
+	// with new values sharing one backing array as in copyRequestHeaders.
+	header := w.Header()
+	n := 0
+	for _, values := range resp.Header {
+		n += len(values)
+	}
+	backing := make([]string, 0, n)
+	chained := routeFor(r).Chain != nil
 	for key, values := range resp.Header {
-		if !strings.HasPrefix(strings.ToLower(key), "access-control-") {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+		if isAccessControlHeader(key) {
+			continue
+		}
+		if chained && key == "X-Request-Id" {
+			continue // the next instance echoes our own ID
+		}
+		if *upstreamAnnotations && strings.HasPrefix(key, "X-Argon-Upstream-") {
+			continue // a chained instance's annotations, replaced by ours
 		}
+		if *rateLimit > 0 && strings.HasPrefix(key, "X-Ratelimit-") {
+			continue // the upstream's allowance, replaced by the proxy's
+		}
+		if existing := header[key]; len(existing) > 0 {
+			header[key] = append(existing, values...)
+			continue
+		}
+		start := len(backing)
+		backing = append(backing, values...)
+		header[key] = backing[start:len(backing):len(backing)]
 	}
 
-	// Set the status code
-	w.WriteHeader(resp.StatusCode)
+	// Replace the upstream's cross-origin isolation headers with the configured ones
+	addIsolationHeaders(w, r)
+	addAcceptCH(w, r)
+	addProxiedBy(w)
 
-	// Copy the response body
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("Error copying response: %v", err)
+	// Keep cookies and redirects on the encoded subdomain
+	if _, ok := subdomainTarget(r); ok {
+		rewriteSubdomainResponse(r, w.Header())
 	}
 }
 
@@ -251,14 +1121,11 @@ func processProxyResponse(w http.ResponseWriter, r *http.Request, resp *http.Res
 func handlePreflight(w http.ResponseWriter, r *http.Request) {
 	addCORSHeaders(w, r)
 
-	// Handle the specific Access-Control-Request-Method header
-	if r.Header.Get("Access-Control-Request-Method") != "" {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE, HEAD, PATCH")
-	}
+	// Methods and headers only matter to preflights, so simple requests skip them
+	w.Header().Set("Access-Control-Allow-Methods", routeFor(r).allowMethods)
 
 	// Handle the specific Access-Control-Request-Headers header
-	if r.Header.Get("Access-Control-Request-Headers") != "" {
-		requestHeaders := r.Header.Get("Access-Control-Request-Headers")
+	if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
 		w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
 	} else {
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
@@ -270,29 +1137,79 @@ func handlePreflight(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent) // 204 No Content
 }
 
-// addCORSHeaders adds CORS headers to the response
+// addCORSHeaders adds the CORS headers every response needs
 func addCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	rt := routeFor(r)
 	origin := r.Header.Get("Origin")
 
-	// If the request has an Origin header and it's allowed, use it for CORS
-	if origin != "" && (*allowedOrigin == "*" || *allowedOrigin == origin) {
+	// If the request has an Origin header and it's allowed, use it for CORS.
+	// A list or wildcard cannot be sent as is, so other requests get no
+	// Allow-Origin from it.
+	// An opaque null origin that is not allowed gets no Allow-Origin at all.
+	if origin != "" && rt.originAllowed(origin) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-	} else {
-		w.Header().Set("Access-Control-Allow-Origin", *allowedOrigin)
+	} else if origin != "null" && (!strings.ContainsAny(rt.AllowOrigin, ",*") || rt.AllowOrigin == "*") {
+		w.Header().Set("Access-Control-Allow-Origin", rt.AllowOrigin)
 	}
 
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE, HEAD, PATCH")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Vary", "Origin")
 }
 
+// originAllowed reports whether an Origin matches the route's allow_origin:
+// "*", or a comma-separated list of exact origins and "https://*.example.com"
+// wildcard subdomains. The null origin is governed by null_origin instead,
+// as any sandboxed or local page can send it.
+func (rt *Route) originAllowed(origin string) bool {
+	if origin == "null" {
+		return rt.NullOrigin == "allow"
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range splitList(rt.AllowOrigin) {
+		if pattern == "*" || originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareNullOrigin checks the route's null_origin policy
+func (rt *Route) prepareNullOrigin() error {
+	if rt.NullOrigin != "allow" && rt.NullOrigin != "reject" {
+		return fmt.Errorf("route %q: null_origin must be allow or reject", rt.Name)
+	}
+	return nil
+}
+
+// checkCORSOrigin refuses requests from browser origins the route does not
+// allow. Requests without an Origin header are not affected.
+func checkCORSOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || routeFor(r).originAllowed(origin) || reportOnly(r, "origin", fmt.Sprintf("origin %q is not allowed", origin)) {
+		return true
+	}
+	w.Header().Set("Vary", "Origin")
+	proxyError(w, r, http.StatusForbidden, fmt.Sprintf("Origin %q is not allowed", origin), "")
+	return false
+}
+
+// isAccessControlHeader reports whether a header is an Access-Control-* header
+func isAccessControlHeader(key string) bool {
+	const prefix = "Access-Control-"
+	return len(key) >= len(prefix) && strings.EqualFold(key[:len(prefix)], prefix)
+}
+
 // -----------------------------
 // UTILITY FUNCTIONS
 // -----------------------------
 
 // getClientIP extracts the original client IP address
 func getClientIP(r *http.Request) string {
+	// Another instance that chained the request vouched for its client
+	if f := federated(r); f != nil && f.client != "" {
+		return f.client
+	}
+
 	// X-Forwarded-For can be comma-separated list of IPs
 	// The leftmost IP is the original client IP
 	if *trustProxy {
@@ -313,16 +1230,47 @@ func getClientIP(r *http.Request) string {
 	return strings.Split(r.RemoteAddr, ":")[0]
 }
 
+type requestIDContextKey struct{}
+
+// newRequestID reuses a valid incoming X-Request-ID or generates a new one
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID assigned to the request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // shouldSkipHeader returns true if a header should not be forwarded
 func shouldSkipHeader(key string) bool {
-	lower := strings.ToLower(key)
-	return strings.EqualFold(key, "Connection") ||
-		strings.EqualFold(key, "Host") ||
-		strings.EqualFold(key, "X-Forwarded-Host") ||
-		strings.EqualFold(key, "X-Forwarded-Proto") ||
-		strings.EqualFold(key, "Content-Length") ||
-		// Skip Nginx specific headers that should not be forwarded
-		strings.HasPrefix(lower, "x-nginx")
+	switch textproto.CanonicalMIMEHeaderKey(key) {
+	case "Connection", "Host", "X-Forwarded-Host", "X-Forwarded-Proto", "Content-Length", captchaHeader, paginateHeader, immutableHeader, corsTokenHeader, checksumHeader:
+		return true
+	}
+	// Federation headers are only set by the proxy itself
+	if len(key) >= len(federationHeaderPrefix) && strings.EqualFold(key[:len(federationHeaderPrefix)], federationHeaderPrefix) {
+		return true
+	}
+	// Skip Nginx specific headers that should not be forwarded
+	return len(key) >= 7 && strings.EqualFold(key[:7], "x-nginx")
 }
 
 // -----------------------------
@@ -381,6 +1329,8 @@ func getContentType(filename string) string {
 		return "application/xml"
 	case ".yaml", ".yml":
 		return "application/yaml"
+	case ".html", ".htm":
+		return "text/html; charset=utf-8"
 	case ".conf":
 		return "text/plain"
 	default:
@@ -451,11 +1401,54 @@ func displayUsage(w http.ResponseWriter, r *http.Request, section string) {
 
 // printStartupInfo logs information about the server configuration
 func printStartupInfo(listenAddr string) {
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
 	log.Printf("Starting CORS proxy server on %s", listenAddr)
 	log.Printf("CORS proxy supports:")
-	log.Printf("  - http://%s/proxy/{target-url}", listenAddr)
-	log.Printf("  - http://%s/proxy/?target={target-url}", listenAddr)
-	log.Printf("  - http://%s/getconfig/{filename}", listenAddr)
+	log.Printf("  - %s://%s/proxy/{target-url}", scheme, listenAddr)
+	log.Printf("  - %s://%s/proxy/?target={target-url}", scheme, listenAddr)
+	log.Printf("  - %s://%s/getconfig/{filename}", scheme, listenAddr)
 	log.Printf("CORS Allow-Origin: %s", *allowedOrigin)
+	log.Printf("Target hosts: %s", hostPolicySummary())
 	log.Printf("Trust X-Forwarded-* headers: %v", *trustProxy)
+	log.Printf("Store: %s", storeName(*storeURL))
+	if *listenerCount > 1 {
+		log.Printf("Listeners: %d (SO_REUSEPORT), GOMAXPROCS: %d", *listenerCount, runtime.GOMAXPROCS(0))
+	}
+	if acmeEnabled() {
+		log.Printf("ACME certificate (%s DNS-01): %s", *acmeDNS, *acmeDomains)
+	}
+	if *http3Listen {
+		log.Printf("HTTP/3 (experimental): udp %s", listenAddr)
+	}
+	if *metricsEnabled {
+		log.Printf("Metrics: %s://%s/metrics (max hosts: %d)", scheme, listenAddr, *metricsMaxHosts)
+	}
+	if *adminToken != "" {
+		log.Printf("Admin API: %s://%s/admin/", scheme, listenAddr)
+	}
+	if captchaEnabled() {
+		log.Printf("Captcha gate (%s): %s://%s/captcha", *captchaProviderName, scheme, listenAddr)
+	}
+	if authenticator != nil {
+		log.Printf("Proxy authentication: %s", *authMode)
+	}
+	log.Printf("Instance: %s", proxiedBy)
+	if *abuseContact != "" {
+		log.Printf("Abuse reports: %s://%s/abuse (contact %s)", scheme, listenAddr, *abuseContact)
+	}
+	if *subdomainSuffix != "" {
+		log.Printf("Subdomain targets: %s://{encoded-host}.%s/{path}", scheme, *subdomainSuffix)
+	}
+	for _, rt := range activeRoutes.Load().routes {
+		log.Printf("Route %s: hosts=%s allow-origin=%s", rt.Name, strings.Join(rt.Hosts, ","), rt.AllowOrigin)
+		if rt.SLO != nil {
+			log.Printf("Route %s: SLO latency=%s max-bytes=%d objective=%g", rt.Name, rt.SLO.Latency, rt.SLO.MaxBytes, rt.SLO.Objective)
+		}
+		if rt.ResponseSchema != "" {
+			log.Printf("Route %s: response schema %s (on failure: %s)", rt.Name, rt.ResponseSchema, rt.SchemaAction)
+		}
+	}
 }
@@ -0,0 +1,172 @@
+package argonproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTargetURL(t *testing.T) {
+	if _, err := NewTestHandler(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr error
+	}{
+		{"query", "/proxy/?target=https%3A%2F%2Fexample.com%2Fa%3Fb%3D1", "https://example.com/a?b=1", nil},
+		{"query after other params", "/proxy/?x=1&target=https%3A%2F%2Fexample.com", "https://example.com", nil},
+		{"path", "/proxy/https://example.com/a", "https://example.com/a", nil},
+		{"encoded path", "/proxy/https%3A%2F%2Fexample.com%2Fa", "https://example.com/a", nil},
+		{"similar key is not a target", "/proxy/?mytarget=https%3A%2F%2Fevil.example&target=https%3A%2F%2Fexample.com", "https://example.com", nil},
+		{"duplicate query targets", "/proxy/?target=https%3A%2F%2Fexample.com&target=https%3A%2F%2Fevil.example", "", errAmbiguousTarget},
+		{"duplicate with empty first", "/proxy/?target=&target=https%3A%2F%2Fevil.example", "", errAmbiguousTarget},
+		{"path and query", "/proxy/https%3A%2F%2Fexample.com%2F?target=https%3A%2F%2Fevil.example", "", errAmbiguousTarget},
+		{"bad encoding", "/proxy/?target=https%3A%2F%2Fexample.com%zz", "", errInvalidTargetEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTargetURL(httptest.NewRequest("GET", tt.url, nil))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("target = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmbiguousTargetRejected(t *testing.T) {
+	handler, err := NewTestHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{
+		"/proxy/?target=https%3A%2F%2Fexample.com&target=https%3A%2F%2Fevil.example",
+		"/proxy/https%3A%2F%2Fexample.com%2F?target=https%3A%2F%2Fevil.example",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+// failingReader fails like a client that disconnected mid-body
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read tcp 10.0.0.1:443: connection reset by peer")
+}
+
+func TestSignAndChainErrors(t *testing.T) {
+	defer NewTestHandler()
+	if _, err := NewTestHandler("--max-body-size=100"); err != nil {
+		t.Fatal(err)
+	}
+	rt := &Route{Name: "aws", AWSSigV4: &awsSigV4{Service: "execute-api", Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret"}}
+
+	tests := []struct {
+		name string
+		body func(w http.ResponseWriter) io.ReadCloser
+		want int
+		msg  string
+	}{
+		{"signed", func(http.ResponseWriter) io.ReadCloser { return io.NopCloser(strings.NewReader("{}")) }, http.StatusOK, ""},
+		{"client gone", func(http.ResponseWriter) io.ReadCloser { return io.NopCloser(failingReader{}) }, http.StatusBadRequest, "Error reading request body"},
+		{"over --max-body-size", func(w http.ResponseWriter) io.ReadCloser {
+			return http.MaxBytesReader(w, io.NopCloser(strings.NewReader(strings.Repeat("a", 200))), 100)
+		}, http.StatusRequestEntityTooLarge, "exceeds 100 bytes"},
+		{"too large to sign", func(http.ResponseWriter) io.ReadCloser {
+			return io.NopCloser(io.LimitReader(zeroReader{}, sigv4MaxBody+1))
+		}, http.StatusRequestEntityTooLarge, "the most that can be signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/proxy/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, rt))
+			rec := httptest.NewRecorder()
+			proxyReq := httptest.NewRequest("POST", "https://api.example/items", nil)
+			proxyReq.Body = tt.body(rec)
+			if ok := signAndChain(rec, r, proxyReq, proxyReq.URL.String()); ok != (tt.want == http.StatusOK) {
+				t.Fatalf("signAndChain = %v", ok)
+			}
+			if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.msg) {
+				t.Errorf("response = %d %q, want %d containing %q", rec.Code, rec.Body.String(), tt.want, tt.msg)
+			}
+			if strings.Contains(rec.Body.String(), "connection reset") {
+				t.Errorf("response leaks the read error: %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+// zeroReader reads endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// benchHeader returns n headers like a browser's or upstream's
+func benchHeader(n int) http.Header {
+	header := make(http.Header, n)
+	for i := range n {
+		header.Set(fmt.Sprintf("X-Bench-%d", i), "value-"+strings.Repeat("x", 16))
+	}
+	return header
+}
+
+func BenchmarkAddCORSHeaders(b *testing.B) {
+	if _, err := NewTestHandler("--allow-origin=https://app.example"); err != nil {
+		b.Fatal(err)
+	}
+	defer NewTestHandler()
+	r := httptest.NewRequest("GET", "/proxy/?target=https%3A%2F%2Fexample.com", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	for range b.N {
+		clear(w.Header())
+		addCORSHeaders(w, r)
+	}
+}
+
+func BenchmarkCopyRequestHeaders(b *testing.B) {
+	if _, err := NewTestHandler(); err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/proxy/?target=https%3A%2F%2Fexample.com", nil)
+	r.Header = benchHeader(10)
+	b.ReportAllocs()
+	for range b.N {
+		proxyReq, _ := http.NewRequest("GET", "https://example.com", nil)
+		copyRequestHeaders(r, proxyReq)
+	}
+}
+
+func BenchmarkProcessProxyResponse(b *testing.B) {
+	if _, err := NewTestHandler(); err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/proxy/?target=https%3A%2F%2Fexample.com", nil)
+	r.Header.Set("Origin", "https://app.example")
+	header := benchHeader(10)
+	b.ReportAllocs()
+	for range b.N {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader("{}")), ContentLength: 2}
+		processProxyResponse(httptest.NewRecorder(), r, resp)
+	}
+}
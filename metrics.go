@@ -0,0 +1,150 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// -----------------------------
+// METRICS
+// -----------------------------
+
+// otherHostLabel is the label used for hosts beyond the cardinality limits
+const otherHostLabel = "other"
+
+// hostMetrics holds the counters tracked per target host label
+type hostMetrics struct {
+	requests map[string]uint64 // by status class, e.g. "2xx" or "error"
+	bytes    uint64
+}
+
+// proxyMetrics tracks per-target-host counters with bounded label cardinality
+type proxyMetrics struct {
+	mu       sync.Mutex
+	hosts    map[string]*hostMetrics
+	overflow uint64
+}
+
+var metrics = &proxyMetrics{hosts: make(map[string]*hostMetrics)}
+
+// metricsCollectors write additional metric families to the /metrics output
+var metricsCollectors []func(w io.Writer)
+
+// registerMetrics adds a collector to the /metrics output
+func registerMetrics(collector func(w io.Writer)) {
+	metricsCollectors = append(metricsCollectors, collector)
+}
+
+// hostLabel maps a target host to its metrics label. Hosts matching a
+// -metrics-hosts pattern are labelled with the pattern, so a wildcard stays
+// one series, and everything else is "other"; without a list, the first
+// -metrics-max-hosts distinct hosts are tracked. Must be called with m.mu
+// held.
+func (m *proxyMetrics) hostLabel(host string) string {
+	host = strings.ToLower(host)
+	if known := splitList(*metricsHosts); len(known) > 0 {
+		for _, pattern := range known {
+			if hostMatches(pattern, host) {
+				return strings.ToLower(pattern)
+			}
+		}
+		return otherHostLabel
+	}
+
+	if _, ok := m.hosts[host]; ok {
+		return host
+	}
+	tracked := len(m.hosts)
+	if _, ok := m.hosts[otherHostLabel]; ok {
+		tracked--
+	}
+	if tracked < *metricsMaxHosts {
+		return host
+	}
+	return otherHostLabel
+}
+
+// recordProxyMetrics counts a proxied request; status 0 means the upstream failed
+func recordProxyMetrics(host string, status int, bytes int64) {
+	if !*metricsEnabled {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	label := metrics.hostLabel(host)
+	if label == otherHostLabel && host != otherHostLabel {
+		metrics.overflow++
+	}
+
+	hm := metrics.hosts[label]
+	if hm == nil {
+		hm = &hostMetrics{requests: make(map[string]uint64)}
+		metrics.hosts[label] = hm
+	}
+
+	class := "error"
+	if status > 0 {
+		class = fmt.Sprintf("%dxx", status/100)
+	}
+	hm.requests[class]++
+	if bytes > 0 {
+		hm.bytes += uint64(bytes)
+	}
+}
+
+// handleMetrics serves metrics in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics.mu.Lock()
+	labels := make([]string, 0, len(metrics.hosts))
+	for label := range metrics.hosts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Fprintf(w, "# HELP argon_proxy_requests_total Proxied requests by target host and status class.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_requests_total counter\n")
+	for _, label := range labels {
+		classes := make([]string, 0, len(metrics.hosts[label].requests))
+		for class := range metrics.hosts[label].requests {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "argon_proxy_requests_total{host=%s,status=%q} %d\n",
+				quoteLabel(label), class, metrics.hosts[label].requests[class])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_response_bytes_total Response body bytes relayed by target host.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_response_bytes_total counter\n")
+	for _, label := range labels {
+		fmt.Fprintf(w, "argon_proxy_response_bytes_total{host=%s} %d\n", quoteLabel(label), metrics.hosts[label].bytes)
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_tracked_hosts Distinct host labels currently tracked.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_tracked_hosts gauge\n")
+	fmt.Fprintf(w, "argon_proxy_tracked_hosts %d\n", len(labels))
+
+	fmt.Fprintf(w, "# HELP argon_proxy_host_overflow_total Requests counted under the \"other\" host label.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_host_overflow_total counter\n")
+	fmt.Fprintf(w, "argon_proxy_host_overflow_total %d\n", metrics.overflow)
+	metrics.mu.Unlock()
+
+	for _, collector := range metricsCollectors {
+		collector(w)
+	}
+}
+
+// quoteLabel quotes a Prometheus label value
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
@@ -0,0 +1,28 @@
+package argonproxy
+
+import "testing"
+
+func TestHostLabel(t *testing.T) {
+	defer NewTestHandler()
+	if _, err := NewTestHandler("--metrics-hosts=api.example.com,*.CDN.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &proxyMetrics{hosts: make(map[string]*hostMetrics)}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.Example.com", "api.example.com"},
+		{"a.cdn.example.com", "*.cdn.example.com"},
+		{"b.c.cdn.example.com", "*.cdn.example.com"},
+		{"cdn.example.com", otherHostLabel},
+		{"evil.example", otherHostLabel},
+	}
+	for _, tt := range tests {
+		if got := m.hostLabel(tt.host); got != tt.want {
+			t.Errorf("hostLabel(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package argonproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// -----------------------------
+// PER-ORIGIN TARGET RESTRICTIONS
+// -----------------------------
+
+// errTargetNotAllowed is returned when a redirect leaves the origin's targets
+var errTargetNotAllowed = errors.New("target host not allowed for this origin")
+
+// errHostDenied is returned when a redirect leaves --allow-hosts or enters --deny-hosts
+var errHostDenied = errors.New("target host not allowed")
+
+// errIPTarget is returned when a redirect leads to a raw IP address while
+// --deny-ip-targets is set
+var errIPTarget = errors.New("raw IP targets are not allowed")
+
+// numericHost matches the IPv4 spellings resolvers accept besides the dotted
+// quad, such as 2130706433, 0x7f.1 or 0177.0.0.1
+var numericHost = regexp.MustCompile(`(?i)^(0x[0-9a-f]*|[0-9]+)(\.(0x[0-9a-f]*|[0-9]+)){0,3}\.?$`)
+
+// normalizeOriginTargets lower-cases the origins and host patterns of
+// origin_targets so lookups are case-insensitive
+func (rt *Route) normalizeOriginTargets() {
+	if len(rt.OriginTargets) == 0 {
+		return
+	}
+	byOrigin := make(map[string][]string, len(rt.OriginTargets))
+	for origin, hosts := range rt.OriginTargets {
+		patterns := make([]string, len(hosts))
+		for i, host := range hosts {
+			patterns[i] = strings.ToLower(host)
+		}
+		byOrigin[strings.ToLower(strings.TrimSuffix(origin, "/"))] = patterns
+	}
+	rt.OriginTargets = byOrigin
+}
+
+// originAllowsHost reports whether the request's Origin may reach host. An
+// origin that is not listed uses the "*" entry; without one it may reach
+// nothing. Requests without an Origin header are matched like any other.
+func (rt *Route) originAllowsHost(r *http.Request, host string) bool {
+	if len(rt.OriginTargets) == 0 {
+		return true
+	}
+	patterns, ok := rt.OriginTargets[strings.ToLower(r.Header.Get("Origin"))]
+	if !ok {
+		patterns = rt.OriginTargets["*"]
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if pattern == "*" || hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOriginTarget refuses a target the request's Origin may not reach
+func checkOriginTarget(w http.ResponseWriter, r *http.Request, target string) bool {
+	rt := routeFor(r)
+	if len(rt.OriginTargets) == 0 {
+		return true
+	}
+	u, err := url.Parse(target)
+	if err == nil && rt.originAllowsHost(r, u.Hostname()) {
+		return true
+	}
+	if reportOnly(r, "targets", fmt.Sprintf("target %s not allowed for origin %q", target, r.Header.Get("Origin"))) {
+		return true
+	}
+	addCORSHeaders(w, r)
+	proxyError(w, r, http.StatusForbidden, fmt.Sprintf("Target host not allowed for origin %q", r.Header.Get("Origin")), target)
+	return false
+}
+
+// isIPHost reports whether a target host is an IP address rather than a name
+func isIPHost(host string) bool {
+	host, _, _ = strings.Cut(strings.Trim(host, "[]"), "%")
+	return net.ParseIP(host) != nil || numericHost.MatchString(host)
+}
+
+// checkIPTarget refuses a raw IP target when --deny-ip-targets is set, so
+// that only host names, which allowlists and DNS policies can see, are
+// proxied
+func checkIPTarget(w http.ResponseWriter, r *http.Request, target string) bool {
+	if !*denyIPTargets {
+		return true
+	}
+	u, err := url.Parse(target)
+	if err == nil && !isIPHost(u.Hostname()) || reportOnly(r, "targets", "raw IP target "+target) {
+		return true
+	}
+	addCORSHeaders(w, r)
+	proxyError(w, r, http.StatusForbidden, "Raw IP targets are not allowed; use a host name", target)
+	return false
+}
+
+// restrictRedirects stops the client from following a redirect to a host
+// the request's Origin may not reach, a blocklisted host, or a raw IP with
+// --deny-ip-targets
+func restrictRedirects(r *http.Request, client *http.Client) {
+	rt := routeFor(r)
+	if len(rt.OriginTargets) == 0 && !*denyIPTargets && *allowHosts == "" && *denyHosts == "" && *blocklistSources == "" {
+		return
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		var err error
+		switch {
+		case *denyIPTargets && isIPHost(req.URL.Hostname()):
+			err = fmt.Errorf("redirect to %s: %w", req.URL.Host, errIPTarget)
+		case !targetHostAllowed(req.URL.Hostname()):
+			err = fmt.Errorf("redirect to %s: %w", req.URL.Host, errHostDenied)
+		case blocklisted(req.URL.Hostname()) != "":
+			if reportOnly(r, "blocklist", fmt.Sprintf("redirect to %s, which is on a blocklist", req.URL.Host)) {
+				return nil
+			}
+			blocklists.blocked.Add(1)
+			return fmt.Errorf("redirect to %s: %w", req.URL.Host, errBlocklisted)
+		case !rt.originAllowsHost(r, req.URL.Hostname()):
+			err = fmt.Errorf("redirect to %s: %w", req.URL.Host, errTargetNotAllowed)
+		}
+		if err != nil && reportOnly(r, "targets", err.Error()) {
+			return nil
+		}
+		return err
+	}
+}
+
+// validateHostPolicy checks the --allow-hosts and --deny-hosts patterns
+func validateHostPolicy() error {
+	for _, pattern := range append(splitList(*allowHosts), splitList(*denyHosts)...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q in --allow-hosts or --deny-hosts", pattern)
+		}
+	}
+	return nil
+}
+
+// targetHostAllowed applies --deny-hosts, then --allow-hosts when it is set.
+// Patterns are globs, so "*.example.com" covers every subdomain.
+func targetHostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range splitList(*denyHosts) {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return false
+		}
+	}
+	allowed := splitList(*allowHosts)
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return len(allowed) == 0
+}
+
+// checkTargetHost refuses a target outside the --allow-hosts and
+// --deny-hosts policy
+func checkTargetHost(w http.ResponseWriter, r *http.Request, target string) bool {
+	if *allowHosts == "" && *denyHosts == "" {
+		return true
+	}
+	u, err := url.Parse(target)
+	if err == nil && targetHostAllowed(u.Hostname()) || reportOnly(r, "targets", "target host not allowed: "+target) {
+		return true
+	}
+	addCORSHeaders(w, r)
+	proxyError(w, r, http.StatusForbidden, "Target host not allowed", target)
+	return false
+}
+
+// hostPolicySummary describes the target host policy for the startup log
+func hostPolicySummary() string {
+	switch {
+	case *allowHosts == "" && *denyHosts == "":
+		return "any host (open proxy; see --allow-hosts)"
+	case *allowHosts == "":
+		return "any host except " + *denyHosts
+	case *denyHosts == "":
+		return "only " + *allowHosts
+	}
+	return "only " + *allowHosts + ", except " + *denyHosts
+}
@@ -0,0 +1,297 @@
+package argonproxy
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------
+// PAGINATION AGGREGATION
+// -----------------------------
+
+// Headers asking for and describing a merged paginated response
+const (
+	paginateHeader       = "X-Argon-Paginate"  // "all" or a page count
+	paginatePages        = "X-Argon-Pages"     // pages merged
+	paginateRemaining    = "X-Argon-Next-Page" // next page not fetched, if any
+	defaultPaginatePages = 10
+	defaultPaginateBytes = 8 << 20
+)
+
+// pagination lets clients of a route receive every page of a paginated JSON
+// API as one array, the proxy following the next-page links
+type pagination struct {
+	MaxPages int    `json:"max_pages,omitempty"` // default 10
+	MaxBytes int64  `json:"max_bytes,omitempty"` // of all pages, decoded; default 8 MiB
+	Items    string `json:"items,omitempty"`     // dotted path to each page's array; the page itself by default
+	Next     string `json:"next,omitempty"`      // dotted path to the next page URL; the Link header by default
+}
+
+// paginatedRequest is a request whose response is merged, and how many
+// pages it may fetch
+type paginatedRequest struct {
+	cfg   *pagination
+	pages int
+}
+
+// prepare checks a route's pagination settings and fills in defaults
+func (p *pagination) prepare(routeName string) error {
+	if p.MaxPages < 0 || p.MaxBytes < 0 {
+		return fmt.Errorf("route %q: paginate max_pages and max_bytes must be positive", routeName)
+	}
+	if p.MaxPages == 0 {
+		p.MaxPages = defaultPaginatePages
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = defaultPaginateBytes
+	}
+	return nil
+}
+
+// startPagination checks whether the client asked for a merged response on a
+// route that allows it. An invalid page count gets 400.
+func startPagination(w http.ResponseWriter, r *http.Request, target string) (*paginatedRequest, bool) {
+	value := strings.TrimSpace(r.Header.Get(paginateHeader))
+	cfg := routeFor(r).Paginate
+	if value == "" || cfg == nil || r.Method != "GET" {
+		return nil, true
+	}
+	pages := cfg.MaxPages
+	if !strings.EqualFold(value, "all") {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			proxyError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s header: use all or a page count", paginateHeader), target)
+			return nil, false
+		}
+		pages = min(n, cfg.MaxPages)
+	}
+	return &paginatedRequest{cfg: cfg, pages: pages}, true
+}
+
+// merge replaces a successful JSON response with the items of it and the
+// pages that follow, fetched with the same client and headers. Other
+// responses are left alone.
+func (p *paginatedRequest) merge(w http.ResponseWriter, r *http.Request, client *http.Client, proxyReq *http.Request, resp *http.Response) error {
+	if p == nil || resp.StatusCode != http.StatusOK || !isJSONResponse(resp) {
+		return nil
+	}
+
+	var items []json.RawMessage
+	budget := p.cfg.MaxBytes
+	seen := map[string]bool{proxyReq.URL.String(): true}
+	page, req := resp, proxyReq
+	pages := 0
+	var next *url.URL
+	for {
+		body, err := readPage(page, budget)
+		if page != resp {
+			page.Body.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("page %d: %w", pages+1, err)
+		}
+		budget -= int64(len(body))
+		pageItems, err := p.cfg.items(body)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", pages+1, err)
+		}
+		items = append(items, pageItems...)
+		pages++
+
+		if next, err = p.cfg.nextPage(req.URL, page.Header, body); err != nil {
+			return fmt.Errorf("page %d: %w", pages, err)
+		}
+		if next == nil || seen[next.String()] {
+			next = nil
+			break
+		}
+		if pages >= p.pages || next.Scheme != req.URL.Scheme || next.Host != req.URL.Host {
+			break // reported to the client instead
+		}
+		seen[next.String()] = true
+
+		if req, err = nextPageRequest(r, proxyReq, next); err != nil {
+			return err
+		}
+		if page, err = client.Do(req); err != nil {
+			return fmt.Errorf("page %d: %w", pages+1, err)
+		}
+		if page.StatusCode != http.StatusOK {
+			page.Body.Close()
+			return fmt.Errorf("page %d: upstream returned %s", pages+1, page.Status)
+		}
+	}
+
+	merged, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		merged = []byte("[]")
+	}
+	if *verbose {
+		log.Printf("Merged %d pages (%d items) from %s", pages, len(items), proxyReq.URL.Host)
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(merged))
+	resp.ContentLength = int64(len(merged))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(merged)))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Link")
+	resp.Header.Del("ETag")
+
+	exposed := []string{paginatePages}
+	w.Header().Set(paginatePages, strconv.Itoa(pages))
+	if next != nil {
+		w.Header().Set(paginateRemaining, next.String())
+		exposed = append(exposed, paginateRemaining)
+	}
+	w.Header().Add("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	return nil
+}
+
+// isJSONResponse reports whether a response has a JSON media type
+func isJSONResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// readPage reads a page's decoded body, failing once it exceeds the bytes
+// left in the budget
+func readPage(resp *http.Response, budget int64) ([]byte, error) {
+	body := io.Reader(resp.Body)
+	if coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); coding != "" && coding != "identity" {
+		decoder, ok := contentCodings[coding]
+		if !ok {
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		decoded, err := decoder.reader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer decoded.Close()
+		body = decoded
+	}
+	data, err := io.ReadAll(io.LimitReader(body, budget+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > budget {
+		return nil, errPagesTooLarge
+	}
+	return data, nil
+}
+
+// errPagesTooLarge is returned when the pages exceed the route's max_bytes
+var errPagesTooLarge = errors.New("pages exceed the route's max_bytes")
+
+// items returns the array of a page
+func (p *pagination) items(body []byte) ([]json.RawMessage, error) {
+	value, err := jsonField(body, p.Items)
+	if err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(value, &items); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON array", cmp.Or(p.Items, "page"))
+	}
+	return items, nil
+}
+
+// nextPage returns the URL of the page after one, resolved against its URL,
+// or nil on the last page
+func (p *pagination) nextPage(base *url.URL, header http.Header, body []byte) (*url.URL, error) {
+	link := ""
+	if p.Next == "" {
+		link = nextLink(header)
+	} else {
+		value, err := jsonField(body, p.Next)
+		if err != nil {
+			return nil, nil // no link on the last page
+		}
+		json.Unmarshal(value, &link)
+	}
+	if link == "" {
+		return nil, nil
+	}
+	u, err := base.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next page link %q", link)
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u, nil
+}
+
+// jsonField follows a dotted path of object keys into a JSON document
+func jsonField(data []byte, path string) (json.RawMessage, error) {
+	value := json.RawMessage(data)
+	if path == "" {
+		return value, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(value, &object); err != nil {
+			return nil, fmt.Errorf("%s: not a JSON object", path)
+		}
+		field, ok := object[key]
+		if !ok {
+			return nil, fmt.Errorf("%s: no %q field", path, key)
+		}
+		value = field
+	}
+	return value, nil
+}
+
+// nextLink returns the rel="next" target of RFC 8288 Link headers
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for {
+			start := strings.IndexByte(value, '<')
+			end := strings.IndexByte(value, '>')
+			if start == -1 || end < start {
+				break
+			}
+			target, params := value[start+1:end], value[end+1:]
+			value = ""
+			if i := strings.IndexByte(params, '<'); i != -1 {
+				params, value = params[:i], params[i:]
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, rel, _ := strings.Cut(param, "=")
+				if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+					continue
+				}
+				for _, kind := range strings.Fields(strings.Trim(strings.TrimSpace(rel), `",`)) {
+					if strings.EqualFold(kind, "next") {
+						return target
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// nextPageRequest copies the first upstream request for another page,
+// signing it again when the route signs requests
+func nextPageRequest(r *http.Request, first *http.Request, next *url.URL) (*http.Request, error) {
+	req := first.Clone(first.Context())
+	req.URL = next
+	req.Host = next.Host
+	req.Body = http.NoBody
+	if err := signUpstreamRequest(r, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,226 @@
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// PARALLEL RANGE FETCHES
+// -----------------------------
+
+// parallelResults counts downloads fetched as parallel ranges
+var parallelResults struct {
+	downloads atomic.Uint64
+	chunks    atomic.Uint64
+	retries   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if *parallelHosts == "" {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_parallel_downloads_total Downloads fetched from upstream as parallel range requests.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_parallel_downloads_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_parallel_downloads_total %d\n", parallelResults.downloads.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_parallel_chunks_total Range requests made for parallel downloads, by result.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_parallel_chunks_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_parallel_chunks_total{result=\"ok\"} %d\n", parallelResults.chunks.Load())
+		fmt.Fprintf(w, "argon_proxy_parallel_chunks_total{result=\"retried\"} %d\n", parallelResults.retries.Load())
+		fmt.Fprintf(w, "argon_proxy_parallel_chunks_total{result=\"failed\"} %d\n", parallelResults.failed.Load())
+	})
+}
+
+// parallelChunkAttempts is how often a chunk is requested before the
+// download is given up
+const parallelChunkAttempts = 3
+
+// parallelHost reports whether the host is listed in --parallel-hosts
+func parallelHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range splitList(*parallelHosts) {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// accelerateDownload replaces the body of a large download from a
+// --parallel-hosts upstream with one reassembled from range requests made
+// in parallel. The response already in hand supplies the first chunk. Only
+// plain GET responses of known length whose upstream accepts ranges and
+// identifies the content with a validator qualify; If-Range makes a change
+// to the content mid-download fail the download instead of mixing versions.
+func accelerateDownload(r *http.Request, client *http.Client, resp *http.Response) {
+	if *parallelHosts == "" || resp.Request == nil || !parallelHost(resp.Request.URL.Hostname()) {
+		return
+	}
+	chunk := *parallelChunkSize
+	encoding := resp.Header.Get("Content-Encoding")
+	if r.Method != "GET" || r.Header.Get("Range") != "" || resp.StatusCode != http.StatusOK ||
+		resp.ContentLength <= 2*chunk || !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") ||
+		(encoding != "" && !strings.EqualFold(encoding, "identity")) {
+		return
+	}
+	validator := rangeValidator(resp)
+	if validator == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(resp.Request.Context())
+	template := resp.Request.Clone(ctx)
+	template.Header.Set("If-Range", validator)
+	template.Header.Set("Accept-Encoding", "identity")
+	f := &parallelFetch{
+		ctx:       ctx,
+		cancel:    cancel,
+		client:    client,
+		template:  template,
+		size:      resp.ContentLength,
+		first:     resp.Body,
+		current:   resp.Body,
+		remaining: chunk,
+		next:      chunk,
+	}
+	f.schedule()
+	resp.Body = f
+	parallelResults.downloads.Add(1)
+}
+
+// rangeChunk is one range of a parallel download
+type rangeChunk struct {
+	start, end int64 // inclusive, as in a Range header
+	done       chan struct{}
+	data       []byte
+	err        error
+}
+
+// parallelFetch reads a download in order while the chunks ahead of the
+// reader are fetched, at most --parallel-connections at a time
+type parallelFetch struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   *http.Client
+	template *http.Request // cloned for every range request
+	size     int64
+
+	first     io.ReadCloser // the original body, read for the first chunk
+	current   io.Reader
+	remaining int64 // bytes of the current chunk not yet read
+	next      int64 // start of the next chunk to request
+	pending   []*rangeChunk
+}
+
+func (f *parallelFetch) Read(p []byte) (int, error) {
+	for {
+		if f.remaining > 0 {
+			n, err := f.current.Read(p[:min(int64(len(p)), f.remaining)])
+			f.remaining -= int64(n)
+			if err == io.EOF {
+				err = nil
+				if f.remaining > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		// The original connection is done with once the first chunk is read
+		if f.first != nil {
+			f.first.Close()
+			f.first = nil
+		}
+		if len(f.pending) == 0 {
+			return 0, io.EOF
+		}
+		c := f.pending[0]
+		f.pending = f.pending[1:]
+		f.schedule()
+		select {
+		case <-c.done:
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		f.current, f.remaining = bytes.NewReader(c.data), int64(len(c.data))
+	}
+}
+
+func (f *parallelFetch) Close() error {
+	f.cancel()
+	if f.first != nil {
+		return f.first.Close()
+	}
+	return nil
+}
+
+// schedule starts fetching chunks ahead of the reader until
+// --parallel-connections are busy, counting the original one while the
+// first chunk is read from it
+func (f *parallelFetch) schedule() {
+	limit := *parallelConnections
+	if f.first != nil {
+		limit--
+	}
+	for len(f.pending) < limit && f.next < f.size {
+		c := &rangeChunk{start: f.next, end: min(f.next+*parallelChunkSize, f.size) - 1, done: make(chan struct{})}
+		f.next = c.end + 1
+		f.pending = append(f.pending, c)
+		go f.fetch(c)
+	}
+}
+
+// fetch requests a chunk, retrying failed attempts
+func (f *parallelFetch) fetch(c *rangeChunk) {
+	defer close(c.done)
+	for attempt := 1; ; attempt++ {
+		c.data, c.err = f.fetchRange(c.start, c.end)
+		if c.err == nil {
+			parallelResults.chunks.Add(1)
+			return
+		}
+		if f.ctx.Err() != nil {
+			return
+		}
+		if attempt == parallelChunkAttempts {
+			parallelResults.failed.Add(1)
+			log.Printf("Parallel download of %s failed: %v", f.template.URL.Host, c.err)
+			return
+		}
+		parallelResults.retries.Add(1)
+	}
+}
+
+// fetchRange requests bytes start to end of the download
+func (f *parallelFetch) fetchRange(start, end int64) ([]byte, error) {
+	req := f.template.Clone(f.ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	want := fmt.Sprintf("bytes %d-%d/%d", start, end, f.size)
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != want {
+		return nil, fmt.Errorf("range %d-%d answered with status %d and Content-Range %q", start, end, resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
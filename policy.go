@@ -0,0 +1,172 @@
+//go:build !noopa
+
+package argonproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+// -----------------------------
+// REGO POLICIES
+// -----------------------------
+
+// policyInput is the input document a Rego policy is evaluated with: the
+// request description sent to --ext-authz-url, with every request header
+type policyInput struct {
+	authzCheck
+	Headers map[string]string `json:"headers"`
+}
+
+// opaPolicy evaluates the Rego bundle given with -opa-bundle
+var opaPolicy *sdk.OPA
+
+// policyResults counts policy decisions by outcome
+var policyResults struct {
+	allowed, denied, failed atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if opaPolicy == nil {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_policy_total Rego policy decisions by outcome.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_policy_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_policy_total{result=\"allowed\"} %d\n", policyResults.allowed.Load())
+		fmt.Fprintf(w, "argon_proxy_policy_total{result=\"denied\"} %d\n", policyResults.denied.Load())
+		fmt.Fprintf(w, "argon_proxy_policy_total{result=\"failed\"} %d\n", policyResults.failed.Load())
+	})
+}
+
+// startPolicy loads the bundle given with -opa-bundle, an http(s) URL of a
+// bundle server or a local bundle file or directory, and refreshes it every
+// -opa-refresh. Requests are refused until the first bundle is active.
+func startPolicy() error {
+	if *opaBundle == "" {
+		return nil
+	}
+	refresh := int64(opaRefresh.Seconds())
+	if refresh < 1 {
+		return fmt.Errorf("--opa-refresh must be at least 1s")
+	}
+
+	source := map[string]any{}
+	services := map[string]any{}
+	local := !strings.HasPrefix(*opaBundle, "http://") && !strings.HasPrefix(*opaBundle, "https://")
+	if local {
+		path, err := filepath.Abs(*opaBundle)
+		if err != nil {
+			return err
+		}
+		source["resource"] = (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	} else {
+		u, err := url.Parse(*opaBundle)
+		if err != nil {
+			return err
+		}
+		resource := strings.TrimPrefix(u.Path, "/")
+		u.Path, u.RawQuery = "", ""
+		services["bundles"] = map[string]any{"url": u.String()}
+		source["service"] = "bundles"
+		source["resource"] = resource
+		source["polling"] = map[string]any{"min_delay_seconds": refresh, "max_delay_seconds": refresh}
+	}
+	config, _ := json.Marshal(map[string]any{
+		"services": services,
+		"bundles":  map[string]any{"argon": source},
+	})
+
+	logger := logging.New()
+	logger.SetLevel(logging.Warn)
+	var manager *plugins.Manager
+	ready := make(chan struct{})
+	opa, err := sdk.New(context.Background(), sdk.Options{
+		ID:          "argon-proxy",
+		Config:      bytes.NewReader(config),
+		Logger:      logger,
+		Ready:       ready,
+		ManagerOpts: []func(*plugins.Manager){func(m *plugins.Manager) { manager = m }},
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ready
+		log.Printf("Policy bundle loaded from %s", *opaBundle)
+	}()
+
+	// Bundle files are read once by OPA, so reload them on the same schedule
+	if local {
+		go func() {
+			for range time.Tick(*opaRefresh) {
+				if p := bundle.Lookup(manager); p != nil {
+					p.Trigger(context.Background())
+				}
+			}
+		}()
+	}
+
+	opaPolicy = opa
+	authzSources = append(authzSources, authzSource{"policy", evaluatePolicy, func() bool { return false }})
+	return nil
+}
+
+// evaluatePolicy asks the Rego policy about a request. The decision at
+// -opa-decision is either a boolean or an object with allow, status, reason
+// and headers; an undefined decision denies the request.
+func evaluatePolicy(ctx context.Context, r *http.Request, check authzCheck) (authzDecision, error) {
+	input := policyInput{authzCheck: check, Headers: make(map[string]string, len(r.Header))}
+	for name, values := range r.Header {
+		input.Headers[name] = strings.Join(values, ", ")
+	}
+
+	decision := authzDecision{Status: http.StatusForbidden}
+	result, err := opaPolicy.Decision(ctx, sdk.DecisionOptions{Path: *opaDecision, Input: input})
+	if sdk.IsUndefinedErr(err) {
+		policyResults.denied.Add(1)
+		return decision, nil
+	}
+	if err != nil {
+		policyResults.failed.Add(1)
+		return decision, err
+	}
+
+	switch v := result.Result.(type) {
+	case bool:
+		decision.Allow = v
+	case map[string]any:
+		data, _ := json.Marshal(v)
+		if err := json.Unmarshal(data, &decision); err != nil {
+			policyResults.failed.Add(1)
+			return decision, fmt.Errorf("decision %s: %v", *opaDecision, err)
+		}
+	default:
+		policyResults.failed.Add(1)
+		return decision, fmt.Errorf("decision %s is %T, not a boolean or object", *opaDecision, v)
+	}
+	if decision.Status < 400 || decision.Status > 499 {
+		decision.Status = http.StatusForbidden
+	}
+	if decision.Allow {
+		policyResults.allowed.Add(1)
+	} else {
+		policyResults.denied.Add(1)
+	}
+	return decision, nil
+}
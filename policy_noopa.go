@@ -0,0 +1,13 @@
+//go:build noopa
+
+package argonproxy
+
+import "fmt"
+
+// startPolicy fails when a bundle is given to a build without OPA
+func startPolicy() error {
+	if *opaBundle == "" {
+		return nil
+	}
+	return fmt.Errorf("this build does not include OPA (built with -tags noopa)")
+}
@@ -0,0 +1,129 @@
+package argonproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// -----------------------------
+// PRIVATE TARGET PROTECTION
+// -----------------------------
+
+func init() {
+	// The name the mode was first asked for under
+	flag.BoolVar(denyPrivateTargets, "block-private-targets", false, "Alias of --deny-private-targets")
+}
+
+// errPrivateTarget is returned when --deny-private-targets refuses a connection
+var errPrivateTarget = errors.New("target resolves to a private or reserved address")
+
+// nonPublicPrefixes are the ranges beyond what netip reports as private,
+// loopback, link-local or multicast that must not be reached
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+}
+
+// nat64Prefix embeds IPv4 addresses, which are checked in turn
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// publicAddr reports whether an address may be reached with --deny-private-targets
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// privateTargetAllowed reports whether a host may reach private addresses
+// through --private-targets-allow
+func privateTargetAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range splitList(*privateTargetsAllow) {
+		if hostMatches(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusePrivate is a dialer Control hook. It runs for the address actually
+// being connected, after resolution, so a name that resolved to a public
+// address for an earlier check cannot rebind to an internal one.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ap.Addr()) {
+		return fmt.Errorf("%s: %w", ap.Addr(), errPrivateTarget)
+	}
+	return nil
+}
+
+// dialUpstream dials upstream TCP connections like http.DefaultTransport,
+// refusing non-public addresses with --deny-private-targets
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: *dialTimeout, KeepAlive: 30 * time.Second}
+	if host, _, err := net.SplitHostPort(addr); *denyPrivateTargets && (err != nil || !privateTargetAllowed(host)) {
+		dialer.Control = refusePrivate
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialQUIC dials HTTP/3 upstreams. With --deny-private-targets the host is
+// resolved here and the connection made to the public address that was
+// checked, rather than letting QUIC resolve the name again.
+func dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if !*denyPrivateTargets || err != nil || privateTargetAllowed(host) {
+		return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if publicAddr(ip) {
+			return quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), tlsCfg, cfg)
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", host, errPrivateTarget)
+}
+
+// newTCPTransport clones http.DefaultTransport for upstream requests, with
+// the private target check in its dialer and the pool flags applied
+func newTCPTransport(tlsConfig *tls.Config) *http.Transport {
+	tcp := http.DefaultTransport.(*http.Transport).Clone()
+	tcp.TLSClientConfig = tlsConfig
+	tcp.DialContext = dialUpstream
+	tuneUpstreamPool(tcp)
+	return tcp
+}
@@ -0,0 +1,80 @@
+package argonproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"64:ff9b::808:808", true}, // NAT64 for 8.8.8.8
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fd00:ec2::254", false},
+		{"100.100.100.200", false},
+		{"64:ff9b::a00:1", false},     // NAT64 for 10.0.0.1
+		{"64:ff9b::7f00:1", false},    // NAT64 for 127.0.0.1
+		{"64:ff9b::a9fe:a9fe", false}, // NAT64 for 169.254.169.254
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDenyPrivateTargets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	defer NewTestHandler()
+
+	tests := []struct {
+		name    string
+		args    []string
+		refused bool
+	}{
+		{"off", nil, false},
+		{"deny", []string{"--deny-private-targets"}, true},
+		{"block alias", []string{"--block-private-targets"}, true},
+		{"allowed host", []string{"--block-private-targets", "--private-targets-allow=127.0.0.1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := NewTestHandler(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialUpstream(context.Background(), "tcp", upstream.Listener.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+			if refused := errors.Is(err, errPrivateTarget); refused != tt.refused || (!refused && err != nil) {
+				t.Errorf("dialUpstream(%s) = %v, want refused %v", upstream.Listener.Addr(), err, tt.refused)
+			}
+
+			req := httptest.NewRequest("GET", "/proxy/?target="+url.QueryEscape(upstream.URL), nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if want := map[bool]int{true: http.StatusForbidden, false: http.StatusOK}[tt.refused]; rec.Code != want {
+				t.Errorf("proxied request: status = %d, want %d", rec.Code, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// -----------------------------
+// CACHE PURGE
+// -----------------------------
+
+// purgeChannel is the pub/sub channel purges are broadcast on
+const purgeChannel = "argon-proxy:purge"
+
+// purgeMessage is a purge broadcast to the other instances
+type purgeMessage struct {
+	Instance string   `json:"instance"`
+	Caches   []string `json:"caches"`
+	Targets  []string `json:"targets,omitempty"` // cached responses to remove instead of whole caches
+}
+
+// purgeFuncs clear this instance's in-process caches, by name
+var purgeFuncs = map[string]func(){
+	"auth": func() {
+		if a, ok := authenticator.(*basicAuth); ok {
+			a.mu.Lock()
+			clear(a.verified)
+			a.mu.Unlock()
+		}
+	},
+	"tokens": func() {
+		identityTokens.Lock()
+		clear(identityTokens.byKey)
+		identityTokens.Unlock()
+		awsCredentialCache.Lock()
+		awsCredentialCache.creds = nil
+		awsCredentialCache.Unlock()
+	},
+	"encodings": func() {
+		encodingHosts.Range(func(key, _ any) bool {
+			encodingHosts.Delete(key)
+			return true
+		})
+	},
+}
+
+// broadcaster is implemented by stores shared between instances that can
+// deliver messages to all of them
+type broadcaster interface {
+	// Publish sends a message to every subscriber of channel
+	Publish(channel string, message []byte) error
+	// Subscribe calls handle with each message on channel until the store
+	// is closed, reconnecting after errors
+	Subscribe(channel string, handle func(message []byte))
+}
+
+// startPurgeListener applies the purges other instances broadcast
+func startPurgeListener() {
+	b, ok := store.(broadcaster)
+	if !ok {
+		return
+	}
+	go b.Subscribe(purgeChannel, func(data []byte) {
+		var msg purgeMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Instance == instanceName {
+			return
+		}
+		if len(msg.Targets) > 0 {
+			removed := 0
+			for _, target := range msg.Targets {
+				removed += purgeTarget(target)
+			}
+			log.Printf("Removed %d cached responses for %s on request of instance %s", removed, strings.Join(msg.Targets, ", "), msg.Instance)
+			return
+		}
+		purged := purgeLocal(msg.Caches)
+		log.Printf("Purged %s on request of instance %s", strings.Join(purged, ", "), msg.Instance)
+	})
+}
+
+// purgeLocal clears the named caches, or all of them, and returns the names
+// of those cleared
+func purgeLocal(names []string) []string {
+	var purged []string
+	for name, purge := range purgeFuncs {
+		if len(names) == 0 || slices.Contains(names, name) {
+			purge()
+			purged = append(purged, name)
+		}
+	}
+	slices.Sort(purged)
+	return purged
+}
+
+// handleAdminPurge clears in-process caches on this instance and, with a
+// Redis store, on every other instance. ?cache= names the caches to clear,
+// comma separated; all are cleared by default.
+func handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names := splitList(r.URL.Query().Get("cache"))
+	for _, name := range names {
+		if _, ok := purgeFuncs[name]; !ok {
+			http.Error(w, "Unknown cache "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	purgeCaches(w, names)
+}
+
+// purgeCaches clears the named caches here and on the other instances and
+// reports which
+func purgeCaches(w http.ResponseWriter, names []string) {
+	purged := purgeLocal(names)
+	broadcast, ok := broadcastPurge(w, purgeMessage{Instance: instanceName, Caches: purged})
+	if !ok {
+		return
+	}
+	log.Printf("Purged %s", strings.Join(purged, ", "))
+	writeJSON(w, http.StatusOK, map[string]any{"purged": purged, "broadcast": broadcast})
+}
+
+// broadcastPurge publishes a purge to the other instances when the store
+// can, reporting whether it did. A failed broadcast is answered 502 and ok
+// is false.
+func broadcastPurge(w http.ResponseWriter, msg purgeMessage) (broadcast, ok bool) {
+	b, shared := store.(broadcaster)
+	if !shared {
+		return false, true
+	}
+	data, _ := json.Marshal(msg)
+	if err := b.Publish(purgeChannel, data); err != nil {
+		log.Printf("Error broadcasting purge: %v", err)
+		http.Error(w, "Purged locally but the broadcast failed: "+err.Error(), http.StatusBadGateway)
+		return false, false
+	}
+	return true, true
+}
+
+// purgeTarget removes the cached responses for a target URL from the cache
+// tiers. A target ending in * removes every URL starting with the rest from
+// the memory and disk tiers; the shared tier can only drop exact URLs.
+func purgeTarget(target string) int {
+	prefix, isPrefix := strings.CutSuffix(target, "*")
+	if !isPrefix {
+		if u, err := url.Parse(target); err == nil {
+			target = u.String()
+		}
+		prefix = target
+	}
+	removed := responseCache.removeTarget(prefix, isPrefix) + diskCache.removeTarget(prefix, isPrefix)
+	if !isPrefix {
+		removed += removeShared(target)
+	}
+	return removed
+}
+
+// handleAdminCache removes the response cache's entries for one target URL
+// with DELETE /admin/cache?target=, on every instance
+func handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+	removed := purgeTarget(target)
+	broadcast, ok := broadcastPurge(w, purgeMessage{Instance: instanceName, Targets: []string{target}})
+	if !ok {
+		return
+	}
+	log.Printf("Removed %d cached responses for %s", removed, target)
+	writeJSON(w, http.StatusOK, map[string]any{"removed": removed, "broadcast": broadcast})
+}
+
+// handleAdminCacheFlush empties the response cache on every instance, like
+// POST /admin/purge?cache=responses
+func handleAdminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	purgeCaches(w, []string{"responses"})
+}
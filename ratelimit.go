@@ -0,0 +1,262 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// PER-CLIENT RATE LIMITING
+// -----------------------------
+
+// Headers telling clients their allowance under --rate-limit: the requests
+// they may make at once, how many are left and the seconds until all are
+const (
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	rateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+const (
+	// rateLimitSweepInterval is how often idle clients are forgotten
+	rateLimitSweepInterval = time.Minute
+	// rateLimitMaxClients bounds the clients tracked at once
+	rateLimitMaxClients = 100000
+)
+
+// tokenBucket holds a client's unspent requests as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	limited   uint64
+}
+
+var rateLimits = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if *rateLimit <= 0 {
+			return
+		}
+		rateLimits.mu.Lock()
+		defer rateLimits.mu.Unlock()
+		fmt.Fprintf(w, "# HELP argon_proxy_rate_limit_clients Clients currently tracked by --rate-limit.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_rate_limit_clients gauge\n")
+		fmt.Fprintf(w, "argon_proxy_rate_limit_clients %d\n", len(rateLimits.buckets))
+		fmt.Fprintf(w, "# HELP argon_proxy_rate_limited_total Requests refused by --rate-limit.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_rate_limited_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_rate_limited_total %d\n", rateLimits.limited)
+	})
+}
+
+// rateBurstSize is the requests a client may make at once, --rate-burst or
+// else --rate-limit rounded up
+func rateBurstSize() float64 {
+	if *rateBurst > 0 {
+		return float64(*rateBurst)
+	}
+	return math.Max(1, math.Ceil(*rateLimit))
+}
+
+// rateLimitKey names the client a request is counted against: its
+// authenticated identity when there is one, else its IP
+func rateLimitKey(r *http.Request) string {
+	identity := identityFor(r)
+	if f := federated(r); f != nil && identity == "" {
+		identity = f.identity
+	}
+	if identity != "" {
+		return "identity:" + identity
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// rateQuota is a client's allowance once a request has been counted
+type rateQuota struct {
+	remaining int           // requests the client may still make at once
+	reset     time.Duration // until the whole --rate-burst is available again
+	wait      time.Duration // until the next request is allowed, when none is
+}
+
+// take spends one of the client's tokens and returns what is left. When
+// there is none, ok is false and quota.wait is how long until there will be.
+func (l *rateLimiter) take(client string, now time.Time) (quota rateQuota, ok bool) {
+	if quota, ok, shared := countShared(client, now, 1); shared {
+		return quota, ok
+	}
+	rate, burst := *rateLimit, rateBurstSize()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= rateLimitMaxClients || now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+			l.sweep(now, rate, burst)
+		}
+		b = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	ok = b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+	return bucketQuota(b.tokens, rate, burst), ok
+}
+
+// peek reports whether the client has a token left without spending it, and
+// if not, how long until it will
+func (l *rateLimiter) peek(client string, now time.Time) (wait time.Duration, ok bool) {
+	if quota, ok, shared := countShared(client, now, 0); shared {
+		return quota.wait, ok
+	}
+	rate, burst := *rateLimit, rateBurstSize()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[client]
+	if b == nil {
+		return 0, true
+	}
+	tokens := math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	return bucketQuota(tokens, rate, burst).wait, tokens >= 1
+}
+
+// bucketQuota is the allowance of a bucket holding tokens
+func bucketQuota(tokens, rate, burst float64) rateQuota {
+	quota := rateQuota{
+		remaining: int(tokens),
+		reset:     time.Duration((burst - tokens) / rate * float64(time.Second)),
+	}
+	if tokens < 1 {
+		quota.wait = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return quota
+}
+
+// rateWindow is the period a shared store counts each client's requests
+// over: the time an empty bucket takes to refill
+func rateWindow() time.Duration {
+	return max(time.Duration(rateBurstSize() / *rateLimit * float64(time.Second)), time.Millisecond)
+}
+
+// countShared counts delta requests for the client in a store shared with
+// other instances, so together they allow --rate-burst requests per
+// rateWindow. ok reports whether the request counted, or with a delta of 0
+// one more, is allowed. shared is false when the store is per instance or
+// failed, and the in-memory buckets apply instead.
+func countShared(client string, now time.Time, delta int64) (quota rateQuota, ok, shared bool) {
+	if _, isShared := store.(broadcaster); !isShared {
+		return rateQuota{}, false, false
+	}
+	window := rateWindow()
+	start := now.Truncate(window)
+	n, err := store.Incr(fmt.Sprintf("ratelimit:%s:%d", client, start.UnixMilli()), delta, window)
+	if err != nil {
+		log.Printf("Error counting rate limit in the store, using this instance's: %v", err)
+		return rateQuota{}, false, false
+	}
+	burst := int64(rateBurstSize())
+	quota = rateQuota{remaining: int(max(burst-n, 0)), reset: start.Add(window).Sub(now)}
+	if quota.remaining == 0 {
+		quota.wait = quota.reset
+	}
+	if delta == 0 {
+		return quota, n < burst, true
+	}
+	return quota, n <= burst, true
+}
+
+// sweep forgets clients whose buckets have refilled, which is the same as
+// never having seen them. If that leaves too many clients, the longest idle
+// ones are forgotten too, giving them a fresh bucket when they return.
+func (l *rateLimiter) sweep(now time.Time, rate, burst float64) {
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*rate >= burst {
+			delete(l.buckets, client)
+		}
+	}
+	if len(l.buckets) < rateLimitMaxClients {
+		return
+	}
+
+	clients := make([]string, 0, len(l.buckets))
+	for client := range l.buckets {
+		clients = append(clients, client)
+	}
+	slices.SortFunc(clients, func(a, b string) int {
+		return l.buckets[a].updated.Compare(l.buckets[b].updated)
+	})
+	for _, client := range clients[:len(clients)-rateLimitMaxClients*9/10] {
+		delete(l.buckets, client)
+	}
+	log.Printf("Rate limiter tracking %d clients, forgot the longest idle", rateLimitMaxClients)
+}
+
+// checkRateLimit tells the client its allowance in the X-RateLimit headers
+// and answers 429 with Retry-After once it has spent its --rate-burst and is
+// making requests faster than --rate-limit
+func checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if *rateLimit <= 0 {
+		return true
+	}
+	quota, ok := rateLimits.take(rateLimitKey(r), time.Now())
+	w.Header().Set(rateLimitLimitHeader, strconv.Itoa(int(rateBurstSize())))
+	w.Header().Set(rateLimitRemainingHeader, strconv.Itoa(quota.remaining))
+	w.Header().Set(rateLimitResetHeader, strconv.Itoa(int(math.Ceil(quota.reset.Seconds()))))
+	return ok || refuseRateLimited(w, r, quota.wait, "client over --rate-limit")
+}
+
+// authFailureKey names the bucket a client IP's failed logins are counted in
+func authFailureKey(r *http.Request) string {
+	return "authfail:" + getClientIP(r)
+}
+
+// checkAuthFailures answers 429 before credentials are checked once a client
+// IP has failed authentication more than --rate-burst times faster than
+// --rate-limit, so passwords and API keys cannot be guessed at full speed
+func checkAuthFailures(w http.ResponseWriter, r *http.Request) bool {
+	if *rateLimit <= 0 {
+		return true
+	}
+	wait, ok := rateLimits.peek(authFailureKey(r), time.Now())
+	return ok || refuseRateLimited(w, r, wait, "client IP over --rate-limit for failed authentication")
+}
+
+// noteAuthFailure counts a failed authentication against the client IP
+func noteAuthFailure(r *http.Request) {
+	if *rateLimit > 0 {
+		rateLimits.take(authFailureKey(r), time.Now())
+	}
+}
+
+// refuseRateLimited answers 429 with a Retry-After of wait, unless the
+// rate-limit policy only reports. It returns true when the request may go on.
+func refuseRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, reason string) bool {
+	if reportOnly(r, "rate-limit", reason) {
+		return true
+	}
+	rateLimits.mu.Lock()
+	rateLimits.limited++
+	rateLimits.mu.Unlock()
+	addCORSHeaders(w, r)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	proxyError(w, r, http.StatusTooManyRequests, "Rate limit exceeded, try again later", "")
+	return false
+}
@@ -0,0 +1,91 @@
+package argonproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sharedMemoryStore is a memory store that passes for one shared between
+// instances
+type sharedMemoryStore struct{ *memoryStore }
+
+func (sharedMemoryStore) Publish(channel string, message []byte) error          { return nil }
+func (sharedMemoryStore) Subscribe(channel string, handle func(message []byte)) {}
+
+func TestRateLimitSharedStore(t *testing.T) {
+	defer NewTestHandler()
+	if _, err := NewTestHandler("--rate-limit=1", "--rate-burst=2"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved Store) { store = saved }(store)
+	store = sharedMemoryStore{newMemoryStore()}
+
+	// Two instances share the client's allowance
+	now := time.Unix(1700000000, 0)
+	first := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	second := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	for i, want := range []bool{true, true} {
+		if _, ok := first.take("ip:192.0.2.30", now); ok != want {
+			t.Errorf("first instance, request %d: allowed = %v, want %v", i+1, ok, want)
+		}
+	}
+	if _, ok := second.peek("ip:192.0.2.30", now); ok {
+		t.Error("second instance would allow a request past the shared burst")
+	}
+	quota, ok := second.take("ip:192.0.2.30", now.Add(500*time.Millisecond))
+	if ok || quota.wait != 1500*time.Millisecond || quota.remaining != 0 {
+		t.Errorf("second instance: take = %+v, %v; want refused for 1.5s", quota, ok)
+	}
+	if _, ok := second.take("ip:192.0.2.30", now.Add(2*time.Second)); !ok {
+		t.Error("request in the next window refused")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+	}))
+	defer upstream.Close()
+	defer NewTestHandler()
+	handler, err := NewTestHandler("--rate-limit=1", "--rate-burst=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status                  int
+		remaining, reset, retry string
+	}{
+		{http.StatusOK, "1", "1", ""},
+		{http.StatusOK, "0", "2", ""},
+		{http.StatusTooManyRequests, "0", "2", "1"},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/proxy/?target="+url.QueryEscape(upstream.URL), nil)
+		req.RemoteAddr = "192.0.2.31:1234"
+		req.Header.Set("Origin", "https://app.example")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		h := rec.Header()
+		if rec.Code != tt.status || h.Get("X-RateLimit-Limit") != "2" || h.Get("Retry-After") != tt.retry {
+			t.Errorf("request %d: status %d, X-RateLimit-Limit %q, Retry-After %q", i+1, rec.Code, h.Get("X-RateLimit-Limit"), h.Get("Retry-After"))
+		}
+		// The upstream's own X-RateLimit-Remaining is replaced by the proxy's
+		if got := h.Values("X-RateLimit-Remaining"); len(got) != 1 || got[0] != tt.remaining {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, tt.remaining)
+		}
+		if got := h.Get("X-RateLimit-Reset"); got != tt.reset {
+			t.Errorf("request %d: X-RateLimit-Reset = %q, want %q", i+1, got, tt.reset)
+		}
+		exposed := strings.Join(h.Values("Access-Control-Expose-Headers"), ",")
+		for _, name := range []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"} {
+			if !strings.Contains(exposed, name) {
+				t.Errorf("request %d: %s not in Access-Control-Expose-Headers %q", i+1, name, exposed)
+			}
+		}
+	}
+}
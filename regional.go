@@ -0,0 +1,257 @@
+package argonproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// REGIONAL UPSTREAMS
+// -----------------------------
+
+// regionalDownTime is how long an endpoint that failed a request is avoided
+// when there are no probes to bring it back
+const regionalDownTime = 30 * time.Second
+
+// regionalGroup serves the target hosts it lists from the nearest of several
+// regional endpoints of the same API, failing over to the others
+type regionalGroup struct {
+	Hosts         []string            `json:"hosts"`
+	Endpoints     []*regionalEndpoint `json:"endpoints"`
+	ProbePath     string              `json:"probe_path,omitempty"`     // measured to rank endpoints by latency
+	ProbeInterval string              `json:"probe_interval,omitempty"` // default 30s
+
+	probeInterval time.Duration
+	probing       atomic.Bool
+	lastProbe     atomic.Int64 // unix nanoseconds
+}
+
+// regionalEndpoint is one regional base URL (scheme, host and port)
+type regionalEndpoint struct {
+	URL    string `json:"url"`
+	Region string `json:"region,omitempty"` // preferred when it is this instance's --region
+
+	url       *url.URL
+	mu        sync.Mutex
+	latency   time.Duration // smoothed probe latency, 0 until measured
+	downUntil time.Time
+}
+
+// regionalPick is the endpoint chosen for one upstream request, kept to
+// fail over to the next
+type regionalPick struct {
+	group   *regionalGroup
+	current *regionalEndpoint
+	tried   map[*regionalEndpoint]bool
+}
+
+func init() {
+	registerMetrics(writeRegionalMetrics)
+}
+
+// prepare checks a route's regional group
+func (g *regionalGroup) prepare(routeName string) error {
+	if len(g.Hosts) == 0 || len(g.Endpoints) == 0 {
+		return fmt.Errorf("route %q: regional_upstreams entries need hosts and endpoints", routeName)
+	}
+	for i, host := range g.Hosts {
+		g.Hosts[i] = strings.ToLower(host)
+	}
+	for _, ep := range g.Endpoints {
+		u, err := url.Parse(ep.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("route %q: regional endpoint %q must be an http(s) URL without a path", routeName, ep.URL)
+		}
+		ep.url = u
+	}
+	g.probeInterval = 30 * time.Second
+	if g.ProbeInterval != "" {
+		d, err := time.ParseDuration(g.ProbeInterval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("route %q: invalid regional probe_interval %q", routeName, g.ProbeInterval)
+		}
+		g.probeInterval = d
+	}
+	if g.ProbePath != "" && !strings.HasPrefix(g.ProbePath, "/") {
+		g.ProbePath = "/" + g.ProbePath
+	}
+	return nil
+}
+
+// selectRegional sends an upstream request to the best endpoint of the
+// route's regional group for its target host, if there is one
+func selectRegional(r *http.Request, proxyReq *http.Request) *regionalPick {
+	host := strings.ToLower(proxyReq.URL.Hostname())
+	for _, g := range routeFor(r).RegionalUpstreams {
+		for _, pattern := range g.Hosts {
+			if hostMatches(pattern, host) {
+				pick := &regionalPick{group: g, tried: make(map[*regionalEndpoint]bool)}
+				g.maybeProbe()
+				pick.next(proxyReq)
+				return pick
+			}
+		}
+	}
+	return nil
+}
+
+// next points the request at the best endpoint not tried yet, reporting
+// false when all were
+func (p *regionalPick) next(proxyReq *http.Request) bool {
+	var best *regionalEndpoint
+	for _, ep := range p.group.Endpoints {
+		if !p.tried[ep] && (best == nil || ep.better(best)) {
+			best = ep
+		}
+	}
+	if best == nil {
+		return false
+	}
+	p.tried[best] = true
+	p.current = best
+	proxyReq.URL.Scheme, proxyReq.URL.Host = best.url.Scheme, best.url.Host
+	proxyReq.Host = best.url.Host
+	return true
+}
+
+// failover marks the current endpoint down after a failed request and moves
+// the request to the next one. Only requests without a body can be resent.
+func (p *regionalPick) failover(proxyReq *http.Request, err error) bool {
+	if p == nil || proxyReq.Context().Err() != nil || (proxyReq.Body != nil && proxyReq.Body != http.NoBody) {
+		return false
+	}
+	p.current.markDown()
+	from := p.current.url.Host
+	if !p.next(proxyReq) {
+		return false
+	}
+	log.Printf("Regional endpoint %s failed (%v), trying %s", from, err, p.current.url.Host)
+	return true
+}
+
+// better reports whether ep should be preferred over other: healthy before
+// down, then the lowest measured latency, then this instance's --region,
+// then configuration order (which keeps other)
+func (ep *regionalEndpoint) better(other *regionalEndpoint) bool {
+	now := time.Now()
+	ep.mu.Lock()
+	up, latency := now.After(ep.downUntil), ep.latency
+	ep.mu.Unlock()
+	other.mu.Lock()
+	otherUp, otherLatency := now.After(other.downUntil), other.latency
+	other.mu.Unlock()
+
+	if up != otherUp {
+		return up
+	}
+	if latency > 0 && otherLatency > 0 {
+		return latency < otherLatency
+	}
+	if latency > 0 != (otherLatency > 0) {
+		return latency > 0
+	}
+	return *region != "" && ep.Region == *region && other.Region != *region
+}
+
+// markDown avoids the endpoint until a probe succeeds or, without probes,
+// for regionalDownTime
+func (ep *regionalEndpoint) markDown() {
+	ep.mu.Lock()
+	ep.downUntil = time.Now().Add(regionalDownTime)
+	ep.mu.Unlock()
+}
+
+// maybeProbe measures every endpoint in the background once the probe
+// interval has passed
+func (g *regionalGroup) maybeProbe() {
+	if g.ProbePath == "" || time.Since(time.Unix(0, g.lastProbe.Load())) < g.probeInterval || !g.probing.CompareAndSwap(false, true) {
+		return
+	}
+	g.lastProbe.Store(time.Now().UnixNano())
+	go func() {
+		defer g.probing.Store(false)
+		var wg sync.WaitGroup
+		for _, ep := range g.Endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ep.probe(g.ProbePath)
+			}()
+		}
+		wg.Wait()
+	}()
+}
+
+// probe times a GET of the probe path, folding it into the smoothed latency
+func (ep *regionalEndpoint) probe(path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ep.url.Scheme+"://"+ep.url.Host+path, nil)
+	started := time.Now()
+	resp, err := (&http.Client{Transport: upstream}).Do(req)
+	elapsed := time.Since(started)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if err != nil || resp.StatusCode >= 500 {
+		ep.downUntil = time.Now().Add(24 * time.Hour) // until a probe succeeds
+		return
+	}
+	ep.downUntil = time.Time{}
+	if ep.latency == 0 {
+		ep.latency = elapsed
+	} else {
+		ep.latency = (ep.latency*7 + elapsed*3) / 10
+	}
+}
+
+// writeRegionalMetrics reports the health and latency of regional endpoints
+func writeRegionalMetrics(w io.Writer) {
+	table := activeRoutes.Load()
+	if table == nil {
+		return
+	}
+	var up, latency strings.Builder
+	now := time.Now()
+	for _, rt := range table.routes {
+		for _, g := range rt.RegionalUpstreams {
+			for _, ep := range g.Endpoints {
+				ep.mu.Lock()
+				healthy, smoothed := now.After(ep.downUntil), ep.latency
+				ep.mu.Unlock()
+				labels := fmt.Sprintf("route=%s,endpoint=%s", quoteLabel(rt.Name), quoteLabel(ep.url.Host))
+				value := 0
+				if healthy {
+					value = 1
+				}
+				fmt.Fprintf(&up, "argon_proxy_regional_endpoint_up{%s} %d\n", labels, value)
+				if smoothed > 0 {
+					fmt.Fprintf(&latency, "argon_proxy_regional_endpoint_latency_seconds{%s} %g\n", labels, smoothed.Seconds())
+				}
+			}
+		}
+	}
+	if up.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP argon_proxy_regional_endpoint_up Whether a regional upstream endpoint is used (1) or avoided after failing (0).\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_regional_endpoint_up gauge\n")
+	io.WriteString(w, up.String())
+	if latency.Len() > 0 {
+		fmt.Fprintf(w, "# HELP argon_proxy_regional_endpoint_latency_seconds Smoothed probe latency of a regional upstream endpoint.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_regional_endpoint_latency_seconds gauge\n")
+		io.WriteString(w, latency.String())
+	}
+}
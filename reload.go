@@ -0,0 +1,170 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// -----------------------------
+// CONFIG RELOAD
+// -----------------------------
+
+// reloadMu serializes reloads from SIGHUP and the admin API
+var reloadMu sync.Mutex
+
+// watchReloadSignal reloads the config file on SIGHUP
+func watchReloadSignal() {
+	if *configFile == "" {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadConfig re-reads the --config file and swaps in its routes. Requests
+// already in flight finish with the routes they started with. A file that
+// fails to load leaves the running config untouched. It returns the changes
+// made, which are also logged.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if *configFile == "" {
+		return nil, errors.New("no --config file to reload")
+	}
+	settings, err := readConfigSettings(*configFile)
+	var table *routeTable
+	if err == nil {
+		table, err = loadRouteTable(*configFile)
+	}
+	if err != nil {
+		log.Printf("Config not reloaded, keeping the running config: %v", err)
+		return nil, err
+	}
+
+	old := activeRoutes.Swap(table)
+	stopScheduledFetches(old)
+	startScheduledFetches()
+
+	changes := diffRouteTables(old, table)
+	changes = append(changes, diffSettings(&loadedSettings, settings)...)
+	if len(changes) == 0 {
+		changes = []string{"no changes"}
+	}
+	for _, change := range changes {
+		log.Printf("Config reloaded from %s: %s", *configFile, change)
+	}
+	return changes, nil
+}
+
+// diffRouteTables describes the routes, scheduled fetches and upstream hosts
+// a reload added, removed or changed. Only the changed keys are named, so
+// secrets in their values are not logged.
+func diffRouteTables(old, table *routeTable) []string {
+	routeName := func(rt *Route) string { return rt.Name }
+	fetchName := func(f *scheduledFetch) string { return f.Name }
+	changes := diffNamed("route", configByName(old.routes, routeName), configByName(table.routes, routeName))
+	changes = append(changes, diffNamed("scheduled fetch", configByName(old.scheduledFetches, fetchName), configByName(table.scheduledFetches, fetchName))...)
+	hostsName := func(h *upstreamHost) string { return strings.Join(h.Hosts, ",") }
+	changes = append(changes, diffNamed("upstream host", configByName(old.upstreamHosts, hostsName), configByName(table.upstreamHosts, hostsName))...)
+	return changes
+}
+
+// configByName turns config entries into JSON objects by name
+func configByName[T any](items []T, name func(T) string) map[string]map[string]any {
+	byName := make(map[string]map[string]any, len(items))
+	for _, item := range items {
+		var doc map[string]any
+		data, _ := json.Marshal(item)
+		json.Unmarshal(data, &doc)
+		byName[name(item)] = doc
+	}
+	return byName
+}
+
+// diffNamed compares two sets of named config entries key by key
+func diffNamed(kind string, old, updated map[string]map[string]any) []string {
+	names := make([]string, 0, len(old)+len(updated))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range updated {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var changes []string
+	for _, name := range names {
+		before, wasThere := old[name]
+		after, isThere := updated[name]
+		switch {
+		case !isThere:
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, name))
+		case !wasThere:
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, name))
+		default:
+			var keys []string
+			for key := range before {
+				if !reflect.DeepEqual(before[key], after[key]) {
+					keys = append(keys, key)
+				}
+			}
+			for key := range after {
+				if _, ok := before[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) > 0 {
+				slices.Sort(keys)
+				changes = append(changes, fmt.Sprintf("%s %s changed: %v", kind, name, keys))
+			}
+		}
+	}
+	return changes
+}
+
+// diffSettings names the server settings that differ from those loaded at
+// startup. They fill in flags, which only take effect on a restart.
+func diffSettings(old, updated *Config) []string {
+	before, after := old.settings(), updated.settings()
+	var changes []string
+	for i := range before {
+		was, _ := configValue(before[i].value)
+		now, _ := configValue(after[i].value)
+		if was != now {
+			changes = append(changes, fmt.Sprintf("setting %s changed; restart to apply it", before[i].key))
+		}
+	}
+	return changes
+}
+
+// handleAdminReload reloads the config file, answering with the changes or
+// with why the file was not loaded
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	changes, err := reloadConfig()
+	if err != nil {
+		http.Error(w, "Config not reloaded: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": *configFile, "changes": changes})
+}
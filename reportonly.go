@@ -0,0 +1,86 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// REPORT-ONLY POLICIES
+// -----------------------------
+
+// reportOnlyPolicies are the policies --report-only and report_only can
+// name, each counting the requests it would have refused
+var reportOnlyPolicies = map[string]*atomic.Uint64{
+	"origin":     new(atomic.Uint64),
+	"methods":    new(atomic.Uint64),
+	"targets":    new(atomic.Uint64),
+	"body-size":  new(atomic.Uint64),
+	"streams":    new(atomic.Uint64),
+	"budget":     new(atomic.Uint64),
+	"schedule":   new(atomic.Uint64),
+	"hotlink":    new(atomic.Uint64),
+	"rate-limit": new(atomic.Uint64),
+	"blocklist":  new(atomic.Uint64),
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		table := activeRoutes.Load()
+		enabled := len(table.fallback.ReportOnly) > 0
+		for _, rt := range table.routes {
+			enabled = enabled || len(rt.ReportOnly) > 0
+		}
+		if !enabled {
+			return
+		}
+		names := make([]string, 0, len(reportOnlyPolicies))
+		for name := range reportOnlyPolicies {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		fmt.Fprintf(w, "# HELP argon_proxy_report_only_total Requests a report-only policy would have refused.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_report_only_total counter\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "argon_proxy_report_only_total{policy=%s} %d\n", quoteLabel(name), reportOnlyPolicies[name].Load())
+		}
+	})
+}
+
+// prepareReportOnly checks the route's report-only policy names; "all"
+// stands for every policy
+func (rt *Route) prepareReportOnly() error {
+	for i, name := range rt.ReportOnly {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := reportOnlyPolicies[name]; !ok && name != "all" {
+			return fmt.Errorf("route %q: unknown report-only policy %q", rt.Name, name)
+		}
+		rt.ReportOnly[i] = name
+	}
+	return nil
+}
+
+// reportsOnly reports whether the route only logs refusals by policy
+func (rt *Route) reportsOnly(policy string) bool {
+	return slices.Contains(rt.ReportOnly, policy) || slices.Contains(rt.ReportOnly, "all")
+}
+
+// reportOnly reports whether the request's route only logs refusals by
+// policy. If so, the refusal the policy would have made is logged, counted
+// and noted in the access log, and the caller lets the request through.
+func reportOnly(r *http.Request, policy, reason string) bool {
+	rt := routeFor(r)
+	if !rt.reportsOnly(policy) {
+		return false
+	}
+	reportOnlyPolicies[policy].Add(1)
+	log.Printf("Report-only: %s policy would refuse %s %s from %s on route %s: %s",
+		policy, r.Method, r.URL.RequestURI(), getClientIP(r), rt.Name, reason)
+	noteAccess(r, func(rec *accessRecord) { rec.ReportOnly = append(rec.ReportOnly, policy) })
+	return true
+}
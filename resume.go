@@ -0,0 +1,148 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// STREAM RESUMPTION
+// -----------------------------
+
+// resumeResults counts upstream bodies that broke off mid-transfer
+var resumeResults struct {
+	resumed atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if *resumeAttempts <= 0 {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_resumed_streams_total Upstream bodies broken off mid-transfer, by whether a range request resumed them.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_resumed_streams_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_resumed_streams_total{result=\"resumed\"} %d\n", resumeResults.resumed.Load())
+		fmt.Fprintf(w, "argon_proxy_resumed_streams_total{result=\"failed\"} %d\n", resumeResults.failed.Load())
+	})
+}
+
+// rangeValidator returns the strong ETag or Last-Modified that range
+// requests for the rest of a response send in If-Range, or "" if it has none
+func rangeValidator(resp *http.Response) string {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return validator
+}
+
+// resumeDownload lets the body of a GET response survive its upstream
+// connection dropping: the rest is requested from the last byte relayed,
+// up to --resume-attempts times. Only responses of known length, without
+// Content-Encoding, from upstreams that accept ranges and give a validator
+// qualify, so the pieces are known to be of the same content.
+func resumeDownload(r *http.Request, client *http.Client, resp *http.Response) {
+	if *resumeAttempts <= 0 || r.Method != "GET" || resp.Request == nil || resp.Uncompressed ||
+		!strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return
+	}
+	validator := rangeValidator(resp)
+	if validator == "" {
+		return
+	}
+
+	b := &resumableBody{client: client, request: resp.Request, validator: validator, body: resp.Body}
+	switch {
+	case resp.StatusCode == http.StatusOK && resp.ContentLength > 0:
+		b.start, b.end, b.size = 0, resp.ContentLength-1, resp.ContentLength
+	case resp.StatusCode == http.StatusPartialContent:
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &b.start, &b.end, &b.size)
+		if err != nil {
+			return
+		}
+	default:
+		return
+	}
+	resp.Body = b
+}
+
+// resumableBody reads bytes start to end of an upstream resource, making a
+// range request for the remainder whenever the connection breaks
+type resumableBody struct {
+	client    *http.Client
+	request   *http.Request // the upstream request, cloned for each range
+	validator string
+	start     int64
+	end       int64 // inclusive, as in a Range header
+	size      int64
+
+	body      io.ReadCloser
+	delivered int64
+	attempts  int
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.delivered += int64(n)
+	if err == nil || err == io.EOF || b.start+b.delivered > b.end {
+		return n, err
+	}
+	if !b.resume(err) {
+		return n, err
+	}
+	// The caller reads on with the new connection
+	return n, nil
+}
+
+// resume replaces the broken body with a range request for what is left,
+// reporting whether it got one
+func (b *resumableBody) resume(cause error) bool {
+	ctx := b.request.Context()
+	for b.attempts < *resumeAttempts && ctx.Err() == nil {
+		b.attempts++
+		if b.attempts > 1 {
+			select {
+			case <-time.After(time.Duration(b.attempts-1) * 100 * time.Millisecond):
+			case <-ctx.Done():
+				continue
+			}
+		}
+		from := b.start + b.delivered
+		req := b.request.Clone(ctx)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, b.end))
+		req.Header.Set("If-Range", b.validator)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := b.client.Do(req)
+		if err != nil {
+			continue
+		}
+		want := fmt.Sprintf("bytes %d-%d/%d", from, b.end, b.size)
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != want {
+			// The content changed or ranges are no longer served; retrying will not help
+			resp.Body.Close()
+			break
+		}
+		b.body.Close()
+		b.body = resp.Body
+		resumeResults.resumed.Add(1)
+		log.Printf("Resumed %s from byte %d after: %v", b.request.URL.Host, from, cause)
+		return true
+	}
+	resumeResults.failed.Add(1)
+	log.Printf("Could not resume %s from byte %d after: %v", b.request.URL.Host, b.start+b.delivered, cause)
+	return false
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package argonproxy
+
+import "net"
+
+// listenReusePort is not supported on this platform
+func listenReusePort(string) (net.Listener, error) {
+	return nil, errNoReusePort
+}
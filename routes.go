@@ -0,0 +1,413 @@
+package argonproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// VIRTUAL HOST ROUTING
+// -----------------------------
+
+// defaultMethods lists the methods a route accepts when none are configured
+var defaultMethods = []string{"GET", "POST", "OPTIONS", "PUT", "DELETE", "HEAD", "PATCH"}
+
+// Route is a proxy personality selected by the incoming Host header
+type Route struct {
+	Name        string            `json:"name"`
+	Hosts       []string          `json:"hosts,omitempty"`
+	AllowOrigin string            `json:"allow_origin,omitempty"`
+	NullOrigin  string            `json:"null_origin,omitempty"` // allow or reject Origin: null
+	Methods     []string          `json:"methods,omitempty"`
+	ErrorPages  map[string]string `json:"error_pages,omitempty"`
+
+	// ResponseSchema is a JSON Schema file that JSON responses are checked
+	// against; SchemaAction is what happens on failure: log, header or reject
+	ResponseSchema string `json:"response_schema,omitempty"`
+	SchemaAction   string `json:"schema_action,omitempty"`
+
+	SLO *routeSLO `json:"slo,omitempty"`
+
+	// When the route may be used, overall and per authenticated caller
+	Schedule          *accessSchedule            `json:"schedule,omitempty"`
+	IdentitySchedules map[string]*accessSchedule `json:"identity_schedules,omitempty"`
+
+	// Monthly transfer budgets for the route and per authenticated caller
+	Budget          *byteBudget            `json:"budget,omitempty"`
+	IdentityBudgets map[string]*byteBudget `json:"identity_budgets,omitempty"`
+
+	// A candidate upstream whose responses are diffed against the target's
+	Compare *upstreamCompare `json:"compare,omitempty"`
+
+	// Cross-origin isolation headers, optionally overridden per request Origin
+	isolationPolicy
+	OriginIsolation map[string]isolationPolicy `json:"origin_policies,omitempty"`
+
+	// Client hints forwarded upstream, others removed, and whether browsers
+	// are asked for them with Accept-CH
+	ClientHints []string `json:"client_hints,omitempty"`
+	AcceptCH    bool     `json:"accept_ch,omitempty"`
+
+	// Accept-Language sent upstream: pass, strip or a fixed value
+	AcceptLanguage string `json:"accept_language,omitempty"`
+
+	// Policies that log what they would refuse instead of refusing
+	ReportOnly []string `json:"report_only,omitempty"`
+
+	// Origins whose pages may embed media responses; others get 403
+	HotlinkOrigins []string `json:"hotlink_origins,omitempty"`
+
+	// Target host patterns each Origin may reach; "*" covers unlisted origins
+	OriginTargets map[string][]string `json:"origin_targets,omitempty"`
+
+	// Credentials added to upstream requests; values may reference Vault secrets
+	UpstreamHeaders map[string]string `json:"upstream_headers,omitempty"`
+	UpstreamTLS     *upstreamTLS      `json:"upstream_tls,omitempty"`
+	AWSSigV4        *awsSigV4         `json:"aws_sigv4,omitempty"`
+	IdentityToken   *identityToken    `json:"identity_token,omitempty"`
+
+	// Another Argon-Proxy instance requests are forwarded through
+	Chain *proxyChain `json:"chain,omitempty"`
+
+	// Regional endpoints serving the same API, the nearest healthy one used
+	RegionalUpstreams []*regionalGroup `json:"regional_upstreams,omitempty"`
+
+	// Merges the pages of a paginated JSON API for clients that ask
+	Paginate *pagination `json:"paginate,omitempty"`
+
+	// Answers polls naming an earlier version with a JSON Patch from it
+	JSONDelta *jsonDelta `json:"json_delta,omitempty"`
+
+	// Served to GET and HEAD requests when the upstream fails
+	Fallback *upstreamFallback `json:"fallback,omitempty"`
+
+	RequestCompression *requestCompression `json:"request_compression,omitempty"`
+	Archive            *archiveTarget      `json:"archive,omitempty"`
+
+	// SHA-256 digests GET responses from these target URLs must have
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	allowMethods string // Methods joined for Access-Control-Allow-Methods
+	errorPages   map[string]*errorPage
+	schema       *jsonSchema
+	transport    *upstreamTransport
+	checksums    map[string][]byte
+}
+
+// routeFile is the on-disk layout of the configuration file
+type routeFile struct {
+	Routes           []*Route          `json:"routes"`
+	UpstreamHosts    []*upstreamHost   `json:"upstream_hosts,omitempty"`
+	ScheduledFetches []*scheduledFetch `json:"scheduled_fetches,omitempty"`
+}
+
+// routeTable holds the configured routes and the fallback built from flags
+type routeTable struct {
+	routes        []*Route
+	fallback      *Route
+	upstreamHosts []*upstreamHost
+
+	scheduledFetches []*scheduledFetch
+}
+
+// activeRoutes is the route table used to serve requests
+var activeRoutes atomic.Pointer[routeTable]
+
+type routeContextKey struct{}
+
+// defaultRoute builds the fallback route from the command line flags
+func defaultRoute() *Route {
+	rt := &Route{
+		Name:           "default",
+		AllowOrigin:    *allowedOrigin,
+		NullOrigin:     *nullOrigin,
+		HotlinkOrigins: splitList(*hotlinkOrigins),
+		Methods:        defaultMethods,
+		SLO:            defaultSLO(),
+		ClientHints:    splitList(*clientHints),
+		AcceptCH:       *acceptCH,
+		AcceptLanguage: *acceptLanguage,
+		ReportOnly:     splitList(*reportOnlyList),
+		isolationPolicy: isolationPolicy{
+			ResourcePolicy: *resourcePolicy,
+			EmbedderPolicy: *embedderPolicy,
+			ReferrerPolicy: *referrerPolicy,
+		},
+	}
+	if *webDAV {
+		rt.Methods = append(slices.Clip(defaultMethods), webDAVMethods...)
+	}
+	rt.allowMethods = strings.Join(rt.Methods, ", ")
+	if *paginateMaxPages > 0 {
+		rt.Paginate = &pagination{MaxPages: *paginateMaxPages, MaxBytes: defaultPaginateBytes}
+	}
+	return rt
+}
+
+// loadRouteTable reads the routes from the config file, if one is given
+func loadRouteTable(filename string) (*routeTable, error) {
+	table := &routeTable{fallback: defaultRoute()}
+	if err := table.fallback.validateIsolation(); err != nil {
+		return nil, err
+	}
+	if err := table.fallback.prepareClientHints(); err != nil {
+		return nil, err
+	}
+	if err := table.fallback.prepareAcceptLanguage(); err != nil {
+		return nil, err
+	}
+	if err := table.fallback.prepareReportOnly(); err != nil {
+		return nil, err
+	}
+	if err := table.fallback.prepareNullOrigin(); err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return table, nil
+	}
+
+	data, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file routeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	if err := prepareUpstreamHosts(file.UpstreamHosts); err != nil {
+		return nil, err
+	}
+	table.upstreamHosts = file.UpstreamHosts
+	if err := prepareScheduledFetches(file.ScheduledFetches); err != nil {
+		return nil, err
+	}
+	table.scheduledFetches = file.ScheduledFetches
+
+	for i, rt := range file.Routes {
+		if rt.Name == "" {
+			rt.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		if len(rt.Hosts) == 0 {
+			return nil, fmt.Errorf("route %q: at least one host is required", rt.Name)
+		}
+		rt.inherit(table.fallback)
+		if err := rt.loadErrorPages(filepath.Dir(filename)); err != nil {
+			return nil, err
+		}
+		if err := rt.loadSchema(filepath.Dir(filename)); err != nil {
+			return nil, err
+		}
+		if err := rt.validateIsolation(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareClientHints(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareAcceptLanguage(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareReportOnly(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareNullOrigin(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareSchedules(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareBudgets(); err != nil {
+			return nil, err
+		}
+		if err := rt.prepareChecksums(); err != nil {
+			return nil, err
+		}
+		if rt.Compare != nil {
+			if err := rt.Compare.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if err := rt.prepareUpstreamAuth(filepath.Dir(filename)); err != nil {
+			return nil, err
+		}
+		if rt.AWSSigV4 != nil {
+			if err := rt.AWSSigV4.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.IdentityToken != nil {
+			if err := rt.IdentityToken.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Chain != nil {
+			if err := rt.Chain.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		for _, g := range rt.RegionalUpstreams {
+			if err := g.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Paginate != nil {
+			if rt.Chain != nil {
+				return nil, fmt.Errorf("route %q: paginate cannot be combined with chain", rt.Name)
+			}
+			if err := rt.Paginate.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.JSONDelta != nil {
+			if err := rt.JSONDelta.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Fallback != nil {
+			if err := rt.Fallback.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.RequestCompression != nil {
+			if err := rt.RequestCompression.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Archive != nil {
+			if err := rt.Archive.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.SLO != nil {
+			if err := rt.SLO.prepare(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		table.routes = append(table.routes, rt)
+	}
+
+	return table, nil
+}
+
+// inherit fills unset route policies from the fallback route
+func (rt *Route) inherit(fallback *Route) {
+	if rt.AllowOrigin == "" {
+		rt.AllowOrigin = fallback.AllowOrigin
+	}
+	if rt.HotlinkOrigins == nil {
+		rt.HotlinkOrigins = fallback.HotlinkOrigins
+	}
+	if rt.NullOrigin == "" {
+		rt.NullOrigin = fallback.NullOrigin
+	}
+	if rt.AcceptLanguage == "" {
+		rt.AcceptLanguage = fallback.AcceptLanguage
+	}
+	if rt.ReportOnly == nil {
+		rt.ReportOnly = fallback.ReportOnly
+	}
+	if rt.ClientHints == nil {
+		rt.ClientHints, rt.AcceptCH = fallback.ClientHints, fallback.AcceptCH
+	}
+	rt.isolationPolicy = rt.isolationPolicy.merge(fallback.isolationPolicy)
+	if len(rt.OriginIsolation) > 0 {
+		byOrigin := make(map[string]isolationPolicy, len(rt.OriginIsolation))
+		for origin, policy := range rt.OriginIsolation {
+			byOrigin[strings.ToLower(strings.TrimSuffix(origin, "/"))] = policy
+		}
+		rt.OriginIsolation = byOrigin
+	}
+	rt.normalizeOriginTargets()
+	if len(rt.Methods) == 0 {
+		rt.Methods = fallback.Methods
+	} else {
+		rt.Methods = expandMethods(rt.Methods)
+	}
+	rt.allowMethods = strings.Join(rt.Methods, ", ")
+}
+
+// allowsMethod reports whether the route accepts the given request method
+func (rt *Route) allowsMethod(method string) bool {
+	for _, m := range rt.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the route serving the given host, or the fallback route
+func (t *routeTable) match(host string) *Route {
+	for _, rt := range t.routes {
+		for _, pattern := range rt.Hosts {
+			if hostMatches(pattern, host) {
+				return rt
+			}
+		}
+	}
+	return t.fallback
+}
+
+// named returns the route called name, or the fallback when there is none
+// by that name any more
+func (t *routeTable) named(name string) *Route {
+	for _, rt := range t.routes {
+		if rt.Name == name {
+			return rt
+		}
+	}
+	return t.fallback
+}
+
+// hostMatches compares a host against an exact or "*.example.com" pattern
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// requestHost returns the lower-cased incoming host without its port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if *trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// withRoute selects the route for each request and stores it in the context
+func withRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := activeRoutes.Load().match(requestHost(r))
+		if *verbose && rt.Name != "default" {
+			log.Printf("Request for host %s served by route %s", r.Host, rt.Name)
+		}
+		ctx := context.WithValue(r.Context(), routeContextKey{}, rt)
+		ctx = context.WithValue(ctx, requestIDContextKey{}, newRequestID(r))
+		w.Header().Set("X-Request-ID", ctx.Value(requestIDContextKey{}).(string))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// routeFor returns the route selected for the request
+func routeFor(r *http.Request) *Route {
+	if rt, ok := r.Context().Value(routeContextKey{}).(*Route); ok {
+		return rt
+	}
+	return activeRoutes.Load().fallback
+}
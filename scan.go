@@ -0,0 +1,304 @@
+package argonproxy
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// -----------------------------
+// CONTENT SCANNING
+// -----------------------------
+
+// scanResults counts scanned downloads by outcome
+var scanResults struct {
+	clean    atomic.Uint64
+	infected atomic.Uint64
+	oversize atomic.Uint64
+	failed   atomic.Uint64
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		if !scanEnabled() {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_scans_total Downloads passed to --scan-command or --scan-icap, by result.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_scans_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_scans_total{result=\"clean\"} %d\n", scanResults.clean.Load())
+		fmt.Fprintf(w, "argon_proxy_scans_total{result=\"infected\"} %d\n", scanResults.infected.Load())
+		fmt.Fprintf(w, "argon_proxy_scans_total{result=\"oversize\"} %d\n", scanResults.oversize.Load())
+		fmt.Fprintf(w, "argon_proxy_scans_total{result=\"error\"} %d\n", scanResults.failed.Load())
+	})
+}
+
+// errInfected is returned by a scanner that found something; the error
+// text names it
+type errInfected struct{ finding string }
+
+func (e errInfected) Error() string { return e.finding }
+
+// scanEnabled reports whether downloads are scanned
+func scanEnabled() bool {
+	return *scanCommand != "" || *scanICAP != ""
+}
+
+// validateScan checks the scanning flags
+func validateScan() error {
+	if !scanEnabled() {
+		return nil
+	}
+	if *scanCommand != "" && *scanICAP != "" {
+		return errors.New("--scan-command and --scan-icap cannot be used together")
+	}
+	if *scanICAP != "" {
+		u, err := url.Parse(*scanICAP)
+		if err != nil || u.Scheme != "icap" || u.Host == "" {
+			return fmt.Errorf("--scan-icap must be an icap://host[:port]/service URL")
+		}
+	}
+	if *scanMaxSize <= 0 || *scanMinSize < 0 || *scanTimeout <= 0 {
+		return errors.New("--scan-max-size and --scan-timeout must be positive and --scan-min-size not negative")
+	}
+	return nil
+}
+
+// wantsScan reports whether a response is a download the filter selects
+func wantsScan(r *http.Request, resp *http.Response) bool {
+	if !scanEnabled() || r.Method == "HEAD" || resp.StatusCode < 200 || resp.StatusCode >= 300 ||
+		resp.StatusCode == http.StatusNoContent || isLongLivedStream(resp) {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < *scanMinSize {
+		return false
+	}
+	types := splitList(*scanTypes)
+	if len(types) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, pattern := range types {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanDownload holds back a download the scanning filter selects until
+// the scanner has passed it. The body is spooled to a temporary file and
+// relayed from there once clean. Infected and oversized downloads get 403,
+// and downloads that could not be scanned 502. It reports whether the
+// response may be relayed.
+func scanDownload(w http.ResponseWriter, r *http.Request, resp *http.Response, finalURL string) bool {
+	if !wantsScan(r, resp) {
+		return true
+	}
+	if resp.ContentLength > *scanMaxSize {
+		scanResults.oversize.Add(1)
+		log.Printf("Refusing %s: %d bytes is over --scan-max-size", finalURL, resp.ContentLength)
+		proxyError(w, r, http.StatusForbidden, "Download is too large to scan", finalURL)
+		return false
+	}
+
+	spool, err := os.CreateTemp("", "argon-scan-*")
+	if err != nil {
+		scanResults.failed.Add(1)
+		log.Printf("Error spooling %s for scanning: %v", finalURL, err)
+		proxyError(w, r, http.StatusBadGateway, "Content scan failed", finalURL)
+		return false
+	}
+	discard := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	size, err := io.Copy(spool, io.LimitReader(resp.Body, *scanMaxSize+1))
+	if err == nil && size > *scanMaxSize {
+		discard()
+		scanResults.oversize.Add(1)
+		log.Printf("Refusing %s: body is over --scan-max-size", finalURL)
+		proxyError(w, r, http.StatusForbidden, "Download is too large to scan", finalURL)
+		return false
+	}
+	if err != nil {
+		discard()
+		scanResults.failed.Add(1)
+		log.Printf("Error reading %s for scanning: %v", finalURL, err)
+		proxyError(w, r, http.StatusBadGateway, "Error reading upstream response", finalURL)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *scanTimeout)
+	defer cancel()
+	if *scanICAP != "" {
+		err = scanWithICAP(ctx, spool, size, finalURL, resp)
+	} else {
+		err = scanWithCommand(ctx, spool)
+	}
+	var infected errInfected
+	switch {
+	case errors.As(err, &infected):
+		discard()
+		scanResults.infected.Add(1)
+		log.Printf("Blocked %s: scanner found %s", finalURL, infected.finding)
+		proxyError(w, r, http.StatusForbidden, "Download blocked by content scan", finalURL)
+		return false
+	case err != nil:
+		discard()
+		scanResults.failed.Add(1)
+		log.Printf("Error scanning %s: %v", finalURL, err)
+		proxyError(w, r, http.StatusBadGateway, "Content scan failed", finalURL)
+		return false
+	}
+	scanResults.clean.Add(1)
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		discard()
+		proxyError(w, r, http.StatusBadGateway, "Content scan failed", finalURL)
+		return false
+	}
+	resp.Body.Close()
+	resp.ContentLength = size
+	resp.Body = spooledBody{spool}
+	return true
+}
+
+// spooledBody relays a scanned body from its temporary file, removing the
+// file once closed
+type spooledBody struct {
+	*os.File
+}
+
+func (b spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// scanWithCommand runs --scan-command with the body on its standard input.
+// Exit status 0 means clean and 1 infected, as with clamdscan; its output
+// names the finding.
+func scanWithCommand(ctx context.Context, body *os.File) error {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	args := strings.Fields(*scanCommand)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = body
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		finding := strings.TrimSpace(string(out))
+		if line, _, _ := strings.Cut(finding, "\n"); line != "" {
+			finding = line
+		}
+		return errInfected{finding: cmp.Or(finding, "a threat")}
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// scanWithICAP sends the response to the --scan-icap service as an ICAP
+// RESPMOD request (RFC 3507). 204 No Content means the service left it
+// alone; a 200 carrying a replacement response means it was blocked.
+func scanWithICAP(ctx context.Context, body *os.File, size int64, target string, resp *http.Response) error {
+	service, _ := url.Parse(*scanICAP)
+	addr := service.Host
+	if service.Port() == "" {
+		addr = net.JoinHostPort(service.Hostname(), "1344")
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var reqHdr, resHdr bytes.Buffer
+	fmt.Fprintf(&reqHdr, "GET %s HTTP/1.1\r\n", target)
+	if u, err := url.Parse(target); err == nil {
+		fmt.Fprintf(&reqHdr, "Host: %s\r\n", u.Host)
+	}
+	reqHdr.WriteString("\r\n")
+	fmt.Fprintf(&resHdr, "HTTP/1.1 %s\r\n", resp.Status)
+	header := resp.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Write(&resHdr)
+	resHdr.WriteString("\r\n")
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", *scanICAP)
+	fmt.Fprintf(w, "Host: %s\r\n", service.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", reqHdr.Len(), reqHdr.Len()+resHdr.Len())
+	w.Write(reqHdr.Bytes())
+	w.Write(resHdr.Bytes())
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return err
+	}
+	icapHeader, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	proto, code, _ := strings.Cut(status, " ")
+	code, _, _ = strings.Cut(code, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return fmt.Errorf("unexpected ICAP status line %q", status)
+	}
+	switch code {
+	case "204":
+		return nil
+	case "200":
+		finding := icapHeader.Get("X-Infection-Found")
+		if finding == "" {
+			finding = icapHeader.Get("X-Violations-Found")
+		}
+		return errInfected{finding: cmp.Or(finding, "a threat")}
+	}
+	return fmt.Errorf("ICAP service answered %q", status)
+}
@@ -0,0 +1,222 @@
+package argonproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// ACCESS SCHEDULES
+// -----------------------------
+
+// weekdayNames maps the day names used in schedules to weekdays
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// accessSchedule limits when a route, or a caller on a route, may use the
+// proxy. Allow windows are opening hours (none means always open); deny
+// windows and blackouts close it, e.g. for maintenance.
+type accessSchedule struct {
+	Timezone  string           `json:"timezone,omitempty"`
+	Allow     []weeklyWindow   `json:"allow,omitempty"`
+	Deny      []weeklyWindow   `json:"deny,omitempty"`
+	Blackouts []blackoutPeriod `json:"blackouts,omitempty"`
+
+	location *time.Location
+}
+
+// weeklyWindow is a daily time range on some weekdays; a range ending
+// before it starts runs past midnight into the next day
+type weeklyWindow struct {
+	Days []string `json:"days,omitempty"` // mon..sun; none means every day
+	From string   `json:"from"`           // 15:04
+	To   string   `json:"to"`             // 15:04
+
+	days     [7]bool
+	from, to int // minutes after midnight
+}
+
+// blackoutPeriod closes access between two instants
+type blackoutPeriod struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// prepare validates the schedule and parses its times
+func (s *accessSchedule) prepare() error {
+	s.location = time.UTC
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("schedule timezone: %v", err)
+		}
+		s.location = loc
+	}
+	for _, windows := range [][]weeklyWindow{s.Allow, s.Deny} {
+		for i := range windows {
+			if err := windows[i].prepare(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range s.Blackouts {
+		if !b.End.After(b.Start) {
+			return fmt.Errorf("schedule blackout ending %s does not end after it starts", b.End.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// prepareSchedules validates the route's schedule and its callers' schedules
+func (rt *Route) prepareSchedules() error {
+	if rt.Schedule != nil {
+		if err := rt.Schedule.prepare(); err != nil {
+			return fmt.Errorf("route %q: %v", rt.Name, err)
+		}
+	}
+	for identity, s := range rt.IdentitySchedules {
+		if err := s.prepare(); err != nil {
+			return fmt.Errorf("route %q, identity %q: %v", rt.Name, identity, err)
+		}
+	}
+	return nil
+}
+
+// prepare parses the window's days and times
+func (w *weeklyWindow) prepare() error {
+	var err error
+	if w.from, err = parseClock(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return err
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, name := range w.Days {
+		day, ok := weekdayNames[strings.ToLower(name)[:min(3, len(name))]]
+		if !ok {
+			return fmt.Errorf("schedule: unknown day %q", name)
+		}
+		w.days[day] = true
+	}
+	return nil
+}
+
+// parseClock parses "15:04" into minutes after midnight; "24:00" ends a day
+func parseClock(value string) (int, error) {
+	h, m, ok := strings.Cut(value, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("schedule: invalid time %q, expected HH:MM", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains reports whether the window covers a local time
+func (w *weeklyWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from <= w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	// Overnight: the evening part belongs to today, the morning to yesterday
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.from) || (w.days[yesterday] && minute < w.to)
+}
+
+// String describes the window, e.g. "mon-fri 08:00-18:00"
+func (w *weeklyWindow) String() string {
+	days := "daily"
+	if len(w.Days) > 0 {
+		days = strings.ToLower(strings.Join(w.Days, ","))
+	}
+	return days + " " + w.From + "-" + w.To
+}
+
+// check returns why the schedule is closed at t and, for a deny window or
+// blackout, when it ends; an empty reason means access is allowed
+func (s *accessSchedule) check(t time.Time) (reason string, until time.Time) {
+	for _, b := range s.Blackouts {
+		if !t.Before(b.Start) && t.Before(b.End) {
+			reason = "unavailable until " + b.End.In(s.location).Format(time.RFC3339)
+			if b.Reason != "" {
+				reason += " (" + b.Reason + ")"
+			}
+			return reason, b.End
+		}
+	}
+
+	local := t.In(s.location)
+	for i := range s.Deny {
+		if w := &s.Deny[i]; w.contains(local) {
+			return fmt.Sprintf("unavailable %s (%s)", w, s.location), s.windowEnd(w, local)
+		}
+	}
+	if len(s.Allow) == 0 {
+		return "", time.Time{}
+	}
+	hours := make([]string, len(s.Allow))
+	for i := range s.Allow {
+		if s.Allow[i].contains(local) {
+			return "", time.Time{}
+		}
+		hours[i] = s.Allow[i].String()
+	}
+	return fmt.Sprintf("only available %s (%s)", strings.Join(hours, ", "), s.location), time.Time{}
+}
+
+// windowEnd returns when a window containing local ends
+func (s *accessSchedule) windowEnd(w *weeklyWindow, local time.Time) time.Time {
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+	end := midnight.Add(time.Duration(w.to) * time.Minute)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// checkSchedule refuses requests outside the schedules of the route and of
+// the authenticated caller: 403 outside opening hours, 503 with Retry-After
+// during deny windows and blackouts
+func checkSchedule(w http.ResponseWriter, r *http.Request) bool {
+	rt := routeFor(r)
+	schedules := []*accessSchedule{rt.Schedule}
+	who := "This route"
+	if identity := identityFor(r); identity != "" {
+		if s := rt.IdentitySchedules[identity]; s != nil {
+			schedules = append(schedules, s)
+		}
+	}
+
+	now := time.Now()
+	for i, s := range schedules {
+		if s == nil {
+			continue
+		}
+		if i > 0 {
+			who = "Access for " + identityFor(r)
+		}
+		reason, until := s.check(now)
+		if reason == "" || reportOnly(r, "schedule", strings.ToLower(who[:1])+who[1:]+" is "+reason) {
+			continue
+		}
+		addCORSHeaders(w, r)
+		status := http.StatusForbidden
+		if !until.IsZero() {
+			status = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+		}
+		proxyError(w, r, status, who+" is "+reason, "")
+		return false
+	}
+	return true
+}
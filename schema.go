@@ -0,0 +1,422 @@
+package argonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// -----------------------------
+// RESPONSE SCHEMA VALIDATION
+// -----------------------------
+
+// jsonSchema is a parsed JSON Schema document. The commonly used validation
+// keywords are supported: type, enum, const, properties, required,
+// additionalProperties, items, min/maxItems, uniqueItems, min/maxLength,
+// pattern, minimum, maximum, exclusiveMinimum/Maximum, multipleOf, allOf,
+// anyOf, oneOf, not and local $ref ("#/definitions/..." or "#/$defs/...").
+type jsonSchema struct {
+	root     any
+	patterns sync.Map // pattern string -> *regexp.Regexp
+}
+
+// schemaFailures counts failed validations per route name
+var schemaFailures = struct {
+	sync.Mutex
+	byRoute map[string]uint64
+}{byRoute: make(map[string]uint64)}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		schemaFailures.Lock()
+		defer schemaFailures.Unlock()
+		if len(schemaFailures.byRoute) == 0 {
+			return
+		}
+		names := make([]string, 0, len(schemaFailures.byRoute))
+		for name := range schemaFailures.byRoute {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "# HELP argon_proxy_schema_failures_total Upstream responses that failed JSON Schema validation.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_schema_failures_total counter\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "argon_proxy_schema_failures_total{route=%s} %d\n", quoteLabel(name), schemaFailures.byRoute[name])
+		}
+	})
+}
+
+// loadSchema reads the route's response schema; relative paths are resolved
+// against the directory of the config file
+func (rt *Route) loadSchema(baseDir string) error {
+	switch rt.SchemaAction {
+	case "":
+		rt.SchemaAction = "log"
+	case "log", "header", "reject":
+	default:
+		return fmt.Errorf("route %q: schema_action must be log, header or reject", rt.Name)
+	}
+
+	if rt.ResponseSchema == "" {
+		return nil
+	}
+
+	file := rt.ResponseSchema
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("route %q: response schema: %v", rt.Name, err)
+	}
+
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(data, &schema.root); err != nil {
+		return fmt.Errorf("route %q: response schema %s: %v", rt.Name, file, err)
+	}
+	rt.schema = schema
+	return nil
+}
+
+// validateResponseSchema checks JSON responses against the route's schema and
+// applies its schema_action. It returns false when the response was rejected
+// and an error has already been written.
+func validateResponseSchema(w http.ResponseWriter, r *http.Request, resp *http.Response, target string) bool {
+	rt := routeFor(r)
+	if rt.schema == nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+
+	// Buffer the body so it can be validated and then relayed
+	buffered, err := io.ReadAll(io.LimitReader(resp.Body, *schemaBodyLimit+1))
+	resp.Body = teeBody{io.MultiReader(bytes.NewReader(buffered), resp.Body), resp.Body}
+	if err != nil {
+		return true
+	}
+	if int64(len(buffered)) > *schemaBodyLimit {
+		if *verbose {
+			log.Printf("Skipping schema validation for %s: body larger than %d bytes", target, *schemaBodyLimit)
+		}
+		return true
+	}
+
+	var document any
+	var problem string
+	if err := json.Unmarshal(buffered, &document); err != nil {
+		problem = "invalid JSON: " + err.Error()
+	} else if errs := rt.schema.validate(document); len(errs) > 0 {
+		problem = errs[0]
+		if len(errs) > 1 {
+			problem = fmt.Sprintf("%s (and %d more)", errs[0], len(errs)-1)
+		}
+	}
+	if problem == "" {
+		return true
+	}
+
+	schemaFailures.Lock()
+	schemaFailures.byRoute[rt.Name]++
+	schemaFailures.Unlock()
+
+	log.Printf("Schema validation failed for %s (route %s): %s", target, rt.Name, problem)
+
+	switch rt.SchemaAction {
+	case "header":
+		w.Header().Set("X-Argon-Schema-Valid", "false")
+		w.Header().Set("X-Argon-Schema-Error", strings.ToValidUTF8(strings.ReplaceAll(problem, "\n", " "), ""))
+	case "reject":
+		proxyError(w, r, http.StatusBadGateway, "Upstream response failed schema validation: "+problem, target)
+		return false
+	}
+	return true
+}
+
+// validate returns the validation errors for a decoded JSON document
+func (s *jsonSchema) validate(document any) []string {
+	var errs []string
+	s.check(s.root, document, "$", nil, &errs)
+	return errs
+}
+
+// check validates value against schema, appending errors for the JSON path.
+// refs holds the $refs already followed for this value, so a circular one
+// is reported instead of followed again.
+func (s *jsonSchema) check(schema any, value any, path string, refs []string, errs *[]string) {
+	switch sch := schema.(type) {
+	case bool:
+		if !sch {
+			*errs = append(*errs, path+": not allowed")
+		}
+		return
+	case map[string]any:
+		s.checkObject(sch, value, path, refs, errs)
+	}
+}
+
+// checkObject applies the keywords of an object schema
+func (s *jsonSchema) checkObject(sch map[string]any, value any, path string, refs []string, errs *[]string) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if ref, ok := sch["$ref"].(string); ok {
+		if slices.Contains(refs, ref) {
+			fail("circular $ref %q", ref)
+			return
+		}
+		target, err := s.resolveRef(ref)
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		s.check(target, value, path, append(refs[:len(refs):len(refs)], ref), errs)
+	}
+
+	if t, ok := sch["type"]; ok && !matchesType(t, value) {
+		fail("expected type %v, got %s", t, jsonTypeName(value))
+		return
+	}
+
+	if enum, ok := sch["enum"].([]any); ok {
+		found := false
+		for _, candidate := range enum {
+			if jsonEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value not in enum")
+		}
+	}
+	if c, ok := sch["const"]; ok && !jsonEqual(c, value) {
+		fail("value does not equal const")
+	}
+
+	for _, sub := range asSlice(sch["allOf"]) {
+		s.check(sub, value, path, refs, errs)
+	}
+	if anyOf := asSlice(sch["anyOf"]); len(anyOf) > 0 && s.countMatches(anyOf, value, refs) == 0 {
+		fail("value matches none of anyOf")
+	}
+	if oneOf := asSlice(sch["oneOf"]); len(oneOf) > 0 {
+		if n := s.countMatches(oneOf, value, refs); n != 1 {
+			fail("value matches %d of oneOf, want exactly 1", n)
+		}
+	}
+	if not, ok := sch["not"]; ok && s.countMatches([]any{not}, value, refs) == 1 {
+		fail("value matches not")
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		props, _ := sch["properties"].(map[string]any)
+		for _, name := range asSlice(sch["required"]) {
+			if key, ok := name.(string); ok {
+				if _, present := v[key]; !present {
+					fail("missing required property %q", key)
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if propSchema, ok := props[key]; ok {
+				s.check(propSchema, v[key], path+"."+key, nil, errs)
+			} else if additional, ok := sch["additionalProperties"]; ok {
+				s.check(additional, v[key], path+"."+key, nil, errs)
+			}
+		}
+
+	case []any:
+		if n, ok := asNumber(sch["minItems"]); ok && float64(len(v)) < n {
+			fail("expected at least %v items, got %d", n, len(v))
+		}
+		if n, ok := asNumber(sch["maxItems"]); ok && float64(len(v)) > n {
+			fail("expected at most %v items, got %d", n, len(v))
+		}
+		if unique, _ := sch["uniqueItems"].(bool); unique {
+			// Encoded items compare like jsonEqual, as objects encode with sorted keys
+			first := make(map[string]int, len(v))
+			for i, item := range v {
+				encoded, _ := json.Marshal(item)
+				if j, seen := first[string(encoded)]; seen {
+					fail("items %d and %d are not unique", j, i)
+				} else {
+					first[string(encoded)] = i
+				}
+			}
+		}
+		if items, ok := sch["items"]; ok {
+			if tuple, isTuple := items.([]any); isTuple {
+				for i := 0; i < len(v) && i < len(tuple); i++ {
+					s.check(tuple[i], v[i], fmt.Sprintf("%s[%d]", path, i), nil, errs)
+				}
+			} else {
+				for i, item := range v {
+					s.check(items, item, fmt.Sprintf("%s[%d]", path, i), nil, errs)
+				}
+			}
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := asNumber(sch["minLength"]); ok && length < n {
+			fail("expected at least %v characters", n)
+		}
+		if n, ok := asNumber(sch["maxLength"]); ok && length > n {
+			fail("expected at most %v characters", n)
+		}
+		if pattern, ok := sch["pattern"].(string); ok {
+			re, err := s.compile(pattern)
+			if err != nil {
+				fail("invalid pattern %q: %v", pattern, err)
+			} else if !re.MatchString(v) {
+				fail("does not match pattern %q", pattern)
+			}
+		}
+
+	case float64:
+		if n, ok := asNumber(sch["minimum"]); ok && v < n {
+			fail("%v is less than minimum %v", v, n)
+		}
+		if n, ok := asNumber(sch["maximum"]); ok && v > n {
+			fail("%v is greater than maximum %v", v, n)
+		}
+		if n, ok := asNumber(sch["exclusiveMinimum"]); ok && v <= n {
+			fail("%v is not greater than %v", v, n)
+		}
+		if n, ok := asNumber(sch["exclusiveMaximum"]); ok && v >= n {
+			fail("%v is not less than %v", v, n)
+		}
+		if n, ok := asNumber(sch["multipleOf"]); ok && n > 0 {
+			if q := v / n; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("%v is not a multiple of %v", v, n)
+			}
+		}
+	}
+}
+
+// countMatches returns how many of the schemas the value satisfies
+func (s *jsonSchema) countMatches(schemas []any, value any, refs []string) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs []string
+		s.check(sub, value, "$", refs, &errs)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// resolveRef looks up a local JSON pointer reference such as "#/definitions/user"
+func (s *jsonSchema) resolveRef(ref string) (any, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q (only local references are supported)", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// compile caches compiled pattern regular expressions
+func (s *jsonSchema) compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.patterns.Store(pattern, re)
+	return re, nil
+}
+
+// matchesType checks a value against a "type" keyword (a name or list of names)
+func matchesType(t any, value any) bool {
+	names := asSlice(t)
+	if name, ok := t.(string); ok {
+		names = []any{name}
+	}
+	actual := jsonTypeName(value)
+	for _, name := range names {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded value
+func jsonTypeName(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares two decoded JSON values
+func jsonEqual(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+// asSlice returns v as a JSON array, or nil
+func asSlice(v any) []any {
+	list, _ := v.([]any)
+	return list
+}
+
+// asNumber returns v as a JSON number
+func asNumber(v any) (float64, bool) {
+	n, ok := v.(float64)
+	return n, ok
+}
@@ -0,0 +1,60 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		document string
+		wantErr  string
+	}{
+		{"self reference", `{"$ref":"#"}`, `1`, "circular"},
+		{"reference cycle", `{"definitions":{"a":{"$ref":"#/definitions/b"},"b":{"allOf":[{"$ref":"#/definitions/a"}]}},"$ref":"#/definitions/a"}`, `{}`, "circular"},
+		{"branching cycle", `{"definitions":{"a":{"anyOf":[{"$ref":"#/definitions/a"},{"$ref":"#/definitions/a"}]}},"$ref":"#/definitions/a"}`, `"x"`, "anyOf"},
+		{"recursive tree", `{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`, `{"children":[{"children":[{"children":[]}]}]}`, ""},
+		{"recursive tree mismatch", `{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`, `{"children":[{"children":[1]}]}`, "$.children[0].children[0]"},
+		{"unique items", `{"uniqueItems":true}`, `[1,"1",{"a":1,"b":2},[1]]`, ""},
+		{"duplicate items", `{"uniqueItems":true}`, `[{"a":1,"b":2},3,{"b":2,"a":1}]`, "items 0 and 2 are not unique"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &jsonSchema{}
+			if err := json.Unmarshal([]byte(tt.schema), &s.root); err != nil {
+				t.Fatal(err)
+			}
+			var document any
+			if err := json.Unmarshal([]byte(tt.document), &document); err != nil {
+				t.Fatal(err)
+			}
+			errs := s.validate(document)
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("validate = %q, want no errors", errs)
+				}
+				return
+			}
+			if !strings.Contains(strings.Join(errs, "\n"), tt.wantErr) {
+				t.Errorf("validate = %q, want an error containing %q", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaUniqueItemsLarge(t *testing.T) {
+	s := &jsonSchema{root: map[string]any{"uniqueItems": true}}
+	items := make([]any, 100000)
+	for i := range items {
+		items[i] = map[string]any{"id": fmt.Sprint(i)}
+	}
+	items = append(items, map[string]any{"id": "5"})
+	errs := s.validate(items)
+	if len(errs) != 1 || !strings.Contains(errs[0], "items 5 and 100000 are not unique") {
+		t.Errorf("validate = %q", errs)
+	}
+}
@@ -0,0 +1,199 @@
+package argonproxy
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// -----------------------------
+// ENCRYPTED CONFIG VALUES
+// -----------------------------
+
+// encryptedPrefix marks a value encrypted with the config key (AES-256-GCM)
+const encryptedPrefix = "enc:v1:"
+
+// errNoSecretKey is returned when encrypted values are used without a key
+var errNoSecretKey = errors.New("encrypted values need a key in $ARGON_CONFIG_KEY or --config-key-file")
+
+// encryptedFlags keeps the encrypted form of flags given as enc:v1: values,
+// so installed services never see the plaintext
+var encryptedFlags = make(map[string]string)
+
+// decryptedSecrets holds the plaintexts of decrypted config values so the
+// admin API can redact them wherever they appear
+var decryptedSecrets sync.Map
+
+// loadSecretKey reads the base64 encoded 32-byte key from the environment or
+// the key file
+func loadSecretKey() ([]byte, error) {
+	encoded := os.Getenv("ARGON_CONFIG_KEY")
+	if encoded == "" && *configKeyFile != "" {
+		data, err := os.ReadFile(*configKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %v", err)
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, errNoSecretKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("config key must be 32 bytes, base64 encoded (see the keygen command)")
+	}
+	return key, nil
+}
+
+// newSecretCipher creates the AEAD for the config key
+func newSecretCipher() (cipher.AEAD, error) {
+	key, err := loadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret returns the enc:v1: form of a plaintext value
+func encryptSecret(aead cipher.AEAD, plaintext string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(encryptedPrefix))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret returns the plaintext of an enc:v1: value
+func decryptSecret(aead cipher.AEAD, value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedPrefix))
+	if err != nil {
+		return "", errors.New("cannot decrypt value (wrong key?)")
+	}
+	return string(plaintext), nil
+}
+
+// decryptFlags replaces enc:v1: flag values with their plaintext
+func decryptFlags() error {
+	var aead cipher.AEAD
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if err != nil || !strings.HasPrefix(value, encryptedPrefix) {
+			return
+		}
+		if aead == nil {
+			if aead, err = newSecretCipher(); err != nil {
+				return
+			}
+		}
+		var plaintext string
+		if plaintext, err = decryptSecret(aead, value); err != nil {
+			err = fmt.Errorf("--%s: %v", f.Name, err)
+			return
+		}
+		encryptedFlags[f.Name] = value
+		err = f.Value.Set(plaintext)
+	})
+	return err
+}
+
+// decryptConfig replaces enc:v1: strings anywhere in a JSON config document
+func decryptConfig(data []byte) ([]byte, error) {
+	if !strings.Contains(string(data), encryptedPrefix) {
+		return data, nil
+	}
+	aead, err := newSecretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc, err = decryptValues(aead, doc, ""); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// decryptValues walks a decoded JSON value and decrypts enc:v1: strings
+func decryptValues(aead cipher.AEAD, value any, path string) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if !strings.HasPrefix(v, encryptedPrefix) {
+			return v, nil
+		}
+		plaintext, err := decryptSecret(aead, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", strings.TrimPrefix(path, "."), err)
+		}
+		decryptedSecrets.Store(plaintext, true)
+		return plaintext, nil
+	case map[string]any:
+		for key, item := range v {
+			decrypted, err := decryptValues(aead, item, path+"."+key)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = decrypted
+		}
+	case []any:
+		for i, item := range v {
+			decrypted, err := decryptValues(aead, item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = decrypted
+		}
+	}
+	return value, nil
+}
+
+// generateSecretKey returns a new random base64 encoded config key
+func generateSecretKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// runEncryptSecret encrypts each line read from in and writes the enc:v1:
+// values to out
+func runEncryptSecret(in io.Reader, out io.Writer) error {
+	aead, err := newSecretCipher()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		value, err := encryptSecret(aead, scanner.Text())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, value)
+	}
+	return scanner.Err()
+}
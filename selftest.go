@@ -0,0 +1,267 @@
+package argonproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// SELF TEST
+// -----------------------------
+
+// selfTestCheck is a single end-to-end check run against an in-process proxy
+type selfTestCheck struct {
+	name string
+	run  func(proxyURL, upstreamURL string) error
+}
+
+// selfTestChecks lists the checks run by the selftest subcommand
+var selfTestChecks = []selfTestCheck{
+	{"cors-headers", checkCORSHeaders},
+	{"preflight", checkPreflight},
+	{"request-body", checkRequestBody},
+	{"streaming", checkStreaming},
+	{"event-stream", checkEventStream},
+	{"redirects", checkRedirects},
+}
+
+// runSelfTest runs the proxy handler against an in-process echo server,
+// prints a report and returns the process exit code
+func runSelfTest() int {
+	// The checks exercise the proxy itself, not the captcha gate in front of it
+	*captchaProviderName = ""
+
+	upstream, err := startLocalServer(selfTestUpstream())
+	if err != nil {
+		fmt.Printf("Error starting the upstream: %v\n", err)
+		return 1
+	}
+	defer upstream.Close()
+	proxy, err := startLocalServer(newHandler())
+	if err != nil {
+		fmt.Printf("Error starting the proxy: %v\n", err)
+		return 1
+	}
+	defer proxy.Close()
+
+	fmt.Printf("Argon-Proxy self test\n")
+	fmt.Printf("  upstream: %s\n  proxy:    %s\n\n", upstream.URL, proxy.URL)
+
+	failed := 0
+	for _, check := range selfTestChecks {
+		if err := check.run(proxy.URL, upstream.URL); err != nil {
+			failed++
+			fmt.Printf("FAIL  %-14s %v\n", check.name, err)
+		} else {
+			fmt.Printf("PASS  %s\n", check.name)
+		}
+	}
+
+	fmt.Printf("\n%d/%d checks passed\n", len(selfTestChecks)-failed, len(selfTestChecks))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// localServer is an HTTP server on a free loopback port
+type localServer struct {
+	*http.Server
+	URL string
+}
+
+// startLocalServer serves handler on a free loopback port, like
+// httptest.NewServer without bringing the testing package into the binary
+func startLocalServer(handler http.Handler) (*localServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &localServer{Server: &http.Server{Handler: handler}, URL: "http://" + ln.Addr().String()}
+	go srv.Serve(ln)
+	return srv, nil
+}
+
+// selfTestUpstream is the echo server the self test proxies to
+func selfTestUpstream() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// Upstream CORS headers must never reach the client
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.invalid")
+		w.Header().Set("X-Echo-Method", r.Method)
+		w.Header().Set("X-Echo-Query", r.URL.RawQuery)
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		flusher, _ := w.(http.Flusher)
+		for i := 0; i < 64; i++ {
+			fmt.Fprintf(w, "chunk %02d %s\n", i, strings.Repeat("x", 1000))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		// One event, then nothing until the client goes away
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/echo?redirected=1", http.StatusFound)
+	})
+	return mux
+}
+
+// selfTestURL builds a proxy URL for the given upstream path
+func selfTestURL(proxyURL, upstreamURL, path string) string {
+	return strings.TrimSuffix(proxyURL, "/") + "/proxy/?target=" + url.QueryEscape(upstreamURL+path)
+}
+
+// checkCORSHeaders verifies CORS headers on a simple proxied request
+func checkCORSHeaders(proxyURL, upstreamURL string) error {
+	origin := "https://selftest.example"
+	req, _ := http.NewRequest("GET", selfTestURL(proxyURL, upstreamURL, "/echo")+"&extra=1", nil)
+	req.Header.Set("Origin", origin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d, want 200", resp.StatusCode)
+	}
+	allowed := resp.Header.Get("Access-Control-Allow-Origin")
+	if allowed == "https://upstream.invalid" {
+		return fmt.Errorf("upstream Access-Control-Allow-Origin leaked through")
+	}
+	if allowed != origin && allowed != routeFor(req).AllowOrigin {
+		return fmt.Errorf("Access-Control-Allow-Origin %q, want %q", allowed, origin)
+	}
+	if !strings.Contains(resp.Header.Get("Vary"), "Origin") {
+		return fmt.Errorf("missing Vary: Origin")
+	}
+	if query := resp.Header.Get("X-Echo-Query"); query != "extra=1" {
+		return fmt.Errorf("upstream saw query %q, want %q", query, "extra=1")
+	}
+	return nil
+}
+
+// checkPreflight verifies the response to a CORS preflight request
+func checkPreflight(proxyURL, upstreamURL string) error {
+	req, _ := http.NewRequest("OPTIONS", selfTestURL(proxyURL, upstreamURL, "/echo"), nil)
+	req.Header.Set("Origin", "https://selftest.example")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom-Header")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("status %d, want 204", resp.StatusCode)
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "PUT") {
+		return fmt.Errorf("Access-Control-Allow-Methods %q does not include PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "X-Custom-Header") {
+		return fmt.Errorf("Access-Control-Allow-Headers %q does not include X-Custom-Header", resp.Header.Get("Access-Control-Allow-Headers"))
+	}
+	if resp.Header.Get("Access-Control-Max-Age") == "" {
+		return fmt.Errorf("missing Access-Control-Max-Age")
+	}
+	return nil
+}
+
+// checkRequestBody verifies that request bodies and methods reach the upstream
+func checkRequestBody(proxyURL, upstreamURL string) error {
+	payload := `{"selftest":true}`
+	resp, err := http.Post(selfTestURL(proxyURL, upstreamURL, "/echo"), "application/json", strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("X-Echo-Method") != "POST" {
+		return fmt.Errorf("upstream saw method %q, want POST", resp.Header.Get("X-Echo-Method"))
+	}
+	if string(body) != payload {
+		return fmt.Errorf("echoed body %q, want %q", body, payload)
+	}
+	return nil
+}
+
+// checkStreaming verifies that a chunked response without a length is relayed intact
+func checkStreaming(proxyURL, upstreamURL string) error {
+	resp, err := http.Get(selfTestURL(proxyURL, upstreamURL, "/stream"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if lines := bytes.Count(body, []byte("\n")); lines != 64 {
+		return fmt.Errorf("received %d chunks, want 64", lines)
+	}
+	return nil
+}
+
+// checkEventStream verifies that server-sent events reach the client while
+// the upstream keeps the stream open
+func checkEventStream(proxyURL, upstreamURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", selfTestURL(proxyURL, upstreamURL, "/events"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("first event not delivered while the stream is open: %v", err)
+	}
+	if line != "data: first\n" {
+		return fmt.Errorf("received %q, want the first event", line)
+	}
+	return nil
+}
+
+// checkRedirects verifies that upstream redirects are followed
+func checkRedirects(proxyURL, upstreamURL string) error {
+	resp, err := http.Get(selfTestURL(proxyURL, upstreamURL, "/redirect"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d, want 200", resp.StatusCode)
+	}
+	if query := resp.Header.Get("X-Echo-Query"); query != "redirected=1" {
+		return fmt.Errorf("final upstream query %q, want %q", query, "redirected=1")
+	}
+	return nil
+}
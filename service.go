@@ -0,0 +1,66 @@
+package argonproxy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// -----------------------------
+// SERVICE INSTALLATION
+// -----------------------------
+
+// serviceName is the name the proxy is registered under with service managers
+const serviceName = "argon-proxy"
+
+// pathFlags are flags holding file paths, made absolute for installed services
+var pathFlags = map[string]bool{"config": true, "config-key-file": true, "tls-cert": true, "tls-key": true}
+
+// serviceCommand returns the absolute executable path and the flags set on
+// the current command line, so the installed service runs with the same
+// settings. Secrets must be given as enc:v1: values, which stay encrypted in
+// the service definition; plaintext ones are refused.
+func serviceCommand() (string, []string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", nil, err
+	}
+
+	var args []string
+	var plaintext []string
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		// Secrets given encrypted stay encrypted in the service definition
+		if encrypted, ok := encryptedFlags[f.Name]; ok {
+			value = encrypted
+		} else if isPlaintextSecret(f.Name, value) {
+			plaintext = append(plaintext, "--"+f.Name)
+		}
+		// Relative file paths would resolve against the service manager's working directory
+		if pathFlags[f.Name] && value != "" {
+			if abs, err := filepath.Abs(value); err == nil {
+				value = abs
+			}
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, value))
+	})
+	if len(plaintext) > 0 {
+		return "", nil, fmt.Errorf("%s would be stored in plaintext in the service definition; give them as enc:v1: values (see the encrypt-secret command)", strings.Join(plaintext, ", "))
+	}
+	return exe, args, nil
+}
+
+// isPlaintextSecret reports whether an unencrypted flag value is a secret
+// that /admin/config would redact: flags named like secrets, header lists
+// and URLs with a password
+func isPlaintextSecret(name, value string) bool {
+	if value == "" || pathFlags[name] {
+		return false
+	}
+	return isSecretName(name) || headerListFlags[name] || redactString(value) != value
+}
@@ -0,0 +1,109 @@
+package argonproxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdLabel identifies the launchd agent
+const launchdLabel = "com.a2hop." + serviceName
+
+// launchdPlistPath returns the location of the per-user launchd agent definition
+func launchdPlistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+// installService registers the proxy as a launchd agent for the current user
+func installService() error {
+	exe, args, err := serviceCommand()
+	if err != nil {
+		return err
+	}
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	logPath := filepath.Join(home, "Library", "Logs", serviceName+".log")
+
+	var programArgs strings.Builder
+	for _, arg := range append([]string{exe}, args...) {
+		programArgs.WriteString("\t\t<string>")
+		xml.EscapeText(&programArgs, []byte(arg))
+		programArgs.WriteString("</string>\n")
+	}
+
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, launchdLabel, programArgs.String(), logPath, logPath)
+
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return err
+	}
+	// The arguments may hold encrypted secrets, so only the user reads them
+	if err := os.WriteFile(plistPath, []byte(plist), 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(plistPath, 0600); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("launchctl", "load", "-w", plistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl load: %v: %s", err, out)
+	}
+
+	fmt.Printf("Installed launchd agent %s (%s)\n", launchdLabel, plistPath)
+	fmt.Printf("Logs: %s\n", logPath)
+	return nil
+}
+
+// uninstallService stops and removes the launchd agent
+func uninstallService() error {
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); err != nil {
+		return fmt.Errorf("launchd agent not installed: %v", err)
+	}
+
+	if out, err := exec.Command("launchctl", "unload", "-w", plistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl unload: %v: %s", err, out)
+	}
+	if err := os.Remove(plistPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Uninstalled launchd agent %s\n", launchdLabel)
+	return nil
+}
+
+// runAsService reports false; launchd runs the proxy as a regular process
+func runAsService(listenAddr string) bool {
+	return false
+}
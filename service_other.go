@@ -0,0 +1,23 @@
+//go:build !windows && !darwin
+
+package argonproxy
+
+import "errors"
+
+// errNoServiceManager is returned where install/uninstall is not supported
+var errNoServiceManager = errors.New("not supported on this platform; use the provided argon-proxy.service systemd unit")
+
+// installService is only implemented for Windows and macOS
+func installService() error {
+	return errNoServiceManager
+}
+
+// uninstallService is only implemented for Windows and macOS
+func uninstallService() error {
+	return errNoServiceManager
+}
+
+// runAsService reports false; systemd runs the proxy as a regular process
+func runAsService(listenAddr string) bool {
+	return false
+}
@@ -0,0 +1,25 @@
+package argonproxy
+
+import "testing"
+
+func TestIsPlaintextSecret(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        bool
+	}{
+		{"admin-token", "s3cret", true},
+		{"federation-secret", "s3cret", true},
+		{"access-log-headers", "Authorization=Bearer x", true},
+		{"store", "redis://:pw@redis.internal:6379/0", true},
+		{"store", "redis://redis.internal:6379/0", false},
+		{"tls-key", "/etc/argon-proxy/key.pem", false},
+		{"admin-token", "", false},
+		{"port", "9000", false},
+		{"allow-origin", "http://localhost:3000", false},
+	}
+	for _, tt := range tests {
+		if got := isPlaintextSecret(tt.name, tt.value); got != tt.want {
+			t.Errorf("isPlaintextSecret(%q, %q) = %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package argonproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService registers the proxy as an automatically started Windows service
+func installService() error {
+	exe, args, err := serviceCommand()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager (run as Administrator): %v", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Argon Proxy Server",
+		Description: "CORS proxy server",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("service installed but failed to start: %v", err)
+	}
+
+	fmt.Printf("Installed and started Windows service %s\n", serviceName)
+	return nil
+}
+
+// uninstallService stops and removes the Windows service
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to service manager (run as Administrator): %v", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	// Stopping fails if the service is not running, which is fine
+	s.Control(svc.Stop)
+	if err := s.Delete(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Uninstalled Windows service %s\n", serviceName)
+	return nil
+}
+
+// windowsService runs the HTTP server under the Windows service control manager
+type windowsService struct {
+	listenAddr string
+}
+
+// Execute implements svc.Handler
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ws.listenAddr) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errc:
+			log.Printf("Server stopped: %v", err)
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				// A stop can arrive while the server is still starting
+				select {
+				case <-serverStarted:
+					if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+						log.Printf("Error shutting down: %v", err)
+					}
+				case err := <-errc:
+					log.Printf("Server stopped: %v", err)
+				case <-ctx.Done():
+				}
+				cancel()
+				return false, 0
+			}
+		}
+	}
+}
+
+// runAsService serves under the service control manager when started by it
+func runAsService(listenAddr string) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+
+	if err := svc.Run(serviceName, &windowsService{listenAddr: listenAddr}); err != nil {
+		log.Fatalf("Service failed: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// -----------------------------
+// SHARED CACHE TIER
+// -----------------------------
+
+// sharedGenerationKey holds the counter a flush increments, so every
+// instance stops finding the responses stored before it
+const sharedGenerationKey = "cache:generation"
+
+// onShared reports whether a response goes to the shared tier: types listed
+// in --cache-shared-types whose body may fit --cache-shared-max-object
+func onShared(resp *http.Response) bool {
+	if *cacheSharedTypes == "" || resp.ContentLength > *cacheSharedMaxObject {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, pattern := range splitList(*cacheSharedTypes) {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedKey is the store key of a cache key in the current generation
+func sharedKey(key string) (string, error) {
+	generation, err := store.Incr(sharedGenerationKey, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("cache:%d:%s", generation, hex.EncodeToString(sum[:])), nil
+}
+
+// getShared returns the shared tier's response for key when it matches the
+// request headers. It may be stale.
+func getShared(key string, header http.Header) *cacheEntry {
+	if *cacheSharedTypes == "" {
+		return nil
+	}
+	skey, err := sharedKey(key)
+	var data []byte
+	var ok bool
+	if err == nil {
+		data, ok, err = store.Get(skey)
+	}
+	if err != nil {
+		log.Printf("Error reading shared cache: %v", err)
+		return nil
+	}
+	line, body, found := bytes.Cut(data, []byte("\n"))
+	var meta diskMeta
+	if !ok || !found || json.Unmarshal(line, &meta) != nil || meta.Key != key {
+		return nil
+	}
+	if meta.Header == nil {
+		meta.Header = http.Header{}
+	}
+	entry := &cacheEntry{
+		target:  meta.Target,
+		status:  meta.Status,
+		header:  meta.Header,
+		vary:    meta.Vary,
+		stored:  meta.Stored,
+		expires: meta.Expires,
+		body:    body,
+		length:  int64(len(body)),
+		shared:  true,
+	}
+	if !entry.matches(header) {
+		return nil
+	}
+	return entry
+}
+
+// putShared stores a response in the shared tier, replacing the variant
+// stored before. It is kept for --cache-ttl past its expiry so it can still
+// be revalidated.
+func putShared(key string, entry *cacheEntry) {
+	meta, _ := json.Marshal(diskMeta{
+		Key:     key,
+		Target:  entry.target,
+		Status:  entry.status,
+		Header:  entry.header,
+		Vary:    entry.vary,
+		Stored:  entry.stored,
+		Expires: entry.expires,
+	})
+	data := make([]byte, 0, len(meta)+1+len(entry.body))
+	data = append(append(append(data, meta...), '\n'), entry.body...)
+	skey, err := sharedKey(key)
+	if err == nil {
+		err = store.Set(skey, data, time.Until(entry.expires)+*cacheTTL)
+	}
+	if err != nil {
+		log.Printf("Error writing shared cache: %v", err)
+	}
+}
+
+// removeShared drops the shared tier's response for a target URL on every
+// route and returns how many there were
+func removeShared(target string) int {
+	if *cacheSharedTypes == "" {
+		return 0
+	}
+	table := activeRoutes.Load()
+	if table == nil {
+		return 0
+	}
+	removed := 0
+	for _, rt := range append([]*Route{table.fallback}, table.routes...) {
+		skey, err := sharedKey(rt.Name + "\n" + target)
+		if err != nil {
+			log.Printf("Error removing from shared cache: %v", err)
+			return removed
+		}
+		if _, ok, _ := store.Get(skey); ok {
+			if err := store.Delete(skey); err != nil {
+				log.Printf("Error removing from shared cache: %v", err)
+				continue
+			}
+			removed++
+		}
+	}
+	return removed
+}
+
+// flushShared starts a new generation of the shared tier; the responses of
+// the old one expire in the store
+func flushShared() {
+	if *cacheSharedTypes == "" {
+		return
+	}
+	if _, err := store.Incr(sharedGenerationKey, 1, 0); err != nil {
+		log.Printf("Error flushing shared cache: %v", err)
+	}
+}
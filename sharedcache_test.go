@@ -0,0 +1,73 @@
+package argonproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSharedCacheTier(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/photo" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+	handler, err := NewTestHandler("--cache-shared-types=application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer NewTestHandler()
+
+	get := func(path string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/proxy/?target="+url.QueryEscape(upstream.URL+path), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"ok":true}` {
+			t.Fatalf("GET %s = %d %q", path, rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get(cacheHeader)
+	}
+
+	tests := []struct {
+		name, path, wantCache string
+		wantCalls             int64
+	}{
+		{"json miss", "/data", "MISS", 1},
+		{"json hit", "/data", "HIT", 1},
+		{"other type is not kept", "/photo", "MISS", 2},
+		{"other type again", "/photo", "MISS", 3},
+	}
+	for _, tt := range tests {
+		if got := get(tt.path); got != tt.wantCache {
+			t.Errorf("%s: %s = %q, want %q", tt.name, cacheHeader, got, tt.wantCache)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("%s: upstream requests = %d, want %d", tt.name, got, tt.wantCalls)
+		}
+	}
+
+	// The entry lives in the store, where other instances find it
+	if getShared("default\n"+upstream.URL+"/data", http.Header{}) == nil {
+		t.Error("no shared entry in the store")
+	}
+	if removed := purgeTarget(upstream.URL + "/data"); removed != 1 {
+		t.Errorf("purgeTarget removed %d, want 1", removed)
+	}
+	if got := get("/data"); got != "MISS" {
+		t.Errorf("after purge: %s = %q, want MISS", cacheHeader, got)
+	}
+	purgeLocal([]string{"responses"})
+	if got := get("/data"); got != "MISS" {
+		t.Errorf("after flush: %s = %q, want MISS", cacheHeader, got)
+	}
+}
@@ -0,0 +1,359 @@
+package argonproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// AWS SIGV4 SIGNING
+// -----------------------------
+
+// sigv4MaxBody is the largest request body that can be signed; SigV4 needs
+// the hash of the whole payload before the request is sent
+const sigv4MaxBody = 10 << 20
+
+// errSignBodyTooLarge is returned for bodies over sigv4MaxBody
+var errSignBodyTooLarge = fmt.Errorf("request body too large to sign (max %d bytes)", sigv4MaxBody)
+
+// awsSigV4 configures SigV4 signing of a route's upstream requests. Without
+// static keys, credentials come from the environment, the ECS task role or
+// the EC2 instance role.
+type awsSigV4 struct {
+	Service         string `json:"service"`
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// awsCredentials are the keys a request is signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialCache holds role credentials until shortly before they expire
+var awsCredentialCache struct {
+	sync.Mutex
+	creds *awsCredentials
+}
+
+// prepare validates the signing settings and checks credentials are available
+func (s *awsSigV4) prepare(routeName string) error {
+	if s.Service == "" {
+		return fmt.Errorf("route %q: aws_sigv4 needs a service, e.g. execute-api or es", routeName)
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_REGION")
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Region == "" {
+		return fmt.Errorf("route %q: aws_sigv4 needs a region", routeName)
+	}
+	if _, err := s.credentials(); err != nil {
+		return fmt.Errorf("route %q: aws_sigv4: %v", routeName, err)
+	}
+	return nil
+}
+
+// credentials returns the configured keys, or the ambient AWS credentials
+func (s *awsSigV4) credentials() (*awsCredentials, error) {
+	if s.AccessKeyID != "" {
+		id, err := expandSecrets(s.AccessKeyID)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := expandSecrets(s.SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		token, err := expandSecrets(s.SessionToken)
+		if err != nil {
+			return nil, err
+		}
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: token}, nil
+	}
+	return ambientAWSCredentials()
+}
+
+// ambientAWSCredentials looks up credentials from the environment, the ECS
+// container endpoint or the EC2 instance metadata service
+func ambientAWSCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	awsCredentialCache.Lock()
+	defer awsCredentialCache.Unlock()
+	if c := awsCredentialCache.creds; c != nil && time.Until(c.Expires) > 5*time.Minute {
+		return c, nil
+	}
+
+	var creds *awsCredentials
+	var err error
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		creds, err = fetchRoleCredentials("http://169.254.170.2"+uri, nil)
+	} else {
+		creds, err = instanceRoleCredentials()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials found: %v", err)
+	}
+	awsCredentialCache.creds = creds
+	return creds, nil
+}
+
+// instanceRoleCredentials reads the EC2 instance role credentials using IMDSv2
+func instanceRoleCredentials() (*awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	req, _ := http.NewRequest("PUT", imds+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+	req, _ = http.NewRequest("GET", imds+"/meta-data/iam/security-credentials/", nil)
+	req.Header = header
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	role, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(role) == 0 {
+		return nil, errors.New("instance has no IAM role")
+	}
+
+	return fetchRoleCredentials(imds+"/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), header)
+}
+
+// fetchRoleCredentials reads temporary credentials from a metadata endpoint
+func fetchRoleCredentials(endpoint string, header http.Header) (*awsCredentials, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("credentials endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		AccessKeyID:     body.AccessKeyID,
+		SecretAccessKey: body.SecretAccessKey,
+		SessionToken:    body.Token,
+		Expires:         body.Expiration,
+	}, nil
+}
+
+// signUpstreamRequest signs the upstream request when the route has aws_sigv4
+func signUpstreamRequest(r *http.Request, proxyReq *http.Request) error {
+	sig := routeFor(r).AWSSigV4
+	if sig == nil {
+		return nil
+	}
+	creds, err := sig.credentials()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUpstreamCredentials, err)
+	}
+
+	// Read the body to hash it, then send the same bytes
+	var payload []byte
+	if proxyReq.Body != nil && proxyReq.Body != http.NoBody {
+		payload, err = io.ReadAll(io.LimitReader(proxyReq.Body, sigv4MaxBody+1))
+		proxyReq.Body.Close()
+		if err != nil {
+			return fmt.Errorf("reading request body: %w", err)
+		}
+		if len(payload) > sigv4MaxBody {
+			return errSignBodyTooLarge
+		}
+		proxyReq.Body = io.NopCloser(bytes.NewReader(payload))
+		proxyReq.ContentLength = int64(len(payload))
+	}
+
+	sig.sign(proxyReq, payload, creds, time.Now().UTC())
+	return nil
+}
+
+// sign adds the SigV4 Authorization header to a request
+func (s *awsSigV4) sign(req *http.Request, payload []byte, creds *awsCredentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	// Canonical headers: host and every x-amz-* header
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(headers[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsCanonicalPath(req.URL, s.Service != "s3"),
+		awsCanonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalPath encodes each path segment; services other than S3 expect
+// the already escaped path to be encoded a second time
+func awsCanonicalPath(u *url.URL, doubleEncode bool) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			decoded = segment
+		}
+		segments[i] = awsURIEncode(decoded)
+		if doubleEncode {
+			segments[i] = awsURIEncode(segments[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery sorts and encodes the query parameters
+func awsCanonicalQuery(u *url.URL) string {
+	var params [][2]string
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		params = append(params, [2]string{awsURIEncode(key), awsURIEncode(value)})
+	}
+	// Sorted by name, then by value
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// awsURIEncode percent-encodes everything except RFC 3986 unreserved characters
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sha256Hex returns the hex encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 computes an HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
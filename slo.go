@@ -0,0 +1,296 @@
+package argonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// SERVICE LEVEL OBJECTIVES
+// -----------------------------
+
+// sloSampleSize is how many recent requests percentiles are computed from
+const sloSampleSize = 1024
+
+// sloAlertInterval is the minimum time between two alerts for the same route
+const sloAlertInterval = 15 * time.Minute
+
+// sloMinRequests is the fewest requests in the short window that can trigger an alert
+const sloMinRequests = 10
+
+// routeSLO is the service level objective configured for a route. A request
+// is good when it succeeds within the latency and size thresholds.
+type routeSLO struct {
+	Latency   string  `json:"latency,omitempty"`
+	MaxBytes  int64   `json:"max_bytes,omitempty"`
+	Objective float64 `json:"objective,omitempty"`
+	Webhook   string  `json:"webhook,omitempty"`
+
+	latency time.Duration
+	tracker *sloTracker
+}
+
+// sloBucket counts good and bad requests for one minute
+type sloBucket struct {
+	minute    int64
+	good, bad uint64
+}
+
+// sloTracker keeps recent samples and per-minute outcomes for one route
+type sloTracker struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	sizes     []int64
+	next      int
+	buckets   [60]sloBucket
+	good, bad uint64
+	lastAlert time.Time
+}
+
+func init() {
+	registerMetrics(writeSLOMetrics)
+}
+
+// defaultSLO builds the fallback route's objective from the command line flags
+func defaultSLO() *routeSLO {
+	if *sloLatency <= 0 && *sloMaxBytes <= 0 {
+		return nil
+	}
+	return &routeSLO{
+		Latency:   sloLatency.String(),
+		MaxBytes:  *sloMaxBytes,
+		Objective: *sloObjective,
+		Webhook:   *sloWebhook,
+		latency:   *sloLatency,
+		tracker:   &sloTracker{},
+	}
+}
+
+// prepare validates the objective and fills in defaults
+func (s *routeSLO) prepare(routeName string) error {
+	if s.Latency != "" {
+		latency, err := time.ParseDuration(s.Latency)
+		if err != nil {
+			return fmt.Errorf("route %q: slo latency: %v", routeName, err)
+		}
+		s.latency = latency
+	}
+	if s.Objective == 0 {
+		s.Objective = *sloObjective
+	}
+	if s.Objective <= 0 || s.Objective >= 1 {
+		return fmt.Errorf("route %q: slo objective must be between 0 and 1", routeName)
+	}
+	if s.Webhook == "" {
+		s.Webhook = *sloWebhook
+	}
+	s.tracker = &sloTracker{}
+	return nil
+}
+
+// recordSLO adds a finished request to the route's objective; status 0 means
+// the upstream failed
+func recordSLO(r *http.Request, status int, bytes int64, elapsed time.Duration) {
+	rt := routeFor(r)
+	slo := rt.SLO
+	if slo == nil || slo.tracker == nil {
+		return
+	}
+
+	good := status > 0 && status < 500
+	if slo.latency > 0 && elapsed > slo.latency {
+		good = false
+	}
+	if slo.MaxBytes > 0 && bytes > slo.MaxBytes {
+		good = false
+	}
+
+	t := slo.tracker
+	t.mu.Lock()
+	if len(t.latencies) < sloSampleSize {
+		t.latencies = append(t.latencies, elapsed)
+		t.sizes = append(t.sizes, bytes)
+	} else {
+		t.latencies[t.next] = elapsed
+		t.sizes[t.next] = bytes
+		t.next = (t.next + 1) % sloSampleSize
+	}
+
+	minute := time.Now().Unix() / 60
+	bucket := &t.buckets[minute%int64(len(t.buckets))]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	if good {
+		bucket.good++
+		t.good++
+	} else {
+		bucket.bad++
+		t.bad++
+	}
+
+	var alert *sloAlert
+	if !good && time.Since(t.lastAlert) >= sloAlertInterval {
+		short, requests := t.burnRate(5, slo.Objective)
+		long, _ := t.burnRate(60, slo.Objective)
+		if requests >= sloMinRequests && short >= *sloBurnRate && long >= *sloBurnRate {
+			t.lastAlert = time.Now()
+			alert = &sloAlert{
+				Route:         rt.Name,
+				Objective:     slo.Objective,
+				BurnRate5m:    short,
+				BurnRate1h:    long,
+				Threshold:     *sloBurnRate,
+				LatencyTarget: slo.Latency,
+				MaxBytes:      slo.MaxBytes,
+				Time:          t.lastAlert.UTC(),
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if alert != nil {
+		log.Printf("SLO burn rate alert for route %s: %.1fx over 5m, %.1fx over 1h (objective %g)",
+			alert.Route, alert.BurnRate5m, alert.BurnRate1h, alert.Objective)
+		if slo.Webhook != "" {
+			go sendSLOAlert(slo.Webhook, alert)
+		}
+	}
+}
+
+// burnRate returns how fast the error budget is spent over the last minutes
+// (1 means exactly on budget) and the number of requests seen. Must be called
+// with t.mu held.
+func (t *sloTracker) burnRate(minutes int64, objective float64) (float64, uint64) {
+	now := time.Now().Unix() / 60
+	var good, bad uint64
+	for _, bucket := range t.buckets {
+		if bucket.minute > now-minutes {
+			good += bucket.good
+			bad += bucket.bad
+		}
+	}
+	total := good + bad
+	if total == 0 {
+		return 0, 0
+	}
+	return (float64(bad) / float64(total)) / (1 - objective), total
+}
+
+// sloAlert is the JSON body posted to the SLO webhook
+type sloAlert struct {
+	Route         string    `json:"route"`
+	Objective     float64   `json:"objective"`
+	BurnRate5m    float64   `json:"burn_rate_5m"`
+	BurnRate1h    float64   `json:"burn_rate_1h"`
+	Threshold     float64   `json:"threshold"`
+	LatencyTarget string    `json:"latency_target,omitempty"`
+	MaxBytes      int64     `json:"max_bytes,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// sendSLOAlert posts an alert to the webhook
+func sendSLOAlert(webhook string, alert *sloAlert) {
+	body, _ := json.Marshal(alert)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error sending SLO alert for route %s: %v", alert.Route, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("SLO webhook for route %s returned %s", alert.Route, resp.Status)
+	}
+}
+
+// sloQuantiles are the percentiles exported for latency and response size
+var sloQuantiles = []float64{0.5, 0.9, 0.99}
+
+// writeSLOMetrics writes percentile, outcome and burn rate metrics for every
+// route with an objective
+func writeSLOMetrics(w io.Writer) {
+	table := activeRoutes.Load()
+	var routes []*Route
+	for _, rt := range append(table.routes, table.fallback) {
+		if rt.SLO != nil && rt.SLO.tracker != nil {
+			routes = append(routes, rt)
+		}
+	}
+	if len(routes) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_slo_latency_seconds Upstream latency percentiles over recent requests.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_slo_latency_seconds gauge\n")
+	for _, rt := range routes {
+		t := rt.SLO.tracker
+		t.mu.Lock()
+		latencies := append([]time.Duration(nil), t.latencies...)
+		t.mu.Unlock()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		for _, q := range sloQuantiles {
+			if len(latencies) > 0 {
+				fmt.Fprintf(w, "argon_proxy_slo_latency_seconds{route=%s,quantile=\"%g\"} %g\n",
+					quoteLabel(rt.Name), q, latencies[quantileIndex(len(latencies), q)].Seconds())
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_slo_response_bytes Response size percentiles over recent requests.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_slo_response_bytes gauge\n")
+	for _, rt := range routes {
+		t := rt.SLO.tracker
+		t.mu.Lock()
+		sizes := append([]int64(nil), t.sizes...)
+		t.mu.Unlock()
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		for _, q := range sloQuantiles {
+			if len(sizes) > 0 {
+				fmt.Fprintf(w, "argon_proxy_slo_response_bytes{route=%s,quantile=\"%g\"} %d\n",
+					quoteLabel(rt.Name), q, sizes[quantileIndex(len(sizes), q)])
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_slo_requests_total Requests counted against the route objective.\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_slo_requests_total counter\n")
+	for _, rt := range routes {
+		t := rt.SLO.tracker
+		t.mu.Lock()
+		fmt.Fprintf(w, "argon_proxy_slo_requests_total{route=%s,result=\"good\"} %d\n", quoteLabel(rt.Name), t.good)
+		fmt.Fprintf(w, "argon_proxy_slo_requests_total{route=%s,result=\"bad\"} %d\n", quoteLabel(rt.Name), t.bad)
+		t.mu.Unlock()
+	}
+
+	fmt.Fprintf(w, "# HELP argon_proxy_slo_burn_rate Error budget burn rate (1 = on budget).\n")
+	fmt.Fprintf(w, "# TYPE argon_proxy_slo_burn_rate gauge\n")
+	for _, rt := range routes {
+		t := rt.SLO.tracker
+		t.mu.Lock()
+		short, _ := t.burnRate(5, rt.SLO.Objective)
+		long, _ := t.burnRate(60, rt.SLO.Objective)
+		t.mu.Unlock()
+		fmt.Fprintf(w, "argon_proxy_slo_burn_rate{route=%s,window=\"5m\"} %g\n", quoteLabel(rt.Name), short)
+		fmt.Fprintf(w, "argon_proxy_slo_burn_rate{route=%s,window=\"1h\"} %g\n", quoteLabel(rt.Name), long)
+	}
+}
+
+// quantileIndex returns the index of quantile q in a sorted slice of length n
+func quantileIndex(n int, q float64) int {
+	i := int(q*float64(n)+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
@@ -0,0 +1,444 @@
+package argonproxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// SCHEDULED FETCHES
+// -----------------------------
+
+// snapshotMaxBytes bounds a stored snapshot unless the fetch sets max_bytes
+const snapshotMaxBytes = 8 << 20
+
+// snapshotNames are the characters allowed in a fetch name, which is a path segment
+var snapshotNames = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// scheduledFetch fetches an upstream URL on a cron schedule or at a fixed
+// interval and keeps the latest response, served at /snapshot/{name}
+type scheduledFetch struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Cron     string            `json:"cron,omitempty"`     // minute hour day-of-month month day-of-week, or @hourly etc.
+	Interval string            `json:"interval,omitempty"` // instead of cron, e.g. 30s
+	Timezone string            `json:"timezone,omitempty"`
+	Method   string            `json:"method,omitempty"`  // default GET
+	Headers  map[string]string `json:"headers,omitempty"` // values may reference Vault secrets
+	MaxBytes int64             `json:"max_bytes,omitempty"`
+
+	schedule *cronSchedule
+	interval time.Duration
+	location *time.Location
+	ok       atomic.Uint64
+	failed   atomic.Uint64
+	stop     chan struct{} // closed when a reload replaces the fetch
+}
+
+// snapshot is the stored result of a scheduled fetch
+type snapshot struct {
+	Fetched     time.Time `json:"fetched"`
+	Changed     time.Time `json:"changed"` // when the body last differed from the previous fetch
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	Body        []byte    `json:"body"`
+}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		table := activeRoutes.Load()
+		if table == nil || len(table.scheduledFetches) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "# HELP argon_proxy_scheduled_fetches_total Scheduled upstream fetches by result.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_scheduled_fetches_total counter\n")
+		for _, f := range table.scheduledFetches {
+			fmt.Fprintf(w, "argon_proxy_scheduled_fetches_total{fetch=%s,result=\"ok\"} %d\n", quoteLabel(f.Name), f.ok.Load())
+			fmt.Fprintf(w, "argon_proxy_scheduled_fetches_total{fetch=%s,result=\"failed\"} %d\n", quoteLabel(f.Name), f.failed.Load())
+		}
+	})
+}
+
+// prepareScheduledFetches checks the scheduled fetches of the config file
+func prepareScheduledFetches(fetches []*scheduledFetch) error {
+	names := make(map[string]bool)
+	for _, f := range fetches {
+		if !snapshotNames.MatchString(f.Name) || names[f.Name] {
+			return fmt.Errorf("scheduled fetch %q: name must be unique and use only letters, digits, '.', '_' and '-'", f.Name)
+		}
+		names[f.Name] = true
+		u, err := url.Parse(f.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("scheduled fetch %q: url must be an http(s) URL", f.Name)
+		}
+		switch {
+		case (f.Cron == "") == (f.Interval == ""):
+			return fmt.Errorf("scheduled fetch %q: set either cron or interval", f.Name)
+		case f.Interval != "":
+			if f.interval, err = time.ParseDuration(f.Interval); err != nil || f.interval < time.Second {
+				return fmt.Errorf("scheduled fetch %q: interval must be a duration of at least 1s", f.Name)
+			}
+		default:
+			if f.schedule, err = parseCron(f.Cron); err != nil {
+				return fmt.Errorf("scheduled fetch %q: %v", f.Name, err)
+			}
+		}
+		f.location = time.UTC
+		if f.Timezone != "" {
+			if f.location, err = time.LoadLocation(f.Timezone); err != nil {
+				return fmt.Errorf("scheduled fetch %q: timezone: %v", f.Name, err)
+			}
+		}
+		if f.Method == "" {
+			f.Method = "GET"
+		}
+		if f.MaxBytes == 0 {
+			f.MaxBytes = snapshotMaxBytes
+		}
+		f.stop = make(chan struct{})
+	}
+	return nil
+}
+
+// startScheduledFetches runs every scheduled fetch in the background. A fetch
+// without a stored snapshot runs once right away.
+func startScheduledFetches() {
+	for _, f := range activeRoutes.Load().scheduledFetches {
+		go f.run()
+	}
+}
+
+// stopScheduledFetches ends the fetches of a route table a reload replaced
+func stopScheduledFetches(table *routeTable) {
+	for _, f := range table.scheduledFetches {
+		close(f.stop)
+	}
+}
+
+// run fetches at each time the schedule names. Intervals are aligned to the
+// clock so instances sharing a store agree on the times.
+func (f *scheduledFetch) run() {
+	if _, ok, err := store.Get("snapshot:" + f.Name); err == nil && !ok {
+		f.fetch(time.Now().Truncate(time.Second))
+	}
+	for {
+		if f.interval > 0 {
+			next := time.Now().Truncate(f.interval).Add(f.interval)
+			if !f.wait(next) {
+				return
+			}
+			f.fetch(next)
+			continue
+		}
+		next := f.schedule.next(time.Now().In(f.location))
+		if next.IsZero() {
+			log.Printf("Scheduled fetch %s: schedule %q never runs again", f.Name, f.Cron)
+			return
+		}
+		if !f.wait(next) {
+			return
+		}
+		f.fetch(next)
+	}
+}
+
+// wait sleeps until t and reports whether the fetch is still configured then
+func (f *scheduledFetch) wait(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
+
+// fetch requests the URL and stores the response as the new snapshot. With a
+// shared store only one instance fetches for each scheduled time; a failed
+// fetch keeps the previous snapshot.
+func (f *scheduledFetch) fetch(slot time.Time) {
+	claimed, err := store.Add("snapshot-lock:"+f.Name+":"+strconv.FormatInt(slot.Unix(), 10), []byte(instanceName), time.Hour)
+	if err == nil && !claimed {
+		return
+	}
+
+	snap, err := f.request()
+	if err == nil {
+		// An unchanged body keeps its Last-Modified time, so conditional
+		// requests still get 304 after the fetch
+		snap.Changed = snap.Fetched
+		var previous snapshot
+		if data, ok, _ := store.Get("snapshot:" + f.Name); ok && json.Unmarshal(data, &previous) == nil &&
+			bytes.Equal(previous.Body, snap.Body) && !previous.Changed.IsZero() {
+			snap.Changed = previous.Changed
+		}
+		var data []byte
+		data, err = json.Marshal(snap)
+		if err == nil {
+			err = store.Set("snapshot:"+f.Name, data, 0)
+		}
+	}
+	if err != nil {
+		f.failed.Add(1)
+		log.Printf("Scheduled fetch %s failed: %v", f.Name, err)
+		return
+	}
+	f.ok.Add(1)
+	if *verbose {
+		log.Printf("Scheduled fetch %s stored %d bytes", f.Name, len(snap.Body))
+	}
+}
+
+// request sends the fetch's request and reads a successful response
+func (f *scheduledFetch) request() (*snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, f.Method, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range f.Headers {
+		expanded, err := expandSecrets(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", name, err)
+		}
+		req.Header.Set(name, expanded)
+	}
+	resp, err := (&http.Client{Transport: upstream}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > f.MaxBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", f.MaxBytes)
+	}
+	// Upstreams without validators get one derived from the body
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	return &snapshot{
+		Fetched:     time.Now().UTC(),
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        etag,
+		Body:        body,
+	}, nil
+}
+
+// registerSnapshotHandlers adds /snapshot/ when the config schedules fetches
+func registerSnapshotHandlers(mux *http.ServeMux) {
+	if len(activeRoutes.Load().scheduledFetches) == 0 {
+		return
+	}
+	mux.HandleFunc("/snapshot/", handleSnapshot)
+}
+
+// handleSnapshot serves the latest snapshot of a scheduled fetch, honoring
+// conditional and range requests
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !checkCORSOrigin(w, r) {
+		return
+	}
+	if r.Method == "OPTIONS" {
+		handlePreflight(w, r)
+		return
+	}
+	addCORSHeaders(w, r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+	if !slices.ContainsFunc(activeRoutes.Load().scheduledFetches, func(f *scheduledFetch) bool { return f.Name == name }) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	data, ok, err := store.Get("snapshot:" + name)
+	if err != nil {
+		http.Error(w, "Store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var snap snapshot
+	if !ok || json.Unmarshal(data, &snap) != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	if snap.ContentType != "" {
+		w.Header().Set("Content-Type", snap.ContentType)
+	}
+	if snap.ETag != "" {
+		w.Header().Set("ETag", snap.ETag)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Argon-Snapshot-Age", strconv.Itoa(int(time.Since(snap.Fetched).Seconds())))
+	w.Header().Add("Access-Control-Expose-Headers", "X-Argon-Snapshot-Age, Last-Modified")
+	addProxiedBy(w)
+	http.ServeContent(w, r, "", cmp.Or(snap.Changed, snap.Fetched), bytes.NewReader(snap.Body))
+}
+
+// -----------------------------
+// CRON SCHEDULES
+// -----------------------------
+
+// cronSchedule is a parsed five-field cron expression; each field is a set
+// of allowed values as bits
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// cronMacros are the shorthand schedules
+var cronMacros = map[string]string{
+	"@yearly": "0 0 1 1 *", "@annually": "0 0 1 1 *", "@monthly": "0 0 1 * *",
+	"@weekly": "0 0 * * 0", "@daily": "0 0 * * *", "@midnight": "0 0 * * *", "@hourly": "0 * * * *",
+}
+
+// cronNames replace month and weekday names (jan, mon) with their numbers
+var cronNames = struct{ month, weekday *strings.Replacer }{
+	month: strings.NewReplacer("jan", "1", "feb", "2", "mar", "3", "apr", "4", "may", "5", "jun", "6",
+		"jul", "7", "aug", "8", "sep", "9", "oct", "10", "nov", "11", "dec", "12"),
+	weekday: strings.NewReplacer("sun", "0", "mon", "1", "tue", "2", "wed", "3", "thu", "4", "fri", "5", "sat", "6"),
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week", where each
+// field is *, a number, a range a-b, a list, and optionally /step. Months and
+// weekdays may be given by name.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q must have five fields", expr)
+	}
+	var c cronSchedule
+	var err error
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		switch i {
+		case 3:
+			field = cronNames.month.Replace(strings.ToLower(field))
+		case 4:
+			field = cronNames.weekday.Replace(strings.ToLower(field))
+		}
+		if *sets[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domStar, c.dowStar = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the values a cron field allows
+func parseCronField(field string, low, high int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = r, n
+		}
+		from, to := low, high
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				to = high // "5/15" runs from 5 on
+			}
+		}
+		if from < low || to > high || from > to {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, low, high)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after t that the schedule names, in t's
+// location, or the zero time if there is none within five years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			// Jump to the next allowed minute of this hour, or the next hour
+			rest := c.minute >> uint(t.Minute())
+			if rest == 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			} else {
+				t = t.Add(time.Duration(bits.TrailingZeros64(rest)) * time.Minute)
+			}
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches applies cron's rule that when both day fields are restricted,
+// either may match
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
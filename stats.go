@@ -0,0 +1,279 @@
+package argonproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// USAGE ANALYTICS
+// -----------------------------
+
+// statsHourFormat names the hourly buckets kept in the store as "stats:<hour>"
+const statsHourFormat = "2006010215"
+
+// statsFlushInterval is how often pending counts are merged into the store
+const statsFlushInterval = time.Minute
+
+// Distinct targets or clients kept per stored hour and per flush interval;
+// the rest are counted as "other"
+const (
+	statsStoredKeys  = 1000
+	statsPendingKeys = 10000
+)
+
+// statsCount is a number of requests and the response bytes they returned
+type statsCount struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// statsBucket aggregates the requests of one hour
+type statsBucket struct {
+	statsCount
+	Status  map[string]int64       `json:"status"`
+	Targets map[string]*statsCount `json:"targets"`
+	Clients map[string]*statsCount `json:"clients"`
+}
+
+// stats holds counts not yet merged into the store, by hour
+var stats struct {
+	sync.Mutex
+	pending map[string]*statsBucket
+}
+
+func newStatsBucket() *statsBucket {
+	return &statsBucket{
+		Status:  make(map[string]int64),
+		Targets: make(map[string]*statsCount),
+		Clients: make(map[string]*statsCount),
+	}
+}
+
+// countIn adds to a key's count, folding new keys into "other" once max is reached
+func countIn(counts map[string]*statsCount, key string, max int, c statsCount) {
+	entry := counts[key]
+	if entry == nil {
+		if len(counts) >= max {
+			key = otherHostLabel
+			entry = counts[key]
+		}
+		if entry == nil {
+			entry = &statsCount{}
+			counts[key] = entry
+		}
+	}
+	entry.Requests += c.Requests
+	entry.Bytes += c.Bytes
+}
+
+// merge adds another bucket's counts to this one
+func (b *statsBucket) merge(other *statsBucket, max int) {
+	b.Requests += other.Requests
+	b.Bytes += other.Bytes
+	for class, n := range other.Status {
+		b.Status[class] += n
+	}
+	for target, c := range other.Targets {
+		countIn(b.Targets, target, max, *c)
+	}
+	for client, c := range other.Clients {
+		countIn(b.Clients, client, max, *c)
+	}
+}
+
+// trim keeps the max busiest keys and folds the others into "other"
+func trimCounts(counts map[string]*statsCount, max int) {
+	if len(counts) <= max {
+		return
+	}
+	for _, key := range rankCounts(counts)[max-1:] {
+		if key.name == otherHostLabel {
+			continue
+		}
+		countIn(counts, otherHostLabel, len(counts)+1, *counts[key.name])
+		delete(counts, key.name)
+	}
+}
+
+// rankedCount is one entry of a top list
+type rankedCount struct {
+	name string
+	statsCount
+}
+
+// rankCounts sorts the entries by requests, then bytes
+func rankCounts(counts map[string]*statsCount) []rankedCount {
+	ranked := make([]rankedCount, 0, len(counts))
+	for name, c := range counts {
+		ranked = append(ranked, rankedCount{name, *c})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Requests != ranked[j].Requests {
+			return ranked[i].Requests > ranked[j].Requests
+		}
+		return ranked[i].Bytes > ranked[j].Bytes
+	})
+	return ranked
+}
+
+// recordStats counts a proxied request; status 0 means the upstream failed
+func recordStats(r *http.Request, host string, status int, bytes int64) {
+	if *statsHours <= 0 {
+		return
+	}
+	class := "error"
+	if status > 0 {
+		class = strconv.Itoa(status/100) + "xx"
+	}
+	count := statsCount{Requests: 1, Bytes: bytes}
+	hour := time.Now().UTC().Format(statsHourFormat)
+
+	stats.Lock()
+	defer stats.Unlock()
+	if stats.pending == nil {
+		stats.pending = make(map[string]*statsBucket)
+	}
+	b := stats.pending[hour]
+	if b == nil {
+		b = newStatsBucket()
+		stats.pending[hour] = b
+	}
+	b.Requests++
+	b.Bytes += bytes
+	b.Status[class]++
+	countIn(b.Targets, host, statsPendingKeys, count)
+	countIn(b.Clients, getClientIP(r), statsPendingKeys, count)
+}
+
+// startStats merges pending counts into the store every minute
+func startStats() {
+	if *statsHours <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(statsFlushInterval) {
+			flushStats()
+		}
+	}()
+}
+
+// flushStats merges the pending counts into the stored hourly buckets. With
+// a shared store, instances flushing the same hour at the same moment can
+// lose each other's update, so cluster-wide numbers are approximate.
+func flushStats() {
+	stats.Lock()
+	pending := stats.pending
+	stats.pending = nil
+	stats.Unlock()
+
+	for hour, delta := range pending {
+		b, err := loadStatsBucket(hour)
+		if err != nil {
+			log.Printf("Error loading stats for %s: %v", hour, err)
+			continue
+		}
+		b.merge(delta, statsStoredKeys+statsPendingKeys)
+		trimCounts(b.Targets, statsStoredKeys)
+		trimCounts(b.Clients, statsStoredKeys)
+
+		data, _ := json.Marshal(b)
+		ttl := time.Duration(*statsHours+1) * time.Hour
+		if err := store.Set("stats:"+hour, data, ttl); err != nil {
+			log.Printf("Error saving stats for %s: %v", hour, err)
+		}
+	}
+}
+
+// loadStatsBucket reads an hour's stored counts, or an empty bucket
+func loadStatsBucket(hour string) (*statsBucket, error) {
+	b := newStatsBucket()
+	data, ok, err := store.Get("stats:" + hour)
+	if err != nil || !ok {
+		return b, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// handleAdminStats returns the aggregates of the last ?hours= hours (default
+// --stats-hours) with the ?top= busiest targets and clients
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *statsHours <= 0 {
+		http.Error(w, "Stats are disabled (--stats-hours=0)", http.StatusNotFound)
+		return
+	}
+	hours, top := *statsHours, 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && v > 0 && v < hours {
+		hours = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && v > 0 {
+		top = v
+	}
+
+	stats.Lock()
+	pending := make(map[string]*statsBucket, len(stats.pending))
+	for hour, b := range stats.pending {
+		copied := newStatsBucket()
+		copied.merge(b, statsPendingKeys)
+		pending[hour] = copied
+	}
+	stats.Unlock()
+
+	type hourly struct {
+		Hour time.Time `json:"hour"`
+		statsCount
+	}
+	total := newStatsBucket()
+	var byHour []hourly
+	now := time.Now().UTC().Truncate(time.Hour)
+	for i := hours - 1; i >= 0; i-- {
+		start := now.Add(-time.Duration(i) * time.Hour)
+		hour := start.Format(statsHourFormat)
+		b, err := loadStatsBucket(hour)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if p := pending[hour]; p != nil {
+			b.merge(p, statsStoredKeys+statsPendingKeys)
+		}
+		total.merge(b, statsStoredKeys+statsPendingKeys)
+		byHour = append(byHour, hourly{start, b.statsCount})
+	}
+
+	topList := func(counts map[string]*statsCount, field string) []map[string]any {
+		ranked := rankCounts(counts)
+		if len(ranked) > top {
+			ranked = ranked[:top]
+		}
+		list := make([]map[string]any, 0, len(ranked))
+		for _, entry := range ranked {
+			list = append(list, map[string]any{field: entry.name, "requests": entry.Requests, "bytes": entry.Bytes})
+		}
+		return list
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"since":       now.Add(-time.Duration(hours-1) * time.Hour),
+		"hours":       hours,
+		"requests":    total.Requests,
+		"bytes":       total.Bytes,
+		"status":      total.Status,
+		"top_targets": topList(total.Targets, "target"),
+		"top_clients": topList(total.Clients, "client"),
+		"hourly":      byHour,
+	})
+}
@@ -0,0 +1,206 @@
+package argonproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// STORAGE
+// -----------------------------
+
+// Store is the key/value persistence used by stateful features: idempotency
+// keys, the shared cache tier and immutable objects, budgets, abuse reports,
+// delta bases, ext-authz decisions, inboxes, stats, snapshots, and rate
+// limits when the store is shared between instances. Keys are namespaced by
+// feature, e.g. "idempotency:<hash>". A ttl of 0 never expires.
+type Store interface {
+	// Get returns the value for key and whether it exists
+	Get(key string) ([]byte, bool, error)
+	// Set stores a value, replacing any existing one
+	Set(key string, value []byte, ttl time.Duration) error
+	// Add stores a value only if the key does not exist and reports whether it did
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes a key
+	Delete(key string) error
+	// Incr adds delta to an integer counter and returns the new value; the
+	// ttl is applied when the counter is created
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+	// Close releases the store's resources
+	Close() error
+}
+
+// errStoreFull is returned when the memory store has no room for a new key
+var errStoreFull = errors.New("store is full")
+
+// store is the storage shared by all features, selected with -store
+var store Store = newMemoryStore()
+
+// openStore creates the store described by a -store value:
+// "memory", "bolt:///path/to/file.db" or "redis://[:password@]host:port[/db]"
+func openStore(spec string) (Store, error) {
+	if spec == "" || spec == "memory" {
+		return newMemoryStore(), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store %q: %v", spec, err)
+	}
+	switch u.Scheme {
+	case "bolt":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		return openBoltStore(path)
+	case "redis", "rediss":
+		return openRedisStore(u)
+	}
+	return nil, fmt.Errorf("unsupported store %q (use memory, bolt:// or redis://)", spec)
+}
+
+// memoryStoreMaxKeys bounds the number of keys held by the memory store
+const memoryStoreMaxKeys = 100000
+
+// memoryEntry is a value held by the memory store
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore keeps everything in process memory; state is lost on restart
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// newMemoryStore creates an empty memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+// expiry converts a ttl into an absolute expiry time
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// expired reports whether an expiry time has passed
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+// lookup returns a live entry. Must be called with m.mu held.
+func (m *memoryStore) lookup(key string) (memoryEntry, bool) {
+	entry, ok := m.entries[key]
+	if ok && expired(entry.expires) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+// makeRoom ensures a new key fits. Must be called with m.mu held.
+func (m *memoryStore) makeRoom() error {
+	if len(m.entries) < memoryStoreMaxKeys {
+		return nil
+	}
+	for key, entry := range m.entries {
+		if expired(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+	if len(m.entries) >= memoryStoreMaxKeys {
+		return errStoreFull
+	}
+	return nil
+}
+
+// Get implements Store
+func (m *memoryStore) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.lookup(key)
+	return entry.value, ok, nil
+}
+
+// Set implements Store
+func (m *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); !ok {
+		if err := m.makeRoom(); err != nil {
+			return err
+		}
+	}
+	m.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return nil
+}
+
+// Add implements Store
+func (m *memoryStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); ok {
+		return false, nil
+	}
+	if err := m.makeRoom(); err != nil {
+		return false, err
+	}
+	m.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return true, nil
+}
+
+// Delete implements Store
+func (m *memoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// Incr implements Store
+func (m *memoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.lookup(key)
+	if !ok {
+		if err := m.makeRoom(); err != nil {
+			return 0, err
+		}
+		entry = memoryEntry{value: []byte("0"), expires: expiry(ttl)}
+	}
+	n, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %q is not a counter", key)
+	}
+	n += delta
+	entry.value = []byte(strconv.FormatInt(n, 10))
+	m.entries[key] = entry
+	return n, nil
+}
+
+// Close implements Store
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// storeName describes the configured store for logs, hiding credentials
+func storeName(spec string) string {
+	if u, err := url.Parse(spec); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	if spec == "" {
+		return "memory"
+	}
+	return strings.TrimSpace(spec)
+}
@@ -0,0 +1,168 @@
+package argonproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds every key of the bolt store
+var boltBucket = []byte("argon-proxy")
+
+// boltSweepInterval is how often expired keys are removed from the file
+const boltSweepInterval = 5 * time.Minute
+
+// boltStore persists keys in a local BoltDB file, so state survives restarts
+// of a single instance
+type boltStore struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// openBoltStore opens or creates the database file
+func openBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt store needs a file path, e.g. bolt:///var/lib/argon-proxy/state.db")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &boltStore{db: db, done: make(chan struct{})}
+	go s.sweep()
+	return s, nil
+}
+
+// encodeBoltValue prefixes a value with its expiry in Unix nanoseconds (0 never expires)
+func encodeBoltValue(value []byte, ttl time.Duration) []byte {
+	buf := make([]byte, 8+len(value))
+	if expires := expiry(ttl); !expires.IsZero() {
+		binary.BigEndian.PutUint64(buf, uint64(expires.UnixNano()))
+	}
+	copy(buf[8:], value)
+	return buf
+}
+
+// decodeBoltValue returns the value and whether it is still live
+func decodeBoltValue(raw []byte) ([]byte, bool) {
+	if len(raw) < 8 {
+		return nil, false
+	}
+	if nanos := binary.BigEndian.Uint64(raw); nanos != 0 && expired(time.Unix(0, int64(nanos))) {
+		return nil, false
+	}
+	return append([]byte(nil), raw[8:]...), true
+}
+
+// Get implements Store
+func (s *boltStore) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value, ok = decodeBoltValue(tx.Bucket(boltBucket).Get([]byte(key)))
+		return nil
+	})
+	return value, ok, err
+}
+
+// Set implements Store
+func (s *boltStore) Set(key string, value []byte, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), encodeBoltValue(value, ttl))
+	})
+}
+
+// Add implements Store
+func (s *boltStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	added := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if _, ok := decodeBoltValue(bucket.Get([]byte(key))); ok {
+			return nil
+		}
+		added = true
+		return bucket.Put([]byte(key), encodeBoltValue(value, ttl))
+	})
+	return added, err
+}
+
+// Delete implements Store
+func (s *boltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// Incr implements Store
+func (s *boltStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	var n int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		raw := bucket.Get([]byte(key))
+		current, ok := decodeBoltValue(raw)
+		if !ok {
+			current = []byte("0")
+			raw = encodeBoltValue(nil, ttl)
+		}
+		var err error
+		if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+			return fmt.Errorf("value of %q is not a counter", key)
+		}
+		n += delta
+		// Keep the original expiry
+		updated := append(append([]byte(nil), raw[:8]...), strconv.FormatInt(n, 10)...)
+		return bucket.Put([]byte(key), updated)
+	})
+	return n, err
+}
+
+// Close implements Store
+func (s *boltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+// sweep periodically deletes expired keys so the file does not grow forever
+func (s *boltStore) sweep() {
+	ticker := time.NewTicker(boltSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltBucket)
+			var stale [][]byte
+			bucket.ForEach(func(key, raw []byte) error {
+				if _, ok := decodeBoltValue(raw); !ok {
+					stale = append(stale, append([]byte(nil), key...))
+				}
+				return nil
+			})
+			for _, key := range stale {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error removing expired keys from store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package argonproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisPoolSize is the number of idle connections kept to Redis
+const redisPoolSize = 16
+
+// redisTimeout bounds dialing and each command round trip
+const redisTimeout = 5 * time.Second
+
+// redisStore keeps keys in Redis so several proxy instances share state
+type redisStore struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+	pool     chan *redisConn
+
+	mu         sync.Mutex
+	closed     bool
+	subscriber net.Conn // held by Subscribe, closed with the store
+}
+
+// redisConn is one connection speaking the RESP protocol
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is the RESP null reply
+var errRedisNil = errors.New("redis: nil")
+
+// openRedisStore connects to the server described by a redis:// or rediss:// URL
+func openRedisStore(u *url.URL) (*redisStore, error) {
+	s := &redisStore{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		pool:   make(chan *redisConn, redisPoolSize),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		s.db = n
+	}
+
+	// Check the connection and credentials up front
+	if _, err := s.do("PING"); err != nil {
+		return nil, fmt.Errorf("connecting to redis at %s: %v", s.addr, err)
+	}
+	return s, nil
+}
+
+// dial opens and authenticates a new connection
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: strings.Split(s.addr, ":")[0]})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do runs one command on a pooled connection
+func (s *redisStore) do(args ...string) (any, error) {
+	var c *redisConn
+	select {
+	case c = <-s.pool:
+	default:
+		var err error
+		if c, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	var redisErr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state after a network error
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do writes a command and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply parses one RESP reply
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// ttlArgs returns the PX arguments for a ttl
+func ttlArgs(ttl time.Duration) []string {
+	if ttl <= 0 {
+		return nil
+	}
+	return []string{"PX", strconv.FormatInt(ttl.Milliseconds(), 10)}
+}
+
+// Get implements Store
+func (s *redisStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", key)
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value, _ := reply.([]byte)
+	return value, true, nil
+}
+
+// Set implements Store
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(append([]string{"SET", key, string(value)}, ttlArgs(ttl)...)...)
+	return err
+}
+
+// Add implements Store
+func (s *redisStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	_, err := s.do(append([]string{"SET", key, string(value), "NX"}, ttlArgs(ttl)...)...)
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete implements Store
+func (s *redisStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+// Incr implements Store
+func (s *redisStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := s.do("INCRBY", key, strconv.FormatInt(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	// A counter equal to delta was just created and needs its expiry
+	if n == delta && ttl > 0 {
+		if _, err := s.do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Publish implements broadcaster
+func (s *redisStore) Publish(channel string, message []byte) error {
+	_, err := s.do("PUBLISH", channel, string(message))
+	return err
+}
+
+// Subscribe implements broadcaster
+func (s *redisStore) Subscribe(channel string, handle func(message []byte)) {
+	for {
+		err := s.subscribe(channel, handle)
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		log.Printf("Redis subscription to %s lost, reconnecting: %v", channel, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// subscribe holds a dedicated connection subscribed to channel until it fails
+func (s *redisStore) subscribe(channel string, handle func(message []byte)) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.subscriber = c.conn
+	s.mu.Unlock()
+
+	if _, err := c.do("SUBSCRIBE", channel); err != nil {
+		return err
+	}
+	// Messages arrive whenever they are published
+	c.conn.SetDeadline(time.Time{})
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		items, _ := reply.([]any)
+		if len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) == "message" {
+			message, _ := items[2].([]byte)
+			handle(message)
+		}
+	}
+}
+
+// Close implements Store
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.subscriber != nil {
+		s.subscriber.Close()
+	}
+	s.mu.Unlock()
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package argonproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// LONG-LIVED STREAM LIMITS
+// -----------------------------
+
+// activeStream is a long-lived stream held open for a client
+type activeStream struct {
+	started time.Time
+	stop    func()
+}
+
+// streamTracker counts long-lived streams per client IP
+type streamTracker struct {
+	mu       sync.Mutex
+	clients  map[string][]*activeStream
+	active   int
+	evicted  uint64
+	rejected uint64
+}
+
+var streams = &streamTracker{clients: make(map[string][]*activeStream)}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		streams.mu.Lock()
+		defer streams.mu.Unlock()
+		fmt.Fprintf(w, "# HELP argon_proxy_active_streams Long-lived streams currently held open.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_active_streams gauge\n")
+		fmt.Fprintf(w, "argon_proxy_active_streams %d\n", streams.active)
+		fmt.Fprintf(w, "# HELP argon_proxy_stream_limit_total Streams evicted or rejected by --max-streams-per-client.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_stream_limit_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_stream_limit_total{action=\"evicted\"} %d\n", streams.evicted)
+		fmt.Fprintf(w, "argon_proxy_stream_limit_total{action=\"rejected\"} %d\n", streams.rejected)
+	})
+}
+
+// isLongLivedStream reports whether a response stays open indefinitely
+func isLongLivedStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.StatusCode == http.StatusSwitchingProtocols
+}
+
+// trackStream registers a long-lived stream for the requesting client. When
+// the client is at --max-streams-per-client, either its oldest stream is
+// stopped or, with the reject policy, ok is false. release must be called
+// when the stream ends.
+func trackStream(r *http.Request, stop func()) (release func(), ok bool) {
+	client := getClientIP(r)
+	stream := &activeStream{started: time.Now(), stop: stop}
+
+	streams.mu.Lock()
+	list := streams.clients[client]
+	var evict []*activeStream
+	if limit := *maxStreamsPerClient; limit > 0 && len(list) >= limit &&
+		!reportOnly(r, "streams", fmt.Sprintf("%d streams already open", len(list))) {
+		if *streamLimitPolicy != "evict-oldest" {
+			streams.rejected++
+			streams.mu.Unlock()
+			log.Printf("Rejecting stream for %s: %d streams already open", client, len(list))
+			return nil, false
+		}
+		evict = list[:len(list)-limit+1]
+		list = append([]*activeStream(nil), list[len(evict):]...)
+		streams.evicted += uint64(len(evict))
+		streams.active -= len(evict)
+	}
+	streams.clients[client] = append(list, stream)
+	streams.active++
+	streams.mu.Unlock()
+
+	for _, old := range evict {
+		log.Printf("Evicting stream for %s opened %s ago", client, time.Since(old.started).Round(time.Second))
+		old.stop()
+	}
+
+	return func() { streams.remove(client, stream) }, true
+}
+
+// remove forgets a stream once it has ended
+func (t *streamTracker) remove(client string, stream *activeStream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.clients[client]
+	for i, s := range list {
+		if s == stream {
+			t.clients[client] = append(list[:i:i], list[i+1:]...)
+			t.active--
+			break
+		}
+	}
+	if len(t.clients[client]) == 0 {
+		delete(t.clients, client)
+	}
+}
+
+// -----------------------------
+// STREAMED RESPONSE FLUSHING
+// -----------------------------
+
+// flushWriter flushes what is written to the client, right away or at most
+// once per interval, so streamed responses are not held in the server's buffer
+type flushWriter struct {
+	w        http.ResponseWriter
+	interval time.Duration
+
+	mu        sync.Mutex
+	scheduled bool
+	stopped   bool
+}
+
+// streamWriter returns the writer a response body is copied to: event streams
+// and responses of unknown length are flushed per --flush-interval, others
+// are left to the server's buffering. stop must be called once the copy is done.
+func streamWriter(w http.ResponseWriter, resp *http.Response) (io.Writer, func()) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	interval := *flushInterval
+	switch {
+	case mediaType == "text/event-stream":
+		interval = 0 // events are always delivered as they arrive
+	case resp.ContentLength != -1 || interval < 0:
+		return w, func() {}
+	}
+	fw := &flushWriter{w: w, interval: interval}
+	return fw, fw.stop
+}
+
+// Write implements io.Writer
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval == 0 {
+		http.NewResponseController(fw.w).Flush()
+	} else if !fw.scheduled {
+		fw.scheduled = true
+		time.AfterFunc(fw.interval, fw.delayedFlush)
+	}
+	return n, nil
+}
+
+// delayedFlush flushes the writes made since the last flush
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.scheduled = false
+	if !fw.stopped {
+		http.NewResponseController(fw.w).Flush()
+	}
+}
+
+// stop keeps a pending flush from touching the writer after the handler returns
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	fw.stopped = true
+	fw.mu.Unlock()
+}
@@ -0,0 +1,113 @@
+package argonproxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// -----------------------------
+// SUBDOMAIN TARGET ENCODING
+// -----------------------------
+
+// withSubdomainTarget proxies requests whose Host encodes the target host,
+// e.g. api-example-com.proxy.mydomain.dev/path -> https://api.example.com/path
+func withSubdomainTarget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetHost, ok := subdomainTarget(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if *verbose {
+			log.Printf("Subdomain %s targets host %s", r.Host, targetHost)
+		}
+
+		// The same checks as /proxy/ requests, authentication included
+		r, ok = admitProxyRequest(w, r, targetHost)
+		if !ok {
+			return
+		}
+		processProxyRequest(w, r, "https://"+targetHost+r.URL.EscapedPath())
+	})
+}
+
+// subdomainTarget returns the target host encoded in the request's subdomain
+func subdomainTarget(r *http.Request) (string, bool) {
+	if *subdomainSuffix == "" {
+		return "", false
+	}
+
+	host := requestHost(r)
+	suffix := "." + strings.ToLower(strings.Trim(*subdomainSuffix, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return "", false
+	}
+
+	label := strings.TrimSuffix(host, suffix)
+	if label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+
+	return decodeSubdomainHost(label), true
+}
+
+// decodeSubdomainHost turns "api-example-com" into "api.example.com";
+// a doubled dash stands for a literal dash
+func decodeSubdomainHost(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '-' {
+			b.WriteByte(label[i])
+			continue
+		}
+		if i+1 < len(label) && label[i+1] == '-' {
+			b.WriteByte('-')
+			i++
+		} else {
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+// encodeSubdomainHost is the inverse of decodeSubdomainHost
+func encodeSubdomainHost(host string) string {
+	host = strings.ReplaceAll(host, "-", "--")
+	return strings.ReplaceAll(host, ".", "-")
+}
+
+// rewriteSubdomainResponse keeps cookies and redirects on the proxy's subdomain
+func rewriteSubdomainResponse(r *http.Request, header http.Header) {
+	// Drop the Domain attribute so cookies stay scoped to the encoded subdomain
+	for i, cookie := range header.Values("Set-Cookie") {
+		parts := strings.Split(cookie, ";")
+		kept := parts[:1]
+		for _, attr := range parts[1:] {
+			name := strings.ToLower(strings.TrimSpace(strings.SplitN(attr, "=", 2)[0]))
+			if name != "domain" {
+				kept = append(kept, attr)
+			}
+		}
+		header["Set-Cookie"][i] = strings.Join(kept, ";")
+	}
+
+	// Point absolute redirects back through the proxy
+	if location := header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && u.IsAbs() && u.Hostname() != "" {
+			scheme := "http"
+			if r.TLS != nil || (*trustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+				scheme = "https"
+			}
+			u.Host = encodeSubdomainHost(u.Hostname()) + "." + strings.Trim(*subdomainSuffix, ".")
+			if _, port, err := net.SplitHostPort(r.Host); err == nil {
+				u.Host = net.JoinHostPort(u.Host, port)
+			}
+			u.Scheme = scheme
+			header.Set("Location", u.String())
+		}
+	}
+}
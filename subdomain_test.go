@@ -0,0 +1,104 @@
+package argonproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveSubdomain sends a request for /path on the subdomain encoding 127.0.0.1
+func serveSubdomain(t *testing.T, handler http.Handler, remoteAddr string, header http.Header) int {
+	t.Helper()
+	return serveSubdomainMethod(t, handler, "GET", nil, remoteAddr, header)
+}
+
+// serveSubdomainMethod is serveSubdomain with a method and body
+func serveSubdomainMethod(t *testing.T, handler http.Handler, method string, body io.Reader, remoteAddr string, header http.Header) int {
+	t.Helper()
+	req := httptest.NewRequest(method, "http://127-0-0-1.proxy.test/path", body)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestSubdomainRequiresAuth(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keys, []byte("alice:s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewTestHandler("--subdomain-suffix=proxy.test", "--auth=apikey", "--auth-file="+keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"no key", nil, http.StatusUnauthorized},
+		{"wrong key", http.Header{"X-Argon-Key": {"wrong"}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveSubdomain(t, handler, "192.0.2.10:1234", tt.header); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// A valid key gets past authentication to the (unreachable) upstream
+	if got := serveSubdomain(t, handler, "192.0.2.10:1234", http.Header{"X-Argon-Key": {"s3cret"}}); got == http.StatusUnauthorized {
+		t.Errorf("status with a valid key = %d", got)
+	}
+}
+
+func TestSubdomainRateLimit(t *testing.T) {
+	handler, err := NewTestHandler("--subdomain-suffix=proxy.test", "--rate-limit=1", "--rate-burst=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, limited := range []bool{false, true, true} {
+		if got := serveSubdomain(t, handler, "192.0.2.11:1234", nil); (got == http.StatusTooManyRequests) != limited {
+			t.Errorf("request %d: status = %d, rate limited should be %v", i+1, got, limited)
+		}
+	}
+}
+
+func TestSubdomainRequestChecks(t *testing.T) {
+	handler, err := NewTestHandler("--subdomain-suffix=proxy.test", "--allow-origin=https://app.example", "--max-body-size=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header http.Header
+		want   int
+	}{
+		{"origin not allowed", "GET", "", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"preflight", "OPTIONS", "", http.Header{"Origin": {"https://app.example"}, "Access-Control-Request-Method": {"GET"}}, http.StatusNoContent},
+		{"body too large", "POST", "a body of more than ten bytes", nil, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			if got := serveSubdomainMethod(t, handler, tt.method, body, "192.0.2.12:1234", tt.header); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
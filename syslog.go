@@ -0,0 +1,140 @@
+package argonproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// SYSLOG OUTPUT
+// -----------------------------
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severities used for log lines
+const (
+	syslogError   = 3
+	syslogWarning = 4
+	syslogInfo    = 6
+)
+
+// syslogWriter sends each log line as an RFC 5424 message, redialling
+// when the connection breaks
+type syslogWriter struct {
+	network, addr string
+	facility      int
+	hostname      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// startSyslog sends the log to syslog when --syslog is set
+func startSyslog() error {
+	if *syslogAddr == "" {
+		return nil
+	}
+	facility, ok := syslogFacilities[strings.ToLower(*syslogFacility)]
+	if !ok {
+		return fmt.Errorf("--syslog-facility: unknown facility %q", *syslogFacility)
+	}
+	w := &syslogWriter{facility: facility, hostname: "-"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		w.hostname = hostname
+	}
+
+	if *syslogAddr == "local" {
+		w.network, w.addr = "unixgram", "/dev/log"
+		if _, err := os.Stat(w.addr); err != nil {
+			w.addr = "/var/run/syslog" // macOS
+		}
+	} else {
+		u, err := url.Parse(*syslogAddr)
+		if err != nil || u.Host == "" && u.Path == "" {
+			return fmt.Errorf("--syslog must be local, udp://host:port, tcp://host:port or unix:///path")
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			w.network, w.addr = u.Scheme, u.Host
+			if u.Port() == "" {
+				w.addr = net.JoinHostPort(u.Host, "514")
+			}
+		case "unix":
+			w.network, w.addr = "unixgram", u.Path
+		default:
+			return fmt.Errorf("--syslog must be local, udp://host:port, tcp://host:port or unix:///path")
+		}
+	}
+
+	w.mu.Lock()
+	err := w.dial()
+	w.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	log.SetFlags(0) // syslog messages carry their own timestamp
+	log.SetOutput(w)
+	return nil
+}
+
+// dial (re)connects to the syslog server; the caller holds mu
+func (w *syslogWriter) dial() error {
+	conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write implements io.Writer for the log package, which writes one line per call
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	line := fmt.Sprintf("<%d>1 %s %s argon-proxy %d - - %s",
+		w.facility*8+syslogSeverity(msg), time.Now().Format(time.RFC3339Nano), w.hostname, os.Getpid(), msg)
+	if w.network == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line // octet counting, RFC 6587
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err := w.dial(); err != nil {
+				break
+			}
+		}
+		if _, err := w.conn.Write([]byte(line)); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	// Don't lose the line when syslog is unreachable
+	os.Stderr.Write(p)
+	return len(p), nil
+}
+
+// syslogSeverity derives a severity from how log lines are worded
+func syslogSeverity(msg string) int {
+	switch {
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Failed"):
+		return syslogError
+	case strings.HasPrefix(msg, "Warning"):
+		return syslogWarning
+	}
+	return syslogInfo
+}
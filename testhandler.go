@@ -0,0 +1,106 @@
+package argonproxy
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// -----------------------------
+// TEST HELPERS
+// -----------------------------
+
+// NewTestHandler returns the proxy's HTTP handler, configured like the
+// command with flags such as "--allow-origin=https://app.example.com", for
+// use with httptest.NewServer. Flags not given keep their defaults.
+//
+// The proxy's configuration is process-wide: each call replaces the one
+// before, so tests using different flags must not run in parallel. Each call
+// also starts from a new memory store and empty caches and rate limits.
+//
+// argonproxytest starts the proxy and the echo upstream on test servers.
+func NewTestHandler(args ...string) (http.Handler, error) {
+	resetState()
+	fs := flag.NewFlagSet("argon-proxy", flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			return // the testing package's own flags
+		}
+		f.Value.Set(f.DefValue)
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if err := applyConfigFile(fs); err != nil {
+		return nil, err
+	}
+	if err := decryptFlags(); err != nil {
+		return nil, err
+	}
+	setInstanceID()
+	setControlParams(*stripParams)
+	if err := configureUpstreamTLS(); err != nil {
+		return nil, err
+	}
+	table, err := loadRouteTable(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	activeRoutes.Store(table)
+	newStore, err := openStore(*storeURL)
+	if err != nil {
+		return nil, err
+	}
+	store.Close()
+	store = newStore
+
+	if err := validateCaptcha(); err != nil {
+		return nil, err
+	}
+	if err := validateTLSWatch(); err != nil {
+		return nil, err
+	}
+	if err := validateUpstreamEncodings(); err != nil {
+		return nil, err
+	}
+	if err := validateHostPolicy(); err != nil {
+		return nil, err
+	}
+	if authenticator, err = openAuthenticator(*authMode); err != nil {
+		return nil, err
+	}
+	return newHandler(), nil
+}
+
+// TestUpstreamHandler returns the echo server the selftest command uses.
+// /echo answers with the request body, reporting the method and query in
+// X-Echo-Method and X-Echo-Query along with a CORS header the proxy must
+// replace; /stream sends a flushed 64 KB response and /redirect redirects
+// to /echo.
+func TestUpstreamHandler() http.Handler {
+	return selfTestUpstream()
+}
+
+// resetState clears what requests to the previous handler left behind:
+// rate-limit buckets, cached responses and the other caches /admin/purge
+// clears, the immutable object index and coalesced requests. Requests still
+// in flight finish on their own, and the counters behind /metrics keep
+// counting.
+func resetState() {
+	rateLimits.mu.Lock()
+	clear(rateLimits.buckets)
+	rateLimits.mu.Unlock()
+	purgeLocal(nil)
+	immutableObjects.mu.Lock()
+	immutableObjects.order, immutableObjects.items, immutableObjects.total = nil, nil, 0
+	immutableObjects.mu.Unlock()
+	flights.mu.Lock()
+	clear(flights.inFlight)
+	flights.mu.Unlock()
+}
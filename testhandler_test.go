@@ -0,0 +1,23 @@
+package argonproxy
+
+import "testing"
+
+func TestNewTestHandlerResetsStripParams(t *testing.T) {
+	defer NewTestHandler()
+	if _, err := NewTestHandler("--strip-params=foo"); err != nil {
+		t.Fatal(err)
+	}
+	if !isControlParam("foo=1") {
+		t.Fatal("foo not stripped with --strip-params=foo")
+	}
+
+	// A later handler strips only its own parameters
+	if _, err := NewTestHandler("--strip-params=bar"); err != nil {
+		t.Fatal(err)
+	}
+	for part, want := range map[string]bool{"foo=1": false, "bar=1": true, "target=x": true} {
+		if got := isControlParam(part); got != want {
+			t.Errorf("isControlParam(%q) = %v, want %v", part, got, want)
+		}
+	}
+}
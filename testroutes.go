@@ -0,0 +1,160 @@
+package argonproxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// -----------------------------
+// ROUTE TESTING
+// -----------------------------
+
+// routeSample is a request run through the routing and access policy by the
+// test-routes subcommand, with the outcome it is expected to have
+type routeSample struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method,omitempty"` // default GET
+	URL     string            `json:"url"`              // as received by the proxy; its host selects the route
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Expected route name and status; 200 means the request would be forwarded
+	Route  string `json:"route,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// runTestRoutes evaluates the sample requests in a file against the loaded
+// routes and flags, prints the route and policy each would hit and returns
+// the process exit code: 1 if any sample is invalid or misses its expectation
+func runTestRoutes(filename string) int {
+	if filename == "" {
+		fmt.Println("Usage: argon-proxy [flags] test-routes samples.json")
+		return 2
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Failed to read samples: %v\n", err)
+		return 1
+	}
+	var samples []routeSample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		fmt.Printf("Invalid samples file %s: %v\n", filename, err)
+		return 1
+	}
+
+	fmt.Printf("Argon-Proxy route test (%s)\n\n", cmp.Or(*configFile, "no config file"))
+	failed := 0
+	for i, s := range samples {
+		name := cmp.Or(s.Name, fmt.Sprintf("sample %d", i+1))
+		route, status, outcome, err := s.evaluate()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s\n      %v\n", name, err)
+			continue
+		}
+		var missed []string
+		if s.Route != "" && s.Route != route {
+			missed = append(missed, fmt.Sprintf("want route %s", s.Route))
+		}
+		if s.Status != 0 && s.Status != status {
+			missed = append(missed, fmt.Sprintf("want status %d", s.Status))
+		}
+		result := "PASS"
+		if len(missed) > 0 {
+			failed++
+			result = "FAIL"
+		}
+		fmt.Printf("%s  %s\n      request:  %s %s\n      route:    %s\n      result:   %d %s\n",
+			result, name, cmp.Or(s.Method, "GET"), s.URL, route, status, outcome)
+		for _, m := range missed {
+			fmt.Printf("      %s\n", m)
+		}
+	}
+
+	fmt.Printf("\n%d/%d samples passed\n", len(samples)-failed, len(samples))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// evaluate returns the route a sample is served by, the status the proxy
+// would answer with (200 when it would be forwarded) and a description of
+// the outcome
+func (s routeSample) evaluate() (string, int, string, error) {
+	r, err := http.NewRequest(cmp.Or(s.Method, "GET"), s.URL, nil)
+	if err != nil || r.URL.Host == "" {
+		return "", 0, "", errors.New("url must be absolute, e.g. https://proxy.example.com/proxy/?target=...")
+	}
+	for name, value := range s.Headers {
+		r.Header.Set(name, value)
+	}
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+	}
+	rt := activeRoutes.Load().match(requestHost(r))
+	r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, rt))
+
+	w := &sampleRecorder{header: make(http.Header), code: http.StatusOK}
+	target, ok := checkRouteSample(w, r)
+	switch {
+	case ok:
+		return rt.Name, http.StatusOK, "forwarded to " + target, nil
+	case w.code == http.StatusNoContent:
+		return rt.Name, w.code, "preflight allowed for " + w.Header().Get("Access-Control-Allow-Methods"), nil
+	}
+	return rt.Name, w.code, "refused: " + strings.TrimSpace(w.body.String()), nil
+}
+
+// sampleRecorder records the response to a sample
+type sampleRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *sampleRecorder) Header() http.Header         { return w.header }
+func (w *sampleRecorder) WriteHeader(status int)      { w.code = status }
+func (w *sampleRecorder) Write(p []byte) (int, error) { return w.body.Write(p) }
+
+// checkRouteSample applies the checks handleProxy and processProxyRequest
+// make before contacting anything: origin, method, schedule, target parsing
+// and the target host policies. It returns the upstream URL if all pass.
+// Authentication, captchas, budgets and the policy service depend on the
+// caller or on other services and are not evaluated.
+func checkRouteSample(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !checkCORSOrigin(w, r) {
+		return "", false
+	}
+	if isPreflight(r) {
+		handlePreflight(w, r)
+		return "", false
+	}
+	if !routeFor(r).allowsMethod(r.Method) && !reportOnly(r, "methods", "method not allowed") {
+		proxyError(w, r, http.StatusMethodNotAllowed, "Method not allowed", "")
+		return "", false
+	}
+	if !checkSchedule(w, r) {
+		return "", false
+	}
+	targetURL, err := parseTargetURL(r)
+	if err != nil {
+		proxyError(w, r, http.StatusBadRequest, err.Error(), "")
+		return "", false
+	}
+	if targetURL == "" {
+		proxyError(w, r, http.StatusBadRequest, "No target given", "")
+		return "", false
+	}
+	finalURL := resolveTargetURL(r, targetURL)
+	if !checkIPTarget(w, r, finalURL) || !checkTargetHost(w, r, finalURL) || !checkOriginTarget(w, r, finalURL) {
+		return "", false
+	}
+	return finalURL, true
+}
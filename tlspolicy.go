@@ -0,0 +1,166 @@
+package argonproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// -----------------------------
+// UPSTREAM TLS POLICY
+// -----------------------------
+
+// tlsCurveNames maps curve names accepted in policies to curve IDs
+var tlsCurveNames = map[string]tls.CurveID{
+	"x25519": tls.X25519, "p-256": tls.CurveP256, "p-384": tls.CurveP384, "p-521": tls.CurveP521,
+}
+
+// tlsPolicy constrains the TLS handshake with upstreams. Unset fields keep
+// the Go defaults, or for an upstream host the global -upstream-tls-* flags.
+type tlsPolicy struct {
+	MinVersion string   `json:"min_tls_version,omitempty"` // 1.0 to 1.3
+	Ciphers    []string `json:"ciphers,omitempty"`         // IANA names; TLS 1.2 and older only
+	Curves     []string `json:"curves,omitempty"`          // X25519, P-256, P-384, P-521
+	ServerName string   `json:"server_name,omitempty"`     // SNI sent and name verified instead of the host
+
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+// upstreamHost holds the connection settings for matching target hosts.
+// Address pins the connection to an IP (or another name), optionally with
+// a port, while SNI and certificate checks still use the target host or
+// server_name.
+type upstreamHost struct {
+	Hosts   []string `json:"hosts"`
+	Address string   `json:"address,omitempty"`
+	tlsPolicy
+	hostLimits
+}
+
+// globalTLSPolicy is built from the -upstream-tls-* flags
+var globalTLSPolicy tlsPolicy
+
+// prepare parses the policy's names
+func (p *tlsPolicy) prepare() error {
+	if p.MinVersion != "" {
+		version, ok := tlsVersionNames[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("TLS version %q must be 1.0, 1.1, 1.2 or 1.3", p.MinVersion)
+		}
+		p.minVersion = version
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	p.ciphers = nil
+	for _, name := range p.Ciphers {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %q", name)
+		}
+		p.ciphers = append(p.ciphers, id)
+	}
+
+	p.curves = nil
+	for _, name := range p.Curves {
+		id, ok := tlsCurveNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown curve %q, expected X25519, P-256, P-384 or P-521", name)
+		}
+		p.curves = append(p.curves, id)
+	}
+	return nil
+}
+
+// apply sets the policy's fields on a client TLS config, leaving unset ones alone
+func (p *tlsPolicy) apply(cfg *tls.Config) {
+	if p.minVersion != 0 {
+		cfg.MinVersion = p.minVersion
+	}
+	if len(p.ciphers) > 0 {
+		cfg.CipherSuites = p.ciphers
+	}
+	if len(p.curves) > 0 {
+		cfg.CurvePreferences = p.curves
+	}
+	if p.ServerName != "" {
+		cfg.ServerName = p.ServerName
+	}
+}
+
+// configureUpstreamTLS parses the global policy and builds the shared
+// upstream transport; it must run before routes build their own transports
+func configureUpstreamTLS() error {
+	globalTLSPolicy = tlsPolicy{
+		MinVersion: *upstreamTLSMin,
+		Ciphers:    splitList(*upstreamTLSCiphers),
+		Curves:     splitList(*upstreamTLSCurves),
+	}
+	if err := globalTLSPolicy.prepare(); err != nil {
+		return fmt.Errorf("upstream TLS policy: %v", err)
+	}
+	upstream = newDefaultUpstream()
+	return nil
+}
+
+// prepareUpstreamHosts validates the upstream_hosts entries of the config file
+func prepareUpstreamHosts(hosts []*upstreamHost) error {
+	for i, h := range hosts {
+		if len(h.Hosts) == 0 {
+			return fmt.Errorf("upstream_hosts entry %d: at least one host is required", i+1)
+		}
+		if err := h.prepare(); err != nil {
+			return fmt.Errorf("upstream_hosts %s: %v", strings.Join(h.Hosts, ","), err)
+		}
+		if err := h.prepareLimits(); err != nil {
+			return fmt.Errorf("upstream_hosts %s: %v", strings.Join(h.Hosts, ","), err)
+		}
+		if strings.Contains(h.Address, "/") || strings.HasSuffix(h.Address, ":") {
+			return fmt.Errorf("upstream_hosts %s: address must be host or host:port", strings.Join(h.Hosts, ","))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the entry covers a target host
+func (h *upstreamHost) matches(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range h.Hosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialAddress returns where to connect instead of addr, a host:port the
+// transport is about to dial; connections to proxies are left alone
+func (h *upstreamHost) dialAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if h.Address == "" || err != nil || !h.matches(host) {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(h.Address); err == nil {
+		return h.Address
+	}
+	return net.JoinHostPort(strings.Trim(h.Address, "[]"), port)
+}
+
+// upstreamHostFor returns the first upstream_hosts entry matching a target host
+func upstreamHostFor(host string) *upstreamHost {
+	table := activeRoutes.Load()
+	if table == nil {
+		return nil
+	}
+	for _, h := range table.upstreamHosts {
+		if h.matches(host) {
+			return h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package argonproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------
+// UPSTREAM TLS DOWNGRADE DETECTION
+// -----------------------------
+
+// tlsWarningHeader carries the weaknesses of the upstream connection to the client
+const tlsWarningHeader = "X-Argon-TLS-Warning"
+
+// errWeakTLS is returned when -tls-block-weak refuses an upstream connection
+var errWeakTLS = errors.New("upstream TLS is too weak")
+
+// tlsVersionNames maps -tls-warn-below values to versions
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13,
+}
+
+// tlsWatch remembers the best version each upstream host negotiated, so a
+// later fallback to an older one shows up as a downgrade
+var tlsWatch = struct {
+	mu   sync.Mutex
+	best map[string]uint16
+
+	version, cipher, downgrade, blocked atomic.Uint64
+}{best: make(map[string]uint16)}
+
+func init() {
+	registerMetrics(func(w io.Writer) {
+		fmt.Fprintf(w, "# HELP argon_proxy_upstream_tls_weak_total Upstream responses received over weak TLS, by weakness.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_upstream_tls_weak_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_upstream_tls_weak_total{reason=\"version\"} %d\n", tlsWatch.version.Load())
+		fmt.Fprintf(w, "argon_proxy_upstream_tls_weak_total{reason=\"cipher\"} %d\n", tlsWatch.cipher.Load())
+		fmt.Fprintf(w, "argon_proxy_upstream_tls_weak_total{reason=\"downgrade\"} %d\n", tlsWatch.downgrade.Load())
+		fmt.Fprintf(w, "# HELP argon_proxy_upstream_tls_blocked_total Upstream TLS connections refused by -tls-block-weak.\n")
+		fmt.Fprintf(w, "# TYPE argon_proxy_upstream_tls_blocked_total counter\n")
+		fmt.Fprintf(w, "argon_proxy_upstream_tls_blocked_total %d\n", tlsWatch.blocked.Load())
+	})
+}
+
+// validateTLSWatch checks the -tls-warn-below value
+func validateTLSWatch() error {
+	if _, ok := tlsVersionNames[*tlsWarnBelow]; !ok {
+		return fmt.Errorf("--tls-warn-below must be 1.0, 1.1, 1.2 or 1.3")
+	}
+	return nil
+}
+
+// weakCipher reports whether a suite is insecure, lacks forward secrecy or uses CBC
+func weakCipher(id uint16) bool {
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.ID == id {
+			return true
+		}
+	}
+	name := tls.CipherSuiteName(id)
+	return strings.HasPrefix(name, "TLS_RSA_") || strings.Contains(name, "_CBC_")
+}
+
+// tlsWeaknesses lists what is wrong with a connection to host, with the
+// counter of each weakness
+func tlsWeaknesses(host string, state *tls.ConnectionState) (problems []string, kinds []*atomic.Uint64) {
+	host = strings.ToLower(host)
+	version := tls.VersionName(state.Version)
+	if state.Version < tlsVersionNames[*tlsWarnBelow] {
+		problems = append(problems, "protocol "+version)
+		kinds = append(kinds, &tlsWatch.version)
+	}
+	if state.Version < tls.VersionTLS13 && weakCipher(state.CipherSuite) {
+		problems = append(problems, "cipher "+tls.CipherSuiteName(state.CipherSuite))
+		kinds = append(kinds, &tlsWatch.cipher)
+	}
+
+	tlsWatch.mu.Lock()
+	defer tlsWatch.mu.Unlock()
+	best, seen := tlsWatch.best[host]
+	switch {
+	case seen && state.Version < best:
+		problems = append(problems, "downgraded from "+tls.VersionName(best))
+		kinds = append(kinds, &tlsWatch.downgrade)
+	case !seen && len(tlsWatch.best) >= maxCertHosts:
+	case state.Version > best:
+		tlsWatch.best[host] = state.Version
+	}
+	return problems, kinds
+}
+
+// verifyUpstreamTLS is the tls.Config.VerifyConnection of upstream
+// transports. With -tls-block-weak it aborts the handshake of a weak or
+// downgraded connection, before any request data is sent over it.
+func verifyUpstreamTLS(state tls.ConnectionState) error {
+	if !*tlsBlockWeak {
+		return nil
+	}
+	problems, _ := tlsWeaknesses(state.ServerName, &state)
+	if len(problems) == 0 {
+		return nil
+	}
+	tlsWatch.blocked.Add(1)
+	log.Printf("Refused upstream TLS connection to %s: %s", state.ServerName, strings.Join(problems, ", "))
+	return fmt.Errorf("%w: %s", errWeakTLS, strings.Join(problems, ", "))
+}
+
+// upstreamTLSConfig returns a client TLS config that follows the global
+// policy and checks upstream connections
+func upstreamTLSConfig() *tls.Config {
+	cfg := &tls.Config{VerifyConnection: verifyUpstreamTLS}
+	globalTLSPolicy.apply(cfg)
+	return cfg
+}
+
+// tlsWarned holds when each weak upstream host was last logged
+var tlsWarned sync.Map
+
+// checkUpstreamTLS marks a response that came over a weak or downgraded
+// connection with X-Argon-TLS-Warning, counting it and logging the host
+// at most hourly
+func checkUpstreamTLS(w http.ResponseWriter, host string, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	problems, kinds := tlsWeaknesses(host, state)
+	if len(problems) == 0 {
+		return
+	}
+	warning := tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite) + ": " + strings.Join(problems, ", ")
+	w.Header().Set(tlsWarningHeader, warning)
+	w.Header().Add("Access-Control-Expose-Headers", tlsWarningHeader)
+	for _, kind := range kinds {
+		kind.Add(1)
+	}
+	if last, ok := tlsWarned.Load(host); !ok || time.Since(last.(time.Time)) >= time.Hour {
+		tlsWarned.Store(host, time.Now())
+		log.Printf("Warning: weak TLS to upstream %s: %s", host, warning)
+	}
+}
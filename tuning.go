@@ -0,0 +1,92 @@
+package argonproxy
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+)
+
+// -----------------------------
+// RUNTIME AND LISTENER TUNING
+// -----------------------------
+
+// applyGOMAXPROCS sets GOMAXPROCS from --gomaxprocs, or lowers it to the
+// container's CPU limit so a pod limited to 2 CPUs on a 64-core node does not
+// run 64 threads that are throttled by the CFS quota
+func applyGOMAXPROCS() {
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(*gomaxprocs)
+		return
+	}
+	// Already limited by $GOMAXPROCS or a container-aware runtime
+	if runtime.GOMAXPROCS(0) < runtime.NumCPU() {
+		return
+	}
+	limit, ok := cgroupCPULimit()
+	if !ok {
+		return
+	}
+	procs := int(math.Ceil(limit))
+	if procs < 1 {
+		procs = 1
+	}
+	if procs < runtime.NumCPU() {
+		runtime.GOMAXPROCS(procs)
+		log.Printf("GOMAXPROCS set to %d from the container CPU limit (%.2f CPUs)", procs, limit)
+	}
+}
+
+// errNoReusePort is returned where SO_REUSEPORT listeners are unavailable
+var errNoReusePort = errors.New("--listeners above 1 needs SO_REUSEPORT (Linux, BSD or macOS)")
+
+// listen opens the TCP listeners for the server. With more than one, each is
+// bound with SO_REUSEPORT and the kernel spreads new connections across them.
+func listen(listenAddr string, count int) ([]net.Listener, error) {
+	if count <= 1 {
+		l, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		l, err := listenReusePort(listenAddr)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serveListeners runs the server on every listener and returns the first error
+func serveListeners(srv *http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if tlsEnabled() {
+				errs <- srv.ServeTLS(l, *tlsCert, *tlsKey)
+			} else {
+				errs <- srv.Serve(l)
+			}
+		}(l)
+	}
+	return <-errs
+}
+
+// tuneUpstreamPool applies the connection pool flags to an upstream
+// transport. Every route shares its transport across requests, so these
+// bound the idle connections kept for reuse.
+func tuneUpstreamPool(tcp *http.Transport) {
+	tcp.MaxIdleConns = *maxIdleConns
+	tcp.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	tcp.IdleConnTimeout = *idleConnTimeout
+}
@@ -0,0 +1,47 @@
+package argonproxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPULimit reads the CPU quota of the process's cgroup (v2, then v1)
+// as a number of CPUs; ok is false when there is no limit
+func cgroupCPULimit() (limit float64, ok bool) {
+	// cgroup v2: "<quota> <period>" or "max <period>"
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuRatio(fields[0], fields[1])
+	}
+
+	// cgroup v1: a quota of -1 means unlimited
+	for _, dir := range []string{"/sys/fs/cgroup/cpu,cpuacct", "/sys/fs/cgroup/cpu"} {
+		quota, err := os.ReadFile(dir + "/cpu.cfs_quota_us")
+		if err != nil {
+			continue
+		}
+		period, err := os.ReadFile(dir + "/cpu.cfs_period_us")
+		if err != nil {
+			continue
+		}
+		return cpuRatio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0, false
+}
+
+// cpuRatio divides a CFS quota by its period
+func cpuRatio(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package argonproxy
+
+// cgroupCPULimit reports no limit; CPU quotas are only read from Linux cgroups
+func cgroupCPULimit() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,147 @@
+package argonproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// -----------------------------
+// UPSTREAM CREDENTIALS
+// -----------------------------
+
+// upstreamTLS is the TLS material a route uses towards its upstreams. Each
+// field is a PEM file path or a ${vault:path#field} reference holding PEM.
+type upstreamTLS struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	CA   string `json:"ca,omitempty"`
+}
+
+// pemSource loads PEM data from a file or from Vault
+type pemSource struct {
+	value   string
+	baseDir string
+}
+
+// load returns the current PEM data
+func (p pemSource) load() ([]byte, error) {
+	if strings.Contains(p.value, "${vault:") {
+		data, err := expandSecrets(p.value)
+		return []byte(data), err
+	}
+	file := p.value
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(p.baseDir, file)
+	}
+	return os.ReadFile(file)
+}
+
+// clientCertificate presents the route's client certificate, re-parsing it
+// only when the PEM data changed (e.g. after a Vault refresh)
+type clientCertificate struct {
+	cert, key pemSource
+
+	mu      sync.Mutex
+	lastPEM string
+	parsed  *tls.Certificate
+}
+
+// get implements tls.Config.GetClientCertificate
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certPEM, err := c.cert.load()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := c.key.load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.parsed != nil && c.lastPEM == string(certPEM)+string(keyPEM) {
+		return c.parsed, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.lastPEM, c.parsed = string(certPEM)+string(keyPEM), &cert
+	return c.parsed, nil
+}
+
+// prepareUpstreamAuth checks the route's upstream headers and builds its own
+// transport when it has TLS settings
+func (rt *Route) prepareUpstreamAuth(baseDir string) error {
+	// Resolve Vault references now so a missing secret stops the startup
+	for name, value := range rt.UpstreamHeaders {
+		if _, err := expandSecrets(value); err != nil {
+			return fmt.Errorf("route %q: upstream header %s: %v", rt.Name, name, err)
+		}
+	}
+
+	if rt.UpstreamTLS == nil {
+		return nil
+	}
+	tlsConfig := upstreamTLSConfig()
+
+	if rt.UpstreamTLS.CA != "" {
+		caPEM, err := pemSource{rt.UpstreamTLS.CA, baseDir}.load()
+		if err != nil {
+			return fmt.Errorf("route %q: upstream CA: %v", rt.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("route %q: upstream CA contains no certificates", rt.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (rt.UpstreamTLS.Cert == "") != (rt.UpstreamTLS.Key == "") {
+		return fmt.Errorf("route %q: upstream TLS cert and key must be given together", rt.Name)
+	}
+	if rt.UpstreamTLS.Cert != "" {
+		cert := &clientCertificate{
+			cert: pemSource{rt.UpstreamTLS.Cert, baseDir},
+			key:  pemSource{rt.UpstreamTLS.Key, baseDir},
+		}
+		if _, err := cert.get(nil); err != nil {
+			return fmt.Errorf("route %q: upstream client certificate: %v", rt.Name, err)
+		}
+		tlsConfig.GetClientCertificate = cert.get
+	}
+
+	tcp := newTCPTransport(tlsConfig)
+	rt.transport = newUpstreamTransport(tcp, tlsConfig)
+	return nil
+}
+
+// upstreamClient returns the HTTP client for the route's upstream requests
+func (rt *Route) upstreamClient() *http.Client {
+	if rt.transport != nil {
+		return &http.Client{Transport: rt.transport}
+	}
+	return &http.Client{Transport: upstream}
+}
+
+// errUpstreamCredentials is returned when a route's credentials are unavailable
+var errUpstreamCredentials = errors.New("upstream credentials unavailable")
+
+// applyUpstreamHeaders sets the route's configured headers on an upstream request
+func applyUpstreamHeaders(r *http.Request, proxyReq *http.Request) error {
+	for name, value := range routeFor(r).UpstreamHeaders {
+		expanded, err := expandSecrets(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUpstreamCredentials, err)
+		}
+		proxyReq.Header.Set(name, expanded)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package argonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------
+// HASHICORP VAULT SECRETS
+// -----------------------------
+
+// vaultRefPattern matches ${vault:<path>#<field>} references in config values
+var vaultRefPattern = regexp.MustCompile(`\$\{vault:([^#}]+)#([^}]+)\}`)
+
+// vaultClient reads secrets from Vault and keeps them cached in memory
+type vaultClient struct {
+	addr   string
+	client *http.Client
+
+	mu      sync.RWMutex
+	token   string
+	secrets map[string]map[string]any // secret path -> fields
+}
+
+// vault is the configured Vault client, or nil when --vault-addr is not set
+var vault *vaultClient
+
+// startVault logs in to Vault and starts renewing the token and refreshing secrets
+func startVault() error {
+	if *vaultAddr == "" {
+		return nil
+	}
+
+	v := &vaultClient{
+		addr:    strings.TrimRight(*vaultAddr, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		secrets: make(map[string]map[string]any),
+		token:   *vaultToken,
+	}
+	if *vaultRoleID != "" {
+		if err := v.login(); err != nil {
+			return fmt.Errorf("vault approle login: %v", err)
+		}
+	} else if v.token == "" {
+		return errors.New("--vault-addr needs --vault-token ($VAULT_TOKEN) or --vault-role-id")
+	}
+
+	vault = v
+	go v.renewToken()
+	go v.refreshSecrets()
+	return nil
+}
+
+// call sends a request to the Vault HTTP API and decodes the JSON reply
+func (v *vaultClient) call(method, path string, body any) (map[string]any, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+strings.TrimLeft(path, "/"), &payload)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.RLock()
+	req.Header.Set("X-Vault-Token", v.token)
+	v.mu.RUnlock()
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		if errs, ok := reply["errors"].([]any); ok && len(errs) > 0 {
+			return nil, fmt.Errorf("%s %s: %s: %v", method, path, resp.Status, errs[0])
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return reply, nil
+}
+
+// login exchanges the AppRole credentials for a token
+func (v *vaultClient) login() error {
+	reply, err := v.call("POST", "auth/approle/login", map[string]string{
+		"role_id":   *vaultRoleID,
+		"secret_id": *vaultSecretID,
+	})
+	if err != nil {
+		return err
+	}
+	auth, _ := reply["auth"].(map[string]any)
+	token, _ := auth["client_token"].(string)
+	if token == "" {
+		return errors.New("no token in login response")
+	}
+	v.mu.Lock()
+	v.token = token
+	v.mu.Unlock()
+	return nil
+}
+
+// tokenTTL returns the remaining lifetime of the current token; 0 means it does not expire
+func (v *vaultClient) tokenTTL() (time.Duration, error) {
+	reply, err := v.call("GET", "auth/token/lookup-self", nil)
+	if err != nil {
+		return 0, err
+	}
+	data, _ := reply["data"].(map[string]any)
+	ttl, _ := data["ttl"].(float64)
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// renewToken renews the token at half its lifetime, logging in again with
+// AppRole when renewal is no longer possible
+func (v *vaultClient) renewToken() {
+	ttl, err := v.tokenTTL()
+	if err != nil {
+		log.Printf("Vault token lookup failed: %v", err)
+		ttl = time.Minute
+	}
+	for ttl > 0 {
+		time.Sleep(ttl / 2)
+
+		reply, err := v.call("POST", "auth/token/renew-self", map[string]any{})
+		if err == nil {
+			auth, _ := reply["auth"].(map[string]any)
+			lease, _ := auth["lease_duration"].(float64)
+			ttl = time.Duration(lease) * time.Second
+			// A token at its max TTL cannot be extended any further
+			if ttl > time.Minute || *vaultRoleID == "" {
+				continue
+			}
+		}
+		if *vaultRoleID == "" {
+			log.Printf("Vault token renewal failed: %v", err)
+			ttl = time.Minute
+			continue
+		}
+		if err := v.login(); err != nil {
+			log.Printf("Vault approle login failed: %v", err)
+			ttl = time.Minute
+			continue
+		}
+		if ttl, err = v.tokenTTL(); err != nil {
+			ttl = time.Minute
+		}
+	}
+}
+
+// read fetches the fields of a secret. KV version 2 secrets are unwrapped
+// from their metadata envelope.
+func (v *vaultClient) read(path string) (map[string]any, error) {
+	reply, err := v.call("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := reply["data"].(map[string]any)
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = inner
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("secret %s has no data", path)
+	}
+	return data, nil
+}
+
+// refreshSecrets re-reads all cached secrets every --vault-refresh, so
+// rotated credentials are picked up without a restart
+func (v *vaultClient) refreshSecrets() {
+	for {
+		time.Sleep(*vaultRefresh)
+
+		v.mu.RLock()
+		paths := make([]string, 0, len(v.secrets))
+		for path := range v.secrets {
+			paths = append(paths, path)
+		}
+		v.mu.RUnlock()
+
+		for _, path := range paths {
+			data, err := v.read(path)
+			if err != nil {
+				log.Printf("Vault refresh of %s failed, keeping the previous value: %v", path, err)
+				continue
+			}
+			v.mu.Lock()
+			v.secrets[path] = data
+			v.mu.Unlock()
+		}
+	}
+}
+
+// field returns one field of a secret, reading the secret on first use
+func (v *vaultClient) field(path, name string) (string, error) {
+	v.mu.RLock()
+	data, ok := v.secrets[path]
+	v.mu.RUnlock()
+
+	if !ok {
+		var err error
+		if data, err = v.read(path); err != nil {
+			return "", err
+		}
+		v.mu.Lock()
+		v.secrets[path] = data
+		v.mu.Unlock()
+	}
+
+	value, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %q", path, name)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// expandSecrets replaces ${vault:path#field} references with their values
+func expandSecrets(value string) (string, error) {
+	if !strings.Contains(value, "${vault:") {
+		return value, nil
+	}
+	if vault == nil {
+		return "", errors.New("vault reference used but --vault-addr is not set")
+	}
+
+	var firstErr error
+	expanded := vaultRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		match := vaultRefPattern.FindStringSubmatch(ref)
+		secret, err := vault.field(match[1], match[2])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return secret
+	})
+	return expanded, firstErr
+}
@@ -0,0 +1,81 @@
+package argonproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// -----------------------------
+// WEBDAV
+// -----------------------------
+
+// webDAVMethods are the WebDAV and CalDAV methods --webdav and the WEBDAV
+// entry of a route's methods stand for
+var webDAVMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "REPORT", "MKCALENDAR", "ACL", "SEARCH"}
+
+// webDAVExposed are the response headers WebDAV clients need to read
+const webDAVExposed = "DAV, ETag, Lock-Token, Location"
+
+// expandMethods upper-cases a route's methods and replaces WEBDAV with the
+// WebDAV and CalDAV methods
+func expandMethods(methods []string) []string {
+	expanded := make([]string, 0, len(methods))
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if method == "WEBDAV" {
+			expanded = append(expanded, webDAVMethods...)
+			continue
+		}
+		expanded = append(expanded, method)
+	}
+	return expanded
+}
+
+// allowsWebDAV reports whether the route accepts any WebDAV method
+func (rt *Route) allowsWebDAV() bool {
+	return slices.ContainsFunc(rt.Methods, func(m string) bool { return slices.Contains(webDAVMethods, m) })
+}
+
+// isPreflight reports whether an OPTIONS request is a CORS preflight. On
+// WebDAV routes other OPTIONS requests go upstream, where clients discover
+// the server's DAV classes and methods.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && (r.Header.Get("Access-Control-Request-Method") != "" || !routeFor(r).allowsWebDAV())
+}
+
+// prepareWebDAV exposes the WebDAV response headers and points a COPY or
+// MOVE Destination given as a proxy URL at the upstream
+func prepareWebDAV(w http.ResponseWriter, r *http.Request, proxyReq *http.Request) error {
+	if !routeFor(r).allowsWebDAV() {
+		return nil
+	}
+	w.Header().Add("Access-Control-Expose-Headers", webDAVExposed)
+
+	destination := proxyReq.Header.Get("Destination")
+	if destination == "" {
+		return nil
+	}
+	u, err := url.Parse(destination)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid Destination header")
+	}
+	// Destinations elsewhere already name the upstream
+	if !strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+
+	dest := &http.Request{Method: r.Method, URL: u, Host: u.Host, Header: http.Header{}}
+	target, err := parseTargetURL(dest.WithContext(r.Context()))
+	if err != nil || target == "" {
+		return errors.New("Destination must be a proxy URL like the request's")
+	}
+	finalURL, err := url.Parse(resolveTargetURL(dest, target))
+	if err != nil || !strings.EqualFold(finalURL.Host, proxyReq.URL.Host) || finalURL.Scheme != proxyReq.URL.Scheme {
+		return errors.New("Destination must be on the same upstream as the request")
+	}
+	proxyReq.Header.Set("Destination", finalURL.String())
+	return nil
+}
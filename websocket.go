@@ -0,0 +1,89 @@
+package argonproxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// -----------------------------
+// WEBSOCKET PROXYING
+// -----------------------------
+
+// isWebSocketRequest reports whether a client asks to switch to the
+// WebSocket protocol
+func isWebSocketRequest(r *http.Request) bool {
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketTarget maps ws:// and wss:// targets to the http:// and https://
+// URLs the handshake is sent to
+func webSocketTarget(target string) string {
+	switch {
+	case strings.HasPrefix(target, "ws://"):
+		return "http://" + target[len("ws://"):]
+	case strings.HasPrefix(target, "wss://"):
+		return "https://" + target[len("wss://"):]
+	}
+	return target
+}
+
+// relayWebSocket completes the handshake with the client once the upstream
+// has switched protocols, then copies frames both ways until either side
+// closes. It returns the bytes sent to and received from the client.
+func relayWebSocket(w http.ResponseWriter, r *http.Request, resp *http.Response) (sent, received int64) {
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		proxyError(w, r, http.StatusBadGateway, "Upstream switched protocols without a connection", "")
+		return 0, 0
+	}
+	defer upstreamConn.Close()
+
+	clientConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Error taking over the WebSocket connection: %v", err)
+		proxyError(w, r, http.StatusInternalServerError, "WebSocket connections are not supported on this connection", "")
+		return 0, 0
+	}
+	defer clientConn.Close()
+	// Server read and write timeouts no longer apply to the connection
+	clientConn.SetDeadline(time.Time{})
+
+	// Relay the upstream's handshake response, which carries Sec-WebSocket-Accept
+	// and the chosen subprotocol and extensions
+	header := resp.Header.Clone()
+	header.Set("X-Proxied-By", proxiedBy)
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return 0, 0
+	}
+
+	done := make(chan int64, 1)
+	go func() {
+		// Bytes the client sent after the handshake may already be buffered
+		n, _ := copyBody(upstreamConn, brw.Reader)
+		upstreamConn.Close()
+		done <- n
+	}()
+	sent, _ = copyBody(clientConn, upstreamConn)
+	clientConn.Close()
+	received = <-done
+	if *verbose {
+		log.Printf("WebSocket to %s closed (%d bytes sent, %d received)", resp.Request.URL.Host, sent, received)
+	}
+	return sent, received
+}